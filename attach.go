@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// attachedIDOffset separates the IDs of the records of each attached
+// database from those of the others, the records of the nth being given IDs
+// n times it below their own
+const attachedIDOffset = 1 << 40
+
+// Attach searches the history of the retour databases at paths along with
+// this one's until it is closed, without copying any of it: every query of
+// the history sees their records too, each with the Source it came from, the
+// name of its database file. The attached databases are only read and must
+// have been brought up to date by this version of retour. Their command text
+// is decrypted with this database's key. Their records are given IDs below
+// any of this database's, in the same order as their own, so they cannot be
+// taken for its records.
+func (db *DB) Attach(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	var mainPath string
+	if err := db.reader.QueryRow("SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&mainPath); err != nil {
+		return err
+	}
+	columns, err := tableColumns(db.reader, "history")
+	if err != nil {
+		return err
+	}
+
+	// The attached databases and the view joining their history to this
+	// one's belong to a connection, so each pool is kept to the one
+	// connection they are set up on
+	pools := []*sql.DB{db.conn}
+	if db.reader != db.conn {
+		pools = append(pools, db.reader)
+	}
+	for _, pool := range pools {
+		pool.SetMaxOpenConns(1)
+		if err := attachTo(pool, mainPath, paths, columns); err != nil {
+			return err
+		}
+	}
+	db.attached = true
+	return nil
+}
+
+// attachTo attaches the databases at paths to the connection of pool and
+// creates the temporary history view on it, which is found before the
+// history table of the main database. It is created even on a connection
+// which may only read, as it changes no database file.
+func attachTo(pool *sql.DB, mainPath string, paths []string, columns []string) error {
+	ctx := context.Background()
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var queryOnly bool
+	if err := conn.QueryRowContext(ctx, "PRAGMA query_only").Scan(&queryOnly); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA query_only = "+strconv.FormatBool(queryOnly))
+
+	sources := sourceNames(append([]string{mainPath}, paths...))
+	selects := []string{historySelect("main", columns, 0, sources[0])}
+	for i, path := range paths {
+		schema := "attached" + strconv.Itoa(i+1)
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("failed to attach %s: %w", path, err)
+		}
+		if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS "+schema, "file:"+path+"?mode=ro"); err != nil {
+			return fmt.Errorf("failed to attach %s: %w", path, err)
+		}
+
+		var version int
+		if err := conn.QueryRowContext(ctx, "PRAGMA "+schema+".user_version").Scan(&version); err != nil {
+			return fmt.Errorf("failed to attach %s: %w", path, err)
+		}
+		if version < schemaVersion {
+			return fmt.Errorf("failed to attach %s: its schema is out of date, it must be opened once by itself to update it", path)
+		}
+		selects = append(selects, historySelect(schema, columns, int64(i+1)*attachedIDOffset, sources[i+1]))
+	}
+
+	_, err = conn.ExecContext(ctx, "CREATE TEMP VIEW history AS "+strings.Join(selects, " UNION ALL "))
+	return err
+}
+
+// historySelect selects the columns of the history of the database attached
+// as schema, with IDs lowered by offset and source naming where they came from
+func historySelect(schema string, columns []string, offset int64, source string) string {
+	selected := make([]string, len(columns))
+	for i, column := range columns {
+		selected[i] = column
+		if column == "id" && offset > 0 {
+			selected[i] = "id - " + strconv.FormatInt(offset, 10) + " AS id"
+		}
+	}
+	return fmt.Sprintf("SELECT %s, '%s' AS source FROM %s.history",
+		strings.Join(selected, ", "), strings.ReplaceAll(source, "'", "''"), schema)
+}
+
+// sourceNames names each database by its file name without the extension,
+// numbering those which would otherwise share a name
+func sourceNames(paths []string) []string {
+	names := make([]string, len(paths))
+	taken := map[string]bool{}
+	for i, path := range paths {
+		base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		name := base
+		for n := 2; taken[name]; n++ {
+			name = base + "-" + strconv.Itoa(n)
+		}
+		taken[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// tableColumns returns the names of the columns of a table, in order
+func tableColumns(pool *sql.DB, table string) ([]string, error) {
+	rows, err := pool.Query("SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,135 @@
+package main_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestAttach(t *testing.T) {
+	dir := t.TempDir()
+	database := createHistory(t, filepath.Join(dir, "history.db"), "ls", "make")
+	createHistory(t, filepath.Join(dir, "backup", "history-2022.db"), "make", "go test")
+	createHistory(t, filepath.Join(dir, "other", "history-2022.db"), "make")
+
+	err := database.Attach([]string{
+		filepath.Join(dir, "backup", "history-2022.db"),
+		filepath.Join(dir, "other", "history-2022.db"),
+	})
+	if err != nil {
+		t.Fatalf("Attach() unexpected error = %v", err)
+	}
+
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	sources := map[string]int{}
+	ids := map[int64]bool{}
+	for _, r := range records {
+		sources[r.Source]++
+		if ids[r.ID] {
+			t.Errorf("ID %d given to more than one record", r.ID)
+		}
+		ids[r.ID] = true
+		if r.Source != "history" && r.ID > 0 {
+			t.Errorf("Record %+v of an attached database has ID %d, want it below the others", r, r.ID)
+		}
+	}
+	want := map[string]int{"history": 2, "history-2022": 2, "history-2022-2": 1}
+	if len(sources) != len(want) {
+		t.Errorf("Records came from %v, want %v", sources, want)
+	}
+	for source, n := range want {
+		if sources[source] != n {
+			t.Errorf("Records from %s = %d, want %d", source, sources[source], n)
+		}
+	}
+
+	unique, err := database.QueryUnique(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryUnique() unexpected error = %v", err)
+	}
+	for _, r := range unique {
+		if r.Command == "make" && r.Count != 3 {
+			t.Errorf("make counted %d times across the databases, want 3", r.Count)
+		}
+	}
+
+	// Nothing is merged into the database itself
+	database.Close()
+	reopened, err := rt.NewDB(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer reopened.Close()
+	if records, err := reopened.QueryFiltered(0, "all", rt.Scope{}, 0); err != nil || len(records) != 2 {
+		t.Errorf("QueryFiltered() after closing = %d records, %v, want the 2 of its own", len(records), err)
+	}
+}
+
+func TestAttachPrune(t *testing.T) {
+	dir := t.TempDir()
+	database := createHistory(t, filepath.Join(dir, "history.db"), "ls", "make")
+	createHistory(t, filepath.Join(dir, "backup.db"), "make", "go test")
+	if err := database.Attach([]string{filepath.Join(dir, "backup.db")}); err != nil {
+		t.Fatalf("Attach() unexpected error = %v", err)
+	}
+
+	// Only the database's own records are pruned
+	if pruned, err := database.Prune(time.Now().Add(time.Hour)); err != nil || pruned != 2 {
+		t.Errorf("Prune() with a database attached = %d, %v, want the 2 records of its own", pruned, err)
+	}
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 0)
+	if err != nil || len(records) != 2 || records[0].Source != "backup" {
+		t.Errorf("QueryFiltered() after pruning = %+v, %v, want the attached records left", records, err)
+	}
+}
+
+func TestAttachStats(t *testing.T) {
+	dir := t.TempDir()
+	database := createHistory(t, filepath.Join(dir, "history.db"), "ls", "make")
+	createHistory(t, filepath.Join(dir, "backup.db"), "make", "go test", "make")
+	if err := database.Attach([]string{filepath.Join(dir, "backup.db")}); err != nil {
+		t.Fatalf("Attach() unexpected error = %v", err)
+	}
+
+	// Every breakdown counts the attached records, not only those the
+	// database's own rollup has
+	stats, err := database.UsageStats(10)
+	if err != nil {
+		t.Fatalf("UsageStats() unexpected error = %v", err)
+	}
+	if stats.Total != 5 || stats.Succeeded != 5 {
+		t.Errorf("UsageStats() total = %d, succeeded = %d, want 5 of each", stats.Total, stats.Succeeded)
+	}
+	if len(stats.Commands) == 0 || stats.Commands[0] != (rt.Count{Name: "make", Count: 3}) {
+		t.Errorf("UsageStats() commands = %+v, want make run 3 times first", stats.Commands)
+	}
+	sum := func(counts []rt.Count) int {
+		total := 0
+		for _, c := range counts {
+			total += c.Count
+		}
+		return total
+	}
+	for name, counts := range map[string][]rt.Count{
+		"directories":  stats.Directories,
+		"hours":        stats.Hours,
+		"weekdays":     stats.Weekdays,
+		"exit classes": stats.ExitClasses,
+	} {
+		if got := sum(counts); got != 5 {
+			t.Errorf("UsageStats() %s count %d commands, want 5", name, got)
+		}
+	}
+}
+
+func TestAttachMissing(t *testing.T) {
+	database := openTestDB(t)
+	if err := database.Attach([]string{filepath.Join(t.TempDir(), "missing.db")}); err == nil {
+		t.Error("Attach() of a missing database succeeded")
+	}
+}
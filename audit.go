@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// ErrImmutable is returned when the history is immutable and an operation
+// would have changed or removed what was recorded.
+var ErrImmutable = errors.New("history is immutable")
+
+// ErrReadOnly is returned when the history was opened read-only and an
+// operation would have changed it.
+var ErrReadOnly = errors.New("history is opened read-only")
+
+// AuditEntry records an attempt to change the history while it was immutable.
+type AuditEntry struct {
+	// ID is the unique identifier for this entry in the database
+	ID int64
+
+	// Timestamp is when the mutation was attempted
+	Timestamp time.Time
+
+	// Action names the operation which was attempted, e.g. "query"
+	Action string
+
+	// Detail describes what the operation would have changed, e.g. the SQL
+	Detail string
+
+	// Allowed reports whether the operation went ahead, which it only does
+	// for the automated retention policy
+	Allowed bool
+}
+
+// SetImmutable turns immutability on or off. While the history is immutable
+// nothing already recorded may be changed or removed, other than by the
+// automated retention policy, and every attempt to do so is audited.
+func (db *DB) SetImmutable(immutable bool) {
+	db.immutable = immutable
+}
+
+// checkMutable returns ErrImmutable, after auditing the attempt, if the
+// history is immutable, and ErrReadOnly, which cannot be audited, if it was
+// opened read-only. Operations which change or remove records call it before
+// doing so.
+func (db *DB) checkMutable(action, detail string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if !db.immutable {
+		return nil
+	}
+	if err := db.audit(action, detail, false); err != nil {
+		return err
+	}
+	return ErrImmutable
+}
+
+// audit adds an entry to the audit log
+func (db *DB) audit(action, detail string, allowed bool) error {
+	_, err := db.conn.Exec(`
+	INSERT INTO audit (timestamp, action, detail, allowed)
+	VALUES (?, ?, ?, ?)`, time.Now(), action, detail, allowed)
+	if err != nil {
+		return fmt.Errorf("failed to audit %s: %w", action, err)
+	}
+	return nil
+}
+
+// AuditLog returns up to limit audit entries, most recent first.
+func (db *DB) AuditLog(limit int) ([]AuditEntry, error) {
+	rows, err := db.reader.Query(`
+	SELECT id, timestamp, action, detail, allowed
+	FROM audit
+	ORDER BY id DESC
+	LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Timestamp, &e.Action, &e.Detail, &e.Allowed); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// ErrWriteQuery is returned when a query run with QueryStreamReadOnly would
+// have changed the history.
+var ErrWriteQuery = errors.New("query would change the history, pass --allow-write to run it")
+
+// QueryStreamReadOnly is like QueryStream but runs the query on a connection
+// which cannot write, so a mistyped query cannot damage the history. A query
+// which tries to write fails with ErrWriteQuery, or ErrImmutable after being
+// audited if the history is immutable.
+func (db *DB) QueryStreamReadOnly(query string, fn func(Record) error, args ...interface{}) error {
+	err := func() error {
+		rows, err := db.reader.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return db.scanRecords(rows, fn)
+	}()
+
+	if sqliteCode(err) != sqliteReadonly {
+		return err
+	}
+	if err := db.checkMutable("query", query); err != nil {
+		return err
+	}
+	return ErrWriteQuery
+}
+
+// queryReadOnly runs a query on a connection which SQLite will not let write
+// to the database, so arbitrary SQL can be run against an immutable history.
+// A statement which tries to write is audited and fails with ErrImmutable.
+func (db *DB) queryReadOnly(query string, fn func(*sql.Rows) error, args ...interface{}) error {
+	ctx := context.Background()
+	conn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return err
+	}
+	// The connection goes back to the pool afterwards, where it must be
+	// writable again for the audit log and the shell hooks
+	defer conn.ExecContext(ctx, "PRAGMA query_only = OFF")
+
+	err = func() error {
+		rows, err := conn.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return fn(rows)
+	}()
+
+	if sqliteCode(err) == sqliteReadonly {
+		return db.checkMutable("query", query)
+	}
+	return err
+}
+
+// runAudit implements the audit subcommand
+func runAudit(config *Config, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	count := flags.Int("n", 20, "Number of entries to list")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	entries, err := db.AuditLog(*count)
+	if err != nil {
+		return err
+	}
+	return writeAuditLog(os.Stdout, entries)
+}
+
+// writeAuditLog renders the audit entries as an aligned table
+func writeAuditLog(w io.Writer, entries []AuditEntry) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TIME\tACTION\tOUTCOME\tDETAIL")
+	for _, e := range entries {
+		outcome := "denied"
+		if e.Allowed {
+			outcome = "allowed"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n",
+			e.Timestamp.Local().Format(time.DateTime), e.Action, outcome, e.Detail)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,120 @@
+package main_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestImmutableQuery(t *testing.T) {
+	database := openTestDB(t)
+	record := rt.NewRecord("ls -la", "/tmp", 0, time.Now())
+	if err := database.Insert(&record); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+	database.SetImmutable(true)
+
+	for _, query := range []string{
+		"DELETE FROM history",
+		"UPDATE history SET command = 'rm'",
+		"DROP TABLE history",
+	} {
+		if _, err := database.Query(query); !errors.Is(err, rt.ErrImmutable) {
+			t.Errorf("Query(%q) error = %v, want %v", query, err, rt.ErrImmutable)
+		}
+	}
+
+	records, err := database.Query("SELECT * FROM history")
+	if err != nil {
+		t.Fatalf("Query() unexpected error = %v", err)
+	}
+	if len(records) != 1 || records[0].Command != "ls" {
+		t.Errorf("Query() = %+v, want the original record untouched", records)
+	}
+
+	// Recording new commands is not a mutation of the history
+	record = rt.NewRecord("pwd", "/tmp", 0, time.Now())
+	if err := database.Insert(&record); err != nil {
+		t.Errorf("Insert() unexpected error = %v", err)
+	}
+
+	entries, err := database.AuditLog(10)
+	if err != nil {
+		t.Fatalf("AuditLog() unexpected error = %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("AuditLog() = %+v, want 3 entries", entries)
+	}
+	got := entries[len(entries)-1]
+	if got.Action != "query" || got.Detail != "DELETE FROM history" || got.Allowed {
+		t.Errorf("AuditLog() oldest entry = %+v", got)
+	}
+}
+
+func TestMutableQuery(t *testing.T) {
+	database := openTestDB(t)
+	record := rt.NewRecord("ls", "/tmp", 0, time.Now())
+	if err := database.Insert(&record); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+
+	if _, err := database.Query("DELETE FROM history"); err != nil {
+		t.Fatalf("Query() unexpected error = %v", err)
+	}
+	records, err := database.Query("SELECT * FROM history")
+	if err != nil {
+		t.Fatalf("Query() unexpected error = %v", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("Query() = %+v, want the history deleted", records)
+	}
+
+	entries, err := database.AuditLog(10)
+	if err != nil {
+		t.Fatalf("AuditLog() unexpected error = %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("AuditLog() = %+v, want no entries", entries)
+	}
+}
+
+func TestQueryStreamReadOnly(t *testing.T) {
+	database := openTestDB(t)
+	record := rt.NewRecord("ls -la", "/tmp", 0, time.Now())
+	if err := database.Insert(&record); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+	collect := func(query string) ([]rt.Record, error) {
+		var records []rt.Record
+		err := database.QueryStreamReadOnly(query, func(r rt.Record) error {
+			records = append(records, r)
+			return nil
+		})
+		return records, err
+	}
+
+	for _, query := range []string{
+		"DELETE FROM history",
+		"UPDATE history SET command = 'rm'",
+		"DROP TABLE history",
+	} {
+		if _, err := collect(query); !errors.Is(err, rt.ErrWriteQuery) {
+			t.Errorf("QueryStreamReadOnly(%q) error = %v, want %v", query, err, rt.ErrWriteQuery)
+		}
+	}
+	records, err := collect("SELECT * FROM history")
+	if err != nil || len(records) != 1 || records[0].Command != "ls" {
+		t.Errorf("QueryStreamReadOnly() = %+v, %v, want the original record untouched", records, err)
+	}
+
+	// Attempts on immutable history are audited as before
+	database.SetImmutable(true)
+	if _, err := collect("DELETE FROM history"); !errors.Is(err, rt.ErrImmutable) {
+		t.Errorf("QueryStreamReadOnly() on immutable history error = %v, want %v", err, rt.ErrImmutable)
+	}
+	if entries, err := database.AuditLog(10); err != nil || len(entries) != 1 {
+		t.Errorf("AuditLog() = %+v, %v, want the attempt", entries, err)
+	}
+}
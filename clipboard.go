@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Clipboard copies text to the system clipboard.
+type Clipboard func(text string) error
+
+// clipboardTool is a program which copies its standard input to the
+// clipboard, usable where env is set
+type clipboardTool struct {
+	name string
+	args []string
+	env  string // Environment variable the tool needs, empty for none
+	goos string // Operating system the tool is for, empty for any
+}
+
+// clipboardTools are the programs tried, in order, after the terminal is
+// asked to copy
+var clipboardTools = []clipboardTool{
+	{name: "pbcopy", goos: "darwin"},
+	{name: "wl-copy", env: "WAYLAND_DISPLAY"},
+	{name: "xclip", args: []string{"-selection", "clipboard"}, env: "DISPLAY"},
+	{name: "xsel", args: []string{"--clipboard", "--input"}, env: "DISPLAY"},
+}
+
+// SystemClipboard returns a Clipboard which asks the terminal written to by
+// terminal to copy with an OSC 52 escape sequence, which works over ssh in
+// terminals supporting it, and then copies with the first of pbcopy,
+// wl-copy, xclip and xsel usable here. Copying fails only if neither works.
+func SystemClipboard(terminal io.Writer) Clipboard {
+	return func(text string) error {
+		_, oscErr := io.WriteString(terminal, osc52(text, os.Getenv("TMUX") != ""))
+		for _, tool := range clipboardTools {
+			if tool.goos != "" && tool.goos != runtime.GOOS || tool.env != "" && os.Getenv(tool.env) == "" {
+				continue
+			}
+			path, err := exec.LookPath(tool.name)
+			if err != nil {
+				continue
+			}
+			cmd := exec.Command(path, tool.args...)
+			cmd.Stdin = strings.NewReader(text)
+			if err := cmd.Run(); err != nil && oscErr != nil {
+				return fmt.Errorf("%s failed: %w", tool.name, err)
+			}
+			return nil
+		}
+		if oscErr != nil {
+			return errors.New("no clipboard available")
+		}
+		return nil
+	}
+}
+
+// osc52 returns the escape sequence asking the terminal to put text on the
+// clipboard, wrapped to pass through tmux to the terminal outside it
+func osc52(text string, tmux bool) string {
+	sequence := "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\x07"
+	if tmux {
+		return "\x1bPtmux;\x1b" + sequence + "\x1b\\"
+	}
+	return sequence
+}
@@ -0,0 +1,41 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"runtime"
+	"testing"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestSystemClipboard(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("pbcopy would copy to the real clipboard")
+	}
+	// Without a display only the terminal is asked to copy
+	t.Setenv("DISPLAY", "")
+	t.Setenv("WAYLAND_DISPLAY", "")
+	encoded := base64.StdEncoding.EncodeToString([]byte("git push --force"))
+
+	tests := []struct {
+		name string
+		tmux string
+		want string
+	}{
+		{name: "Terminal", want: "\x1b]52;c;" + encoded + "\x07"},
+		{name: "Within tmux", tmux: "/tmp/tmux-1000/default,1,0", want: "\x1bPtmux;\x1b\x1b]52;c;" + encoded + "\x07\x1b\\"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TMUX", tt.tmux)
+			var terminal bytes.Buffer
+			if err := rt.SystemClipboard(&terminal)("git push --force"); err != nil {
+				t.Fatalf("Clipboard() unexpected error = %v", err)
+			}
+			if got := terminal.String(); got != tt.want {
+				t.Errorf("Terminal received %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
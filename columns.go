@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Column is a field of a record shown in the text output and the picker,
+// cut short at Width characters unless Width is 0.
+type Column struct {
+	Name  string
+	Width int
+}
+
+// columnValues renders each column from a record, giving its time relative
+// to now unless now is zero. The line column is the command with its
+// arguments.
+var columnValues = map[string]func(r Record, now time.Time) string{
+	"id":       func(r Record, now time.Time) string { return strconv.FormatInt(r.ID, 10) },
+	"time":     timeColumn,
+	"exit":     func(r Record, now time.Time) string { return strconv.Itoa(r.ExitStatus) },
+	"duration": func(r Record, now time.Time) string { return r.Duration.String() },
+	"cwd":      func(r Record, now time.Time) string { return r.WorkingDirectory },
+	"cmd":      func(r Record, now time.Time) string { return r.Command },
+	"args":     func(r Record, now time.Time) string { return r.Arguments },
+	"line":     func(r Record, now time.Time) string { return r.CommandLine() },
+	"session":  func(r Record, now time.Time) string { return r.Session },
+	"host":     func(r Record, now time.Time) string { return r.Hostname },
+	"repo":     func(r Record, now time.Time) string { return r.Repo },
+	"branch":   func(r Record, now time.Time) string { return r.Branch },
+	"source":   func(r Record, now time.Time) string { return r.Source },
+}
+
+// timeColumn renders the time a record ran, exactly unless now is given
+func timeColumn(r Record, now time.Time) string {
+	if now.IsZero() {
+		return r.Timestamp.Format(time.RFC3339)
+	}
+	return FormatRelative(r.Timestamp, now)
+}
+
+// Columns lists the columns to show, in order. It is written as their names
+// separated by commas, each optionally followed by a colon and its width,
+// e.g. "time,exit,cwd:30,line".
+type Columns []Column
+
+// defaultColumns are those the text output shows unless others are chosen
+var defaultColumns = Columns{{Name: "time"}, {Name: "exit"}, {Name: "cwd"}, {Name: "line"}}
+
+// pickerColumns are those the picker shows unless others are chosen
+var pickerColumns = Columns{{Name: "time"}, {Name: "cwd"}, {Name: "duration"}, {Name: "line"}}
+
+// numericColumns are aligned to the right in the picker
+var numericColumns = map[string]bool{"id": true, "exit": true, "duration": true}
+
+const (
+	// columnGap separates the columns in the picker
+	columnGap = "  "
+	// minLastColumn is the narrowest the picker squeezes its last column,
+	// usually the command line, before making way for it by shrinking or
+	// dropping the others
+	minLastColumn = 20
+	// minDirColumn is the narrowest the picker shortens the working
+	// directory to before dropping columns
+	minDirColumn = 12
+)
+
+// ParseColumns parses a list of columns written as for Columns
+func ParseColumns(text string) (Columns, error) {
+	var columns Columns
+	for _, field := range strings.Split(text, ",") {
+		name, width, hasWidth := strings.Cut(strings.TrimSpace(field), ":")
+		if _, ok := columnValues[name]; !ok {
+			return nil, fmt.Errorf("unknown column %q, want one of %s", name, strings.Join(columnNames(), ", "))
+		}
+		column := Column{Name: name}
+		if hasWidth {
+			n, err := strconv.Atoi(width)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid width %q for column %s", width, name)
+			}
+			column.Width = n
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// columnNames returns the names of the columns, in order
+func columnNames() []string {
+	var names []string
+	for name := range columnValues {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Render returns the value of each column for the record, cut to width. The
+// time is given relative to now, or exactly if now is zero.
+func (c Columns) Render(r Record, now time.Time) []string {
+	values := make([]string, len(c))
+	for i, column := range c {
+		values[i] = truncate(columnValues[column.Name](r, now), column.Width)
+	}
+	return values
+}
+
+// truncate cuts text down to width characters, ending it with an ellipsis
+// when anything was cut. A width of 0 leaves it whole.
+func truncate(text string, width int) string {
+	runes := []rune(text)
+	if width == 0 || len(runes) <= width {
+		return text
+	}
+	return string(runes[:width-1]) + "…"
+}
+
+// String writes the columns as they are parsed
+func (c Columns) String() string {
+	fields := make([]string, len(c))
+	for i, column := range c {
+		fields[i] = column.Name
+		if column.Width > 0 {
+			fields[i] += ":" + strconv.Itoa(column.Width)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// Set parses the columns given on the command line
+func (c *Columns) Set(text string) error {
+	columns, err := ParseColumns(text)
+	if err != nil {
+		return err
+	}
+	*c = columns
+	return nil
+}
+
+// UnmarshalText parses the columns given in the config file
+func (c *Columns) UnmarshalText(text []byte) error {
+	return c.Set(string(text))
+}
+
+// layoutColumns fits rows of column values into width cells for the picker,
+// returning the columns kept and the width of each. Every column but the last
+// is as wide as its own width, if it has one, or else its widest value, and
+// the last takes what is left, up to its own width. When that is too little, the working directory is
+// shortened, then the columns nearest the last are dropped. A width of 0
+// leaves every column its widest value.
+func layoutColumns(columns Columns, rows [][]string, width int) ([]int, []int) {
+	kept := make([]int, len(columns))
+	widths := make([]int, len(columns))
+	for i, column := range columns {
+		kept[i] = i
+		for _, row := range rows {
+			widths[i] = max(widths[i], lipgloss.Width(row[i]))
+		}
+		if column.Width > 0 {
+			widths[i] = column.Width
+		}
+	}
+	if width <= 0 {
+		return kept, widths
+	}
+
+	// The last column need only be as wide as its widest value
+	need := min(minLastColumn, max(1, widths[len(columns)-1]))
+	for {
+		last := len(kept) - 1
+		used := len(columnGap) * last
+		for _, i := range kept[:last] {
+			used += widths[i]
+		}
+		remaining := width - used
+		if remaining >= need || last == 0 {
+			widths[kept[last]] = max(1, remaining)
+			if columns[kept[last]].Width > 0 {
+				widths[kept[last]] = max(1, min(columns[kept[last]].Width, remaining))
+			}
+			return kept, widths
+		}
+
+		shrunk := false
+		for _, i := range kept[:last] {
+			if columns[i].Name == "cwd" && widths[i] > minDirColumn {
+				widths[i] = max(minDirColumn, widths[i]-(need-remaining))
+				shrunk = true
+			}
+		}
+		if !shrunk {
+			kept = append(kept[:last-1], kept[last])
+		}
+	}
+}
+
+// pickerValues returns the value of each column for the record as the picker
+// shows it, with times relative to now unless it is zero, nothing for
+// records without a time and working directories in home given with ~
+func (c Columns) pickerValues(r Record, now time.Time, home string) []string {
+	values := make([]string, len(c))
+	for i, column := range c {
+		switch {
+		case column.Name == "time" && r.Timestamp.IsZero():
+			// Nothing to show
+		case column.Name == "cwd":
+			values[i] = tildePath(r.WorkingDirectory, home)
+		default:
+			values[i] = columnValues[column.Name](r, now)
+		}
+	}
+	return values
+}
+
+// fitColumn renders a value in exactly width cells, shortening working
+// directories in the middle, where the least telling part of a path usually
+// is, and anything else at the end. Numbers are aligned to the right.
+func fitColumn(column Column, value string, width int) string {
+	if column.Name == "cwd" {
+		value = truncateMiddle(value, width)
+	} else {
+		value = truncate(value, width)
+	}
+	style := lipgloss.NewStyle().Width(width)
+	if numericColumns[column.Name] {
+		style = style.Align(lipgloss.Right)
+	}
+	return style.Render(value)
+}
+
+// tildePath writes path with the home directory at its start as ~
+func tildePath(path, home string) string {
+	if home == "" || home == "/" {
+		return path
+	}
+	if path == home {
+		return "~"
+	}
+	if rest, ok := strings.CutPrefix(path, home+string(filepath.Separator)); ok {
+		return "~" + string(filepath.Separator) + rest
+	}
+	return path
+}
+
+// truncateMiddle cuts text down to width characters by replacing its middle
+// with an ellipsis, keeping more of the end than the start
+func truncateMiddle(text string, width int) string {
+	runes := []rune(text)
+	if width == 0 || len(runes) <= width {
+		return text
+	}
+	if width == 1 {
+		return "…"
+	}
+	head := (width - 1) / 2
+	tail := width - 1 - head
+	return string(runes[:head]) + "…" + string(runes[len(runes)-tail:])
+}
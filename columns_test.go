@@ -0,0 +1,152 @@
+package main_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	rt "github.com/nuchs/retour"
+)
+
+func TestParseColumns(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    rt.Columns
+		wantErr bool
+	}{
+		{text: "cmd,args,cwd,exit,time", want: rt.Columns{{Name: "cmd"}, {Name: "args"}, {Name: "cwd"}, {Name: "exit"}, {Name: "time"}}},
+		{text: "exit, cwd:20,line", want: rt.Columns{{Name: "exit"}, {Name: "cwd", Width: 20}, {Name: "line"}}},
+		{text: "command", wantErr: true},
+		{text: "cwd:0", wantErr: true},
+		{text: "cwd:wide", wantErr: true},
+		{text: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := rt.ParseColumns(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseColumns() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseColumns() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Column %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestColumnWriter(t *testing.T) {
+	columns, err := rt.ParseColumns("exit,cwd:8,cmd,args:6")
+	if err != nil {
+		t.Fatalf("ParseColumns() unexpected error = %v", err)
+	}
+	if got := columns.String(); got != "exit,cwd:8,cmd,args:6" {
+		t.Errorf("String() = %q, want it as parsed", got)
+	}
+
+	var buf bytes.Buffer
+	writer := rt.NewColumnWriter(&buf, columns, time.Time{})
+	record := rt.NewRecord("git commit --amend", "/home/user/project", 1, time.Now())
+	if err := writer.Write(record); err != nil {
+		t.Fatalf("Write() unexpected error = %v", err)
+	}
+	if want := "1\t/home/u…\tgit\tcommi…\n"; buf.String() != want {
+		t.Errorf("Wrote %q, want %q", buf.String(), want)
+	}
+}
+
+func TestColumnsInPicker(t *testing.T) {
+	columns, err := rt.ParseColumns("cwd:10,line")
+	if err != nil {
+		t.Fatalf("ParseColumns() unexpected error = %v", err)
+	}
+	records := []rt.Record{rt.NewRecord("make test", "/src", 0, time.Now())}
+	model, _ := rt.NewUI(rt.NewFilter(records)).WithColumns(columns).Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+
+	if view := model.View(); !strings.Contains(view, "/src        make test") {
+		t.Errorf("View() does not show the padded columns:\n%s", view)
+	}
+}
+
+func TestRelativeTimeInPicker(t *testing.T) {
+	columns, err := rt.ParseColumns("time,line")
+	if err != nil {
+		t.Fatalf("ParseColumns() unexpected error = %v", err)
+	}
+	ran := time.Now().Add(-2*time.Hour - time.Minute)
+	if ran.Day() != time.Now().Day() {
+		t.Skip("Two hours ago was yesterday")
+	}
+	records := []rt.Record{rt.NewRecord("make test", "/src", 0, ran)}
+	var model tea.Model = rt.NewUI(rt.NewFilter(records)).WithColumns(columns)
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+
+	if view := model.View(); !strings.Contains(view, "2h ago  make test") {
+		t.Errorf("View() does not show how long ago the command ran:\n%s", view)
+	}
+
+	// Ctrl-T toggles exact timestamps
+	model, _ = model.Update(tea.KeyMsg{Type: tea.KeyCtrlT})
+	if view := model.View(); !strings.Contains(view, ran.Format(time.RFC3339)+"  make test") {
+		t.Errorf("View() does not show the exact time after Ctrl-T:\n%s", view)
+	}
+}
+
+func TestPickerLayout(t *testing.T) {
+	t.Setenv("HOME", "/home/user")
+	now := time.Now()
+	records := []rt.Record{
+		{Command: "make", Arguments: "test", WorkingDirectory: "/home/user/src/app", Timestamp: now.Add(-time.Minute), Duration: 1500 * time.Millisecond},
+		{Command: "git", Arguments: "status", WorkingDirectory: "/var/lib/something/very/deep/inside/the/tree", ExitStatus: 1, Timestamp: now.Add(-5 * time.Minute), Duration: 12 * time.Millisecond},
+	}
+
+	tests := []struct {
+		name  string
+		width int
+		want  []string
+	}{
+		{
+			name:  "Wide enough for everything",
+			width: 100,
+			want: []string{
+				"✓ 1m ago  ~/src/app                                     1.5s  make test",
+				"✗ 5m ago  /var/lib/something/very/deep/inside/the/tree  12ms  git status",
+			},
+		},
+		{
+			name:  "Directories shortened in the middle",
+			width: 60,
+			want: []string{
+				"✓ 1m ago  ~/src/app                       1.5s  make test",
+				"✗ 5m ago  /var/lib/somet…inside/the/tree  12ms  git status",
+			},
+		},
+		{
+			name:  "Columns dropped",
+			width: 30,
+			want:  []string{"✓ 1m ago  make test", "✗ 5m ago  git status"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model, _ := rt.NewUI(rt.NewFilter(records)).Update(tea.WindowSizeMsg{Width: tt.width, Height: 10})
+			view := model.View()
+			for _, want := range tt.want {
+				if !strings.Contains(view, want) {
+					t.Errorf("View() does not contain %q:\n%s", want, view)
+				}
+			}
+		})
+	}
+}
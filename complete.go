@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// frecencyScore ranks a group of records by how often and how recently they
+// were run. Each run contributes its stored score, see Decay.
+const frecencyScore = "SUM(score)"
+
+// frecency scores a single run of the given age, contributing less the more
+// days ago it happened
+func frecency(age time.Duration) float64 {
+	return 1.0 / (1.0 + age.Hours()/24)
+}
+
+// maxRune sorts after every valid UTF-8 sequence, so prefix + maxRune is an
+// exclusive upper bound for strings starting with prefix.
+const maxRune = "\U0010FFFF"
+
+// Complete returns the command lines starting with prefix, ranked by frecency.
+// The command part of the prefix is matched with a range scan on the command
+// index so completions stay fast on large histories.
+func (db *DB) Complete(prefix string, limit int) ([]Suggestion, error) {
+	prefix = strings.TrimLeft(prefix, " ")
+	if prefix == "" {
+		return nil, nil
+	}
+	if db.cipher != nil {
+		return db.completeSealed(prefix, limit)
+	}
+
+	var where string
+	var args []interface{}
+	if command, rest, found := strings.Cut(prefix, " "); found {
+		where = "command = ? AND substr(COALESCE(arguments, ''), 1, length(?)) = ?"
+		args = append(args, command, rest, rest)
+	} else {
+		where = "command >= ? AND command < ?"
+		args = append(args, prefix, prefix+maxRune)
+	}
+	args = append(args, limit)
+
+	rows, err := db.reader.Query(`
+	SELECT command, COALESCE(arguments, ''), COUNT(*)
+	FROM history
+	WHERE `+where+`
+	GROUP BY command, arguments
+	ORDER BY `+frecencyScore+` DESC
+	LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suggestions []Suggestion
+	for rows.Next() {
+		var r Record
+		var s Suggestion
+		if err := rows.Scan(&r.Command, &r.Arguments, &s.Count); err != nil {
+			return nil, err
+		}
+		s.CommandLine = r.CommandLine()
+		suggestions = append(suggestions, s)
+	}
+
+	return suggestions, rows.Err()
+}
+
+// completeSealed is Complete for encrypted history, where the database
+// cannot compare prefixes, so the candidates are decrypted and matched here
+func (db *DB) completeSealed(prefix string, limit int) ([]Suggestion, error) {
+	where, args := "1", []interface{}{}
+	if command, _, found := strings.Cut(prefix, " "); found {
+		where, args = "command = ?", append(args, db.seal(command))
+	}
+
+	rows, err := db.reader.Query(`
+	SELECT command, COALESCE(arguments, ''), COUNT(*)
+	FROM history
+	WHERE `+where+`
+	GROUP BY command, arguments
+	ORDER BY `+frecencyScore+` DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suggestions []Suggestion
+	for rows.Next() && len(suggestions) < limit {
+		var r Record
+		var s Suggestion
+		if err := rows.Scan(&r.Command, &r.Arguments, &s.Count); err != nil {
+			return nil, err
+		}
+		if err := db.openRecord(&r); err != nil {
+			return nil, err
+		}
+		if s.CommandLine = r.CommandLine(); strings.HasPrefix(s.CommandLine, prefix) {
+			suggestions = append(suggestions, s)
+		}
+	}
+
+	return suggestions, rows.Err()
+}
+
+// CompleteArg returns the values previously passed to command as its pos'th
+// argument (counting from 1, as COMP_CWORD does) which start with prefix,
+// ranked by frecency.
+func (db *DB) CompleteArg(command string, pos int, prefix string, limit int) ([]Suggestion, error) {
+	if pos < 1 {
+		return nil, nil
+	}
+
+	rows, err := db.reader.Query(
+		"SELECT COALESCE(arguments, ''), score FROM history WHERE command = ?", db.seal(command))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scores := map[string]float64{}
+	counts := map[string]int{}
+	for rows.Next() {
+		var arguments string
+		var score float64
+		if err := rows.Scan(&arguments, &score); err != nil {
+			return nil, err
+		}
+		if arguments, err = db.open(arguments); err != nil {
+			return nil, err
+		}
+
+		words := Tokenize(arguments)
+		if len(words) < pos || !strings.HasPrefix(words[pos-1], prefix) {
+			continue
+		}
+		value := words[pos-1]
+		scores[value] += score
+		counts[value]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	suggestions := make([]Suggestion, 0, len(scores))
+	for value, count := range counts {
+		suggestions = append(suggestions, Suggestion{CommandLine: value, Count: count})
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		si, sj := scores[suggestions[i].CommandLine], scores[suggestions[j].CommandLine]
+		if si != sj {
+			return si > sj
+		}
+		return suggestions[i].CommandLine < suggestions[j].CommandLine
+	})
+
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions, nil
+}
+
+// runCompleteArg implements the complete-arg subcommand
+func runCompleteArg(config *Config, args []string) error {
+	flags := flag.NewFlagSet("complete-arg", flag.ContinueOnError)
+	command := flags.String("cmd", "", "Command being completed")
+	pos := flags.Int("pos", 1, "Position of the argument being completed, counting from 1")
+	prefix := flags.String("prefix", "", "Text typed so far for the argument")
+	count := flags.Int("n", 20, "Number of values to return")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *command == "" {
+		return fmt.Errorf("complete-arg requires --cmd")
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	suggestions, err := db.CompleteArg(*command, *pos, *prefix, *count)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range suggestions {
+		fmt.Println(s.CommandLine)
+	}
+	return nil
+}
+
+// runComplete implements the complete subcommand
+func runComplete(config *Config, args []string) error {
+	flags := flag.NewFlagSet("complete", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "Text typed so far")
+	count := flags.Int("n", 1, "Number of completions to return")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	suggestions, err := db.Complete(*prefix, *count)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range suggestions {
+		fmt.Println(s.CommandLine)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestComplete(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now()
+	history := []struct {
+		line string
+		age  time.Duration
+	}{
+		{line: "git checkout main", age: 30 * 24 * time.Hour},
+		{line: "git checkout main", age: 29 * 24 * time.Hour},
+		{line: "git checkout -b feature", age: time.Hour},
+		{line: "git cherry-pick abc", age: 2 * time.Hour},
+		{line: "gitk", age: time.Hour},
+		{line: "go test ./...", age: time.Hour},
+	}
+	for _, h := range history {
+		record := rt.NewRecord(h.line, "/", 0, now.Add(-h.age))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{name: "Recent beats frequent", prefix: "git ch", want: []string{"git checkout -b feature", "git cherry-pick abc", "git checkout main"}},
+		{name: "Argument prefix", prefix: "git checkout m", want: []string{"git checkout main"}},
+		{name: "Command prefix", prefix: "go", want: []string{"go test ./..."}},
+		{name: "No match", prefix: "docker", want: nil},
+		{name: "Empty prefix", prefix: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suggestions, err := database.Complete(tt.prefix, 5)
+			if err != nil {
+				t.Fatalf("Complete() unexpected error = %v", err)
+			}
+			if len(suggestions) != len(tt.want) {
+				t.Fatalf("Got %v, want %v", suggestions, tt.want)
+			}
+			for i, want := range tt.want {
+				if suggestions[i].CommandLine != want {
+					t.Errorf("Completion %d = %q, want %q", i, suggestions[i].CommandLine, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompleteArg(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now()
+	history := []struct {
+		line string
+		age  time.Duration
+	}{
+		{line: "kubectl get pods -n staging", age: 10 * 24 * time.Hour},
+		{line: "kubectl get pods -n staging", age: 9 * 24 * time.Hour},
+		{line: "kubectl get pods -n production", age: time.Hour},
+		{line: "kubectl logs web -n 'sandbox env'", age: time.Hour},
+		{line: "kubectl get", age: time.Hour},
+		{line: "helm list -n other", age: time.Hour},
+	}
+	for _, h := range history {
+		record := rt.NewRecord(h.line, "/", 0, now.Add(-h.age))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		pos    int
+		prefix string
+		want   []string
+	}{
+		{name: "Subcommands", pos: 1, want: []string{"get", "logs"}},
+		{name: "Quoted values", pos: 4, want: []string{"production", "sandbox env", "staging"}},
+		{name: "Prefix", pos: 4, prefix: "st", want: []string{"staging"}},
+		{name: "Past the end", pos: 9, want: nil},
+		{name: "Invalid position", pos: 0, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suggestions, err := database.CompleteArg("kubectl", tt.pos, tt.prefix, 10)
+			if err != nil {
+				t.Fatalf("CompleteArg() unexpected error = %v", err)
+			}
+			if len(suggestions) != len(tt.want) {
+				t.Fatalf("Got %v, want %v", suggestions, tt.want)
+			}
+			for i, want := range tt.want {
+				if suggestions[i].CommandLine != want {
+					t.Errorf("Value %d = %q, want %q", i, suggestions[i].CommandLine, want)
+				}
+			}
+		})
+	}
+}
@@ -7,11 +7,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
-
-	"github.com/BurntSushi/toml"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 // getDefaultDBPath returns the default path for the SQLite database file
@@ -43,6 +47,67 @@ const (
 	AllTime TimeRange = "alltime"
 )
 
+// OutputMode represents how the record chosen in interactive mode is emitted.
+type OutputMode string
+
+const (
+	// PrintOutput renders the picker on stdout and prints the selection after it exits
+	PrintOutput OutputMode = "print"
+	// ShellOutput renders the picker on stderr and writes only the bare command line
+	// to stdout, so shell widgets can splice it into the line editor buffer
+	ShellOutput OutputMode = "shell"
+)
+
+// Duration returns how far back from now the time range reaches, or zero for AllTime.
+func (t TimeRange) Duration(now time.Time) time.Duration {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch t {
+	case Today:
+		return now.Sub(midnight)
+	case Yesterday:
+		return now.Sub(midnight.AddDate(0, 0, -1))
+	case LastWeek:
+		return 7 * 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+// OutputFormat represents how records are written by the non-interactive modes.
+type OutputFormat string
+
+const (
+	// TextFormat writes one tab separated line per record
+	TextFormat OutputFormat = "text"
+	// JSONFormat writes one JSON object per line (JSON Lines)
+	JSONFormat OutputFormat = "json"
+	// CSVFormat writes comma separated values with a header row
+	CSVFormat OutputFormat = "csv"
+	// TSVFormat writes tab separated values with a header row
+	TSVFormat OutputFormat = "tsv"
+	// TemplateFormat writes each record as the template given with
+	// --template renders it
+	TemplateFormat OutputFormat = "template"
+)
+
+// JoinMode represents how multiple selected records are combined on output.
+type JoinMode string
+
+const (
+	// NewlineJoin puts each selected command on its own line
+	NewlineJoin JoinMode = "newline"
+	// AndJoin chains the selected commands with && so they run in sequence
+	AndJoin JoinMode = "and"
+)
+
+// Separator returns the text placed between joined commands.
+func (j JoinMode) Separator() string {
+	if j == AndJoin {
+		return " && "
+	}
+	return "\n"
+}
+
 // ResultFilter represents how to filter commands based on their exit status.
 type ResultFilter string
 
@@ -55,50 +120,254 @@ const (
 	FailedResults ResultFilter = "failed"
 )
 
-// Config holds all configuration for the application
 // Config holds all the configuration settings for the retour application.
 type Config struct {
-	// Database configuration
-	ConnectionString string `toml:"connection_string"`
-	RetentionPeriod  string `toml:"retention_period"`
+	// Database configuration. A postgres:// URL as the connection string
+	// keeps the history in a shared PostgreSQL database instead of SQLite.
+	ConnectionString string  `toml:"connection_string"`
+	RetentionPeriod  string  `toml:"retention_period"`
+	Pragmas          Pragmas `toml:"pragmas"`
+	// Immutable forbids changing or removing recorded history, for machines
+	// where it serves as an audit trail. It is deliberately only read from
+	// the config file.
+	Immutable bool `toml:"immutable"`
+	// ReadOnly opens the database without writing to it and refuses
+	// anything which would, for looking through someone else's archived
+	// history or a mounted backup
+	ReadOnly bool `toml:"read_only"`
+	// Socket is the path of the daemon's Unix socket, empty for the default
+	// beside the database
+	Socket string `toml:"socket"`
+	// EncryptionKeyFile holds the secret command text is encrypted with,
+	// empty to store it in plain text
+	EncryptionKeyFile string `toml:"encryption_key_file"`
+	// SyncRemote is the directory, or host:dir reached with ssh, sync
+	// exchanges records through
+	SyncRemote string `toml:"sync_remote"`
+	// SyncKeyFile holds the secret the records sync exchanges are encrypted
+	// with, empty to exchange them in plain text
+	SyncKeyFile string `toml:"sync_key_file"`
+	// Fingerprint records the environment each session runs in: the shell
+	// version, a hash of PATH and the output of FingerprintProbes, commands
+	// such as "go version"
+	Fingerprint       bool     `toml:"fingerprint"`
+	FingerprintProbes []string `toml:"fingerprint_probes"`
+	// Language is the code of the language messages are shown in, e.g. fr,
+	// empty to follow the locale
+	Language string `toml:"language"`
+	// Daemon limits what each client of the daemon may ask of it
+	Daemon DaemonLimits `toml:"daemon"`
 
 	// Command filtering
-	ExclusionPatterns []string `toml:"exclusion_patterns"`
-	Limit             int      `toml:"limit"`
+	ExclusionPatterns []string  `toml:"exclusion_patterns"`
+	Redaction         Redaction `toml:"redaction"`
+	DangerousPatterns []string  `toml:"dangerous_patterns"`
+	Limit             int       `toml:"limit"`
 	WorkingDirectory  string
+	Recursive         bool
+	Repo              string
+	Branch            string
+	// Starred only shows the commands starred in the picker
+	Starred bool
+	// Tag only shows the commands tagged with it
+	Tag string
+	// KeepTags exempt the commands tagged with any of them from pruning, as
+	// starred commands are
+	KeepTags []string `toml:"keep_tags"`
 
 	// Runtime options
-	Mode      Mode
-	Query     string
-	Result    ResultFilter
-	TimeRange TimeRange
+	Mode   Mode
+	Output OutputMode
+	Join   JoinMode
+	Format OutputFormat
+	// Template is the text/template records are written with in the
+	// template format
+	Template string
+	// Keys binds the picker's actions to keys other than the usual ones
+	Keys Keymap `toml:"keys"`
+	// Theme sets the picker's colours
+	Theme Theme `toml:"theme"`
+	// Columns are those shown by the text format and the picker, empty for
+	// their usual ones
+	Columns Columns `toml:"columns"`
+	// AbsoluteTime shows exact timestamps rather than how long ago commands
+	// ran
+	AbsoluteTime bool `toml:"absolute_time"`
+	// SearchHistory has the picker search the database for the filter text
+	// when only some of the history is loaded, rather than filtering only
+	// the records loaded
+	SearchHistory bool `toml:"search_history"`
+	// Match is how the picker's filter text matches commands until it is
+	// switched with Alt-M
+	Match  MatchMode `toml:"match"`
+	Filter string
+	// SavedSearch names the saved search the picker starts with
+	SavedSearch string
+	// Attach lists other retour databases searched along with this one's
+	// for the run, without merging them into it, so it is only given on the
+	// command line
+	Attach []string `toml:"-"`
+	WithID bool
+	// Exec runs the command selected in the picker rather than emitting it,
+	// in the directory it ran in, or the current one with ExecHere
+	Exec     bool
+	ExecHere bool
+	// Trace reports how long the stages of the run took on stderr
+	Trace bool
+	// AllowWrite lets a query given with --query change the history
+	AllowWrite bool
+	Unique     bool
+	Here       bool
+	Query      string
+	Result     ResultFilter
+	TimeRange  TimeRange
+
+	// Subcommand and its arguments, empty when none was given
+	Command string
+	Args    []string
+
+	// StrictConfig makes problems with the config file, such as unknown keys,
+	// errors rather than warnings
+	StrictConfig bool `toml:"strict_config"`
+
+	// file is the path of the config file, which may not exist, relative
+	// to the filesystem it was loaded from unless absolute
+	file string
+	// sources records the layer each setting not left at its default came from
+	sources map[string]Source
+	// warnings describes the problems found with the config file
+	warnings []string
 }
 
-// LoadConfig loads the configuration from both the config file and command line flags
-// LoadConfig creates a new Config by combining settings from command line arguments
-// and a TOML configuration file. Command line arguments take precedence over file settings.
-// If the config file doesn't exist, default values will be used for file-only settings.
-//
-// The fsys parameter should be a filesystem containing the config file at .config/retour/config.toml
-// The args parameter should be the command line arguments (including the program name as args[0])
-func LoadConfig(fsys fs.FS, args []string) (*Config, error) {
-	config := &Config{
+// Source identifies the layer a setting's effective value came from.
+type Source string
+
+const (
+	// DefaultSource marks a setting left at its built in default
+	DefaultSource Source = "default"
+	// FileSource marks a setting read from the config file
+	FileSource Source = "file"
+	// EnvSource marks a setting read from a RETOUR_* environment variable
+	EnvSource Source = "env"
+	// FlagSource marks a setting given on the command line
+	FlagSource Source = "flag"
+)
+
+// envSettings lists the settings which may be given in the environment. Each
+// is read from RETOUR_ followed by its name in upper case, with underscores
+// for hyphens, e.g. RETOUR_TIME_RANGE.
+var envSettings = []string{
+	"connection-string",
+	"retention-period",
+	"encryption-key-file",
+	"socket",
+	"sync-remote",
+	"sync-key-file",
+	"language",
+	"read-only",
+	"strict-config",
+	"limit",
+	"working-directory",
+	"recursive",
+	"repo",
+	"branch",
+	"starred",
+	"tag",
+	"result",
+	"time-range",
+	"output",
+	"format",
+	"template",
+	"columns",
+	"absolute-time",
+	"search-history",
+	"match",
+	"join",
+	"unique",
+	"here",
+}
+
+// envVar returns the environment variable a setting is read from
+func envVar(setting string) string {
+	return "RETOUR_" + strings.ToUpper(strings.ReplaceAll(setting, "-", "_"))
+}
+
+// defaultConfig returns the configuration used when nothing else is given
+func defaultConfig() *Config {
+	return &Config{
+		ConnectionString:  getDefaultDBPath(),
+		Pragmas:           DefaultPragmas(),
+		Daemon:            DefaultDaemonLimits(),
 		Mode:              InteractiveMode,
+		Output:            PrintOutput,
+		Join:              NewlineJoin,
+		Match:             SubstringMatch,
+		Format:            TextFormat,
 		Query:             "",
+		Limit:             100,
 		Result:            AllResults,
 		TimeRange:         AllTime,
 		ExclusionPatterns: []string{},
+		DangerousPatterns: []string{},
+		Redaction:         DefaultRedaction(),
+		Keys:              DefaultKeymap(),
+		sources:           map[string]Source{},
 	}
+}
 
-	configPath, err := parseCommandLine(config, args)
+// LoadConfig creates a new Config by layering, from lowest to highest
+// precedence, the defaults, the TOML config file, RETOUR_* environment
+// variables and the command line arguments. Each layer overrides only the
+// settings it actually contains, and the layer each effective value came from
+// is reported by Config.Source.
+//
+// The fsys parameter should be a filesystem containing the config file at .config/retour/config.toml
+// The args parameter should be the command line arguments (including the program name as args[0])
+func LoadConfig(fsys fs.FS, args []string) (*Config, error) {
+	config := defaultConfig()
+
+	flags, configPath, err := parseCommandLine(config, args)
 	if err != nil {
 		return nil, err
 	}
 
+	// The command line had to be parsed first to find the config file, so
+	// start again from the defaults and apply the layers in order
+	*config = *defaultConfig()
+	config.file = configPath
+
 	if err := readConfig(config, fsys, configPath); err != nil {
 		return nil, err
 	}
 
+	if err := readEnv(config, flags); err != nil {
+		return nil, err
+	}
+
+	if err := flags.Apply(); err != nil {
+		return nil, fmt.Errorf("failed to apply command line flags: %w", err)
+	}
+	for _, setting := range flags.Given() {
+		if setting == "cwd-prefix" {
+			config.sources["working-directory"] = FlagSource
+			config.sources["recursive"] = FlagSource
+			continue
+		}
+		config.sources[setting] = FlagSource
+	}
+
+	if config.StrictConfig && len(config.warnings) > 0 {
+		return nil, fmt.Errorf("invalid config file:\n  %s", strings.Join(config.warnings, "\n  "))
+	}
+
+	if config.Query != "" {
+		config.Mode = QueryMode
+	}
+	if rest := flags.Args(); len(rest) > 0 {
+		config.Command = rest[0]
+		config.Args = rest[1:]
+	}
+
 	if err := validateConfig(config); err != nil {
 		return nil, err
 	}
@@ -106,11 +375,97 @@ func LoadConfig(fsys fs.FS, args []string) (*Config, error) {
 	return config, nil
 }
 
+// Warnings returns the problems found with the config file which were not
+// errors, as the config is not strict
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
+// Scope returns the place the settings restrict commands to. The repository
+// may be given as any directory within it.
+func (c *Config) Scope() Scope {
+	scope := Scope{Dir: c.WorkingDirectory, Recursive: c.Recursive, Repo: c.Repo, Branch: c.Branch, Starred: c.Starred, Tag: c.Tag}
+	if scope.Repo != "" {
+		if root, _, ok := findRepo(scope.Repo); ok {
+			scope.Repo = root
+		} else if abs, err := filepath.Abs(scope.Repo); err == nil {
+			scope.Repo = abs
+		}
+	}
+	return scope
+}
+
+// relativeTo returns the time the timestamps shown are given relative to,
+// zero if they are to be exact
+func (c *Config) relativeTo() time.Time {
+	if c.AbsoluteTime {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// Retention returns how long records are kept before the daemon prunes them,
+// 0 to keep them all. The period is given in days or weeks, e.g. 90d or 12w,
+// or as a Go duration, e.g. 720h.
+func (c *Config) Retention() (time.Duration, error) {
+	period := strings.TrimSpace(c.RetentionPeriod)
+	if period == "" {
+		return 0, nil
+	}
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(period, suffix); ok {
+			count, err := strconv.Atoi(n)
+			if err != nil || count < 0 {
+				return 0, fmt.Errorf("invalid retention period: %s", c.RetentionPeriod)
+			}
+			return time.Duration(count) * unit, nil
+		}
+	}
+	retention, err := time.ParseDuration(period)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("invalid retention period: %s", c.RetentionPeriod)
+	}
+	return retention, nil
+}
+
+// SocketPath returns the path of the daemon's socket
+func (c *Config) SocketPath() string {
+	if c.Socket != "" {
+		return c.Socket
+	}
+	return filepath.Join(filepath.Dir(c.ConnectionString), "retour.sock")
+}
+
+// cwdPrefix is the --cwd-prefix option, shorthand for filtering by working
+// directory recursively
+type cwdPrefix struct {
+	config *Config
+}
+
+func (p cwdPrefix) String() string {
+	if p.config == nil || !p.config.Recursive {
+		return ""
+	}
+	return p.config.WorkingDirectory
+}
+
+func (p cwdPrefix) Set(dir string) error {
+	p.config.WorkingDirectory = dir
+	p.config.Recursive = true
+	return nil
+}
+
+// Source returns the layer the effective value of the named setting came from
+func (c *Config) Source(setting string) Source {
+	if source, ok := c.sources[setting]; ok {
+		return source
+	}
+	return DefaultSource
+}
+
 func readConfig(config *Config, fsys fs.FS, configPath string) error {
-	configFile, err := fsys.Open(configPath)
+	configFile, err := openConfig(fsys, configPath)
 	if errors.Is(err, fs.ErrNotExist) {
-		// Set default connection string when no config file exists
-		config.ConnectionString = getDefaultDBPath()
 		return nil
 	}
 	if err != nil {
@@ -118,62 +473,131 @@ func readConfig(config *Config, fsys fs.FS, configPath string) error {
 	}
 	defer configFile.Close()
 
-	if _, err := toml.NewDecoder(configFile).Decode(config); err != nil {
+	text, err := io.ReadAll(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	warnings, decoded, err := decodeConfigFile(config, string(text))
+	if err != nil {
 		return fmt.Errorf("failed to decode config file: %w", err)
 	}
+	config.warnings = append(config.warnings, warnings...)
+	for _, key := range decoded {
+		config.sources[strings.ReplaceAll(key.String(), "_", "-")] = FileSource
+	}
 
-	// Set default connection string if not specified in config
+	// An empty connection string in the file means the default
 	if config.ConnectionString == "" {
 		config.ConnectionString = getDefaultDBPath()
+		delete(config.sources, "connection-string")
 	}
 
 	return nil
 }
 
-func parseCommandLine(config *Config, args []string) (string, error) {
-	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
-	flags.Usage = usage
+// readEnv applies the settings given in RETOUR_* environment variables. Those
+// which are also command line flags are parsed the same way as the flag.
+func readEnv(config *Config, flags *flagSet) error {
+	for _, setting := range envSettings {
+		value, ok := os.LookupEnv(envVar(setting))
+		if !ok {
+			continue
+		}
 
-	flags.StringVar(&config.Query, "q", "", "SQL query to execute")
-	flags.StringVar(&config.Query, "query", "", "SQL query to execute")
+		switch setting {
+		case "connection-string":
+			config.ConnectionString = value
+		case "retention-period":
+			config.RetentionPeriod = value
+		case "encryption-key-file":
+			config.EncryptionKeyFile = value
+		case "socket":
+			config.Socket = value
+		case "sync-remote":
+			config.SyncRemote = value
+		case "sync-key-file":
+			config.SyncKeyFile = value
+		case "language":
+			config.Language = value
+		default:
+			if err := flags.Set(setting, value); err != nil {
+				return fmt.Errorf("invalid %s: %w", envVar(setting), err)
+			}
+		}
+		config.sources[setting] = EnvSource
+	}
 
-	flags.IntVar(&config.Limit, "l", 100, "Limit the number of results returned")
-	flags.IntVar(&config.Limit, "limit", 100, "Limit the number of results returned")
+	// Colour is turned off by NO_COLOR whatever the config file says, see
+	// https://no-color.org
+	if os.Getenv("NO_COLOR") != "" {
+		config.Theme.NoColor = true
+		config.sources["theme.no-color"] = EnvSource
+	}
+	return nil
+}
 
-	flags.StringVar(&config.WorkingDirectory, "w", "", "Filter by working directory")
-	flags.StringVar(&config.WorkingDirectory, "working-directory", "", "Filter by working directory")
+// openConfig opens the config file, reading absolute paths given on the command
+// line from the host filesystem rather than fsys, which only holds relative paths.
+func openConfig(fsys fs.FS, configPath string) (fs.File, error) {
+	if filepath.IsAbs(configPath) {
+		return os.Open(configPath)
+	}
+	return fsys.Open(configPath)
+}
 
-	result := ""
-	flags.StringVar(&result, "r", string(AllResults), "Filter results (success, failed, all)")
-	flags.StringVar(&result, "result", string(AllResults), "Filter results (success, failed, all)")
+// parseCommandLine binds the command line flags to config and parses args,
+// returning the flags, which remember what was given, and the config file path.
+func parseCommandLine(config *Config, args []string) (*flagSet, string, error) {
+	flags := newFlagSet(args[0], flag.ExitOnError)
+	flags.flags.Usage = usage
 
-	timeRange := ""
-	flags.StringVar(&timeRange, "t", string(AllTime), "Time range (today, yesterday, thelastweek, alltime)")
-	flags.StringVar(&timeRange, "time-range", string(AllTime), "Time range (today, yesterday, thelastweek, alltime)")
+	flags.StringVar(&config.Query, "q", "query", config.Query, "SQL query to execute")
+	flags.BoolVar(&config.AllowWrite, "", "allow-write", config.AllowWrite, "Let the SQL query change the history")
+	flags.StringVar(&config.Filter, "f", "filter", config.Filter, "Initial filter text for interactive mode")
+	flags.StringVar(&config.SavedSearch, "", "search", config.SavedSearch, "Start interactive mode with the search saved under this name")
+	flags.Var(stringList{&config.Attach}, "", "attach", "Also search the retour database at this path, may be given more than once")
+	flags.BoolVar(&config.Unique, "u", "unique", config.Unique, "Collapse repeated command lines into one row with a count")
+	flags.BoolVar(&config.Here, "", "here", config.Here, "Suggest the commands run in the working directory tree first")
+	flags.BoolVar(&config.WithID, "", "with-id", config.WithID, "Prefix the selected command with its record ID and a tab")
+	flags.BoolVar(&config.Exec, "", "exec", config.Exec, "Run the selected command in the directory it ran in and record it")
+	flags.BoolVar(&config.ExecHere, "", "exec-here", config.ExecHere, "Run the selected command in the current directory and record it")
+	flags.BoolVar(&config.ReadOnly, "", "read-only", config.ReadOnly, "Open the database read-only and refuse anything which would change it")
+	flags.BoolVar(&config.StrictConfig, "", "strict-config", config.StrictConfig, "Fail on unknown keys and invalid values in the config file")
+	flags.BoolVar(&config.Trace, "", "trace", config.Trace, "Report how long loading, querying and rendering took on stderr")
+	flags.IntVar(&config.Limit, "l", "limit", config.Limit, "Limit the number of results returned")
+	flags.StringVar(&config.WorkingDirectory, "w", "working-directory", config.WorkingDirectory, "Filter by working directory")
+	flags.BoolVar(&config.Recursive, "R", "recursive", config.Recursive, "Also match the directories below the working directory filter")
+	flags.Var(cwdPrefix{config}, "", "cwd-prefix", "Filter by working directory, including the directories below it")
+	flags.StringVar(&config.Repo, "", "repo", config.Repo, "Filter by the git repository containing this directory")
+	flags.StringVar(&config.Branch, "", "branch", config.Branch, "Filter by git branch")
+	flags.BoolVar(&config.Starred, "", "starred", config.Starred, "Only show the commands starred in the picker")
+	flags.StringVar(&config.Tag, "", "tag", config.Tag, "Only show the commands tagged with this tag")
+	flags.Var(typedString[ResultFilter]{&config.Result}, "r", "result", "Filter results (success, failed, all)")
+	flags.Var(typedString[OutputMode]{&config.Output}, "o", "output", "Output mode for the selected command (print, shell)")
+	flags.Var(typedString[OutputFormat]{&config.Format}, "", "format", "Output format for query mode (text, json, csv, tsv, template)")
+	flags.StringVar(&config.Template, "", "template", config.Template, "Template records are written with in the template format")
+	flags.Var(&config.Columns, "", "columns", "Columns shown by the text format and the picker, e.g. time,exit,cwd:30,line")
+	flags.BoolVar(&config.SearchHistory, "", "search-history", config.SearchHistory, "Search the whole history for the filter text, not only the records loaded")
+	flags.BoolVar(&config.AbsoluteTime, "", "absolute-time", config.AbsoluteTime, "Show exact timestamps rather than how long ago commands ran")
+	flags.Var(typedString[MatchMode]{&config.Match}, "", "match", "How the filter text matches commands (substring, fuzzy, exact, regex)")
+	flags.Var(typedString[JoinMode]{&config.Join}, "j", "join", "How to join multiple selected commands (newline, and)")
+	flags.Var(typedString[TimeRange]{&config.TimeRange}, "t", "time-range", "Time range (today, yesterday, thelastweek, alltime)")
 
-	defaultConfigPath := filepath.Join(".config", "retour", "config.toml")
 	configPath := ""
-	flags.StringVar(&configPath, "c", defaultConfigPath, "Config file path")
-	flags.StringVar(&configPath, "config", defaultConfigPath, "Config file path")
+	flags.StringVar(&configPath, "c", "config", filepath.Join(".config", "retour", "config.toml"), "Config file path")
 
 	if err := flags.Parse(args[1:]); err != nil {
-		return "", fmt.Errorf("failed to parse command line flags: %w", err)
-	}
-
-	config.Result = ResultFilter(result)
-	config.TimeRange = TimeRange(timeRange)
-	if config.Query != "" {
-		config.Mode = QueryMode
+		return nil, "", fmt.Errorf("failed to parse command line flags: %w", err)
 	}
 
 	// Check if config file exists only if explicitly specified
-	if configPath != defaultConfigPath {
+	if flags.IsSet("config") {
 		if _, err := os.Stat(configPath); os.IsNotExist(err) {
-			return "", fmt.Errorf("config file %q does not exist", configPath)
+			return nil, "", fmt.Errorf("config file %q does not exist", configPath)
 		}
 	}
 
-	return configPath, nil
+	return flags, configPath, nil
 }
 
 func validateConfig(config *Config) error {
@@ -184,6 +608,27 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("invalid mode: %s", config.Mode)
 	}
 
+	if config.ReadOnly && config.AllowWrite {
+		return errors.New("--allow-write cannot be given with --read-only")
+	}
+	if config.Exec || config.ExecHere {
+		switch {
+		case config.ReadOnly:
+			return errors.New("--exec records the command run, which --read-only forbids")
+		case len(config.Attach) > 0:
+			return errors.New("--exec records the command run, which cannot be done with --attach")
+		case config.Output == ShellOutput:
+			return errors.New("--exec cannot be given with --output shell, which leaves running the command to the shell")
+		}
+	}
+
+	if config.Starred && IsPostgres(config.ConnectionString) {
+		return errors.New("--starred needs a SQLite database, a PostgreSQL one keeps no stars")
+	}
+	if config.Tag != "" && IsPostgres(config.ConnectionString) {
+		return errors.New("--tag needs a SQLite database, a PostgreSQL one keeps no tags")
+	}
+
 	switch config.TimeRange {
 	case Today, Yesterday, LastWeek, AllTime:
 		// valid
@@ -198,6 +643,41 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("invalid result filter: %s", config.Result)
 	}
 
+	switch config.Output {
+	case PrintOutput, ShellOutput:
+		// valid
+	default:
+		return fmt.Errorf("invalid output mode: %s", config.Output)
+	}
+
+	switch config.Format {
+	case TextFormat, JSONFormat, CSVFormat, TSVFormat:
+		// valid
+	case TemplateFormat:
+		if config.Template == "" {
+			return fmt.Errorf("the template format needs a template, given with --template")
+		}
+		if _, err := NewTemplateWriter(io.Discard, config.Template); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid output format: %s", config.Format)
+	}
+
+	switch config.Join {
+	case NewlineJoin, AndJoin:
+		// valid
+	default:
+		return fmt.Errorf("invalid join mode: %s", config.Join)
+	}
+
+	switch config.Match {
+	case SubstringMatch, FuzzyMatch, ExactMatch, RegexMatch:
+		// valid
+	default:
+		return fmt.Errorf("invalid match mode: %s", config.Match)
+	}
+
 	if config.WorkingDirectory != "" {
 		if _, err := os.Stat(config.WorkingDirectory); err != nil {
 			return fmt.Errorf("invalid working directory: %w", err)
@@ -208,32 +688,520 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("limit must be greater than 0, got %d", config.Limit)
 	}
 
+	if _, err := config.Retention(); err != nil {
+		return err
+	}
+
+	if err := config.Keys.Validate(); err != nil {
+		return fmt.Errorf("invalid keys: %w", err)
+	}
+
+	if err := config.Theme.Validate(); err != nil {
+		return fmt.Errorf("invalid theme: %w", err)
+	}
+
 	if config.ConnectionString == "" {
 		return errors.New("connection string is empty")
 	}
 
+	switch strings.ToUpper(config.Pragmas.JournalMode) {
+	case "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+		// valid
+	default:
+		return fmt.Errorf("invalid journal mode: %s", config.Pragmas.JournalMode)
+	}
+
+	switch strings.ToUpper(config.Pragmas.Synchronous) {
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+		// valid
+	default:
+		return fmt.Errorf("invalid synchronous setting: %s", config.Pragmas.Synchronous)
+	}
+
+	if err := config.Daemon.Validate(); err != nil {
+		return err
+	}
+	if config.Pragmas.BusyTimeout < 0 {
+		return fmt.Errorf("busy timeout must not be negative, got %d", config.Pragmas.BusyTimeout)
+	}
+
+	switch config.Redaction.Action {
+	case ScrubSecrets, SkipSecrets, KeepSecrets:
+		// valid
+	default:
+		return fmt.Errorf("invalid redaction action: %s", config.Redaction.Action)
+	}
+	if _, err := NewRedactor(config.Redaction); err != nil {
+		return err
+	}
+	for _, pattern := range config.DangerousPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid dangerous pattern %q: %w", pattern, err)
+		}
+	}
+
 	return nil
 }
 
+// settings lists the user facing settings, in the order config show prints them
+var settings = []string{
+	"connection-string",
+	"retention-period",
+	"immutable",
+	"read-only",
+	"encryption-key-file",
+	"socket",
+	"sync-remote",
+	"sync-key-file",
+	"fingerprint",
+	"fingerprint-probes",
+	"language",
+	"strict-config",
+	"exclusion-patterns",
+	"redaction.action",
+	"redaction.builtin",
+	"redaction.patterns",
+	"dangerous-patterns",
+	"limit",
+	"working-directory",
+	"recursive",
+	"repo",
+	"branch",
+	"starred",
+	"tag",
+	"keep-tags",
+	"result",
+	"time-range",
+	"output",
+	"format",
+	"template",
+	"columns",
+	"absolute-time",
+	"search-history",
+	"match",
+	"join",
+	"unique",
+	"here",
+	"filter",
+	"search",
+	"attach",
+	"query",
+	"pragmas.journal-mode",
+	"pragmas.busy-timeout",
+	"pragmas.synchronous",
+	"pragmas.foreign-keys",
+	"daemon.requests-per-second",
+	"daemon.burst",
+	"daemon.request-timeout",
+	"daemon.max-results",
+	"keys.up",
+	"keys.down",
+	"keys.select",
+	"keys.delete",
+	"keys.preview",
+	"keys.quit",
+	"keys.result",
+	"keys.time-range",
+	"keys.scope",
+	"keys.copy",
+	"keys.star",
+	"keys.tag",
+	"keys.ignore",
+	"keys.match",
+	"theme.preset",
+	"theme.selected",
+	"theme.normal",
+	"theme.failed",
+	"theme.filter",
+	"theme.no-color",
+}
+
+// Setting returns the effective value of the named setting as text
+func (c *Config) Setting(name string) string {
+	switch name {
+	case "connection-string":
+		return c.ConnectionString
+	case "retention-period":
+		return c.RetentionPeriod
+	case "immutable":
+		return strconv.FormatBool(c.Immutable)
+	case "read-only":
+		return strconv.FormatBool(c.ReadOnly)
+	case "encryption-key-file":
+		return c.EncryptionKeyFile
+	case "socket":
+		return c.SocketPath()
+	case "sync-remote":
+		return c.SyncRemote
+	case "sync-key-file":
+		return c.SyncKeyFile
+	case "fingerprint":
+		return strconv.FormatBool(c.Fingerprint)
+	case "fingerprint-probes":
+		return strings.Join(c.FingerprintProbes, ", ")
+	case "language":
+		return c.Language
+	case "strict-config":
+		return strconv.FormatBool(c.StrictConfig)
+	case "exclusion-patterns":
+		return strings.Join(c.ExclusionPatterns, ", ")
+	case "redaction.action":
+		return string(c.Redaction.Action)
+	case "redaction.builtin":
+		return strconv.FormatBool(c.Redaction.Builtin)
+	case "redaction.patterns":
+		return strings.Join(c.Redaction.Patterns, ", ")
+	case "dangerous-patterns":
+		return strings.Join(c.DangerousPatterns, ", ")
+	case "limit":
+		return strconv.Itoa(c.Limit)
+	case "working-directory":
+		return c.WorkingDirectory
+	case "recursive":
+		return strconv.FormatBool(c.Recursive)
+	case "repo":
+		return c.Repo
+	case "branch":
+		return c.Branch
+	case "starred":
+		return strconv.FormatBool(c.Starred)
+	case "tag":
+		return c.Tag
+	case "keep-tags":
+		return strings.Join(c.KeepTags, ", ")
+	case "result":
+		return string(c.Result)
+	case "time-range":
+		return string(c.TimeRange)
+	case "output":
+		return string(c.Output)
+	case "format":
+		return string(c.Format)
+	case "template":
+		return c.Template
+	case "columns":
+		return c.Columns.String()
+	case "absolute-time":
+		return strconv.FormatBool(c.AbsoluteTime)
+	case "search-history":
+		return strconv.FormatBool(c.SearchHistory)
+	case "match":
+		return string(c.Match)
+	case "join":
+		return string(c.Join)
+	case "unique":
+		return strconv.FormatBool(c.Unique)
+	case "here":
+		return strconv.FormatBool(c.Here)
+	case "filter":
+		return c.Filter
+	case "search":
+		return c.SavedSearch
+	case "attach":
+		return strings.Join(c.Attach, ", ")
+	case "query":
+		return c.Query
+	case "pragmas.journal-mode":
+		return c.Pragmas.JournalMode
+	case "pragmas.busy-timeout":
+		return strconv.Itoa(c.Pragmas.BusyTimeout)
+	case "pragmas.synchronous":
+		return c.Pragmas.Synchronous
+	case "pragmas.foreign-keys":
+		return strconv.FormatBool(c.Pragmas.ForeignKeys)
+	case "daemon.requests-per-second":
+		return strconv.FormatFloat(c.Daemon.RequestsPerSecond, 'g', -1, 64)
+	case "daemon.burst":
+		return strconv.Itoa(c.Daemon.Burst)
+	case "daemon.request-timeout":
+		return strconv.Itoa(c.Daemon.RequestTimeout)
+	case "daemon.max-results":
+		return strconv.Itoa(c.Daemon.MaxResults)
+	case "keys.up":
+		return strings.Join(c.Keys.Up, ", ")
+	case "keys.down":
+		return strings.Join(c.Keys.Down, ", ")
+	case "keys.select":
+		return strings.Join(c.Keys.Select, ", ")
+	case "keys.delete":
+		return strings.Join(c.Keys.Delete, ", ")
+	case "keys.preview":
+		return strings.Join(c.Keys.Preview, ", ")
+	case "keys.quit":
+		return strings.Join(c.Keys.Quit, ", ")
+	case "keys.result":
+		return strings.Join(c.Keys.Result, ", ")
+	case "keys.time-range":
+		return strings.Join(c.Keys.TimeRange, ", ")
+	case "keys.scope":
+		return strings.Join(c.Keys.Scope, ", ")
+	case "keys.copy":
+		return strings.Join(c.Keys.Copy, ", ")
+	case "keys.star":
+		return strings.Join(c.Keys.Star, ", ")
+	case "keys.tag":
+		return strings.Join(c.Keys.Tag, ", ")
+	case "keys.ignore":
+		return strings.Join(c.Keys.Ignore, ", ")
+	case "keys.match":
+		return strings.Join(c.Keys.Match, ", ")
+	case "theme.preset":
+		return c.Theme.preset()
+	case "theme.selected":
+		return c.Theme.Resolved().Selected
+	case "theme.normal":
+		return c.Theme.Resolved().Normal
+	case "theme.failed":
+		return c.Theme.Resolved().Failed
+	case "theme.filter":
+		return c.Theme.Resolved().Filter
+	case "theme.no-color":
+		return strconv.FormatBool(c.Theme.NoColor)
+	default:
+		return ""
+	}
+}
+
+// runConfig implements the config subcommand
+func runConfig(config *Config, args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return fmt.Errorf("usage: retour config show [--sources]")
+	}
+
+	flags := flag.NewFlagSet("config show", flag.ContinueOnError)
+	sources := flags.Bool("sources", false, "Show where each setting's value came from")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	return writeSettings(os.Stdout, config, *sources)
+}
+
+// writeSettings renders the effective settings as an aligned table, with the
+// source of each when requested
+func writeSettings(w io.Writer, config *Config, sources bool) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range settings {
+		if sources {
+			fmt.Fprintf(table, "%s\t%s\t%s\n", name, config.Setting(name), config.Source(name))
+		} else {
+			fmt.Fprintf(table, "%s\t%s\n", name, config.Setting(name))
+		}
+	}
+	return table.Flush()
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, `Retour - Command History Manager
 
 Usage:
   retour [options]
+  retour [options] <command> [arguments]
+
+Commands:
+  audit [-n count]        List attempts to change the history while it was immutable
+  complete --prefix text  Print the best history completion for the text typed so far
+  complete-arg --cmd c --pos n
+                          Print argument values previously used at that position
+  config show [--sources] Print the effective settings, optionally with where each came from
+  daemon [--socket path] [--grpc path]
+                          Serve recording and searching over a Unix socket, so the
+                          shell hooks need not open the database themselves; it stops
+                          on SIGINT or SIGTERM once the commands received are stored,
+                          and reads the config file again on SIGHUP. --grpc also
+                          serves the History service of proto/retour.proto over gRPC
+                          on a second socket, for editors and other tools
+  demo [--records n] [--seed n]
+                          Try the picker over a synthetic history [default: 5000
+                          records], leaving the real one untouched
+  dirs [--top|--aliases|--cdpath]
+                          List the most frecent directories or export them for the shell
+  doctor                  Look for history split across several databases, such as
+                          the configured one and one at the default path
+  doctor --lint [--fix]   Look for malformed records left by old importers: zero
+                          timestamps, empty commands, invalid UTF-8 and absurd
+                          durations; --fix normalises them
+  encrypt                 Encrypt the commands recorded before encryption_key_file was set
+  export [--format f] [--template t] [--out file]
+                          Stream the filtered history as jsonl, csv, tsv, text or
+                          a template of its own
+  gen-fixture [--records n] [--seed n] [--out file]
+                          Write a synthetic history into a database file of its own
+                          [default: retour-fixture.db], for benchmarks and tests; the
+                          same seed gives the same history
+  import <format> <file>  Import an existing history file or database
+                          (bash|zsh|fish|atuin|mcfly|zsh-histdb); history files
+                          take --timestamp-format and --assume-timezone; an import
+                          interrupted by a signal resumes where it stopped
+  init <shell> [--ctrl-r] [--daemon]
+                          Print the shell integration script (bash|zsh), optionally
+                          binding Ctrl-R to the search widget and sending commands
+                          to the daemon rather than recording them
+  merge [--yes] [path...] Merge other retour databases into the configured one, by
+                          default those doctor finds, asking before each
+  pick [--filter text] [--first]
+                          Print the matches the picker would offer, best first, or
+                          only the best, without showing it (for scripts)
+  prompt-info [flags]     Print the last exit status and directory stats for the prompt
+  record [flags] -- cmd   Record an executed command (used by the shell hooks)
+  record --stdin [--format ndjson]
+                          Record the JSON records piped in, one per line, reporting
+                          invalid lines without stopping; a signal stops the reading,
+                          keeping the records read so far
+  rerun [--yes] [--propagate-exit] <id>
+                          Run a recorded command again, recording it as a rerun;
+                          commands matching dangerous_patterns are confirmed first;
+                          --propagate-exit exits with the command's status and adds
+                          nothing to its output, for scripts and Makefiles
+  searches [list]         List the saved searches
+  searches delete <name>  Delete a saved search
+  send [flags] -- cmd     Send an executed command to the daemon, dropping it if the
+                          daemon does not answer within --timeout (default 250ms)
+  session start|end|list  Register or close a shell session (used by the shell hooks),
+                          or list sessions with their status and duration
+  stats [--sample n]      Show the top commands and directories, success rate,
+                          busiest times and exit classes; --sample estimates them
+                          from every nth command, for huge histories
+  stats [--days n] [--sparks style]
+                          Also draw the commands a day and their mean duration over the
+                          last n days [default: 30] (auto|braille|block|ascii)
+  stats --flags <command> Show the flags and subcommands most passed to a command
+  stats --dir <path>      Show exit classes and statuses and the most failed commands in a
+                          directory tree
+  stats --reruns          Show how much of the history was replayed and what is
+                          replayed most
+  stats --repos           Show the commands, failures, active days and top tools of each
+                          git repository, busiest first
+  sync [--remote remote] [push|pull]
+                          Exchange records with other machines through a directory,
+                          or host:dir over ssh [default: sync_remote], encrypting
+                          them with sync_key_file if it is set
+  suggest [--cwd dir]     Print the commands most used in a directory tree, those run
+                          in the directory itself first
+  suggest-next [flags]    Print the commands most likely to follow the last one
 
 Options:
-  -q, --query string      Execute a SQL query on the command history
+  -q, --query string      Execute a SQL query on the command history, which may only
+                          read it unless --allow-write is given
+      --allow-write       Let the query given with --query change the history
   -r, --result string     Filter results by execution status (success|failed|all) [default: all]
   -t, --time-range string Time range to search (today|yesterday|thelastweek|alltime) [default: alltime]
   -c, --config string     Config file path [default: $HOME/.config/retour/config.toml]
-  -l, --limit int         Limit the number of results returned [default: 100]
+  -f, --filter string     Initial filter text for interactive mode; a word may list
+                          alternatives separated by | (docker|podman build) and
+                          filters chained with > refine each other (git > rebase);
+                          class:name keeps the commands whose exit status is of a
+                          class, success (0), error, usage-error (2),
+                          permission (126), not-found (127) or signal (128 and
+                          above), e.g. class:signal make
+  -o, --output string     How to emit the selected command (print|shell) [default: print]
+      --format string     Output format for query mode (text|json|csv|tsv|template) [default: text]
+      --template text     Go text/template each record is written with in the template
+                          format, e.g. '{{.Timestamp}} {{.Command}} {{.Arguments}}'
+      --columns list      Columns the text format and the picker show, each cut short at
+                          an optional :width, e.g. time,exit,cwd:30,cmd,args:40; columns
+                          are id, time, exit, duration, cwd, cmd, args, line, session,
+                          host, repo, branch and source [default: time,exit,cwd,line
+                          for text and time,cwd,duration,line in the picker, which fits
+                          them to the window, shortening the directory and then dropping
+                          columns; Shift-Left and Shift-Right scroll a long command]
+      --absolute-time     Show exact timestamps rather than how long ago commands ran,
+                          e.g. 2h ago or yesterday 14:02; Ctrl-T toggles them in the picker
+      --search-history    While the picker holds only part of the history, see --limit,
+                          also search the rest of it for the filter text once typing
+                          pauses, adding the matches found; not for encrypted history
+      --match mode        How the filter text matches commands (substring|fuzzy|exact|regex)
+                          [default: substring]: fuzzy finds its characters in order, so gco
+                          matches git checkout, exact keeps its case and takes | literally,
+                          and regex takes it as a Go regular expression; whatever the mode,
+                          a filter written 'text is matched exactly and one written /text/
+                          as a regular expression, while > still chains filters
+  -j, --join string       Join multiple selected commands with (newline|and) [default: newline]
+      --search name       Start interactive mode with a saved search instead of the
+                          search options; Ctrl-S in the picker saves the current
+                          search and Ctrl-O offers the saved ones
+      --attach path       Also search the retour database at path, e.g. a backup, for
+                          this run without merging it; may be repeated, and the picker
+                          shows the database each command came from
+      --with-id           Prefix the selected command with its record ID and a tab
+      --exec              Run the selected commands rather than printing them, each in
+                          the directory it ran in, streaming their output, recording
+                          them as reruns and exiting with the last one's status
+      --exec-here         Same as --exec but run them in the current directory
+      --trace             Report how long config load, database open, schema check,
+                          the first query and first render took on stderr
+      --read-only         Open the database read-only, e.g. an archived history file
+                          or a mounted backup, refusing commands and picker actions
+                          which would change it
+      --strict-config     Fail on unknown keys and values of the wrong type in the
+                          config file rather than warning about them and ignoring them
+  -l, --limit int         Limit the number of results returned [default: 100]; the
+                          picker loads that many at a time, more as it is scrolled
+  -u, --unique            Show each command line once with its run count
+      --here              Show the commands run in the working directory tree, ranked
+                          as by the suggest command
   -w, --working-directory Filter by working directory
+  -R, --recursive         Also match the directories below the working directory
+      --cwd-prefix dir    Same as -w dir -R
+      --repo dir          Filter by the git repository containing dir, e.g. .
+      --branch name       Filter by the git branch checked out
+      --starred           Only show the commands starred in the picker
+      --tag name          Only show the commands tagged name (Alt-G in the picker)
   -h, --help              Show this help message
 
+Settings are taken, from lowest to highest precedence, from the defaults, the
+config file, RETOUR_* environment variables (e.g. RETOUR_LIMIT, RETOUR_TIME_RANGE,
+RETOUR_CONNECTION_STRING) and the command line. Messages are shown in the
+language set by language in the config file or RETOUR_LANGUAGE (en|fr), or
+else by the locale.
+
+With fingerprint = true in the config file, each session records its shell
+version, a hash of PATH and the first line printed by each command in
+fingerprint_probes, e.g. ["go version", "node --version"], shown in the preview.
+
+With retention_period set in the config file, e.g. "90d", "12w" or "720h", the
+daemon prunes the commands run longer ago than that when it starts and hourly
+after. Pruning never removes starred commands, nor those tagged with one of
+keep_tags in the config file, e.g. keep_tags = ["keep"], however old they grow.
+
+The picker's keys are bound in the [keys] section of the config file, each of
+up, down, select, delete, preview, quit, result, time_range, scope, copy, star,
+tag, ignore and match listing the keys which do it, e.g. down = ["ctrl+j"] and
+up = ["ctrl+k"].
+Keys are named as bubbletea names them (ctrl+j, alt+k, enter, esc, space) or
+are single characters, which can then no longer be typed in the filter; actions
+not listed keep their usual keys. Result (Alt-R), time_range (Alt-T) and scope
+(Alt-D) change the search in place, cycling through all, succeeded and failed
+commands, all time, today, yesterday and the last week, and anywhere, the
+working directory and the tree below it. Copy (Ctrl-Y) copies the highlighted
+command to the clipboard without leaving the picker, asking the terminal to
+with OSC 52 and using pbcopy, wl-copy, xclip or xsel where they are available.
+Star (Alt-S) stars the highlighted command, pinning it above the rest of the
+history from then on, or unstars it. Tag (Alt-G) asks for a word, e.g. deploy,
+to tag the highlighted command with, for finding it again with --tag. Ignore
+(Alt-I) asks to delete every run of the highlighted command line and, once
+confirmed, adds a pattern matching it to exclusion_patterns in the config file.
+Match (Alt-M) cycles how the filter text matches commands through substring,
+fuzzy, exact and regex, see --match.
+
+The daemon limits requests in the [daemon] section: requests_per_second and
+burst rate limit each client process's requests [default: 50 and 100], though
+records are never refused, request_timeout cuts searches short after that many
+milliseconds [default: 5000] and max_results is the most records a search
+returns [default: 10000]; 0 turns a limit off.
+
+The picker's colours are set in the [theme] section: preset picks a set of them
+(default|light|ocean|mono), and selected, normal, failed and filter override
+its colours for the highlighted record, the others, those of failed commands
+and the filter text, each a colour number from 0 to 255 or a hex code such as
+"#ff5f87". no_color = true, or NO_COLOR in the environment, turns colour off.
+
 Examples:
   retour                           # Interactive mode
   retour -q "SELECT * FROM cmds"   # Query mode
+  retour -q "SELECT * FROM history" --format json | jq .command
   retour -r failed                 # Show failed commands
   retour -t today -r success       # Show today's successful commands
+  eval "$(retour init zsh)"        # Enable shell integration
 `)
 }
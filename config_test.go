@@ -1,8 +1,11 @@
 package main_test
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 	"testing/fstest"
+	"time"
 
 	rt "github.com/nuchs/retour"
 )
@@ -175,6 +178,147 @@ func TestMode(t *testing.T) {
 	}
 }
 
+func TestOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want rt.OutputMode
+	}{
+		{
+			name: "Default",
+			args: []string{"cmd"},
+			want: rt.PrintOutput,
+		},
+		{
+			name: "Short form shell",
+			args: []string{"cmd", "-o", "shell"},
+			want: rt.ShellOutput,
+		},
+		{
+			name: "Long form print",
+			args: []string{"cmd", "--output", "print"},
+			want: rt.PrintOutput,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := rt.LoadConfig(makeConfigFile(t), tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if got := config.Output; got != tt.want {
+				t.Errorf("Output = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want rt.OutputFormat
+	}{
+		{name: "Default", args: []string{"cmd"}, want: rt.TextFormat},
+		{name: "JSON", args: []string{"cmd", "--format", "json"}, want: rt.JSONFormat},
+		{name: "CSV", args: []string{"cmd", "--format", "csv"}, want: rt.CSVFormat},
+		{name: "TSV", args: []string{"cmd", "--format", "tsv"}, want: rt.TSVFormat},
+		{name: "Template", args: []string{"cmd", "--format", "template", "--template", "{{.Command}}"}, want: rt.TemplateFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := rt.LoadConfig(makeConfigFile(t), tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if got := config.Format; got != tt.want {
+				t.Errorf("Format = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoin(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		want     rt.JoinMode
+		wantSepr string
+	}{
+		{name: "Default", args: []string{"cmd"}, want: rt.NewlineJoin, wantSepr: "\n"},
+		{name: "Short form and", args: []string{"cmd", "-j", "and"}, want: rt.AndJoin, wantSepr: " && "},
+		{name: "Long form newline", args: []string{"cmd", "--join", "newline"}, want: rt.NewlineJoin, wantSepr: "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := rt.LoadConfig(makeConfigFile(t), tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if got := config.Join; got != tt.want {
+				t.Errorf("Join = %v, want %v", got, tt.want)
+			}
+			if got := config.Join.Separator(); got != tt.wantSepr {
+				t.Errorf("Separator() = %q, want %q", got, tt.wantSepr)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "Default", args: []string{"cmd"}, want: ""},
+		{name: "Short form", args: []string{"cmd", "-f", "git st"}, want: "git st"},
+		{name: "Long form", args: []string{"cmd", "--filter", "make"}, want: "make"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := rt.LoadConfig(makeConfigFile(t), tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if got := config.Filter; got != tt.want {
+				t.Errorf("Filter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubcommand(t *testing.T) {
+	config, err := rt.LoadConfig(makeConfigFile(t), []string{"cmd", "-l", "5", "record", "--exit", "1", "--", "ls", "-la"})
+	if err != nil {
+		t.Fatalf("LoadConfig() unexpected error = %v", err)
+	}
+
+	if config.Command != "record" {
+		t.Errorf("Command = %v, want record", config.Command)
+	}
+	want := []string{"--exit", "1", "--", "ls", "-la"}
+	if len(config.Args) != len(want) {
+		t.Fatalf("Args = %v, want %v", config.Args, want)
+	}
+	for i := range want {
+		if config.Args[i] != want[i] {
+			t.Errorf("Args[%d] = %v, want %v", i, config.Args[i], want[i])
+		}
+	}
+	if config.Limit != 5 {
+		t.Errorf("Limit = %v, want 5", config.Limit)
+	}
+}
+
 func TestConfigFile(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -272,11 +416,51 @@ func TestBadCommandLine(t *testing.T) {
 			want:       "config file \"invalid\" does not exist",
 			skipConfig: true,
 		},
+		{
+			name: "Invalid output mode",
+			args: []string{"cmd", "-o", "invalid"},
+			want: "invalid output mode: invalid",
+		},
+		{
+			name: "Invalid output format",
+			args: []string{"cmd", "--format", "invalid"},
+			want: "invalid output format: invalid",
+		},
+		{
+			name: "Template format without a template",
+			args: []string{"cmd", "--format", "template"},
+			want: "the template format needs a template, given with --template",
+		},
+		{
+			name: "Invalid template",
+			args: []string{"cmd", "--format", "template", "--template", "{{.Command"},
+			want: "invalid template: template: record:1: unclosed action",
+		},
+		{
+			name: "Invalid join mode",
+			args: []string{"cmd", "--join", "invalid"},
+			want: "invalid join mode: invalid",
+		},
 		{
 			name: "Invalid limit",
 			args: []string{"cmd", "--limit", "0"},
 			want: "limit must be greater than 0, got 0",
 		},
+		{
+			name: "Writing while read-only",
+			args: []string{"cmd", "--read-only", "--allow-write", "-q", "DELETE FROM history"},
+			want: "--allow-write cannot be given with --read-only",
+		},
+		{
+			name: "Running while read-only",
+			args: []string{"cmd", "--read-only", "--exec"},
+			want: "--exec records the command run, which --read-only forbids",
+		},
+		{
+			name: "Running in shell output mode",
+			args: []string{"cmd", "--exec-here", "--output", "shell"},
+			want: "--exec cannot be given with --output shell, which leaves running the command to the shell",
+		},
 		{
 			name: "Invalid working directory",
 			args: []string{"cmd", "--working-directory", "/nonexistent/path"},
@@ -391,3 +575,511 @@ retention_period = "30d"
 	}
 	return &fsys
 }
+
+func TestCommandLineOverridesConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{name: "Config file value", args: []string{"cmd"}, want: 50},
+		{name: "Short form wins", args: []string{"cmd", "-l", "5"}, want: 5},
+		{name: "Long form wins", args: []string{"cmd", "--limit", "7"}, want: 7},
+		{name: "Explicit default wins", args: []string{"cmd", "--limit", "100"}, want: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte("limit = 50\n")}}
+
+			config, err := rt.LoadConfig(fsys, tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if got := config.Limit; got != tt.want {
+				t.Errorf("Limit = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		wantLimit  int
+		wantSource rt.Source
+	}{
+		{name: "Default", args: []string{"cmd"}, wantLimit: 100, wantSource: rt.DefaultSource},
+		{name: "File", args: []string{"cmd"}, wantLimit: 50, wantSource: rt.FileSource},
+		{name: "Env over file", args: []string{"cmd"}, env: map[string]string{"RETOUR_LIMIT": "20"}, wantLimit: 20, wantSource: rt.EnvSource},
+		{name: "Flag over env", args: []string{"cmd", "-l", "5"}, env: map[string]string{"RETOUR_LIMIT": "20"}, wantLimit: 5, wantSource: rt.FlagSource},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte("limit = 50\n")}}
+			if tt.wantSource == rt.DefaultSource {
+				fsys = fstest.MapFS{}
+			}
+
+			config, err := rt.LoadConfig(fsys, tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if got := config.Limit; got != tt.wantLimit {
+				t.Errorf("Limit = %v, want %v", got, tt.wantLimit)
+			}
+			if got := config.Source("limit"); got != tt.wantSource {
+				t.Errorf("Source(limit) = %v, want %v", got, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestEnvSettings(t *testing.T) {
+	t.Setenv("RETOUR_TIME_RANGE", "today")
+	t.Setenv("RETOUR_CONNECTION_STRING", "env.db")
+
+	config, err := rt.LoadConfig(makeConfigFile(t), []string{"cmd"})
+	if err != nil {
+		t.Fatalf("LoadConfig() unexpected error = %v", err)
+	}
+
+	if config.TimeRange != rt.Today {
+		t.Errorf("TimeRange = %v, want %v", config.TimeRange, rt.Today)
+	}
+	if config.ConnectionString != "env.db" {
+		t.Errorf("ConnectionString = %v, want env.db", config.ConnectionString)
+	}
+	if got := config.Source("retention-period"); got != rt.FileSource {
+		t.Errorf("Source(retention-period) = %v, want %v", got, rt.FileSource)
+	}
+	if got := config.Setting("time-range"); got != "today" {
+		t.Errorf("Setting(time-range) = %v, want today", got)
+	}
+}
+
+func TestBadEnv(t *testing.T) {
+	t.Setenv("RETOUR_LIMIT", "lots")
+
+	_, err := rt.LoadConfig(makeConfigFile(t), []string{"cmd"})
+	if err == nil || !strings.Contains(err.Error(), "invalid RETOUR_LIMIT") {
+		t.Errorf("LoadConfig() error = %v, want invalid RETOUR_LIMIT", err)
+	}
+}
+
+func TestConfigFileWarnings(t *testing.T) {
+	configFile := `limit = "ten"
+exclusion_pattern = ["^ssh"]
+retention_period = "30d"
+
+[redaction]
+builtins = false
+`
+	fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte(configFile)}}
+
+	config, err := rt.LoadConfig(fsys, []string{"cmd"})
+	if err != nil {
+		t.Fatalf("LoadConfig() unexpected error = %v", err)
+	}
+	want := []string{
+		`config file line 1 (last key "limit"): incompatible types: TOML value has type string; destination has type integer`,
+		`config file line 2: unknown key "exclusion_pattern", did you mean "exclusion_patterns"?`,
+		`config file line 6: unknown key "redaction.builtins", did you mean "builtin"?`,
+	}
+	if got := config.Warnings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Warnings() = %q, want %q", got, want)
+	}
+	// The other settings are still read, the bad ones left at their defaults
+	if config.RetentionPeriod != "30d" || config.Limit != 100 {
+		t.Errorf("RetentionPeriod, Limit = %q, %d, want 30d, 100", config.RetentionPeriod, config.Limit)
+	}
+	if got := config.Source("limit"); got != rt.DefaultSource {
+		t.Errorf("Source(limit) = %v, want %v", got, rt.DefaultSource)
+	}
+
+	_, err = rt.LoadConfig(fsys, []string{"cmd", "--strict-config"})
+	if err == nil || !strings.Contains(err.Error(), `line 2: unknown key "exclusion_pattern"`) {
+		t.Errorf("LoadConfig() with --strict-config error = %v, want the unknown key", err)
+	}
+
+	fsys[".config/retour/config.toml"].Data = []byte("strict_config = true\nlimt = 5\n")
+	_, err = rt.LoadConfig(fsys, []string{"cmd"})
+	if err == nil || !strings.Contains(err.Error(), `line 2: unknown key "limt", did you mean "limit"?`) {
+		t.Errorf("LoadConfig() with strict_config error = %v, want the unknown key", err)
+	}
+}
+
+func TestPragmas(t *testing.T) {
+	tests := []struct {
+		name       string
+		configFile string
+		want       rt.Pragmas
+		wantErr    string
+	}{
+		{
+			name: "Defaults",
+			want: rt.DefaultPragmas(),
+		},
+		{
+			name:       "Partly configured",
+			configFile: "[pragmas]\njournal_mode = \"DELETE\"\nbusy_timeout = 100\n",
+			want:       rt.Pragmas{JournalMode: "DELETE", BusyTimeout: 100, Synchronous: "NORMAL", ForeignKeys: true},
+		},
+		{
+			name:       "Invalid journal mode",
+			configFile: "[pragmas]\njournal_mode = \"sideways\"\n",
+			wantErr:    "invalid journal mode: sideways",
+		},
+		{
+			name:       "Invalid synchronous",
+			configFile: "[pragmas]\nsynchronous = \"sometimes\"\n",
+			wantErr:    "invalid synchronous setting: sometimes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte(tt.configFile)}}
+
+			config, err := rt.LoadConfig(fsys, []string{"cmd"})
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("LoadConfig() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if config.Pragmas != tt.want {
+				t.Errorf("Pragmas = %+v, want %+v", config.Pragmas, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactionConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		configFile string
+		want       rt.Redaction
+		wantErr    string
+	}{
+		{
+			name: "Defaults",
+			want: rt.DefaultRedaction(),
+		},
+		{
+			name:       "Configured",
+			configFile: "[redaction]\naction = \"skip\"\npatterns = [\"vault login \\\\S+\"]\n",
+			want:       rt.Redaction{Action: rt.SkipSecrets, Builtin: true, Patterns: []string{`vault login \S+`}},
+		},
+		{
+			name:       "Invalid action",
+			configFile: "[redaction]\naction = \"hide\"\n",
+			wantErr:    "invalid redaction action: hide",
+		},
+		{
+			name:       "Invalid pattern",
+			configFile: "[redaction]\npatterns = [\"(\"]\n",
+			wantErr:    "invalid redaction pattern",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte(tt.configFile)}}
+
+			config, err := rt.LoadConfig(fsys, []string{"cmd"})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfig() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if !reflect.DeepEqual(config.Redaction, tt.want) {
+				t.Errorf("Redaction = %+v, want %+v", config.Redaction, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeysConfig(t *testing.T) {
+	remapped := rt.DefaultKeymap()
+	remapped.Up = []string{"ctrl+k"}
+	remapped.Down = []string{"ctrl+j"}
+	remapped.Quit = []string{"esc", "ctrl+c"}
+
+	tests := []struct {
+		name       string
+		configFile string
+		want       rt.Keymap
+		wantErr    string
+	}{
+		{
+			name: "Defaults",
+			want: rt.DefaultKeymap(),
+		},
+		{
+			name:       "Remapped",
+			configFile: "[keys]\nup = [\"ctrl+k\"]\ndown = [\"ctrl+j\"]\nquit = [\"esc\", \"ctrl+c\"]\n",
+			want:       remapped,
+		},
+		{
+			name:       "Unknown key",
+			configFile: "[keys]\nquit = [\"ctrl+escape\"]\n",
+			wantErr:    `invalid key "ctrl+escape" for quit`,
+		},
+		{
+			name:       "Key bound twice",
+			configFile: "[keys]\npreview = [\"ctrl+p\"]\n",
+			wantErr:    `key "ctrl+p" is bound to both up and preview`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte(tt.configFile)}}
+
+			config, err := rt.LoadConfig(fsys, []string{"cmd"})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfig() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if !reflect.DeepEqual(config.Keys, tt.want) {
+				t.Errorf("Keys = %+v, want %+v", config.Keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestThemeConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		configFile string
+		noColor    string
+		want       rt.Theme
+		wantErr    string
+	}{
+		{
+			name: "Defaults",
+			want: rt.Theme{Selected: "205", Normal: "252", Failed: "167", Filter: "205"},
+		},
+		{
+			name:       "Preset with an override",
+			configFile: "[theme]\npreset = \"light\"\nfailed = \"#ff0000\"\n",
+			want:       rt.Theme{Preset: "light", Selected: "162", Normal: "236", Failed: "#ff0000", Filter: "162"},
+		},
+		{
+			name:    "NO_COLOR",
+			noColor: "1",
+			want:    rt.Theme{Selected: "205", Normal: "252", Failed: "167", Filter: "205", NoColor: true},
+		},
+		{
+			name:       "Unknown preset",
+			configFile: "[theme]\npreset = \"neon\"\n",
+			wantErr:    `unknown preset "neon"`,
+		},
+		{
+			name:       "Invalid colour",
+			configFile: "[theme]\nselected = \"pink\"\n",
+			wantErr:    `invalid selected colour "pink"`,
+		},
+		{
+			name:       "Colour out of range",
+			configFile: "[theme]\nnormal = \"256\"\n",
+			wantErr:    `invalid normal colour "256"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NO_COLOR", tt.noColor)
+			fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte(tt.configFile)}}
+
+			config, err := rt.LoadConfig(fsys, []string{"cmd"})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfig() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if got := config.Theme.Resolved(); got != tt.want {
+				t.Errorf("Theme = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnique(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{name: "Default", args: []string{"cmd"}, want: false},
+		{name: "Short form", args: []string{"cmd", "-u"}, want: true},
+		{name: "Long form", args: []string{"cmd", "--unique"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := rt.LoadConfig(makeConfigFile(t), tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if config.Unique != tt.want {
+				t.Errorf("Unique = %v, want %v", config.Unique, tt.want)
+			}
+		})
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	tests := []struct {
+		name       string
+		configFile string
+		env        string
+		want       bool
+	}{
+		{name: "Default", want: false},
+		{name: "Config file", configFile: "immutable = true\n", want: true},
+		// Whoever can set the environment must not be able to lift it
+		{name: "Environment ignored", configFile: "immutable = true\n", env: "false", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("RETOUR_IMMUTABLE", tt.env)
+			}
+			fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte(tt.configFile)}}
+			config, err := rt.LoadConfig(fsys, []string{"cmd"})
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if config.Immutable != tt.want {
+				t.Errorf("Immutable = %v, want %v", config.Immutable, tt.want)
+			}
+		})
+	}
+}
+
+func TestHere(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want bool
+	}{
+		{name: "Default", args: []string{"cmd"}, want: false},
+		{name: "Flag", args: []string{"cmd", "--here"}, want: true},
+		{name: "Environment", args: []string{"cmd"}, env: "true", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("RETOUR_HERE", tt.env)
+			}
+			config, err := rt.LoadConfig(makeConfigFile(t), tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if config.Here != tt.want {
+				t.Errorf("Here = %v, want %v", config.Here, tt.want)
+			}
+		})
+	}
+}
+
+func TestScope(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name       string
+		args       []string
+		want       rt.Scope
+		wantSource rt.Source
+	}{
+		{name: "Default", args: []string{"cmd"}, want: rt.Scope{}, wantSource: rt.DefaultSource},
+		{name: "Exact", args: []string{"cmd", "-w", dir}, want: rt.Scope{Dir: dir}, wantSource: rt.FlagSource},
+		{name: "Recursive", args: []string{"cmd", "-w", dir, "-R"}, want: rt.Scope{Dir: dir, Recursive: true}, wantSource: rt.FlagSource},
+		{name: "Prefix", args: []string{"cmd", "--cwd-prefix", dir}, want: rt.Scope{Dir: dir, Recursive: true}, wantSource: rt.FlagSource},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := rt.LoadConfig(makeConfigFile(t), tt.args)
+			if err != nil {
+				t.Fatalf("LoadConfig() unexpected error = %v", err)
+			}
+
+			if got := config.Scope(); got != tt.want {
+				t.Errorf("Scope() = %+v, want %+v", got, tt.want)
+			}
+			if got := config.Source("working-directory"); got != tt.wantSource {
+				t.Errorf("Source(working-directory) = %v, want %v", got, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestAttachFlag(t *testing.T) {
+	config, err := rt.LoadConfig(makeConfigFile(t), []string{"cmd", "--attach", "a.db", "--attach", "b.db"})
+	if err != nil {
+		t.Fatalf("LoadConfig() unexpected error = %v", err)
+	}
+	if want := []string{"a.db", "b.db"}; !reflect.DeepEqual(config.Attach, want) {
+		t.Errorf("Attach = %v, want %v", config.Attach, want)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	tests := []struct {
+		period  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{period: "", want: 0},
+		{period: "90d", want: 90 * 24 * time.Hour},
+		{period: "12w", want: 12 * 7 * 24 * time.Hour},
+		{period: "720h", want: 720 * time.Hour},
+		{period: "d", wantErr: true},
+		{period: "-3d", wantErr: true},
+		{period: "forever", wantErr: true},
+	}
+	for _, tt := range tests {
+		config := rt.Config{RetentionPeriod: tt.period}
+		got, err := config.Retention()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("Retention() of %q = %v, %v, want %v and error %v", tt.period, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// decodeConfigFile decodes the text of a config file into config one
+// top-level key at a time, so that a value of the wrong type leaves only its
+// own setting at the default. It returns a warning, giving the line, for
+// each such value and each key which sets nothing, as a misspelt one
+// doesn't, along with the keys which were decoded. Only text which is not
+// valid TOML is an error.
+func decodeConfigFile(config *Config, text string) (warnings []string, decoded []toml.Key, err error) {
+	var raw map[string]toml.Primitive
+	meta, err := toml.Decode(text, &raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields := reflect.ValueOf(config).Elem()
+	failed := map[string]bool{}
+	for _, key := range meta.Keys() {
+		// Only top-level keys are decoded separately, tables as a whole
+		if len(key) != 1 {
+			continue
+		}
+		name := key[0]
+		field, ok := configField(fields, name)
+		if !ok {
+			failed[name] = true
+			warnings = append(warnings, unknownKeyWarning(text, key, fields.Type()))
+			continue
+		}
+		if err := meta.PrimitiveDecode(raw[name], field.Addr().Interface()); err != nil {
+			failed[name] = true
+			warnings = append(warnings, "config file "+strings.TrimPrefix(err.Error(), "toml: "))
+		}
+	}
+
+	// Keys within tables which set nothing are only known once the tables
+	// have been decoded
+	undecoded := map[string]bool{}
+	for _, key := range meta.Undecoded() {
+		undecoded[key.String()] = true
+		if len(key) > 1 && !failed[key[0]] {
+			warnings = append(warnings, unknownKeyWarning(text, key, fields.Type()))
+		}
+	}
+
+	for _, key := range meta.Keys() {
+		if !failed[key[0]] && !undecoded[key.String()] {
+			decoded = append(decoded, key)
+		}
+	}
+
+	// Warnings are given in the order of the lines they are about
+	slices.SortStableFunc(warnings, func(a, b string) int {
+		return warningLine(a) - warningLine(b)
+	})
+	return warnings, decoded, nil
+}
+
+// warningLine returns the line a warning about the config file is about, 0
+// if it doesn't say
+func warningLine(warning string) int {
+	var line int
+	fmt.Sscanf(warning, "config file line %d", &line)
+	return line
+}
+
+// configField returns the field of the struct fields which key sets
+func configField(fields reflect.Value, key string) (reflect.Value, bool) {
+	field, ok := fieldByKey(fields.Type(), key)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return fields.FieldByIndex(field.Index), true
+}
+
+// fieldKey returns the key a struct field is set by, empty if its toml tag
+// doesn't name one
+func fieldKey(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+	return name
+}
+
+// unknownKeyWarning describes a key which sets nothing, suggesting the key
+// closest to it in its table of config, which has type t
+func unknownKeyWarning(text string, key toml.Key, t reflect.Type) string {
+	warning := fmt.Sprintf("unknown key %q", key.String())
+	if line := keyLine(text, key); line > 0 {
+		warning = fmt.Sprintf("line %d: %s", line, warning)
+	}
+
+	// Only keys given by toml tags are suggested, those matching field names
+	// work but are not documented
+	for _, name := range key[:len(key)-1] {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		field, ok := fieldByKey(t, name)
+		if !ok {
+			return "config file " + warning
+		}
+		t = field.Type
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Struct {
+		var known []string
+		for i := range t.NumField() {
+			if name := fieldKey(t.Field(i)); name != "" && name != "-" {
+				known = append(known, name)
+			}
+		}
+		if suggestion := closestKey(key[len(key)-1], known); suggestion != "" {
+			warning += fmt.Sprintf(", did you mean %q?", suggestion)
+		}
+	}
+	return "config file " + warning
+}
+
+// fieldByKey returns the field of struct type t which key sets, matching the
+// toml tag or, for fields without one, the name in any case as the TOML
+// decoder does
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	if t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if name := fieldKey(field); name == key || name == "" && strings.EqualFold(field.Name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// closestKey returns the known key a mistyped one was most likely meant to
+// be, empty if none is close
+func closestKey(key string, known []string) string {
+	best, bestDistance := "", max(2, len(key)/4)+1
+	for _, candidate := range known {
+		if d := editDistance(key, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(min(previous[j], current[j-1])+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// keyLine returns the number of the line of text setting key, 0 if it
+// cannot be found. Keys are looked for within the table headers before them,
+// which covers the way config files are usually written.
+func keyLine(text string, key toml.Key) int {
+	want := key.String()
+	table := ""
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			header, _, _ := strings.Cut(strings.Trim(line, "[]"), "]")
+			table = normaliseKey(header)
+			if table == want {
+				return i + 1
+			}
+			continue
+		}
+		name, _, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(line, "#") {
+			continue
+		}
+		path := normaliseKey(name)
+		if table != "" {
+			path = table + "." + path
+		}
+		if path == want {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// normaliseKey writes a possibly dotted and quoted key as toml.Key.String
+// does, for the simple keys config files use
+func normaliseKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
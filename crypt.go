@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// sealedPrefix marks command text stored encrypted, distinguishing it from
+// text recorded before encryption was enabled
+const sealedPrefix = "retour-enc1:"
+
+// ErrWrongKey is returned when encrypted history cannot be decrypted with the
+// configured key.
+var ErrWrongKey = errors.New("history was encrypted with a different key")
+
+// ErrNoKey is returned when encrypted history is read without a key.
+var ErrNoKey = errors.New("history is encrypted, set encryption_key_file in the config file to read it")
+
+// textCipher encrypts command text with AES-GCM. The nonce is derived from
+// the text, so the same text always encrypts the same way and the database
+// can still group, count and look up commands by equality. This reveals which
+// records share a command, but not what it is.
+type textCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// newTextCipher derives the encryption and nonce keys from secret
+func newTextCipher(secret []byte) (*textCipher, error) {
+	aead, err := newAEAD(secret, "retour history encryption")
+	if err != nil {
+		return nil, err
+	}
+	nonceKey, err := hkdf.Key(sha256.New, secret, nil, "retour history nonce", 32)
+	if err != nil {
+		return nil, err
+	}
+	return &textCipher{aead: aead, nonceKey: nonceKey}, nil
+}
+
+// newAEAD returns AES-GCM keyed with the key derived from secret for the
+// purpose described by info
+func newAEAD(secret []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts text. Empty text, e.g. a command without arguments, is left
+// empty.
+func (c *textCipher) seal(text string) string {
+	if text == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write([]byte(text))
+	nonce := mac.Sum(nil)[:c.aead.NonceSize()]
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(text), nil)
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// open decrypts text sealed by seal, returning text stored before encryption
+// was enabled unchanged
+func (c *textCipher) open(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if c == nil {
+		return "", ErrNoKey
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", fmt.Errorf("corrupt encrypted text %q", stored)
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	text, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrWrongKey
+	}
+	return string(text), nil
+}
+
+// LoadEncryptionKey reads the secret history is encrypted with from path,
+// ignoring surrounding whitespace. The file must not be readable by other
+// users.
+func LoadEncryptionKey(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %w", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("encryption key file %s must only be accessible by its owner (chmod 600)", path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key: %w", err)
+	}
+	secret := []byte(strings.TrimSpace(string(content)))
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("encryption key in %s is too short, use at least 16 characters", path)
+	}
+	return secret, nil
+}
+
+// SetEncryptionKey encrypts the command text of records stored from now on
+// with a key derived from secret, and decrypts it when they are read. Records
+// stored before encryption was enabled are read as they are; Encrypt converts
+// them.
+//
+// Only the command and its arguments are encrypted. Queries given in SQL see
+// the encrypted text, so can only compare it for equality.
+func (db *DB) SetEncryptionKey(secret []byte) error {
+	c, err := newTextCipher(secret)
+	if err != nil {
+		return fmt.Errorf("failed to derive encryption key: %w", err)
+	}
+	db.cipher = c
+	return nil
+}
+
+// seal encrypts command text for storage when encryption is enabled
+func (db *DB) seal(text string) string {
+	if db.cipher == nil {
+		return text
+	}
+	return db.cipher.seal(text)
+}
+
+// open decrypts stored command text
+func (db *DB) open(stored string) (string, error) {
+	return db.cipher.open(stored)
+}
+
+// openRecord decrypts a scanned record's command and arguments
+func (db *DB) openRecord(r *Record) error {
+	var err error
+	if r.Command, err = db.open(r.Command); err != nil {
+		return err
+	}
+	r.Arguments, err = db.open(r.Arguments)
+	return err
+}
+
+// Encrypt encrypts the command text of the records stored before encryption
+// was enabled, returning how many were converted.
+func (db *DB) Encrypt() (int, error) {
+	if db.cipher == nil {
+		return 0, errors.New("no encryption key is set")
+	}
+	if err := db.checkMutable("encrypt", "encrypt stored command text"); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+	SELECT id, command, COALESCE(arguments, '')
+	FROM history
+	WHERE substr(command, 1, length(?1)) != ?1`, sealedPrefix)
+	if err != nil {
+		return 0, err
+	}
+	var plain []Record
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.ID, &r.Command, &r.Arguments); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plain = append(plain, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	update, err := tx.Prepare("UPDATE history SET command = ?, arguments = ? WHERE id = ?")
+	if err != nil {
+		return 0, err
+	}
+	defer update.Close()
+	for _, r := range plain {
+		if _, err := update.Exec(db.seal(r.Command), db.seal(r.Arguments), r.ID); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(plain), tx.Commit()
+}
+
+// runEncrypt implements the encrypt subcommand
+func runEncrypt(config *Config, args []string) error {
+	flags := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if config.EncryptionKeyFile == "" {
+		return errors.New("set encryption_key_file in the config file to encrypt the history")
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	n, err := db.Encrypt()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Encrypted %d records\n", n)
+	return nil
+}
@@ -0,0 +1,213 @@
+package main_test
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+var testSecret = []byte("correct horse battery staple")
+
+// openEncryptedDB opens a database at path encrypting with secret
+func openEncryptedDB(t *testing.T, path string, secret []byte) *rt.DB {
+	t.Helper()
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if secret != nil {
+		if err := database.SetEncryptionKey(secret); err != nil {
+			t.Fatalf("SetEncryptionKey() unexpected error = %v", err)
+		}
+	}
+	return database
+}
+
+func TestEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	database := openEncryptedDB(t, path, testSecret)
+
+	lines := []string{"git status", "git commit -m secret-plans", "git status", "make"}
+	for i, line := range lines {
+		record := rt.NewRecord(line, "/src/app", 0, time.Now().Add(time.Duration(i-10)*time.Second))
+		record.Session = "s1"
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+	}
+
+	// Nothing readable reaches the file
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer raw.Close()
+	var stored string
+	if err := raw.QueryRow("SELECT group_concat(command || ' ' || COALESCE(arguments, '')) FROM history").Scan(&stored); err != nil {
+		t.Fatalf("Failed to read database: %v", err)
+	}
+	for _, word := range []string{"git", "status", "secret-plans", "make"} {
+		if strings.Contains(stored, word) {
+			t.Errorf("Stored text %q contains %q", stored, word)
+		}
+	}
+
+	records, err := database.QueryUnique(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryUnique() unexpected error = %v", err)
+	}
+	counts := map[string]int{}
+	for _, r := range records {
+		counts[r.CommandLine()] = r.Count
+	}
+	if len(counts) != 3 || counts["git status"] != 2 || counts["git commit -m secret-plans"] != 1 {
+		t.Errorf("QueryUnique() counted %v", counts)
+	}
+
+	suggestions, err := database.Complete("git c", 10)
+	if err != nil {
+		t.Fatalf("Complete() unexpected error = %v", err)
+	}
+	if len(suggestions) != 1 || suggestions[0].CommandLine != "git commit -m secret-plans" {
+		t.Errorf("Complete() = %+v, want the commit", suggestions)
+	}
+
+	next, err := database.SuggestNext("git status", "/src/app", 10)
+	if err != nil {
+		t.Fatalf("SuggestNext() unexpected error = %v", err)
+	}
+	if len(next) != 2 {
+		t.Errorf("SuggestNext() = %+v, want the commit and make", next)
+	}
+
+	flags, err := database.FlagStats("git")
+	if err != nil {
+		t.Fatalf("FlagStats() unexpected error = %v", err)
+	}
+	if len(flags.Subcommands) != 2 || flags.Subcommands[0] != (rt.Count{Name: "status", Count: 2}) {
+		t.Errorf("FlagStats() = %+v, want status twice and commit", flags)
+	}
+
+	usage, err := database.UsageStats(10)
+	if err != nil {
+		t.Fatalf("UsageStats() unexpected error = %v", err)
+	}
+	if len(usage.Commands) != 2 || usage.Commands[0] != (rt.Count{Name: "git", Count: 3}) {
+		t.Errorf("UsageStats() commands = %+v, want git 3 times then make", usage.Commands)
+	}
+}
+
+func TestEncryptionKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	database := openEncryptedDB(t, path, testSecret)
+	record := rt.NewRecord("ls -la", "/tmp", 0, time.Now())
+	if err := database.Insert(&record); err != nil {
+		t.Fatalf("Insert() unexpected error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		secret  []byte
+		wantErr error
+	}{
+		{name: "Same key", secret: testSecret},
+		{name: "Different key", secret: []byte("another secret of some length"), wantErr: rt.ErrWrongKey},
+		{name: "No key", wantErr: rt.ErrNoKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reopened := openEncryptedDB(t, path, tt.secret)
+			records, err := reopened.Query("SELECT * FROM history")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Query() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (len(records) != 1 || records[0].CommandLine() != "ls -la") {
+				t.Errorf("Query() = %+v, want ls -la", records)
+			}
+		})
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	plain := openEncryptedDB(t, path, nil)
+	for _, line := range []string{"ls", "cat notes.txt"} {
+		record := rt.NewRecord(line, "/tmp", 0, time.Now())
+		if err := plain.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+	}
+
+	database := openEncryptedDB(t, path, testSecret)
+	for range 2 {
+		record := rt.NewRecord("ls", "/tmp", 0, time.Now())
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+	}
+
+	n, err := database.Encrypt()
+	if err != nil {
+		t.Fatalf("Encrypt() unexpected error = %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Encrypt() = %d, want the 2 plain text records", n)
+	}
+
+	records, err := database.QueryUnique(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryUnique() unexpected error = %v", err)
+	}
+	if len(records) != 2 || records[0].CommandLine() != "ls" || records[0].Count != 3 {
+		t.Errorf("QueryUnique() = %+v, want ls 3 times and cat", records)
+	}
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string, perm os.FileMode) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), perm); err != nil {
+			t.Fatalf("Failed to write key: %v", err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr string
+	}{
+		{name: "Valid", path: write("valid", string(testSecret)+"\n", 0o600), want: string(testSecret)},
+		{name: "Readable by others", path: write("shared", string(testSecret), 0o644), wantErr: "chmod 600"},
+		{name: "Too short", path: write("short", "hunter2", 0o600), wantErr: "too short"},
+		{name: "Missing", path: filepath.Join(dir, "missing"), wantErr: "no such file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rt.LoadEncryptionKey(tt.path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadEncryptionKey() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadEncryptionKey() unexpected error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("LoadEncryptionKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
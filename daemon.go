@@ -0,0 +1,695 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// The daemon serves the history over a Unix socket so shells can record and
+// search without each opening the database. Requests and responses are JSON
+// objects, one per line, and a connection may carry any number of requests.
+
+// daemonRequest asks the daemon to record or search
+type daemonRequest struct {
+	// Op is "record", "search" or "ping"
+	Op     string  `json:"op"`
+	Record *Record `json:"record,omitempty"`
+	Search *Search `json:"search,omitempty"`
+}
+
+// daemonResponse answers a request. Error is empty if it succeeded.
+type daemonResponse struct {
+	Error string `json:"error,omitempty"`
+	// ID is the ID a recorded command was stored with
+	ID      int64    `json:"id,omitempty"`
+	Records []Record `json:"records,omitempty"`
+}
+
+// pendingRecord is a record waiting for the daemon's writer
+type pendingRecord struct {
+	record Record
+	done   chan error
+}
+
+// pendingPrune is a request to prune the history waiting for the daemon's
+// writer, which sets how many records were pruned
+type pendingPrune struct {
+	before time.Time
+	pruned int
+	done   chan error
+}
+
+// daemonQueueSize is how many records may wait to be written before
+// submitting more blocks
+const daemonQueueSize = 1024
+
+// DaemonLimits bounds what each client of the daemon may ask of it, from the
+// [daemon] section of the config file, so that a misbehaving integration can
+// neither keep the database busy nor take the whole history in one request.
+// Zero leaves a limit off.
+type DaemonLimits struct {
+	// RequestsPerSecond is how many requests a client may make a second,
+	// averaged over its bursts
+	RequestsPerSecond float64 `toml:"requests_per_second"`
+
+	// Burst is how many requests a client may make in quick succession
+	Burst int `toml:"burst"`
+
+	// RequestTimeout is how long, in milliseconds, a search may take
+	RequestTimeout int `toml:"request_timeout"`
+
+	// MaxResults is the most records a search returns
+	MaxResults int `toml:"max_results"`
+}
+
+// DefaultDaemonLimits returns the limits applied unless configured otherwise
+func DefaultDaemonLimits() DaemonLimits {
+	return DaemonLimits{
+		RequestsPerSecond: 50,
+		Burst:             100,
+		RequestTimeout:    5000,
+		MaxResults:        10000,
+	}
+}
+
+// Validate checks no limit is negative
+func (l DaemonLimits) Validate() error {
+	switch {
+	case l.RequestsPerSecond < 0:
+		return fmt.Errorf("daemon requests per second must not be negative, got %g", l.RequestsPerSecond)
+	case l.Burst < 0:
+		return fmt.Errorf("daemon burst must not be negative, got %d", l.Burst)
+	case l.RequestTimeout < 0:
+		return fmt.Errorf("daemon request timeout must not be negative, got %d", l.RequestTimeout)
+	case l.MaxResults < 0:
+		return fmt.Errorf("daemon max results must not be negative, got %d", l.MaxResults)
+	}
+	return nil
+}
+
+// rateLimiter lets requests through at a steady rate, allowing bursts, as a
+// bucket of tokens refilled over time which each request takes one from. It
+// is safe for concurrent use.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added a second, 0 for no limit
+	burst  float64 // Tokens the bucket holds
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter to the rate and burst of limits, starting
+// with a full bucket
+func newRateLimiter(limits DaemonLimits, now time.Time) *rateLimiter {
+	burst := float64(max(1, limits.Burst))
+	return &rateLimiter{rate: limits.RequestsPerSecond, burst: burst, tokens: burst, last: now}
+}
+
+// allow reports whether a request made at now may go ahead, taking a token
+// if so
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l.rate == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// full reports whether the bucket will have refilled by now, when the
+// limiter is no different from a new one
+func (l *rateLimiter) full(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate == 0 || l.tokens+now.Sub(l.last).Seconds()*l.rate >= l.burst
+}
+
+// Daemon owns the database for the shells talking to it over its socket.
+// Records are written by a single goroutine, in batches of whatever has
+// arrived since the last write, so shells never contend for the write lock.
+type Daemon struct {
+	db     *DB
+	queue  chan *pendingRecord
+	prunes chan *pendingPrune
+
+	// grpcListener is where the History service is served over gRPC, nil
+	// if it isn't
+	grpcListener net.Listener
+
+	// mu guards the config and the redactor and limiters built from it,
+	// which are replaced when the config is reloaded
+	mu       sync.RWMutex
+	config   *Config
+	redactor *Redactor
+	// limiters rate limit each client, by the process ID of its end of the
+	// socket, so an integration dialling afresh for each request is still
+	// limited as one client, and one flooding the daemon doesn't slow the
+	// others down
+	limiters map[int]*rateLimiter
+}
+
+// NewDaemon creates a daemon serving db. Records it is sent are checked
+// against the config's exclusion patterns and redacted before being stored.
+// The config is replaced by any published on db's events as reloaded.
+func NewDaemon(db *DB, config *Config) (*Daemon, error) {
+	redactor, err := NewRedactor(config.Redaction)
+	if err != nil {
+		return nil, err
+	}
+	d := &Daemon{
+		db:       db,
+		config:   config,
+		redactor: redactor,
+		limiters: map[int]*rateLimiter{},
+		queue:    make(chan *pendingRecord, daemonQueueSize),
+		prunes:   make(chan *pendingPrune),
+	}
+	db.Events().Subscribe(func(event Event) {
+		if reloaded, ok := event.(ConfigReloaded); ok {
+			d.reload(reloaded.Config)
+		}
+	})
+	return d, nil
+}
+
+// reload applies a config read again, keeping the one in use if its
+// redaction patterns are invalid. The rate limits start afresh only if they
+// have changed.
+func (d *Daemon) reload(config *Config) {
+	redactor, err := NewRedactor(config.Redaction)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "retour: not reloading the config: %v\n", err)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if config.Daemon.RequestsPerSecond != d.config.Daemon.RequestsPerSecond || config.Daemon.Burst != d.config.Daemon.Burst {
+		d.limiters = map[int]*rateLimiter{}
+	}
+	d.config, d.redactor = config, redactor
+}
+
+// EnableGRPC has Serve also serve the History service of proto/retour.proto
+// over gRPC on listener, which it closes on stopping. It must be called
+// before Serve.
+func (d *Daemon) EnableGRPC(listener net.Listener) {
+	d.grpcListener = listener
+}
+
+// Serve accepts connections on listener until ctx is cancelled, then closes
+// the listener and returns once the records already received are stored.
+func (d *Daemon) Serve(ctx context.Context, listener net.Listener) error {
+	var wg sync.WaitGroup
+	writerDone := make(chan struct{})
+	go func() {
+		d.write()
+		close(writerDone)
+	}()
+
+	// The gRPC requests in flight are finished before the writer stops
+	if d.grpcListener != nil {
+		server := d.newGRPCServer()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-ctx.Done()
+			server.GracefulStop()
+		}()
+		go func() {
+			if err := server.Serve(d.grpcListener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+				fmt.Fprintf(os.Stderr, "retour: stopped serving gRPC: %v\n", err)
+			}
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var err error
+	for {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			if ctx.Err() == nil {
+				err = acceptErr
+			}
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.serve(ctx, conn)
+		}()
+	}
+
+	wg.Wait()
+	close(d.queue)
+	<-writerDone
+	return err
+}
+
+// serve answers the requests on a connection until it is closed. Records
+// are never rate limited: the shell hooks drop a record the daemon refuses,
+// so limiting them would lose commands to a client flooding it with searches.
+func (d *Daemon) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	pid := peerPID(conn)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var request daemonRequest
+		var response daemonResponse
+		switch err := json.Unmarshal(scanner.Bytes(), &request); {
+		case err != nil:
+			response.Error = fmt.Sprintf("invalid request: %v", err)
+		case request.Op != "record" && !d.allow(pid):
+			response.Error = "too many requests, slow down"
+		default:
+			response = d.handle(ctx, request)
+		}
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+// allow reports whether the client with process ID pid may make a request
+// now, creating its rate limiter for its first. The limiters of clients
+// whose buckets have refilled are dropped meanwhile, so those which have
+// come and gone don't pile up.
+func (d *Daemon) allow(pid int) bool {
+	now := time.Now()
+	d.mu.Lock()
+	limiter, ok := d.limiters[pid]
+	if !ok {
+		for other, l := range d.limiters {
+			if l.full(now) {
+				delete(d.limiters, other)
+			}
+		}
+		limiter = newRateLimiter(d.config.Daemon, now)
+		d.limiters[pid] = limiter
+	}
+	d.mu.Unlock()
+	return limiter.allow(now)
+}
+
+// handle carries out a request. Searches are cut short at the configured
+// timeout and return no more than the configured number of records.
+func (d *Daemon) handle(ctx context.Context, request daemonRequest) daemonResponse {
+	switch {
+	case request.Op == "ping":
+		return daemonResponse{}
+	case request.Op == "record" && request.Record != nil:
+		id, err := d.record(*request.Record)
+		if err != nil {
+			return daemonResponse{Error: err.Error()}
+		}
+		return daemonResponse{ID: id}
+	case request.Op == "search" && request.Search != nil:
+		if err := request.Search.Validate(); err != nil {
+			return daemonResponse{Error: err.Error()}
+		}
+		records, err := d.search(ctx, *request.Search)
+		if err != nil {
+			return daemonResponse{Error: err.Error()}
+		}
+		return daemonResponse{Records: records}
+	default:
+		return daemonResponse{Error: fmt.Sprintf("invalid %q request", request.Op)}
+	}
+}
+
+// errRequestTimeout is returned for a query cut short at the configured
+// timeout
+var errRequestTimeout = errors.New("query took longer than the request timeout")
+
+// search runs a search within the configured limits
+func (d *Daemon) search(ctx context.Context, search Search) ([]Record, error) {
+	return d.query(ctx, search.Limit, func(db *DB, limit int) ([]Record, error) {
+		search.Limit = limit
+		return db.Search(search)
+	})
+}
+
+// query runs a query of up to limit records, 0 for all, within the
+// configured limits, passing it the database to query and the limit clamped
+// to the configured maximum
+func (d *Daemon) query(ctx context.Context, limit int, query func(db *DB, limit int) ([]Record, error)) ([]Record, error) {
+	d.mu.RLock()
+	limits := d.config.Daemon
+	d.mu.RUnlock()
+
+	if limits.MaxResults > 0 && (limit == 0 || limit > limits.MaxResults) {
+		limit = limits.MaxResults
+	}
+	if limits.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(limits.RequestTimeout)*time.Millisecond)
+		defer cancel()
+	}
+	records, err := query(d.db.withContext(ctx), limit)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w of %dms", errRequestTimeout, limits.RequestTimeout)
+	}
+	return records, err
+}
+
+// record queues a record for the writer and waits for it to be stored,
+// returning its ID, or 0 if it was excluded
+func (d *Daemon) record(record Record) (int64, error) {
+	record.ID = 0
+	d.mu.RLock()
+	config, redactor := d.config, d.redactor
+	d.mu.RUnlock()
+	excluded, err := Excluded(record.CommandLine(), config.ExclusionPatterns)
+	if err != nil {
+		return 0, err
+	}
+	if excluded || !redactor.RedactRecord(&record) {
+		return 0, nil
+	}
+
+	pending := &pendingRecord{record: record, done: make(chan error, 1)}
+	d.queue <- pending
+	if err := <-pending.done; err != nil {
+		return 0, err
+	}
+	return pending.record.ID, nil
+}
+
+// write stores queued records until the queue is closed. Each transaction
+// holds the records which arrived while the previous one was written. The
+// scores are decayed, and the history pruned, between batches every
+// decayInterval, so the writer is the only one to write to the database.
+func (d *Daemon) write() {
+	d.decay(false)
+	d.prune()
+	ticker := time.NewTicker(decayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case first, ok := <-d.queue:
+			if !ok {
+				return
+			}
+			d.writeBatch(first)
+		case p := <-d.prunes:
+			var err error
+			p.pruned, err = d.pruneHistory(p.before)
+			p.done <- err
+		case <-ticker.C:
+			d.decay(true)
+			d.prune()
+		}
+	}
+}
+
+// writeBatch stores first and whatever else is waiting in the queue
+func (d *Daemon) writeBatch(first *pendingRecord) {
+	batch := []*pendingRecord{first}
+drain:
+	for len(batch) < daemonQueueSize {
+		select {
+		case next, ok := <-d.queue:
+			if !ok {
+				break drain
+			}
+			batch = append(batch, next)
+		default:
+			break drain
+		}
+	}
+
+	err := d.store(batch)
+	for _, p := range batch {
+		p.done <- err
+	}
+}
+
+// decay decays the scores, or only if they are stale unless always is set.
+// A failure is reported and left for the next attempt.
+func (d *Daemon) decay(always bool) {
+	var err error
+	if always {
+		err = d.db.Decay()
+	} else {
+		_, err = d.db.DecayIfStale(decayInterval)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "retour: failed to decay scores: %v\n", err)
+	}
+}
+
+// prune removes the records older than the retention period, if one is set,
+// other than the starred ones and those tagged with a keep tag. A failure is
+// reported and left for the next attempt.
+func (d *Daemon) prune() {
+	d.mu.RLock()
+	config := d.config
+	d.mu.RUnlock()
+
+	// The config was checked when loaded
+	retention, err := config.Retention()
+	if err != nil || retention == 0 {
+		return
+	}
+	if _, err := d.pruneHistory(time.Now().Add(-retention)); err != nil {
+		fmt.Fprintf(os.Stderr, "retour: failed to prune the history: %v\n", err)
+	}
+}
+
+// pruneHistory removes the records run before before, other than the
+// starred ones and those tagged with one of the configured keep tags,
+// returning how many were removed. Only the writer may call it.
+func (d *Daemon) pruneHistory(before time.Time) (int, error) {
+	d.mu.RLock()
+	keepTags := d.config.KeepTags
+	d.mu.RUnlock()
+	d.db.SetKeepTags(keepTags)
+	return d.db.Prune(before)
+}
+
+// pruneBefore has the writer prune the records run before before, between
+// batches, and waits for it to, returning how many were removed
+func (d *Daemon) pruneBefore(before time.Time) (int, error) {
+	pending := &pendingPrune{before: before, done: make(chan error, 1)}
+	d.prunes <- pending
+	if err := <-pending.done; err != nil {
+		return 0, err
+	}
+	return pending.pruned, nil
+}
+
+// store writes a batch in one transaction, setting the records' IDs
+func (d *Daemon) store(batch []*pendingRecord) error {
+	tx, err := d.db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	records := make([]Record, len(batch))
+	for i, p := range batch {
+		if err := d.db.insert(tx, &p.record); err != nil {
+			return err
+		}
+		records[i] = p.record
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	d.db.publishInserted(records)
+	return nil
+}
+
+// ListenDaemon listens on the socket at path, readable only by the user. A
+// socket left behind by a daemon which is no longer running is replaced.
+func ListenDaemon(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a daemon is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// Nobody else may connect, even before the socket's mode can be set
+	mask := syscall.Umask(0o077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(mask)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// DaemonClient talks to a running daemon.
+type DaemonClient struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// DialDaemon connects to the daemon listening on the socket at path. Each
+// request must be answered within timeout.
+func DialDaemon(path string, timeout time.Duration) (*DaemonClient, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &DaemonClient{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// Close closes the connection to the daemon
+func (c *DaemonClient) Close() error {
+	return c.conn.Close()
+}
+
+// Record has the daemon store record, setting its ID. Excluded records are
+// not stored and are left without one.
+func (c *DaemonClient) Record(record *Record) error {
+	response, err := c.do(daemonRequest{Op: "record", Record: record})
+	if err != nil {
+		return err
+	}
+	record.ID = response.ID
+	return nil
+}
+
+// Search has the daemon run a search, returning the matching records
+func (c *DaemonClient) Search(search Search) ([]Record, error) {
+	response, err := c.do(daemonRequest{Op: "search", Search: &search})
+	if err != nil {
+		return nil, err
+	}
+	return response.Records, nil
+}
+
+// do sends a request and waits for the daemon's response
+func (c *DaemonClient) do(request daemonRequest) (daemonResponse, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return daemonResponse{}, err
+	}
+	if err := json.NewEncoder(c.conn).Encode(request); err != nil {
+		return daemonResponse{}, fmt.Errorf("failed to send to daemon: %w", err)
+	}
+
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return daemonResponse{}, fmt.Errorf("failed to read from daemon: %w", err)
+	}
+	var response daemonResponse
+	if err := json.Unmarshal(line, &response); err != nil {
+		return daemonResponse{}, fmt.Errorf("invalid response from daemon: %w", err)
+	}
+	if response.Error != "" {
+		return daemonResponse{}, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// Send ships a record to the daemon listening on socket, giving up once
+// timeout has passed however far it got. The daemon applies exclusion
+// patterns and redaction.
+func Send(socket string, record Record, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	client, err := DialDaemon(socket, timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	client.timeout = time.Until(deadline)
+	return client.Record(&record)
+}
+
+// daemonTimeout is how long commands wait for the daemon before giving up
+const daemonTimeout = 2 * time.Second
+
+// dialDaemon connects to the configured daemon, returning nil if none is
+// running
+func dialDaemon(config *Config) *DaemonClient {
+	client, err := DialDaemon(config.SocketPath(), daemonTimeout)
+	if err != nil {
+		return nil
+	}
+	return client
+}
+
+// runDaemon implements the daemon subcommand
+func runDaemon(config *Config, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	socket := flags.String("socket", config.SocketPath(), "Path of the Unix socket to listen on")
+	grpcSocket := flags.String("grpc", "", "Path of a Unix socket to also serve the History service on over gRPC")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	daemon, err := NewDaemon(db, config)
+	if err != nil {
+		return err
+	}
+	// The socket is removed when the listener is closed
+	listener, err := ListenDaemon(*socket)
+	if err != nil {
+		return err
+	}
+	if *grpcSocket != "" {
+		grpcListener, err := ListenDaemon(*grpcSocket)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		daemon.EnableGRPC(grpcListener)
+		fmt.Fprintf(os.Stderr, "Serving gRPC on %s\n", *grpcSocket)
+	}
+
+	// SIGHUP reloads the config rather than stopping the daemon
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	reloadOnHangup(ctx, db.Events(), func() (*Config, error) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find home directory: %w", err)
+		}
+		return LoadConfig(os.DirFS(home), os.Args)
+	})
+	fmt.Fprintf(os.Stderr, "Listening on %s\n", *socket)
+	return daemon.Serve(ctx, listener)
+}
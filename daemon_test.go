@@ -0,0 +1,349 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+// startDaemon serves database on a socket in a temporary directory, returning
+// the socket's path and a function stopping the daemon
+func startDaemon(t *testing.T, database *rt.DB, configFile string) (string, func() error) {
+	t.Helper()
+	return serveDaemon(t, newDaemon(t, database, configFile))
+}
+
+// newDaemon creates a daemon for database with the config in configFile
+func newDaemon(t *testing.T, database *rt.DB, configFile string) *rt.Daemon {
+	t.Helper()
+	fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte(configFile)}}
+	config, err := rt.LoadConfig(fsys, []string{"cmd"})
+	if err != nil {
+		t.Fatalf("LoadConfig() unexpected error = %v", err)
+	}
+	daemon, err := rt.NewDaemon(database, config)
+	if err != nil {
+		t.Fatalf("NewDaemon() unexpected error = %v", err)
+	}
+	return daemon
+}
+
+// serveDaemon serves daemon as startDaemon does
+func serveDaemon(t *testing.T, daemon *rt.Daemon) (string, func() error) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "retour.sock")
+	listener, err := rt.ListenDaemon(socket)
+	if err != nil {
+		t.Fatalf("ListenDaemon() unexpected error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- daemon.Serve(ctx, listener) }()
+
+	var once sync.Once
+	var serveErr error
+	stop := func() error {
+		once.Do(func() {
+			cancel()
+			serveErr = <-served
+		})
+		return serveErr
+	}
+	t.Cleanup(func() { stop() })
+	return socket, stop
+}
+
+func dial(t *testing.T, socket string) *rt.DaemonClient {
+	t.Helper()
+	client, err := rt.DialDaemon(socket, time.Second)
+	if err != nil {
+		t.Fatalf("DialDaemon() unexpected error = %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestDaemonRecordsFromManyShells(t *testing.T) {
+	database := openTestDB(t)
+	socket, _ := startDaemon(t, database, "")
+
+	const shells, commands = 10, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, shells*commands)
+	for s := range shells {
+		client := dial(t, socket)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range commands {
+				record := rt.NewRecord(fmt.Sprintf("echo %d %d", s, c), "/tmp", 0, time.Now())
+				record.Session = fmt.Sprintf("shell-%d", s)
+				if err := client.Record(&record); err != nil {
+					errs <- err
+				} else if record.ID == 0 {
+					errs <- fmt.Errorf("%q was stored without an ID", record.CommandLine())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Record() error = %v", err)
+	}
+
+	checkStored(t, database, shells*commands)
+	sessions, err := database.Sessions(100)
+	if err != nil {
+		t.Fatalf("Sessions() unexpected error = %v", err)
+	}
+	if len(sessions) != shells {
+		t.Errorf("Sessions() = %d sessions, want %d", len(sessions), shells)
+	}
+}
+
+func TestDaemonFiltersRecords(t *testing.T) {
+	database := openTestDB(t)
+	socket, _ := startDaemon(t, database, "exclusion_patterns = [\"^sudo\"]\n")
+	client := dial(t, socket)
+
+	for _, line := range []string{"sudo reboot", "mysql --password=hunter2"} {
+		record := rt.NewRecord(line, "/tmp", 0, time.Now())
+		if err := client.Record(&record); err != nil {
+			t.Fatalf("Record() unexpected error = %v", err)
+		}
+	}
+
+	records, err := database.Query("SELECT * FROM history")
+	if err != nil {
+		t.Fatalf("Query() unexpected error = %v", err)
+	}
+	if len(records) != 1 || records[0].CommandLine() != "mysql --password=REDACTED" {
+		t.Errorf("Stored %+v, want only the redacted mysql command", records)
+	}
+}
+
+func TestDaemonReloadsConfig(t *testing.T) {
+	database := openTestDB(t)
+	socket, _ := startDaemon(t, database, "")
+	client := dial(t, socket)
+
+	fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte("exclusion_patterns = [\"^sudo\"]\n")}}
+	config, err := rt.LoadConfig(fsys, []string{"cmd"})
+	if err != nil {
+		t.Fatalf("LoadConfig() unexpected error = %v", err)
+	}
+	database.Events().Publish(rt.ConfigReloaded{Config: config})
+
+	record := rt.NewRecord("sudo reboot", "/tmp", 0, time.Now())
+	if err := client.Record(&record); err != nil {
+		t.Fatalf("Record() unexpected error = %v", err)
+	}
+	if records, err := database.Query("SELECT * FROM history"); err != nil || len(records) != 0 {
+		t.Errorf("Stored %+v, %v, want sudo excluded by the reloaded config", records, err)
+	}
+}
+
+func TestDaemonPrunes(t *testing.T) {
+	database := openTestDB(t)
+	now := time.Now()
+	for _, r := range []rt.Record{
+		rt.NewRecord("make", "/src", 0, now.AddDate(0, 0, -100)),
+		rt.NewRecord("ssh prod", "/", 0, now.AddDate(0, 0, -100)),
+		rt.NewRecord("ls", "/", 0, now.AddDate(0, 0, -1)),
+	} {
+		if err := database.Insert(&r); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+		if r.Command == "ssh" {
+			if err := database.Tag(r.ID, "keep"); err != nil {
+				t.Fatalf("Tag() unexpected error = %v", err)
+			}
+		}
+	}
+
+	// The history is pruned when the daemon starts
+	_, stop := startDaemon(t, database, "retention_period = \"90d\"\nkeep_tags = [\"keep\"]\n")
+	if err := stop(); err != nil {
+		t.Fatalf("Serve() unexpected error = %v", err)
+	}
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	var lines []string
+	for _, r := range records {
+		lines = append(lines, r.CommandLine())
+	}
+	if want := []string{"ls", "ssh prod"}; !slices.Equal(lines, want) {
+		t.Errorf("Records after the daemon started = %q, want %q", lines, want)
+	}
+}
+
+func TestDaemonSearch(t *testing.T) {
+	database := openTestDB(t)
+	for i, line := range []string{"make test", "make build", "make test", "ls"} {
+		record := rt.NewRecord(line, "/src", 0, time.Now().Add(time.Duration(i)*time.Second))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+	}
+	socket, _ := startDaemon(t, database, "")
+	client := dial(t, socket)
+
+	records, err := client.Search(rt.Search{Result: rt.AllResults, Unique: true, Filter: "make"})
+	if err != nil {
+		t.Fatalf("Search() unexpected error = %v", err)
+	}
+	if len(records) != 2 || records[0].CommandLine() != "make test" || records[0].Count != 2 {
+		t.Errorf("Search() = %+v, want make test twice then make build", records)
+	}
+
+	if _, err := client.Search(rt.Search{Result: "sometimes"}); err == nil {
+		t.Error("Search() with an invalid result filter succeeded, want an error")
+	}
+}
+
+func TestDaemonShutdown(t *testing.T) {
+	database := openTestDB(t)
+	socket, stop := startDaemon(t, database, "")
+
+	if _, err := rt.ListenDaemon(socket); err == nil {
+		t.Error("ListenDaemon() on a socket in use succeeded, want an error")
+	}
+
+	client := dial(t, socket)
+	record := rt.NewRecord("ls", "/tmp", 0, time.Now())
+	if err := client.Record(&record); err != nil {
+		t.Fatalf("Record() unexpected error = %v", err)
+	}
+
+	if err := stop(); err != nil {
+		t.Fatalf("Serve() unexpected error = %v", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Socket still exists after shutdown: %v", err)
+	}
+	if err := client.Record(&record); err == nil {
+		t.Error("Record() after shutdown succeeded, want an error")
+	}
+	checkStored(t, database, 1)
+
+	// A socket left behind is replaced
+	if err := os.WriteFile(socket, nil, 0o600); err != nil {
+		t.Fatalf("Failed to leave a socket behind: %v", err)
+	}
+	listener, err := rt.ListenDaemon(socket)
+	if err != nil {
+		t.Fatalf("ListenDaemon() over a stale socket unexpected error = %v", err)
+	}
+	listener.Close()
+}
+
+func TestSend(t *testing.T) {
+	database := openTestDB(t)
+	socket, _ := startDaemon(t, database, "")
+
+	record := rt.NewRecord("git push", "/src", 0, time.Now())
+	if err := rt.Send(socket, record, time.Second); err != nil {
+		t.Fatalf("Send() unexpected error = %v", err)
+	}
+	checkStored(t, database, 1)
+
+	if err := rt.Send(filepath.Join(t.TempDir(), "missing.sock"), record, time.Second); err == nil {
+		t.Error("Send() without a daemon succeeded, want an error")
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	// A daemon which accepts connections but never answers
+	socket := filepath.Join(t.TempDir(), "wedged.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Listen() unexpected error = %v", err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			<-done
+			conn.Close()
+		}
+	}()
+
+	const timeout = 100 * time.Millisecond
+	start := time.Now()
+	err = rt.Send(socket, rt.NewRecord("ls", "/tmp", 0, time.Now()), timeout)
+	if err == nil {
+		t.Error("Send() to a wedged daemon succeeded, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*timeout {
+		t.Errorf("Send() took %v, want about %v", elapsed, timeout)
+	}
+}
+
+func TestDaemonLimits(t *testing.T) {
+	database := openTestDB(t)
+	for i := range 5 {
+		record := rt.NewRecord(fmt.Sprintf("echo %d", i), "/tmp", 0, time.Now())
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+	}
+	socket, _ := startDaemon(t, database, "[daemon]\nrequests_per_second = 0.01\nburst = 2\nmax_results = 3\n")
+	search := rt.Search{Result: rt.AllResults}
+
+	client := dial(t, socket)
+	records, err := client.Search(search)
+	if err != nil || len(records) != 3 {
+		t.Errorf("Search() = %d records, %v, want the 3 allowed", len(records), err)
+	}
+	search.Limit = 2
+	if records, err := client.Search(search); err != nil || len(records) != 2 {
+		t.Errorf("Search() with limit 2 = %d records, %v, want 2", len(records), err)
+	}
+	if _, err := client.Search(search); err == nil || !strings.Contains(err.Error(), "too many requests") {
+		t.Errorf("Search() beyond the burst error = %v, want too many requests", err)
+	}
+
+	// The connections of a process share its limit, as each command dials
+	// its own
+	if _, err := dial(t, socket).Search(search); err == nil || !strings.Contains(err.Error(), "too many requests") {
+		t.Errorf("Search() on another connection error = %v, want too many requests", err)
+	}
+
+	// Searches using up the limit never cost the shell hooks a record
+	for i := range 3 {
+		record := rt.NewRecord(fmt.Sprintf("make %d", i), "/tmp", 0, time.Now())
+		if err := client.Record(&record); err != nil {
+			t.Errorf("Record() beyond the burst unexpected error = %v", err)
+		}
+	}
+	checkStored(t, database, 8)
+}
+
+func TestDaemonLimitsConnections(t *testing.T) {
+	socket, _ := startDaemon(t, openTestDB(t), "[daemon]\nrequests_per_second = 0.01\nburst = 3\n")
+	search := rt.Search{Result: rt.AllResults}
+	for i := range 5 {
+		_, err := dial(t, socket).Search(search)
+		if i < 3 && err != nil {
+			t.Errorf("Search() on connection %d unexpected error = %v", i, err)
+		}
+		if i >= 3 && (err == nil || !strings.Contains(err.Error(), "too many requests")) {
+			t.Errorf("Search() on connection %d beyond the burst error = %v, want too many requests", i, err)
+		}
+	}
+}
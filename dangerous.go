@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Dangerous reports whether the command line matches any of the patterns
+// marking commands dangerous. An error is returned if one of the patterns is
+// not a valid regular expression.
+func Dangerous(line string, patterns []string) (bool, error) {
+	return matchesAny(line, patterns, "dangerous")
+}
+
+// Outcomes summarises how a command line fared the times it was run.
+type Outcomes struct {
+	Runs     int
+	Failures int
+	// Last is the most recent run, the zero Record if there was none
+	Last Record
+}
+
+// String describes the outcomes in a sentence for a warning
+func (o Outcomes) String() string {
+	if o.Runs == 0 {
+		return tr("never run before")
+	}
+	last := trf("last run %s in %s, exit %d",
+		o.Last.Timestamp.Local().Format("2006-01-02 15:04"), o.Last.WorkingDirectory, o.Last.ExitStatus)
+	return trf("run %d times, %d failed; %s", o.Runs, o.Failures, last)
+}
+
+// Outcomes returns how the command line fared each time it was recorded
+func (db *DB) Outcomes(line string) (Outcomes, error) {
+	command, arguments := SplitCommandLine(line)
+	command, arguments = db.seal(command), db.seal(arguments)
+
+	var o Outcomes
+	err := db.reader.QueryRow(`
+	SELECT COUNT(*), COUNT(*) FILTER (WHERE exit_status != 0)
+	FROM history
+	WHERE command = ? AND COALESCE(arguments, '') = ?`, command, arguments).Scan(&o.Runs, &o.Failures)
+	if err != nil || o.Runs == 0 {
+		return o, err
+	}
+
+	last, err := db.Query(`
+	SELECT `+recordColumns+`
+	FROM history
+	WHERE command = ? AND COALESCE(arguments, '') = ?
+	ORDER BY timestamp DESC, id DESC
+	LIMIT 1`, command, arguments)
+	if err != nil {
+		return Outcomes{}, err
+	}
+	o.Last = last[0]
+	return o, nil
+}
+
+// DangerCheck returns a warning about the records about to be emitted, or
+// the empty string if none of them is dangerous.
+type DangerCheck func([]Record) (string, error)
+
+// dangerCheck returns a check warning about records matching the patterns
+// with how they fared before, nil if there are no patterns
+func dangerCheck(db *DB, patterns []string) DangerCheck {
+	if len(patterns) == 0 {
+		return nil
+	}
+	return func(records []Record) (string, error) {
+		var warning strings.Builder
+		for _, r := range records {
+			line := r.CommandLine()
+			dangerous, err := Dangerous(line, patterns)
+			if err != nil {
+				return "", err
+			}
+			if !dangerous {
+				continue
+			}
+			outcomes, err := db.Outcomes(line)
+			if err != nil {
+				return "", err
+			}
+			warning.WriteString(trf("%s is marked dangerous: %s", line, outcomes) + "\n")
+		}
+		return strings.TrimSuffix(warning.String(), "\n"), nil
+	}
+}
+
+// confirm shows the warning and asks whether to go ahead, reading the answer
+// from in. Only an answer starting with y, or the current language's word for
+// yes, goes ahead.
+func confirm(in io.Reader, out io.Writer, warning, question string) bool {
+	fmt.Fprintf(out, "%s\n%s %s ", warning, question, tr("[y/N]"))
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	return isYes(answer)
+}
+
+// isYes reports whether answer starts with y or the first letter of the
+// current language's word for yes
+func isYes(answer string) bool {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return strings.HasPrefix(answer, "y") || strings.HasPrefix(answer, tr("y"))
+}
@@ -0,0 +1,86 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestDangerous(t *testing.T) {
+	patterns := []string{`^rm -rf /(\s|$)`, `^kubectl delete (ns|namespace)\b`}
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"rm -rf /", true},
+		{"rm -rf /tmp/build", false},
+		{"kubectl delete ns staging", true},
+		{"kubectl delete pod web-1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := rt.Dangerous(tt.line, patterns)
+			if err != nil {
+				t.Fatalf("Dangerous() unexpected error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Dangerous(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := rt.Dangerous("ls", []string{"("}); err == nil || !strings.Contains(err.Error(), "invalid dangerous pattern") {
+		t.Errorf("Dangerous() with an invalid pattern error = %v", err)
+	}
+}
+
+func TestOutcomes(t *testing.T) {
+	database := openTestDB(t)
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i, run := range []struct {
+		line string
+		dir  string
+		exit int
+	}{
+		{"kubectl delete ns staging", "/ops", 0},
+		{"kubectl delete ns staging", "/ops", 1},
+		{"kubectl delete ns prod", "/ops", 0},
+		{"kubectl delete ns staging", "/srv", 1},
+	} {
+		record := rt.NewRecord(run.line, run.dir, run.exit, base.Add(time.Duration(i)*time.Hour))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+	}
+
+	outcomes, err := database.Outcomes("kubectl delete ns staging")
+	if err != nil {
+		t.Fatalf("Outcomes() unexpected error = %v", err)
+	}
+	if outcomes.Runs != 3 || outcomes.Failures != 2 || outcomes.Last.WorkingDirectory != "/srv" || outcomes.Last.ExitStatus != 1 {
+		t.Errorf("Outcomes() = %+v, want 3 runs, 2 failed, last in /srv", outcomes)
+	}
+	if got := outcomes.String(); !strings.HasPrefix(got, "run 3 times, 2 failed; last run ") || !strings.HasSuffix(got, " in /srv, exit 1") {
+		t.Errorf("String() = %q", got)
+	}
+
+	never, err := database.Outcomes("rm -rf /")
+	if err != nil {
+		t.Fatalf("Outcomes() unexpected error = %v", err)
+	}
+	if never.Runs != 0 || never.String() != "never run before" {
+		t.Errorf("Outcomes() of a new command = %+v, %q", never, never.String())
+	}
+}
+
+func TestDangerousPatternsConfig(t *testing.T) {
+	fsys := fstest.MapFS{".config/retour/config.toml": &fstest.MapFile{Data: []byte("dangerous_patterns = [\"^rm -rf\", \"(\"]\n")}}
+	if _, err := rt.LoadConfig(fsys, []string{"cmd"}); err == nil || !strings.Contains(err.Error(), `invalid dangerous pattern "("`) {
+		t.Errorf("LoadConfig() error = %v, want the invalid pattern reported", err)
+	}
+}
@@ -7,11 +7,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
+	"unicode/utf8"
 )
 
 // Record represents a single command history entry in the database.
@@ -35,13 +40,173 @@ type Record struct {
 
 	// Arguments contains any additional arguments passed to the command
 	Arguments string
+
+	// Duration is how long the command took to run, zero if unknown
+	Duration time.Duration
+
+	// Session identifies the shell session the command was run in
+	Session string
+
+	// Hostname is the machine the command was run on, empty if unknown
+	Hostname string
+
+	// RerunOf is the ID of the record this command replayed from history,
+	// zero if it was typed afresh
+	RerunOf int64
+
+	// Repo is the root of the git repository the command ran in, empty
+	// outside a repository or if unknown
+	Repo string
+
+	// Branch is the git branch checked out when the command ran, empty if
+	// unknown
+	Branch string
+
+	// Count is how many runs of the same command line a deduplicated query
+	// collapsed into this record, zero for queries which do not deduplicate
+	Count int
+
+	// Source names the database the record came from when others are
+	// attached, empty otherwise
+	Source string
+
+	// Starred reports whether the command was starred in the picker, which
+	// pins it above the rest of the history. Only the picker's queries of
+	// the SQLite database fill it in.
+	Starred bool
+}
+
+// CommandLine returns the command and its arguments as typed at the prompt.
+func (r Record) CommandLine() string {
+	if r.Arguments == "" {
+		return r.Command
+	}
+	return r.Command + " " + r.Arguments
+}
+
+// SplitCommandLine splits a command line into the command and its arguments.
+// Leading and trailing whitespace is discarded.
+func SplitCommandLine(line string) (command, arguments string) {
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, " \t\n")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimSpace(line[i+1:])
+}
+
+// recordColumns lists the history columns in the order they are selected
+const recordColumns = "id, command, timestamp, working_directory, exit_status, arguments, duration, session, hostname, rerun_of, repo, branch"
+
+// columns returns the history columns the picker's queries select, with the
+// source of each record when other databases are attached
+func (db *DB) columns() string {
+	if db.attached {
+		return recordColumns + ", source"
+	}
+	return recordColumns
+}
+
+// Pragmas holds the SQLite settings applied to every connection to the
+// database. The defaults let shells record commands while the picker reads
+// without either seeing "database is locked" errors.
+type Pragmas struct {
+	// JournalMode is the rollback journal mode, WAL allows readers and a
+	// writer to proceed concurrently
+	JournalMode string `toml:"journal_mode"`
+
+	// BusyTimeout is how long, in milliseconds, to wait for a lock
+	BusyTimeout int `toml:"busy_timeout"`
+
+	// Synchronous controls how often SQLite waits for writes to reach the disk
+	Synchronous string `toml:"synchronous"`
+
+	// ForeignKeys enables enforcement of foreign key constraints
+	ForeignKeys bool `toml:"foreign_keys"`
+}
+
+// DefaultPragmas returns the pragmas used unless configured otherwise
+func DefaultPragmas() Pragmas {
+	return Pragmas{
+		JournalMode: "WAL",
+		BusyTimeout: 5000,
+		Synchronous: "NORMAL",
+		ForeignKeys: true,
+	}
 }
 
+// sqliteDriver is the database/sql driver SQLite databases are opened with:
+// mattn/go-sqlite3, which needs cgo, unless built with the modernc tag.
+const sqliteDriver = "sqlite3"
+
+// The primary SQLite result codes retour handles
+const (
+	sqliteBusy     = 5
+	sqliteLocked   = 6
+	sqliteReadonly = 8
+)
+
 // DB provides an interface to the SQLite database storing command history.
 // It handles connection management, schema creation, and provides methods
 // for storing and querying command records.
 type DB struct {
+	// conn writes the history, and runs queries given by the user, which
+	// may write too
 	conn *sql.DB
+	// reader runs the queries retour makes to read the history, on its own
+	// pool of connections which cannot write, so reading never holds up a
+	// command being recorded
+	reader *sql.DB
+	// immutable forbids changing or removing recorded history, see SetImmutable
+	immutable bool
+	// keepTags exempt the records tagged with them from pruning, see
+	// SetKeepTags
+	keepTags []string
+	// readOnly is set when the database file was opened read-only, see
+	// NewDBReadOnly
+	readOnly bool
+	// attached is set when other databases' history is searched too, see
+	// Attach
+	attached bool
+	// cipher encrypts command text, nil unless SetEncryptionKey was called
+	cipher *textCipher
+	// syncCipher encrypts the records sync exchanges, nil unless SetSyncKey
+	// was called
+	syncCipher *payloadCipher
+	// events carries the changes made to the history, see Events
+	events *Bus
+	// ctx cancels the queries retour makes to read the history, nil for
+	// none, see withContext
+	ctx context.Context
+}
+
+// withContext returns a copy of db whose reads of the history, those made
+// by its query methods, give up once ctx is done.
+func (db *DB) withContext(ctx context.Context) *DB {
+	scoped := *db
+	scoped.ctx = ctx
+	return &scoped
+}
+
+// context returns the context reads of the history are made in
+func (db *DB) context() context.Context {
+	if db.ctx == nil {
+		return context.Background()
+	}
+	return db.ctx
+}
+
+// Events returns the bus the changes made to the history through this
+// database are published on.
+func (db *DB) Events() *Bus {
+	return db.events
+}
+
+// publishInserted publishes the records stored, if there were any
+func (db *DB) publishInserted(records []Record) {
+	if len(records) > 0 {
+		db.events.Publish(RecordsInserted{Records: records})
+	}
 }
 
 // New creates a new database connection and ensures the schema is set up.
@@ -52,37 +217,162 @@ type DB struct {
 // Returns a new DB instance or an error if the connection or schema
 // creation fails.
 func NewDB(connectionString string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", connectionString)
+	return NewDBWithPragmas(connectionString, DefaultPragmas())
+}
+
+// NewDBWithPragmas is like NewDB but applies the given pragmas rather than
+// the defaults.
+func NewDBWithPragmas(connectionString string, pragmas Pragmas) (*DB, error) {
+	conn, err := sql.Open(sqliteDriver, pragmas.dsn(connectionString, false))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	db := &DB{conn: conn}
-	if err := db.ensureSchema(); err != nil {
+	db := &DB{conn: conn, events: NewBus()}
+	endSchema := tracer.Span("schema check")
+	err = db.ensureSchema()
+	endSchema()
+	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("failed to ensure schema: %w", err)
 	}
 
+	// Opened once the schema, and so the journal mode, is set up
+	db.reader, err = sql.Open(sqliteDriver, pragmas.dsn(connectionString, true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
 	return db, nil
 }
 
+// NewDBReadOnly opens an existing database without ever writing to it, not
+// even to bring its schema up to date, for looking through someone else's
+// archived history or a mounted backup. Both pools of connections are read
+// only, so anything which would change the history fails.
+func NewDBReadOnly(connectionString string, pragmas Pragmas) (*DB, error) {
+	if _, err := os.Stat(connectionString); err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	conn, err := sql.Open(sqliteDriver, pragmas.dsn("file:"+connectionString+"?mode=ro", true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	var version int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if version < schemaVersion {
+		conn.Close()
+		return nil, errors.New("database schema is out of date, it must be opened once without --read-only to update it")
+	}
+	return &DB{conn: conn, reader: conn, readOnly: true, events: NewBus()}, nil
+}
+
 // Close closes the database connection and releases any associated resources.
 // It should be called when the database is no longer needed to prevent
 // resource leaks.
 func (db *DB) Close() error {
-	return db.conn.Close()
+	if db.reader == db.conn {
+		return db.conn.Close()
+	}
+	return errors.Join(db.reader.Close(), db.conn.Close())
 }
 
-// ensureSchema creates the necessary tables and indexes if they don't exist
+// schemaVersion is stored in the database's user_version once its schema is
+// up to date. It must be increased whenever ensureSchema changes, so that
+// databases created before are brought up to date.
+const schemaVersion = 5
+
+// ensureSchema creates the necessary tables and indexes if they don't exist.
+// Databases whose schema is already current are left alone without running
+// any DDL, keeping it off every Ctrl-R and recorded command.
 func (db *DB) ensureSchema() error {
+	var version int
+	if err := db.conn.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= schemaVersion {
+		return nil
+	}
+	if err := db.migrateSchema(); err != nil {
+		return err
+	}
+	_, err := db.conn.Exec(fmt.Sprintf("PRAGMA user_version = %d", schemaVersion))
+	return err
+}
+
+// migrateSchema creates whatever tables, columns and indexes of the current
+// schema are missing, filling in the columns added since the database was
+// created.
+func (db *DB) migrateSchema() error {
 	schema := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		host TEXT NOT NULL DEFAULT '',
+		shell TEXT NOT NULL DEFAULT '',
+		tty TEXT NOT NULL DEFAULT '',
+		start_time DATETIME NOT NULL,
+		end_time DATETIME,
+		initial_cwd TEXT NOT NULL DEFAULT '',
+		last_active DATETIME,
+		fingerprint TEXT NOT NULL DEFAULT ''
+	);
+
 	CREATE TABLE IF NOT EXISTS history (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		command TEXT NOT NULL,
 		timestamp DATETIME NOT NULL,
 		working_directory TEXT,
 		exit_status INTEGER NOT NULL,
-		arguments TEXT
+		arguments TEXT,
+		duration INTEGER NOT NULL DEFAULT 0,
+		session TEXT NOT NULL DEFAULT '',
+		hostname TEXT NOT NULL DEFAULT '',
+		session_id INTEGER REFERENCES sessions(id),
+		rerun_of INTEGER REFERENCES history(id),
+		repo TEXT NOT NULL DEFAULT '',
+		branch TEXT NOT NULL DEFAULT '',
+		score REAL NOT NULL DEFAULT 1.0,
+		starred INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS import_progress (
+		path TEXT PRIMARY KEY,
+		hash TEXT NOT NULL,
+		offset INTEGER NOT NULL,
+		updated DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME NOT NULL,
+		action TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		allowed INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS sync_progress (
+		remote TEXT NOT NULL,
+		log TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		updated DATETIME NOT NULL,
+		PRIMARY KEY (remote, log)
+	);
+
+	CREATE TABLE IF NOT EXISTS saved_searches (
+		name TEXT PRIMARY KEY,
+		search TEXT NOT NULL,
+		updated DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS decay (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		timestamp DATETIME NOT NULL
 	);
 	
 	CREATE INDEX IF NOT EXISTS idx_command ON history(command);
@@ -90,65 +380,355 @@ func (db *DB) ensureSchema() error {
 	CREATE INDEX IF NOT EXISTS idx_working_directory ON history(working_directory);
 	`
 
-	_, err := db.conn.Exec(schema)
+	if _, err := db.conn.Exec(schema); err != nil {
+		return err
+	}
+
+	added, err := db.ensureColumns("history", map[string]string{
+		"duration":   "INTEGER NOT NULL DEFAULT 0",
+		"session":    "TEXT NOT NULL DEFAULT ''",
+		"hostname":   "TEXT NOT NULL DEFAULT ''",
+		"session_id": "INTEGER REFERENCES sessions(id)",
+		"rerun_of":   "INTEGER REFERENCES history(id)",
+		"repo":       "TEXT NOT NULL DEFAULT ''",
+		"branch":     "TEXT NOT NULL DEFAULT ''",
+		"score":      "REAL NOT NULL DEFAULT 1.0",
+		"starred":    "INTEGER NOT NULL DEFAULT 0",
+	})
+	if err != nil {
+		return err
+	}
+
+	addedToSessions, err := db.ensureColumns("sessions", map[string]string{
+		"last_active": "DATETIME",
+		"fingerprint": "TEXT NOT NULL DEFAULT ''",
+	})
+	if err != nil {
+		return err
+	}
+
+	if added["session_id"] || addedToSessions["last_active"] {
+		if err := db.backfillSessions(); err != nil {
+			return fmt.Errorf("failed to backfill sessions: %w", err)
+		}
+	}
+	if added["score"] {
+		if err := db.Decay(); err != nil {
+			return fmt.Errorf("failed to backfill scores: %w", err)
+		}
+	}
+
+	// Indexes on columns added after the original schema must wait until
+	// the columns exist
+	_, err = db.conn.Exec(`
+	CREATE INDEX IF NOT EXISTS idx_session ON history(session);
+	CREATE INDEX IF NOT EXISTS idx_session_id ON history(session_id);
+	CREATE INDEX IF NOT EXISTS idx_repo ON history(repo, branch);
+	CREATE INDEX IF NOT EXISTS idx_origin ON history(hostname, session, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_starred ON history(starred, timestamp);`)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.conn.Exec(tagsSchema); err != nil {
+		return err
+	}
+
+	// The triggers maintaining the rollup read columns added since the
+	// original schema too
+	return db.ensureRollup()
+}
+
+// backfillSessions creates the sessions for records stored before the
+// sessions table existed, links the records to them and works out when each
+// session was last active. Only what can be inferred from the records
+// themselves is filled in.
+func (db *DB) backfillSessions() error {
+	_, err := db.conn.Exec(`
+	INSERT OR IGNORE INTO sessions (name, host, start_time)
+	SELECT session, MAX(hostname), MIN(timestamp)
+	FROM history
+	WHERE session != ''
+	GROUP BY session;
+
+	UPDATE history
+	SET session_id = (SELECT id FROM sessions WHERE sessions.name = history.session)
+	WHERE session != '' AND session_id IS NULL;
+
+	UPDATE sessions
+	SET last_active = (
+		SELECT timestamp FROM history
+		WHERE history.session_id = sessions.id
+		ORDER BY julianday(timestamp) DESC
+		LIMIT 1)
+	WHERE last_active IS NULL;`)
 	return err
 }
 
+// ensureColumns adds any of the given columns missing from a table created by
+// an older version of retour. Columns maps each column name to its definition.
+// Returns the set of columns which had to be added.
+func (db *DB) ensureColumns(table string, columns map[string]string) (map[string]bool, error) {
+	rows, err := db.conn.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	added := map[string]bool{}
+	for name, definition := range columns {
+		if existing[name] {
+			continue
+		}
+		if _, err := db.conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, name, definition)); err != nil {
+			return nil, fmt.Errorf("failed to add column %s.%s: %w", table, name, err)
+		}
+		added[name] = true
+	}
+
+	return added, nil
+}
+
+// insertRecord stores a record, linking it to its session by name. The
+// session's name must be passed both for the session column and the lookup.
+// A rerun of a record which no longer exists is stored as organic.
+const insertRecord = `
+	INSERT INTO history (command, timestamp, working_directory, exit_status, arguments, duration, session, hostname, repo, branch, score, rerun_of, session_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+		(SELECT id FROM history WHERE id = ?),
+		(SELECT id FROM sessions WHERE name = ?))`
+
 // Insert adds a new command record to the database.
 // The Record should contain all required fields: Command, Timestamp,
 // WorkingDirectory, ExitStatus, and optionally Arguments.
-// The ID field will be automatically set by the database.
+// Duration, Session, Hostname, Repo and Branch are optional. A session
+// seen for the first time is added to the sessions table. The ID field
+// will be set from the database once the record is stored.
 //
 // Returns an error if the insert operation fails.
 func (db *DB) Insert(record *Record) error {
-	query := `
-	INSERT INTO history (command, timestamp, working_directory, exit_status, arguments)
-	VALUES (?, ?, ?, ?, ?)
-	`
+	if err := db.insert(db.conn, record); err != nil {
+		return err
+	}
+	db.publishInserted([]Record{*record})
+	return nil
+}
+
+// insert stores a record and its session using conn, setting the record's ID
+func (db *DB) insert(conn execer, record *Record) error {
+	if err := ensureSession(conn, *record); err != nil {
+		return err
+	}
 
-	_, err := db.conn.Exec(query,
-		record.Command,
+	result, err := conn.Exec(insertRecord,
+		db.seal(record.Command),
 		record.Timestamp,
 		record.WorkingDirectory,
 		record.ExitStatus,
-		record.Arguments,
+		db.seal(record.Arguments),
+		record.Duration.Milliseconds(),
+		record.Session,
+		record.Hostname,
+		record.Repo,
+		record.Branch,
+		frecency(time.Since(record.Timestamp)),
+		record.RerunOf,
+		record.Session,
 	)
+	if err != nil {
+		return err
+	}
 
+	record.ID, err = result.LastInsertId()
 	return err
 }
 
 // Query executes a custom SQL query and returns the results as a slice of Records.
 // This method allows for custom queries beyond the standard filters provided by
-// QueryFiltered. The query must return all fields of the history table in the
-// correct order (id, command, timestamp, working_directory, exit_status, arguments).
+// QueryFiltered. Result columns are matched to Record fields by name (id, command,
+// timestamp, working_directory, exit_status, arguments, duration, session,
+// hostname, rerun_of, repo, branch, count); columns with other names are ignored and missing fields
+// are left empty. Every row is held in memory, so for large results prefer
+// QueryStream or Records.
 //
 // The args parameter allows for safe parameterization of the query.
 // Returns the matching records or an error if the query fails.
 func (db *DB) Query(query string, args ...interface{}) ([]Record, error) {
+	return db.queryInto(nil, query, args...)
+}
+
+// queryInto is Query appending the records to records, which may have been
+// allocated with room for them
+func (db *DB) queryInto(records []Record, query string, args ...interface{}) ([]Record, error) {
+	err := db.QueryStream(query, func(r Record) error {
+		records = append(records, r)
+		return nil
+	}, args...)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// QueryStream executes a query and calls fn with each resulting record as it
+// is read, so memory use stays constant however many rows match. Columns are
+// matched to fields as described for Query. Iteration stops at the first error
+// returned by fn, which is returned. While the history is immutable, a query
+// which would write fails with ErrImmutable, or ErrReadOnly if it was opened
+// read-only.
+func (db *DB) QueryStream(query string, fn func(Record) error, args ...interface{}) error {
+	scan := func(rows *sql.Rows) error {
+		return db.scanRecords(rows, fn)
+	}
+	if db.immutable || db.readOnly {
+		return db.queryReadOnly(query, scan, args...)
+	}
+
 	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	return scan(rows)
+}
+
+// selectInto is queryInto for the queries retour makes itself, which only
+// read, running them on the read only connections
+func (db *DB) selectInto(records []Record, query string, args ...interface{}) ([]Record, error) {
+	rows, err := db.reader.QueryContext(db.context(), query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var records []Record
+	err = db.scanRecords(rows, func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// scanRecords passes each row to fn as a Record. Every row is scanned into
+// the same targets, so reading many rows allocates little beyond their text.
+func (db *DB) scanRecords(rows *sql.Rows, fn func(Record) error) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	var r Record
+	var stored storedFields
+	targets := scanTargets(columns, &r, &stored)
 	for rows.Next() {
-		var r Record
-		err := rows.Scan(
-			&r.ID,
-			&r.Command,
-			&r.Timestamp,
-			&r.WorkingDirectory,
-			&r.ExitStatus,
-			&r.Arguments,
-		)
-		if err != nil {
-			return nil, err
+		r, stored = Record{}, storedFields{}
+		if err := rows.Scan(targets...); err != nil {
+			return err
+		}
+		stored.apply(&r)
+		if err := db.openRecord(&r); err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// errStopIteration ends a stream early when the consumer of Records stops
+var errStopIteration = errors.New("iteration stopped")
+
+// Records executes a query and returns an iterator over the resulting records
+// for use with range. Records are read as the loop consumes them, as with
+// QueryStream, and breaking out of the loop closes the query. An error ends
+// the iteration, being yielded with a zero Record.
+func (db *DB) Records(query string, args ...interface{}) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		err := db.QueryStream(query, func(r Record) error {
+			if !yield(r, nil) {
+				return errStopIteration
+			}
+			return nil
+		}, args...)
+		if err != nil && !errors.Is(err, errStopIteration) {
+			yield(Record{}, err)
 		}
-		records = append(records, r)
 	}
+}
 
-	return records, rows.Err()
+// storedFields holds the columns whose stored form differs from the Record
+// field they fill, for conversion once a row has been scanned
+type storedFields struct {
+	// durationMillis is the duration in milliseconds
+	durationMillis int64
+	// rerunOf is NULL for commands which were not a rerun
+	rerunOf sql.NullInt64
+}
+
+// apply converts the stored fields into r
+func (s storedFields) apply(r *Record) {
+	r.Duration = time.Duration(s.durationMillis) * time.Millisecond
+	r.RerunOf = s.rerunOf.Int64
+}
+
+// scanTargets returns the destinations for scanning a row with the given
+// columns into r. Columns which need converting are scanned into stored, to
+// be applied by the caller.
+func scanTargets(columns []string, r *Record, stored *storedFields) []interface{} {
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		switch column {
+		case "id":
+			targets[i] = &r.ID
+		case "command":
+			targets[i] = &r.Command
+		case "timestamp":
+			targets[i] = &r.Timestamp
+		case "working_directory":
+			targets[i] = &r.WorkingDirectory
+		case "exit_status":
+			targets[i] = &r.ExitStatus
+		case "arguments":
+			targets[i] = &r.Arguments
+		case "duration":
+			targets[i] = &stored.durationMillis
+		case "session":
+			targets[i] = &r.Session
+		case "hostname":
+			targets[i] = &r.Hostname
+		case "rerun_of":
+			targets[i] = &stored.rerunOf
+		case "repo":
+			targets[i] = &r.Repo
+		case "branch":
+			targets[i] = &r.Branch
+		case "count":
+			targets[i] = &r.Count
+		case "source":
+			targets[i] = &r.Source
+		case "starred":
+			targets[i] = &r.Starred
+		default:
+			targets[i] = new(interface{})
+		}
+	}
+	return targets
 }
 
 // QueryFiltered returns records based on the provided filters.
@@ -156,41 +736,386 @@ func (db *DB) Query(query string, args ...interface{}) ([]Record, error) {
 //
 // - timeRange: how far back to look (e.g., 24h for last day)
 // - resultFilter: filter by command success/failure ("success", "failed", "all")
-// - workingDir: filter by specific working directory (empty string for all)
+// - scope: filter by working directory or tree, git repository and branch (zero value for all)
 // - limit: maximum number of records to return
 //
-// Returns matching records ordered by timestamp (newest first) or an error if the query fails.
-func (db *DB) QueryFiltered(timeRange time.Duration, resultFilter string, workingDir string, limit int) ([]Record, error) {
+// Returns matching records, the starred ones first, each ordered by timestamp
+// (newest first), or an error if the query fails.
+func (db *DB) QueryFiltered(timeRange time.Duration, resultFilter string, scope Scope, limit int) ([]Record, error) {
+	return db.QueryFilteredAfter(timeRange, resultFilter, scope, nil, limit)
+}
+
+// QueryFilteredAfter is like QueryFiltered but returns the records which
+// follow after in its order, for loading the history a page at a time. A nil
+// after starts at the beginning. Pages are found from where after sorts
+// rather than by counting, so commands recorded meanwhile don't shift them,
+// and after need not still be in the history.
+func (db *DB) QueryFilteredAfter(timeRange time.Duration, resultFilter string, scope Scope, after *Record, limit int) ([]Record, error) {
+	where, args := filterClause(timeRange, resultFilter, scope)
+	if after != nil {
+		where += " AND (starred, timestamp, id) < (?, ?, ?)"
+		args = append(args, after.Starred, after.Timestamp, after.ID)
+	}
+	records, err := db.allocateRecords(where, args, limit)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
-	SELECT id, command, timestamp, working_directory, exit_status, arguments
+	SELECT ` + db.columns() + `, starred
 	FROM history
-	WHERE 1=1
-	`
+	WHERE ` + where + `
+	ORDER BY starred DESC, timestamp DESC, id DESC`
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	return db.selectInto(records, query, args...)
+}
+
+// allocateRecords returns an empty slice with room for the records matching
+// where, or for limit of them if it is positive, so loading a large history
+// doesn't repeatedly grow the slice. Only a load without a limit counts the
+// records first, which costs far less than the copying it saves; a page
+// needs no more room than its limit.
+func (db *DB) allocateRecords(where string, args []interface{}, limit int) ([]Record, error) {
+	if limit > 0 {
+		return make([]Record, 0, limit), nil
+	}
+	var n int
+	err := db.reader.QueryRowContext(db.context(), "SELECT COUNT(*) FROM history WHERE "+where, args...).Scan(&n)
+	if err != nil {
+		return nil, err
+	}
+	return make([]Record, 0, n), nil
+}
+
+// QueryUnique is like QueryFiltered but collapses runs of the same command
+// line into one record, the most recent, with Count set to the number of runs
+// matching the filters. A command line is starred if any of its runs is. The
+// limit applies to distinct command lines.
+func (db *DB) QueryUnique(timeRange time.Duration, resultFilter string, scope Scope, limit int) ([]Record, error) {
+	where, args := filterClause(timeRange, resultFilter, scope)
+	query := `
+	SELECT ` + db.columns() + `, count, line_starred AS starred
+	FROM (
+		SELECT *,
+			COUNT(*) OVER line AS count,
+			ROW_NUMBER() OVER (line ORDER BY timestamp DESC, id DESC) AS latest,
+			MAX(starred) OVER line AS line_starred
+		FROM history
+		WHERE ` + where + `
+		WINDOW line AS (PARTITION BY command, COALESCE(arguments, ''))
+	)
+	WHERE latest = 1
+	ORDER BY line_starred DESC, timestamp DESC`
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	return db.selectInto(nil, query, args...)
+}
+
+// QuerySuggested is like QueryUnique but only considers commands run in the
+// scope's directory or, whether or not the scope is recursive, any directory
+// below it, and ranks them for use there: starred command lines come first,
+// then those run in the directory itself, then those run elsewhere in the
+// tree, each by frecency. Count is the number of runs within the tree.
+func (db *DB) QuerySuggested(timeRange time.Duration, resultFilter string, scope Scope, limit int) ([]Record, error) {
+	scope.Recursive = true
+	where, args := filterClause(timeRange, resultFilter, scope)
+	args = append([]interface{}{filepath.Clean(scope.Dir)}, args...)
+	query := `
+	SELECT ` + db.columns() + `, count, line_starred AS starred
+	FROM (
+		SELECT *,
+			COUNT(*) OVER line AS count,
+			ROW_NUMBER() OVER (line ORDER BY timestamp DESC, id DESC) AS latest,
+			SUM(working_directory = ?) OVER line AS here,
+			` + frecencyScore + ` OVER line AS score,
+			MAX(starred) OVER line AS line_starred
+		FROM history
+		WHERE ` + where + `
+		WINDOW line AS (PARTITION BY command, COALESCE(arguments, ''))
+	)
+	WHERE latest = 1
+	ORDER BY line_starred DESC, here > 0 DESC, score DESC, timestamp DESC`
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	return db.selectInto(nil, query, args...)
+}
+
+// Scope restricts queries to the commands run in a particular place: a
+// directory, a git repository or branch, and perhaps to those starred or
+// tagged. The zero value matches everything.
+type Scope struct {
+	// Dir is the working directory, empty for all directories
+	Dir string `json:"dir,omitempty"`
+
+	// Recursive also matches the directories below Dir
+	Recursive bool `json:"recursive,omitempty"`
+
+	// Repo is the root of the git repository, empty for any
+	Repo string `json:"repo,omitempty"`
+
+	// Branch is the git branch checked out, empty for any
+	Branch string `json:"branch,omitempty"`
+
+	// Starred only matches the commands starred in the picker, which only
+	// the SQLite database keeps
+	Starred bool `json:"starred,omitempty"`
+
+	// Tag only matches the commands tagged with it, empty for any. Tags are
+	// only kept by the SQLite database, for its own records.
+	Tag string `json:"tag,omitempty"`
+}
+
+// clause builds the condition and its arguments matching the scope
+func (s Scope) clause() (string, []interface{}) {
+	where := "1=1"
 	var args []interface{}
 
-	if timeRange > 0 {
-		query += " AND timestamp >= ?"
-		args = append(args, time.Now().Add(-timeRange))
+	switch {
+	case s.Dir == "":
+	case s.Recursive:
+		tree, treeArgs := treeClause(s.Dir)
+		where += " AND " + tree
+		args = append(args, treeArgs...)
+	default:
+		where += " AND working_directory = ?"
+		args = append(args, s.Dir)
 	}
 
-	if workingDir != "" {
-		query += " AND working_directory = ?"
-		args = append(args, workingDir)
+	if s.Repo != "" {
+		where += " AND repo = ?"
+		args = append(args, s.Repo)
+	}
+	if s.Branch != "" {
+		where += " AND branch = ?"
+		args = append(args, s.Branch)
+	}
+	if s.Starred {
+		where += " AND starred"
+	}
+	if s.Tag != "" {
+		where += " AND id IN (SELECT record_id FROM tags WHERE tag = ?)"
+		args = append(args, s.Tag)
+	}
+
+	return where, args
+}
+
+// treeClause builds the condition and its arguments matching commands run in
+// dir or any directory below it. Everything below dir sorts between dir
+// followed by a slash and dir followed by the next character, '0', so the
+// range comparison can use the working directory index.
+func treeClause(dir string) (string, []interface{}) {
+	dir = filepath.Clean(dir)
+	prefix := strings.TrimSuffix(dir, "/")
+	return "(working_directory = ? OR (working_directory >= ? AND working_directory < ?))",
+		[]interface{}{dir, prefix + "/", prefix + "0"}
+}
+
+// filterClause builds the WHERE condition and its arguments for the standard
+// filters, as described for QueryFiltered
+func filterClause(timeRange time.Duration, resultFilter string, scope Scope) (string, []interface{}) {
+	where, args := scope.clause()
+
+	if timeRange > 0 {
+		where += " AND timestamp >= ?"
+		args = append(args, time.Now().Add(-timeRange))
 	}
 
 	switch resultFilter {
 	case "success":
-		query += " AND exit_status = 0"
+		where += " AND exit_status = 0"
 	case "failed":
-		query += " AND exit_status != 0"
+		where += " AND exit_status != 0"
 	}
 
-	query += " ORDER BY timestamp DESC"
+	return where, args
+}
+
+// QueryMatching is like QueryFiltered but only returns the records whose
+// command line matches filterText, in mode, as the picker's Filter matches
+// it, so that matches can be found beyond the records the picker has loaded.
+// Command text must not be encrypted, as SQL cannot see it.
+func (db *DB) QueryMatching(timeRange time.Duration, resultFilter string, scope Scope, filterText string, mode MatchMode, limit int) ([]Record, error) {
+	where, args := filterClause(timeRange, resultFilter, scope)
+	match, matchArgs, whole := matchClause(filterText, mode)
+	where += match
+	args = append(args, matchArgs...)
 
-	if limit > 0 {
+	query := `
+	SELECT ` + db.columns() + `, starred
+	FROM history
+	WHERE ` + where + `
+	ORDER BY starred DESC, timestamp DESC, id DESC`
+
+	// A regular expression, or text SQL can't fold, is left to Filter, so the
+	// limit must wait for it
+	if limit > 0 && whole {
 		query += " LIMIT ?"
 		args = append(args, limit)
 	}
 
-	return db.Query(query, args...)
+	records, err := db.selectInto(nil, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Alternatives are only narrowed down by SQL, Filter has the last word
+	filter := NewFilter(records)
+	filter.SetMatchMode(mode)
+	filter.UpdateFilter(filterText)
+	records = filter.FilteredRecords()
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// commandLine is the SQL for the command line of a record, as typed
+const commandLine = "command || CASE WHEN COALESCE(arguments, '') = '' THEN '' ELSE ' ' || arguments END"
+
+// matchClause builds the condition, to be added to the WHERE clause, and its
+// arguments for the records whose command lines match each stage of the
+// filter text in mode, as Filter matches them. A word listing alternatives
+// matches a line containing any of them, which can match lines where the
+// words are not together, so a stage with alternatives only narrows the
+// records down, as does text outside ASCII, see foldLike. A regular
+// expression cannot be matched by SQL at all, so whole is false if a stage
+// is one or has such text. The class: words of a stage match the
+// class of the exit status.
+func matchClause(filterText string, mode MatchMode) (where string, args []interface{}, whole bool) {
+	whole = true
+	for _, stage := range splitStages(filterText) {
+		stage, classes := splitClasses(stage)
+		for _, alternatives := range classes {
+			var names []string
+			for _, name := range alternatives {
+				names = append(names, exitClassSQL+` LIKE ? ESCAPE '\'`)
+				args = append(args, escapeLike(name)+"%")
+			}
+			where += " AND (" + strings.Join(names, " OR ") + ")"
+		}
+		stageMode, stage := stageMatch(stage, mode)
+		if stage == "" {
+			continue
+		}
+		switch stageMode {
+		case RegexMatch:
+			whole = false
+			continue
+		case ExactMatch:
+			// Unlike LIKE, instr is case sensitive
+			where += " AND instr(" + commandLine + ", ?) > 0"
+			args = append(args, stage)
+			continue
+		}
+
+		// A fuzzy match is for the characters of each alternative in order
+		pattern := func(text string) string {
+			like, ascii := foldLike(text)
+			whole = whole && ascii
+			return "%" + like + "%"
+		}
+		if stageMode == FuzzyMatch {
+			pattern = func(text string) string {
+				var like strings.Builder
+				like.WriteString("%")
+				for _, r := range strings.ReplaceAll(text, " ", "") {
+					char, ascii := foldLike(string(r))
+					whole = whole && ascii
+					like.WriteString(char + "%")
+				}
+				return like.String()
+			}
+		}
+		if !strings.Contains(stage, "|") {
+			where += " AND " + commandLine + ` LIKE ? ESCAPE '\'`
+			args = append(args, pattern(stage))
+			continue
+		}
+		for _, word := range strings.Split(stage, " ") {
+			var alternatives []string
+			for _, alternative := range strings.Split(word, "|") {
+				if alternative != "" {
+					alternatives = append(alternatives, commandLine+` LIKE ? ESCAPE '\'`)
+					args = append(args, pattern(alternative))
+				}
+			}
+			if len(alternatives) > 0 {
+				where += " AND (" + strings.Join(alternatives, " OR ") + ")"
+			}
+		}
+	}
+	return where, args, whole
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)
+}
+
+// foldLike escapes text for a LIKE pattern matching it whatever its case.
+// LIKE only folds ASCII letters, whereas Filter folds all of Unicode, so any
+// other character becomes _, matching any one character, to match more lines
+// than Filter would rather than fewer; ascii is false if one did. Only the
+// Kelvin sign and the dotted capital I, which Filter folds to ASCII letters,
+// are still missed.
+func foldLike(text string) (like string, ascii bool) {
+	var b strings.Builder
+	ascii = true
+	for _, r := range text {
+		if r >= utf8.RuneSelf {
+			b.WriteByte('_')
+			ascii = false
+			continue
+		}
+		b.WriteString(escapeLike(string(r)))
+	}
+	return b.String(), ascii
+}
+
+// SessionContext returns up to n records run immediately before and after
+// record in the same session, each in the order they were run. Records without
+// a session have no context.
+func (db *DB) SessionContext(record Record, n int) (before []Record, after []Record, err error) {
+	if record.Session == "" {
+		return nil, nil, nil
+	}
+
+	before, err = db.selectInto(nil, `
+	SELECT `+db.columns()+`
+	FROM history
+	WHERE session = ? AND id < ?
+	ORDER BY id DESC
+	LIMIT ?`, record.Session, record.ID, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+
+	after, err = db.selectInto(nil, `
+	SELECT `+db.columns()+`
+	FROM history
+	WHERE session = ? AND id > ?
+	ORDER BY id
+	LIMIT ?`, record.Session, record.ID, n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return before, after, nil
 }
@@ -1,7 +1,11 @@
 package main_test
 
 import (
+	"database/sql"
+	"errors"
 	"os"
+	"slices"
+	"strconv"
 	"testing"
 	"time"
 
@@ -52,7 +56,7 @@ func TestDB(t *testing.T) {
 	}
 
 	// Test filtered query
-	records, err = database.QueryFiltered(24*time.Hour, "success", "/home/user", 10)
+	records, err = database.QueryFiltered(24*time.Hour, "success", rt.Scope{Dir: "/home/user"}, 10)
 	if err != nil {
 		t.Errorf("Failed to query filtered records: %v", err)
 	}
@@ -62,7 +66,7 @@ func TestDB(t *testing.T) {
 	}
 
 	// Test no results
-	records, err = database.QueryFiltered(24*time.Hour, "failed", "/home/user", 10)
+	records, err = database.QueryFiltered(24*time.Hour, "failed", rt.Scope{Dir: "/home/user"}, 10)
 	if err != nil {
 		t.Errorf("Failed to query filtered records: %v", err)
 	}
@@ -71,3 +75,807 @@ func TestDB(t *testing.T) {
 		t.Errorf("Expected 0 records, got %d", len(records))
 	}
 }
+
+func TestDBDurationAndSession(t *testing.T) {
+	database := openTestDB(t)
+
+	record := &rt.Record{
+		Command:   "sleep",
+		Arguments: "2",
+		Timestamp: time.Now(),
+		Duration:  2 * time.Second,
+		Session:   "42-1700000000",
+	}
+	if err := database.Insert(record); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+	if record.ID == 0 {
+		t.Error("Expected ID to be set after insert")
+	}
+
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 10)
+	if err != nil {
+		t.Fatalf("Failed to query records: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(records))
+	}
+	if records[0].Duration != record.Duration {
+		t.Errorf("Expected duration %v, got %v", record.Duration, records[0].Duration)
+	}
+	if records[0].Session != record.Session {
+		t.Errorf("Expected session %q, got %q", record.Session, records[0].Session)
+	}
+}
+
+func TestDBQueryPartialColumns(t *testing.T) {
+	database := openTestDB(t)
+
+	if err := database.Insert(&rt.Record{Command: "git", Arguments: "status", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+
+	records, err := database.Query("SELECT arguments, command, 1 AS extra FROM history")
+	if err != nil {
+		t.Fatalf("Failed to query records: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(records))
+	}
+	if records[0].Command != "git" || records[0].Arguments != "status" {
+		t.Errorf("Expected 'git status', got %q", records[0].CommandLine())
+	}
+}
+
+func TestDBMigratesOldSchema(t *testing.T) {
+	path := t.TempDir() + "/old.db"
+
+	// Create a database with the original schema
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = conn.Exec(`
+	CREATE TABLE history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		command TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		working_directory TEXT,
+		exit_status INTEGER NOT NULL,
+		arguments TEXT
+	);
+	INSERT INTO history (command, timestamp, working_directory, exit_status, arguments)
+	VALUES ('ls', '2024-01-01 00:00:00', '/', 0, '-la');
+	`)
+	conn.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to open old database: %v", err)
+	}
+	defer database.Close()
+
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 10)
+	if err != nil {
+		t.Fatalf("Failed to query migrated database: %v", err)
+	}
+	if len(records) != 1 || records[0].Duration != 0 || records[0].Session != "" {
+		t.Errorf("Unexpected records after migration: %+v", records)
+	}
+}
+
+func TestDBSkipsCurrentSchema(t *testing.T) {
+	path := t.TempDir() + "/history.db"
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	database.Close()
+
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer conn.Close()
+	tableExists := func() bool {
+		var n int
+		if err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'saved_searches'").Scan(&n); err != nil {
+			t.Fatalf("Failed to look for table: %v", err)
+		}
+		return n == 1
+	}
+	reopen := func() {
+		database, err := rt.NewDB(path)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		database.Close()
+	}
+
+	// A table missing from a database marked current is not looked for
+	if _, err := conn.Exec("DROP TABLE saved_searches"); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+	reopen()
+	if tableExists() {
+		t.Error("Schema was checked although the database is current")
+	}
+
+	if _, err := conn.Exec("PRAGMA user_version = 0"); err != nil {
+		t.Fatalf("Failed to reset version: %v", err)
+	}
+	reopen()
+	if !tableExists() {
+		t.Error("Schema of an outdated database was not brought up to date")
+	}
+}
+
+func openTestDB(t *testing.T) *rt.DB {
+	t.Helper()
+	database, err := rt.NewDB(t.TempDir() + "/history.db")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+func TestDBReadOnly(t *testing.T) {
+	path := t.TempDir() + "/history.db"
+	if _, err := rt.NewDBReadOnly(path, rt.DefaultPragmas()); err == nil {
+		t.Error("NewDBReadOnly() created a missing database")
+	}
+
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	record := rt.NewRecord("ls -la", "/tmp", 0, time.Now())
+	if err := database.Insert(&record); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+	database.Close()
+
+	database, err = rt.NewDBReadOnly(path, rt.DefaultPragmas())
+	if err != nil {
+		t.Fatalf("NewDBReadOnly() unexpected error = %v", err)
+	}
+	defer database.Close()
+
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	if len(records) != 1 || records[0].Command != "ls" {
+		t.Errorf("QueryFiltered() = %+v, want the recorded command", records)
+	}
+
+	if _, err := database.Query("DELETE FROM history"); !errors.Is(err, rt.ErrReadOnly) {
+		t.Errorf("Query() error = %v, want %v", err, rt.ErrReadOnly)
+	}
+	record = rt.NewRecord("pwd", "/tmp", 0, time.Now())
+	if err := database.Insert(&record); err == nil {
+		t.Error("Insert() into a read-only database succeeded")
+	}
+	if err := database.SaveSearch("all", rt.Search{Result: rt.AllResults}); err == nil {
+		t.Error("SaveSearch() into a read-only database succeeded")
+	}
+	if err := database.SetStarred(records[0].ID, true); !errors.Is(err, rt.ErrReadOnly) {
+		t.Errorf("SetStarred() error = %v, want %v", err, rt.ErrReadOnly)
+	}
+}
+
+func TestDBSessionContext(t *testing.T) {
+	database := openTestDB(t)
+
+	var records []rt.Record
+	for i, line := range []string{"a1", "b1", "a2", "a3", "a4", "b2"} {
+		record := rt.NewRecord(line, "/", 0, time.Now().Add(time.Duration(i)*time.Second))
+		record.Session = line[:1]
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	before, after, err := database.SessionContext(records[3], 1)
+	if err != nil {
+		t.Fatalf("SessionContext() unexpected error = %v", err)
+	}
+	if len(before) != 1 || before[0].Command != "a2" {
+		t.Errorf("Expected [a2] before a3, got %v", before)
+	}
+	if len(after) != 1 || after[0].Command != "a4" {
+		t.Errorf("Expected [a4] after a3, got %v", after)
+	}
+
+	before, after, err = database.SessionContext(records[3], 5)
+	if err != nil {
+		t.Fatalf("SessionContext() unexpected error = %v", err)
+	}
+	if len(before) != 2 || before[0].Command != "a1" || before[1].Command != "a2" {
+		t.Errorf("Expected [a1 a2] before a3, got %v", before)
+	}
+	if len(after) != 1 {
+		t.Errorf("Expected only a4 after a3, got %v", after)
+	}
+
+	before, after, err = database.SessionContext(rt.Record{ID: records[3].ID}, 5)
+	if err != nil || before != nil || after != nil {
+		t.Errorf("Expected no context without a session, got %v %v %v", before, after, err)
+	}
+}
+
+func TestDBPragmas(t *testing.T) {
+	tests := []struct {
+		name    string
+		pragmas rt.Pragmas
+		want    string
+	}{
+		{name: "Default", pragmas: rt.DefaultPragmas(), want: "wal"},
+		{name: "Configured", pragmas: rt.Pragmas{JournalMode: "DELETE", Synchronous: "FULL"}, want: "delete"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := t.TempDir() + "/history.db"
+			database, err := rt.NewDBWithPragmas(path, tt.pragmas)
+			if err != nil {
+				t.Fatalf("NewDBWithPragmas() unexpected error = %v", err)
+			}
+			database.Close()
+
+			// The journal mode is a property of the file so outlives the connection
+			conn, err := sql.Open("sqlite3", path)
+			if err != nil {
+				t.Fatalf("Failed to open database: %v", err)
+			}
+			defer conn.Close()
+
+			var mode string
+			if err := conn.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+				t.Fatalf("Failed to read journal mode: %v", err)
+			}
+			if mode != tt.want {
+				t.Errorf("journal_mode = %v, want %v", mode, tt.want)
+			}
+		})
+	}
+}
+
+func TestDBRerunOf(t *testing.T) {
+	database := openTestDB(t)
+
+	original := rt.NewRecord("make test", "/src", 1, time.Now())
+	if err := database.Insert(&original); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+
+	rerun := rt.NewRecord("make test -v", "/src", 0, time.Now())
+	rerun.RerunOf = original.ID
+	if err := database.Insert(&rerun); err != nil {
+		t.Fatalf("Failed to insert rerun: %v", err)
+	}
+
+	orphan := rt.NewRecord("ls", "/", 0, time.Now())
+	orphan.RerunOf = 999
+	if err := database.Insert(&orphan); err != nil {
+		t.Fatalf("Failed to insert rerun of missing record: %v", err)
+	}
+
+	tests := []struct {
+		id   int64
+		want int64
+	}{
+		{id: original.ID, want: 0},
+		{id: rerun.ID, want: original.ID},
+		{id: orphan.ID, want: 0},
+	}
+	for _, tt := range tests {
+		got, err := database.Get(tt.id)
+		if err != nil {
+			t.Fatalf("Get(%d) unexpected error = %v", tt.id, err)
+		}
+		if got.RerunOf != tt.want {
+			t.Errorf("Get(%d).RerunOf = %d, want %d", tt.id, got.RerunOf, tt.want)
+		}
+	}
+
+	if _, err := database.Get(999); err == nil {
+		t.Error("Get() of a missing record succeeded, want error")
+	}
+}
+
+func TestDBQueryStream(t *testing.T) {
+	database := openTestDB(t)
+
+	for _, line := range []string{"first", "second", "third"} {
+		record := rt.NewRecord(line, "/", 0, time.Now())
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	var seen []string
+	err := database.QueryStream("SELECT command FROM history ORDER BY id", func(r rt.Record) error {
+		seen = append(seen, r.Command)
+		return nil
+	})
+	if err != nil || len(seen) != 3 || seen[2] != "third" {
+		t.Errorf("QueryStream() = %v, %v, want all three records", seen, err)
+	}
+
+	stop := errors.New("stop")
+	seen = nil
+	err = database.QueryStream("SELECT command FROM history WHERE id > ? ORDER BY id", func(r rt.Record) error {
+		seen = append(seen, r.Command)
+		return stop
+	}, 1)
+	if !errors.Is(err, stop) || len(seen) != 1 || seen[0] != "second" {
+		t.Errorf("QueryStream() = %v, %v, want to stop after second", seen, err)
+	}
+}
+
+func TestDBRecords(t *testing.T) {
+	database := openTestDB(t)
+
+	for _, line := range []string{"first", "second", "third"} {
+		record := rt.NewRecord(line, "/", 0, time.Now())
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	var seen []string
+	for r, err := range database.Records("SELECT command FROM history ORDER BY id") {
+		if err != nil {
+			t.Fatalf("Records() unexpected error = %v", err)
+		}
+		seen = append(seen, r.Command)
+		if len(seen) == 2 {
+			break
+		}
+	}
+	if len(seen) != 2 || seen[1] != "second" {
+		t.Errorf("Records() = %v, want to stop after second", seen)
+	}
+
+	var gotErr error
+	for _, err := range database.Records("SELECT * FROM missing") {
+		gotErr = err
+	}
+	if gotErr == nil {
+		t.Error("Records() of an invalid query yielded no error")
+	}
+}
+
+func TestDBQueryUnique(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now()
+	history := []struct {
+		line string
+		exit int
+		age  time.Duration
+	}{
+		{"ls", 0, 5 * time.Minute},
+		{"git status", 0, 4 * time.Minute},
+		{"ls", 1, 3 * time.Minute},
+		{"ls", 0, 2 * time.Minute},
+		{"make", 2, time.Minute},
+	}
+	for _, h := range history {
+		record := rt.NewRecord(h.line, "/", h.exit, now.Add(-h.age))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		result     string
+		limit      int
+		wantLines  []string
+		wantCounts []int
+	}{
+		{name: "All", result: "all", wantLines: []string{"make", "ls", "git status"}, wantCounts: []int{1, 3, 1}},
+		{name: "Successes", result: "success", wantLines: []string{"ls", "git status"}, wantCounts: []int{2, 1}},
+		{name: "Limited", result: "all", limit: 2, wantLines: []string{"make", "ls"}, wantCounts: []int{1, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := database.QueryUnique(0, tt.result, rt.Scope{}, tt.limit)
+			if err != nil {
+				t.Fatalf("QueryUnique() unexpected error = %v", err)
+			}
+			if len(records) != len(tt.wantLines) {
+				t.Fatalf("QueryUnique() = %+v, want %v", records, tt.wantLines)
+			}
+			for i, r := range records {
+				if r.CommandLine() != tt.wantLines[i] || r.Count != tt.wantCounts[i] {
+					t.Errorf("Record %d = %q x%d, want %q x%d", i, r.CommandLine(), r.Count, tt.wantLines[i], tt.wantCounts[i])
+				}
+			}
+		})
+	}
+
+	// The collapsed record is the most recent run
+	records, err := database.QueryUnique(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryUnique() unexpected error = %v", err)
+	}
+	if ls := records[1]; !ls.Timestamp.Equal(now.Add(-2*time.Minute)) || ls.ExitStatus != 0 {
+		t.Errorf("Collapsed ls = %+v, want the latest run", ls)
+	}
+}
+
+func TestDBScope(t *testing.T) {
+	database := openTestDB(t)
+
+	for _, dir := range []string{"/home/user/project", "/home/user/project/src", "/home/user/project-two", "/home/user"} {
+		record := rt.NewRecord("ls", dir, 0, time.Now())
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		dirs rt.Scope
+		want []string
+	}{
+		{name: "All", dirs: rt.Scope{}, want: []string{"/home/user", "/home/user/project", "/home/user/project-two", "/home/user/project/src"}},
+		{name: "Exact", dirs: rt.Scope{Dir: "/home/user/project"}, want: []string{"/home/user/project"}},
+		{name: "Recursive", dirs: rt.Scope{Dir: "/home/user/project", Recursive: true}, want: []string{"/home/user/project", "/home/user/project/src"}},
+		{name: "Trailing slash", dirs: rt.Scope{Dir: "/home/user/project/", Recursive: true}, want: []string{"/home/user/project", "/home/user/project/src"}},
+		{name: "Root", dirs: rt.Scope{Dir: "/", Recursive: true}, want: []string{"/home/user", "/home/user/project", "/home/user/project-two", "/home/user/project/src"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := database.QueryFiltered(0, "all", tt.dirs, 0)
+			if err != nil {
+				t.Fatalf("QueryFiltered() unexpected error = %v", err)
+			}
+			var got []string
+			for _, r := range records {
+				got = append(got, r.WorkingDirectory)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("QueryFiltered() directories = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDBQueryFilteredAfter(t *testing.T) {
+	database := openTestDB(t)
+
+	// Two records share a timestamp, so pages must break ties consistently
+	now := time.Now()
+	for i, offset := range []int{5, 4, 4, 2, 1} {
+		record := rt.NewRecord("cmd"+strconv.Itoa(i), "/", 0, now.Add(-time.Duration(offset)*time.Minute))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	all, err := database.QueryFiltered(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	var paged []rt.Record
+	var after *rt.Record
+	for {
+		page, err := database.QueryFilteredAfter(0, "all", rt.Scope{}, after, 2)
+		if err != nil {
+			t.Fatalf("QueryFilteredAfter() unexpected error = %v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+		after = &page[len(page)-1]
+	}
+
+	if len(paged) != len(all) {
+		t.Fatalf("Pages held %d records, want %d", len(paged), len(all))
+	}
+	for i := range all {
+		if paged[i].ID != all[i].ID {
+			t.Errorf("Paged record %d = %s, want %s", i, paged[i].Command, all[i].Command)
+		}
+	}
+
+	// Paging goes on after the last record of a page is deleted
+	first, err := database.QueryFilteredAfter(0, "all", rt.Scope{}, nil, 2)
+	if err != nil {
+		t.Fatalf("QueryFilteredAfter() unexpected error = %v", err)
+	}
+	if _, err := database.DeleteMatching([]string{rt.IgnorePattern(first[1].Command)}); err != nil {
+		t.Fatalf("DeleteMatching() unexpected error = %v", err)
+	}
+	page, err := database.QueryFilteredAfter(0, "all", rt.Scope{}, &first[1], 2)
+	if err != nil {
+		t.Fatalf("QueryFilteredAfter() unexpected error = %v", err)
+	}
+	if len(page) != 2 || page[0].ID != all[2].ID || page[1].ID != all[3].ID {
+		t.Errorf("QueryFilteredAfter() a deleted record = %+v, want %s and %s", page, all[2].Command, all[3].Command)
+	}
+}
+
+func TestDBQueryMatching(t *testing.T) {
+	database := openTestDB(t)
+	now := time.Now()
+	for i, line := range []string{"git status", "git push", "ls", "docker build .", "podman build .", "echo 100%_done", "echo 1000 done", "touch Été", "touch xté"} {
+		record := rt.NewRecord(line, "/", 0, now.Add(time.Duration(i)*time.Second))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"git", []string{"git push", "git status"}},
+		{"GIT ST", []string{"git status"}},
+		{"git > push", []string{"git push"}},
+		{"docker|podman build", []string{"podman build .", "docker build ."}},
+		{"build|push .", []string{"podman build .", "docker build ."}},
+		{"0%_", []string{"echo 100%_done"}},
+		{"été", []string{"touch Été"}},
+		{"ÉTÉ", []string{"touch Été"}},
+		{"nothing", nil},
+	}
+	for _, tt := range tests {
+		records, err := database.QueryMatching(0, "all", rt.Scope{}, tt.filter, rt.SubstringMatch, 0)
+		if err != nil {
+			t.Fatalf("QueryMatching(%q) unexpected error = %v", tt.filter, err)
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.CommandLine())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("QueryMatching(%q) = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+
+	// SQL matches any character for É, so the limit waits for Filter to
+	// drop the more recent xté
+	records, err := database.QueryMatching(0, "all", rt.Scope{}, "été", rt.SubstringMatch, 1)
+	if err != nil {
+		t.Fatalf("QueryMatching() unexpected error = %v", err)
+	}
+	if len(records) != 1 || records[0].CommandLine() != "touch Été" {
+		t.Errorf("QueryMatching(\"été\") limited to 1 = %+v, want touch Été", records)
+	}
+}
+
+func TestDBQueryMatchingModes(t *testing.T) {
+	database := openTestDB(t)
+	now := time.Now()
+	for i, line := range []string{"git checkout main", "go test ./...", "grep TODO main.go", "echo todo"} {
+		record := rt.NewRecord(line, "/", 0, now.Add(time.Duration(i)*time.Second))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		mode   rt.MatchMode
+		filter string
+		want   []string
+	}{
+		{rt.FuzzyMatch, "gco", []string{"git checkout main"}},
+		{rt.FuzzyMatch, "gt|gr mai", []string{"grep TODO main.go", "git checkout main"}},
+		{rt.ExactMatch, "TODO", []string{"grep TODO main.go"}},
+		{rt.SubstringMatch, "'todo", []string{"echo todo"}},
+		{rt.RegexMatch, `\.go$`, []string{"grep TODO main.go"}},
+		{rt.SubstringMatch, "main > /^g.t /", []string{"git checkout main"}},
+	}
+	for _, tt := range tests {
+		records, err := database.QueryMatching(0, "all", rt.Scope{}, tt.filter, tt.mode, 0)
+		if err != nil {
+			t.Fatalf("QueryMatching(%q) unexpected error = %v", tt.filter, err)
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.CommandLine())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("QueryMatching(%q) in %s mode = %q, want %q", tt.filter, tt.mode, got, tt.want)
+		}
+	}
+
+	// SQL cannot match a regular expression, so the limit waits for Filter
+	records, err := database.QueryMatching(0, "all", rt.Scope{}, "^g", rt.RegexMatch, 2)
+	if err != nil {
+		t.Fatalf("QueryMatching() unexpected error = %v", err)
+	}
+	if len(records) != 2 || records[0].CommandLine() != "grep TODO main.go" {
+		t.Errorf("QueryMatching() of a regular expression with a limit = %+v, want the 2 latest matches", records)
+	}
+}
+
+func TestDBQueryMatchingClasses(t *testing.T) {
+	database := openTestDB(t)
+	now := time.Now()
+	for i, h := range []struct {
+		line string
+		exit int
+	}{
+		{"make build", 0},
+		{"make test", 130},
+		{"mkae test", 127},
+		{"make lint", 2},
+		{"./deploy.sh", 126},
+	} {
+		record := rt.NewRecord(h.line, "/", h.exit, now.Add(time.Duration(i)*time.Second))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"class:signal", []string{"make test"}},
+		{"make class:success|usage-error", []string{"make lint", "make build"}},
+		{"Class:Not-Found", []string{"mkae test"}},
+		{"class:perm", []string{"./deploy.sh"}},
+		{"class:error", nil},
+		{"test > class:signal", []string{"make test"}},
+	}
+	for _, tt := range tests {
+		records, err := database.QueryMatching(0, "all", rt.Scope{}, tt.filter, rt.SubstringMatch, 0)
+		if err != nil {
+			t.Fatalf("QueryMatching(%q) unexpected error = %v", tt.filter, err)
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.CommandLine())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("QueryMatching(%q) = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+
+	// A limit counts only the records of the class
+	records, err := database.QueryMatching(0, "all", rt.Scope{}, "class:signal|not-found", rt.SubstringMatch, 1)
+	if err != nil {
+		t.Fatalf("QueryMatching() unexpected error = %v", err)
+	}
+	if len(records) != 1 || records[0].CommandLine() != "mkae test" {
+		t.Errorf("QueryMatching() with a limit = %+v, want mkae test", records)
+	}
+}
+
+func TestDBPruneKeeps(t *testing.T) {
+	database := openTestDB(t)
+	database.SetKeepTags([]string{"keep", "runbook"})
+	now := time.Now()
+	old := now.AddDate(0, -2, 0)
+	var ids []int64
+	for i, line := range []string{"make", "ls", "git status", "ls", "ssh prod", "make"} {
+		record := rt.NewRecord(line, "/", 0, old.Add(time.Duration(i)*time.Minute))
+		if i == 5 {
+			record.Timestamp = now
+		}
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+		ids = append(ids, record.ID)
+	}
+	if err := database.SetStarred(ids[0], true); err != nil {
+		t.Fatalf("SetStarred() unexpected error = %v", err)
+	}
+	if err := database.Tag(ids[1], "keep"); err != nil {
+		t.Fatalf("Tag() unexpected error = %v", err)
+	}
+	if err := database.Tag(ids[4], "prod"); err != nil {
+		t.Fatalf("Tag() unexpected error = %v", err)
+	}
+
+	// The starred make and the ls tagged keep survive, however old
+	pruned, err := database.Prune(now.AddDate(0, -1, 0))
+	if err != nil || pruned != 3 {
+		t.Fatalf("Prune() = %d, %v, want 3 records removed", pruned, err)
+	}
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	var got []int64
+	for _, r := range records {
+		got = append(got, r.ID)
+	}
+	if want := []int64{ids[0], ids[5], ids[1]}; !slices.Equal(got, want) {
+		t.Errorf("Records after pruning = %v, want %v", got, want)
+	}
+
+	// Deduplicated, the pinned line counts the runs left and stays starred
+	unique, err := database.QueryUnique(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryUnique() unexpected error = %v", err)
+	}
+	if len(unique) != 2 || unique[0].CommandLine() != "make" || unique[0].Count != 2 || !unique[0].Starred ||
+		unique[1].CommandLine() != "ls" || unique[1].Count != 1 {
+		t.Errorf("QueryUnique() after pruning = %+v, want make twice, starred, then ls once", unique)
+	}
+
+	// Importing a kept record again is skipped as a duplicate, and pruning
+	// again keeps it still
+	kept := rt.NewRecord("make", "/", 0, old)
+	if inserted, err := database.Import([]rt.Record{kept}); err != nil || inserted != 0 {
+		t.Errorf("Import() of a kept record = %d, %v, want it skipped", inserted, err)
+	}
+	if pruned, err := database.Prune(now.AddDate(0, -1, 0)); err != nil || pruned != 0 {
+		t.Errorf("Prune() again = %d, %v, want nothing removed", pruned, err)
+	}
+}
+
+func TestDBPrune(t *testing.T) {
+	database := openTestDB(t)
+	database.SetImmutable(true)
+
+	now := time.Now()
+	old := rt.NewRecord("make", "/src", 0, now.AddDate(0, -2, 0))
+	if err := database.Insert(&old); err != nil {
+		t.Fatalf("Insert() unexpected error = %v", err)
+	}
+	rerun := rt.NewRecord("make", "/src", 0, now)
+	rerun.RerunOf = old.ID
+	if err := database.Insert(&rerun); err != nil {
+		t.Fatalf("Insert() unexpected error = %v", err)
+	}
+
+	pruned, err := database.Prune(now.AddDate(0, -1, 0))
+	if err != nil || pruned != 1 {
+		t.Fatalf("Prune() = %d, %v, want 1 record removed", pruned, err)
+	}
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 10)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	if len(records) != 1 || records[0].ID != rerun.ID || records[0].RerunOf != 0 {
+		t.Errorf("Records after pruning = %+v, want the rerun as organic", records)
+	}
+
+	// The retention policy may prune immutable history, but is audited
+	entries, err := database.AuditLog(10)
+	if err != nil {
+		t.Fatalf("AuditLog() unexpected error = %v", err)
+	}
+	if len(entries) != 1 || entries[0].Action != "prune" || !entries[0].Allowed {
+		t.Errorf("AuditLog() = %+v, want the prune allowed", entries)
+	}
+}
+
+func BenchmarkQueryFiltered(b *testing.B) {
+	database, err := rt.NewDB(b.TempDir() + "/history.db")
+	if err != nil {
+		b.Fatalf("Failed to create database: %v", err)
+	}
+	defer database.Close()
+
+	records := rt.GenerateFixture(rt.FixtureOptions{Records: 100_000, Seed: 42})
+	if _, err := database.Import(records); err != nil {
+		b.Fatalf("Import() unexpected error = %v", err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		got, err := database.QueryFiltered(0, "all", rt.Scope{}, len(records))
+		if err != nil || len(got) != len(records) {
+			b.Fatalf("QueryFiltered() = %d records, %v", len(got), err)
+		}
+	}
+}
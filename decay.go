@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Each record stores its frecency score so ranking only has to sum the
+// scores rather than work out the age of every run on every keystroke. A
+// score is exact when the record is stored and overstates the run's
+// recency as it ages, until the scores are decayed again.
+
+// decayInterval is how often the stored scores are brought up to date
+const decayInterval = time.Hour
+
+// decayTolerance is how far a score may drift above its exact value before
+// decaying rewrites it, so runs too old to change noticeably are left alone
+const decayTolerance = 0.0001
+
+// Decay recomputes the scores of the records which have aged since they
+// were last scored.
+func (db *DB) Decay() error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	UPDATE history
+	SET score = 1.0 / (1.0 + julianday('now') - julianday(timestamp))
+	WHERE score - 1.0 / (1.0 + julianday('now') - julianday(timestamp)) > ?`, decayTolerance)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO decay (id, timestamp) VALUES (1, ?)", time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DecayIfStale decays the scores if they were last decayed more than maxAge
+// ago, or never have been, reporting whether they were.
+func (db *DB) DecayIfStale(maxAge time.Duration) (bool, error) {
+	var last time.Time
+	err := db.conn.QueryRow("SELECT timestamp FROM decay WHERE id = 1").Scan(&last)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if err == nil && time.Since(last) < maxAge {
+		return false, nil
+	}
+	return true, db.Decay()
+}
@@ -0,0 +1,143 @@
+package main_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+// completions returns the command lines Complete ranks for prefix
+func completions(t *testing.T, database *rt.DB, prefix string) []string {
+	t.Helper()
+	suggestions, err := database.Complete(prefix, 10)
+	if err != nil {
+		t.Fatalf("Complete() unexpected error = %v", err)
+	}
+	var lines []string
+	for _, s := range suggestions {
+		lines = append(lines, s.CommandLine)
+	}
+	return lines
+}
+
+func TestDecay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer database.Close()
+
+	// Run often a month ago, but only once today
+	monthAgo := time.Now().AddDate(0, -1, 0)
+	for range 10 {
+		record := rt.NewRecord("git stash", "/src", 0, monthAgo)
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+	}
+	record := rt.NewRecord("git status", "/src", 0, time.Now())
+	if err := database.Insert(&record); err != nil {
+		t.Fatalf("Insert() unexpected error = %v", err)
+	}
+
+	if got := completions(t, database, "git st"); len(got) != 2 || got[0] != "git status" {
+		t.Fatalf("Complete() = %q, want git status first", got)
+	}
+
+	// Age every run as if they were all stored a month ago and never decayed
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer raw.Close()
+	// Written as text in the format retour stores times in, whichever driver is built in
+	aged := monthAgo.Format("2006-01-02 15:04:05.999999999-07:00")
+	if _, err := raw.Exec("UPDATE history SET timestamp = ? WHERE command = 'git'", aged); err != nil {
+		t.Fatalf("Failed to age records: %v", err)
+	}
+	if _, err := raw.Exec("UPDATE history SET score = 1.0"); err != nil {
+		t.Fatalf("Failed to reset scores: %v", err)
+	}
+	record = rt.NewRecord("git stash pop", "/src", 0, time.Now())
+	if err := database.Insert(&record); err != nil {
+		t.Fatalf("Insert() unexpected error = %v", err)
+	}
+	if got := completions(t, database, "git st"); got[0] != "git stash" {
+		t.Fatalf("Complete() before decaying = %q, want the stale git stash first", got)
+	}
+
+	if err := database.Decay(); err != nil {
+		t.Fatalf("Decay() unexpected error = %v", err)
+	}
+	if got := completions(t, database, "git st"); got[0] != "git stash pop" {
+		t.Errorf("Complete() after decaying = %q, want git stash pop first", got)
+	}
+}
+
+func TestDecayIfStale(t *testing.T) {
+	database := openTestDB(t)
+
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		want   bool
+	}{
+		{name: "Never decayed", maxAge: time.Hour, want: true},
+		{name: "Just decayed", maxAge: time.Hour, want: false},
+		{name: "Stale", maxAge: 0, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := database.DecayIfStale(tt.maxAge)
+			if err != nil {
+				t.Fatalf("DecayIfStale() unexpected error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("DecayIfStale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecayBackfillsScores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Exec(`
+	CREATE TABLE history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		command TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		working_directory TEXT,
+		exit_status INTEGER NOT NULL,
+		arguments TEXT
+	);
+	INSERT INTO history (command, timestamp, working_directory, exit_status, arguments)
+	VALUES ('ls', '2024-01-01 00:00:00', '/', 0, '-la');
+	`)
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to open old database: %v", err)
+	}
+	defer database.Close()
+
+	var score float64
+	if err := conn.QueryRow("SELECT score FROM history").Scan(&score); err != nil {
+		t.Fatalf("Failed to read score: %v", err)
+	}
+	if score <= 0 || score >= 0.01 {
+		t.Errorf("Migrated score = %v, want that of a run years ago", score)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+// TopDirectories returns the working directories commands were run in,
+// ranked by frecency, with the number of commands run in each.
+func (db *DB) TopDirectories(limit int) ([]Count, error) {
+	rows, err := db.reader.Query(`
+	SELECT working_directory, COUNT(*)
+	FROM history
+	WHERE COALESCE(working_directory, '') != ''
+	GROUP BY working_directory
+	ORDER BY `+frecencyScore+` DESC
+	LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dirs []Count
+	for rows.Next() {
+		var c Count
+		if err := rows.Scan(&c.Name, &c.Count); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, c)
+	}
+
+	return dirs, rows.Err()
+}
+
+// unsafeAliasChars matches characters which can't appear in an alias name
+var unsafeAliasChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// DirectoryAliases returns shell alias definitions which cd into each
+// directory, named after the directory's base name with the given prefix.
+// Clashing names are disambiguated with a numeric suffix.
+func DirectoryAliases(dirs []Count, prefix string) []string {
+	used := map[string]bool{}
+	var aliases []string
+	for _, dir := range dirs {
+		base := unsafeAliasChars.ReplaceAllString(filepath.Base(dir.Name), "_")
+		name := prefix + base
+		for i := 2; used[name]; i++ {
+			name = fmt.Sprintf("%s%s%d", prefix, base, i)
+		}
+		used[name] = true
+
+		aliases = append(aliases, fmt.Sprintf("alias %s=%s", name, shellQuote("cd "+shellQuote(dir.Name))))
+	}
+	return aliases
+}
+
+// CDPathCandidates returns the distinct parents of the directories, in rank
+// order, as these are where the frequently visited directories can be found.
+func CDPathCandidates(dirs []Count) []string {
+	seen := map[string]bool{}
+	var parents []string
+	for _, dir := range dirs {
+		parent := filepath.Dir(dir.Name)
+		if !seen[parent] {
+			seen[parent] = true
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+// runDirs implements the dirs subcommand
+func runDirs(config *Config, args []string) error {
+	flags := flag.NewFlagSet("dirs", flag.ContinueOnError)
+	flags.Bool("top", true, "List the most frecent directories with their command counts")
+	aliases := flags.Bool("aliases", false, "Print shell aliases which cd into each directory")
+	prefix := flags.String("alias-prefix", "cd-", "Prefix for the generated alias names")
+	cdpath := flags.Bool("cdpath", false, "Print a CDPATH assignment built from the directories' parents")
+	count := flags.Int("n", 10, "Number of directories to consider")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dirs, err := db.TopDirectories(*count)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *aliases:
+		for _, alias := range DirectoryAliases(dirs, *prefix) {
+			fmt.Println(alias)
+		}
+	case *cdpath:
+		fmt.Printf("export CDPATH=%s\n", shellQuote(strings.Join(append([]string{"."}, CDPathCandidates(dirs)...), ":")))
+	default:
+		return writeDirectories(os.Stdout, dirs)
+	}
+	return nil
+}
+
+// writeDirectories renders the directories as an aligned table
+func writeDirectories(w io.Writer, dirs []Count) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, dir := range dirs {
+		fmt.Fprintf(table, "%d\t%s\n", dir.Count, dir.Name)
+	}
+	return table.Flush()
+}
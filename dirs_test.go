@@ -0,0 +1,67 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestTopDirectories(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now()
+	history := []struct {
+		dir string
+		age time.Duration
+	}{
+		{dir: "/old/busy", age: 100 * 24 * time.Hour},
+		{dir: "/old/busy", age: 100 * 24 * time.Hour},
+		{dir: "/old/busy", age: 100 * 24 * time.Hour},
+		{dir: "/work/project", age: time.Hour},
+		{dir: "/work/project", age: 2 * time.Hour},
+		{dir: "/tmp", age: 3 * time.Hour},
+		{dir: "", age: time.Hour},
+	}
+	for _, h := range history {
+		record := rt.NewRecord("ls", h.dir, 0, now.Add(-h.age))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	dirs, err := database.TopDirectories(10)
+	if err != nil {
+		t.Fatalf("TopDirectories() unexpected error = %v", err)
+	}
+	checkCounts(t, "Directories", dirs, []rt.Count{{"/work/project", 2}, {"/tmp", 1}, {"/old/busy", 3}})
+}
+
+func TestDirectoryAliases(t *testing.T) {
+	dirs := []rt.Count{{Name: "/work/my project"}, {Name: "/other/my project"}, {Name: "/it's"}}
+
+	got := rt.DirectoryAliases(dirs, "cd-")
+	want := []string{
+		`alias cd-my_project='cd '\''/work/my project'\'''`,
+		`alias cd-my_project2='cd '\''/other/my project'\'''`,
+		`alias cd-it_s='cd '\''/it'\''\'\'''\''s'\'''`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("DirectoryAliases() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Alias %d = %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCDPathCandidates(t *testing.T) {
+	dirs := []rt.Count{{Name: "/work/a"}, {Name: "/home/me"}, {Name: "/work/b"}}
+
+	got := rt.CDPathCandidates(dirs)
+	want := []string{"/work", "/home"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("CDPathCandidates() = %q, want %q", got, want)
+	}
+}
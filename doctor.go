@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// HistoryDatabase is a retour database found where retour keeps, or once
+// kept, its history.
+type HistoryDatabase struct {
+	// Path is the absolute path of the database file
+	Path string
+	// Origin says why the path was looked at: "configured" for the one in
+	// use, "default" or "XDG_DATA_HOME"
+	Origin string
+	// Records is how many commands the database holds
+	Records int
+	// Modified is when the database file was last written
+	Modified time.Time
+	// Err is why the database could not be read, nil if it could
+	Err error
+}
+
+// InUse reports whether the database is the one the configuration uses
+func (h HistoryDatabase) InUse() bool {
+	return h.Origin == "configured"
+}
+
+// FindDatabases looks for history databases at the configured path, the
+// default path under home and the same path under $XDG_DATA_HOME, returning
+// those which exist with the configured one first. A path reached more than
+// once, e.g. because it is both configured and the default, is given once.
+func FindDatabases(configured, home string) []HistoryDatabase {
+	candidates := []struct{ path, origin string }{
+		{configured, "configured"},
+		{filepath.Join(home, getDefaultDBPath()), "default"},
+	}
+	if data := os.Getenv("XDG_DATA_HOME"); data != "" {
+		candidates = append(candidates, struct{ path, origin string }{
+			filepath.Join(data, "retour", filepath.Base(getDefaultDBPath())), "XDG_DATA_HOME",
+		})
+	}
+
+	var found []HistoryDatabase
+	var seen []os.FileInfo
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate.path)
+		if err != nil || info.IsDir() || sameFileAsAny(info, seen) {
+			continue
+		}
+		seen = append(seen, info)
+
+		path, err := filepath.Abs(candidate.path)
+		if err != nil {
+			path = candidate.path
+		}
+		database := HistoryDatabase{Path: path, Origin: candidate.origin, Modified: info.ModTime()}
+		database.Records, database.Err = countRecords(path)
+		found = append(found, database)
+	}
+	return found
+}
+
+// sameFileAsAny reports whether info describes the same file as any of files
+func sameFileAsAny(info os.FileInfo, files []os.FileInfo) bool {
+	for _, file := range files {
+		if os.SameFile(info, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// countRecords counts the commands in the database at path without
+// modifying it
+func countRecords(path string) (int, error) {
+	conn, err := sql.Open(sqliteDriver, "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var count int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM history").Scan(&count); err != nil {
+		return 0, fmt.Errorf("not a retour database: %w", err)
+	}
+	return count, nil
+}
+
+// MergeFrom stores the records of other which this database does not already
+// hold, matching them by host, session and timestamp as sync does, so merging
+// the same database twice is harmless. Returns how many records were stored
+// out of how many other holds.
+func (db *DB) MergeFrom(other *DB) (merged int, total int, err error) {
+	records, err := other.Query("SELECT * FROM history ORDER BY timestamp")
+	if err != nil {
+		return 0, 0, err
+	}
+	for i := range records {
+		// Record IDs mean nothing outside the database they came from
+		records[i].RerunOf = 0
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	stored, err := db.mergeRecords(tx, records)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	db.publishInserted(stored)
+	return len(stored), len(records), nil
+}
+
+// runDoctor implements the doctor subcommand, which looks for problems with
+// the setup, so far history split across several databases, or with --lint
+// for malformed records, which --fix normalises
+func runDoctor(config *Config, args []string) error {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	lint := flags.Bool("lint", false, "Look for malformed records instead")
+	fix := flags.Bool("fix", false, "Normalise the malformed records found by --lint")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: retour doctor [--lint [--fix]]")
+	}
+	if *fix && !*lint {
+		return fmt.Errorf("--fix needs --lint")
+	}
+	if *lint {
+		return lintHistory(config, *fix)
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to find home directory: %w", err)
+	}
+	if IsPostgres(config.ConnectionString) {
+		fmt.Println("History is stored in PostgreSQL")
+	}
+	writeDatabaseReport(os.Stdout, FindDatabases(config.ConnectionString, home))
+	return nil
+}
+
+// lintHistory reports the malformed records of the history, normalising
+// them if fix is set
+func lintHistory(config *Config, fix bool) error {
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var findings []LintFinding
+	if fix {
+		findings, err = db.FixLint()
+	} else {
+		findings, err = db.Lint()
+	}
+	if err != nil {
+		return err
+	}
+	writeLintReport(os.Stdout, findings, fix)
+	return nil
+}
+
+// writeDatabaseReport lists the history databases found and, when there is
+// more than one, how to merge the others into the one in use
+func writeDatabaseReport(w io.Writer, databases []HistoryDatabase) {
+	if len(databases) == 0 {
+		fmt.Fprintln(w, "No history database found, one is created when the first command is recorded")
+		return
+	}
+
+	fmt.Fprintln(w, "History databases:")
+	for _, database := range databases {
+		if database.Err != nil {
+			fmt.Fprintf(w, "  %s (%s): %v\n", database.Path, database.Origin, database.Err)
+			continue
+		}
+		fmt.Fprintf(w, "  %s (%s): %d records, last written %s\n",
+			database.Path, database.Origin, database.Records, database.Modified.Format(time.DateTime))
+	}
+
+	others := mergeCandidates(databases)
+	if len(others) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nHistory is split across %d databases, only the configured one is searched.\n", len(databases))
+	if len(databases) > len(others) {
+		fmt.Fprintln(w, "To bring it together, merge the others into it with:")
+	} else {
+		fmt.Fprintln(w, "None of them is the one configured, which does not exist yet. Merge them into it with:")
+	}
+	fmt.Fprintln(w, "  retour merge")
+}
+
+// mergeCandidates returns the readable databases other than the one in use
+func mergeCandidates(databases []HistoryDatabase) []HistoryDatabase {
+	var others []HistoryDatabase
+	for _, database := range databases {
+		if !database.InUse() && database.Err == nil {
+			others = append(others, database)
+		}
+	}
+	return others
+}
+
+// runMerge implements the merge subcommand, which merges other retour
+// databases into the one in use. Without paths it offers each database the
+// doctor subcommand finds, asking before merging unless --yes is given.
+func runMerge(config *Config, args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "Merge without asking first")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to find home directory: %w", err)
+		}
+		for _, database := range mergeCandidates(FindDatabases(config.ConnectionString, home)) {
+			paths = append(paths, database.Path)
+		}
+		if len(paths) == 0 {
+			fmt.Println("No other history databases found")
+			return nil
+		}
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, path := range paths {
+		if err := mergeDatabase(db, config, path, *yes); err != nil {
+			return fmt.Errorf("failed to merge %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// mergeDatabase merges the database at path into db, once confirmed
+func mergeDatabase(db *DB, config *Config, path string, yes bool) error {
+	count, err := countRecords(path)
+	if err != nil {
+		return err
+	}
+	question := fmt.Sprintf("Merge them into %s?", config.ConnectionString)
+	if !yes && !confirm(os.Stdin, os.Stderr, fmt.Sprintf("%s holds %d records.", path, count), question) {
+		fmt.Printf("Skipped %s\n", path)
+		return nil
+	}
+
+	// The other database is opened like this one, so it is decrypted with
+	// the same key, and its schema brought up to date to read it
+	other := *config
+	other.ConnectionString = path
+	source, err := openDB(&other)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	merged, total, err := db.MergeFrom(source)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Merged %d of %d records from %s, which can now be removed\n", merged, total, path)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main_test
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+// createHistory creates a database at path holding a record for each line
+func createHistory(t *testing.T, path string, lines ...string) *rt.DB {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	for i, line := range lines {
+		record := rt.NewRecord(line, "/", 0, time.Now().Add(time.Duration(i)*time.Second))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+	return database
+}
+
+func TestFindDatabases(t *testing.T) {
+	home := t.TempDir()
+	data := t.TempDir()
+	t.Setenv("XDG_DATA_HOME", data)
+
+	configured := filepath.Join(home, "history", "retour.db")
+	createHistory(t, configured, "ls")
+	createHistory(t, filepath.Join(home, ".local", "share", "retour", "history.db"), "make", "make test")
+	if err := os.MkdirAll(filepath.Join(data, "retour"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, "retour", "history.db"), []byte("not sqlite"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	found := rt.FindDatabases(configured, home)
+	if len(found) != 3 {
+		t.Fatalf("FindDatabases() = %+v, want 3 databases", found)
+	}
+	if !found[0].InUse() || found[0].Records != 1 || found[0].Err != nil {
+		t.Errorf("found[0] = %+v, want the configured database with 1 record", found[0])
+	}
+	if found[1].Origin != "default" || found[1].Records != 2 || found[1].Err != nil {
+		t.Errorf("found[1] = %+v, want the default database with 2 records", found[1])
+	}
+	if found[2].Origin != "XDG_DATA_HOME" || found[2].Err == nil {
+		t.Errorf("found[2] = %+v, want the unreadable XDG database", found[2])
+	}
+
+	// The configured database at the default path is only found once
+	found = rt.FindDatabases(filepath.Join(home, ".local", "share", "retour", "history.db"), home)
+	if len(found) != 2 || !found[0].InUse() || found[0].Records != 2 {
+		t.Errorf("FindDatabases() = %+v, want the default database once, in use", found)
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+	dir := t.TempDir()
+	into := createHistory(t, filepath.Join(dir, "into.db"), "ls")
+	from := createHistory(t, filepath.Join(dir, "from.db"), "make", "make test")
+
+	merged, total, err := into.MergeFrom(from)
+	if err != nil || merged != 2 || total != 2 {
+		t.Fatalf("MergeFrom() = %d, %d, %v, want 2 of 2 merged", merged, total, err)
+	}
+	records, err := into.Query("SELECT * FROM history ORDER BY timestamp")
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Query() = %d records, %v, want 3", len(records), err)
+	}
+
+	merged, total, err = into.MergeFrom(from)
+	if err != nil || merged != 0 || total != 2 {
+		t.Errorf("MergeFrom() again = %d, %d, %v, want none of 2 merged", merged, total, err)
+	}
+}
+
+func TestLint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	database := createHistory(t, path, "ls", "make", "git status", "go test", "vim")
+
+	// Corrupt the records as old importers did
+	raw, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer raw.Close()
+	for _, statement := range []string{
+		"UPDATE history SET timestamp = '0001-01-01 00:00:00+00:00' WHERE id = 2",
+		"UPDATE history SET command = ' ' WHERE id = 3",
+		"UPDATE history SET arguments = CAST(x'66ff6f' AS TEXT) WHERE id = 4",
+		"UPDATE history SET duration = 86400000000000 WHERE id = 5",
+		"UPDATE history SET rerun_of = 3 WHERE id = 5",
+	} {
+		if _, err := raw.Exec(statement); err != nil {
+			t.Fatalf("Failed to corrupt records: %v", err)
+		}
+	}
+
+	findings, err := database.Lint()
+	if err != nil {
+		t.Fatalf("Lint() unexpected error = %v", err)
+	}
+	want := []rt.LintFinding{
+		{ID: 2, Problem: rt.ZeroTimestamp},
+		{ID: 3, Problem: rt.EmptyCommand},
+		{ID: 4, Problem: rt.InvalidUTF8},
+		{ID: 5, Problem: rt.AbsurdDuration},
+	}
+	if len(findings) != len(want) {
+		t.Fatalf("Lint() = %+v, want %+v", findings, want)
+	}
+	for i, finding := range findings {
+		if finding.ID != want[i].ID || finding.Problem != want[i].Problem {
+			t.Errorf("Lint()[%d] = %+v, want %+v", i, finding, want[i])
+		}
+	}
+
+	database.SetImmutable(true)
+	if _, err := database.FixLint(); !errors.Is(err, rt.ErrImmutable) {
+		t.Errorf("FixLint() of immutable history error = %v, want %v", err, rt.ErrImmutable)
+	}
+	database.SetImmutable(false)
+
+	fixed, err := database.FixLint()
+	if err != nil {
+		t.Fatalf("FixLint() unexpected error = %v", err)
+	}
+	for _, finding := range fixed {
+		if finding.Fix == "" {
+			t.Errorf("FixLint() left %+v", finding)
+		}
+	}
+	if findings, err := database.Lint(); err != nil || len(findings) != 0 {
+		t.Errorf("Lint() after fixing = %+v, %v, want nothing found", findings, err)
+	}
+
+	records, err := database.Query("SELECT * FROM history ORDER BY id")
+	if err != nil || len(records) != 4 {
+		t.Fatalf("Query() after fixing = %d records, %v, want the 4 with a command", len(records), err)
+	}
+	if !records[1].Timestamp.Equal(records[0].Timestamp) {
+		t.Errorf("Timestamp of record 2 = %v, want that of record 1, %v", records[1].Timestamp, records[0].Timestamp)
+	}
+	if records[2].Arguments != "f\uFFFDo" {
+		t.Errorf("Arguments of record 4 = %q, want the invalid byte replaced", records[2].Arguments)
+	}
+	if records[3].Duration != 0 || records[3].RerunOf != 0 {
+		t.Errorf("Record 5 = %+v, want no duration and no longer a rerun of the removed record", records[3])
+	}
+}
@@ -0,0 +1,576 @@
+package main_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	rt "github.com/nuchs/retour"
+	"github.com/nuchs/retour/proto/retourv1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The end to end tests build retour, install its hooks into a real shell
+// running in a scratch home directory, drive the shell with commands and then
+// check what reached the database and what searching it returns. They are
+// skipped with -short and for shells which are not installed.
+
+var (
+	buildOnce sync.Once
+	binDir    string
+	buildErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if binDir != "" {
+		os.RemoveAll(binDir)
+	}
+	os.Exit(code)
+}
+
+// e2e is a scratch home directory with retour on the PATH
+type e2e struct {
+	home string
+	path string
+}
+
+// newE2E builds retour, once per test run, and creates a home for it
+func newE2E(t *testing.T) *e2e {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("Skipping end to end test in short mode")
+	}
+
+	buildOnce.Do(func() {
+		binDir, buildErr = os.MkdirTemp("", "retour-e2e-*")
+		if buildErr != nil {
+			return
+		}
+		out, err := exec.Command("go", "build", "-o", filepath.Join(binDir, "retour"), ".").CombinedOutput()
+		if err != nil {
+			buildErr = fmt.Errorf("%v\n%s", err, out)
+		}
+	})
+	if buildErr != nil {
+		t.Fatalf("Failed to build retour: %v", buildErr)
+	}
+
+	return &e2e{home: t.TempDir(), path: binDir + ":/usr/local/bin:/usr/bin:/bin"}
+}
+
+// env returns the minimal environment the shells and retour run with
+func (e *e2e) env(extra ...string) []string {
+	return append([]string{"HOME=" + e.home, "PATH=" + e.path, "TERM=dumb"}, extra...)
+}
+
+// shell runs an interactive shell with the retour hooks installed, typing
+// each command in turn in dir, then exiting
+func (e *e2e) shell(t *testing.T, shell, dir string, commands ...string) {
+	t.Helper()
+	binary, err := exec.LookPath(shell)
+	if err != nil {
+		t.Skipf("%s is not installed", shell)
+	}
+
+	var cmd *exec.Cmd
+	switch shell {
+	case "bash":
+		rc := filepath.Join(e.home, ".bashrc")
+		e.writeFile(t, rc, `eval "$(retour init bash)"`+"\n")
+		cmd = exec.Command(binary, "--rcfile", rc, "-i")
+		cmd.Env = e.env("HISTFILE=" + filepath.Join(e.home, ".bash_history"))
+	case "zsh":
+		e.writeFile(t, filepath.Join(e.home, ".zshrc"), `eval "$(retour init zsh)"`+"\n")
+		cmd = exec.Command(binary, "-i")
+		cmd.Env = e.env("ZDOTDIR=" + e.home)
+	default:
+		t.Fatalf("Unsupported shell %s", shell)
+	}
+
+	var output bytes.Buffer
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(strings.Join(append(commands, "exit"), "\n") + "\n")
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%s failed: %v\n%s", shell, err, output.String())
+	}
+}
+
+// retour runs the built binary and returns its standard output
+func (e *e2e) retour(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	return e.pipe(t, "", args...)
+}
+
+// pipe is like retour but with input as the binary's standard input
+func (e *e2e) pipe(t *testing.T, input string, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command(filepath.Join(binDir, "retour"), args...)
+	cmd.Env = e.env()
+	cmd.Dir = e.home
+	cmd.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return string(out), fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	return string(out), nil
+}
+
+// db opens the database retour keeps in the home directory
+func (e *e2e) db(t *testing.T) *rt.DB {
+	t.Helper()
+	database, err := rt.NewDB(filepath.Join(e.home, ".local", "share", "retour", "history.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+	return database
+}
+
+// waitForRecords waits for the hooks, which record in the background, to
+// store want records and returns them oldest first
+func (e *e2e) waitForRecords(t *testing.T, database *rt.DB, want int) []rt.Record {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		records, err := database.Query("SELECT * FROM history ORDER BY id")
+		if err != nil {
+			t.Fatalf("Query() unexpected error = %v", err)
+		}
+		if len(records) >= want || time.Now().After(deadline) {
+			if len(records) != want {
+				t.Fatalf("Recorded %d commands %+v, want %d", len(records), records, want)
+			}
+			return records
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (e *e2e) writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestE2ERecord(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh"} {
+		t.Run(shell, func(t *testing.T) {
+			e := newE2E(t)
+			project := filepath.Join(e.home, "project")
+			if err := os.Mkdir(project, 0o755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+
+			e.shell(t, shell, e.home,
+				"true",
+				"false",
+				"cd project",
+				"echo 'hello world'",
+				"echo --password=hunter2",
+			)
+
+			database := e.db(t)
+			records := e.waitForRecords(t, database, 5)
+
+			// The hooks record in the background so may finish out of order
+			want := map[string]struct {
+				dir    string
+				status int
+			}{
+				"true":               {e.home, 0},
+				"false":              {e.home, 1},
+				"cd project":         {e.home, 0},
+				"echo 'hello world'": {project, 0},
+				// Secrets are scrubbed before they reach the database
+				"echo --password=REDACTED": {project, 0},
+			}
+			for _, r := range records {
+				w, ok := want[r.CommandLine()]
+				if !ok {
+					t.Errorf("Unexpected record %q", r.CommandLine())
+					continue
+				}
+				if r.WorkingDirectory != w.dir || r.ExitStatus != w.status {
+					t.Errorf("%q recorded in %s with status %d, want %s with %d",
+						r.CommandLine(), r.WorkingDirectory, r.ExitStatus, w.dir, w.status)
+				}
+				if r.Session == "" || r.Session != records[0].Session {
+					t.Errorf("%q recorded in session %q, want all in one session", r.CommandLine(), r.Session)
+				}
+			}
+
+			sessions, err := database.Sessions(10)
+			if err != nil {
+				t.Fatalf("Sessions() unexpected error = %v", err)
+			}
+			if len(sessions) != 1 {
+				t.Fatalf("Sessions() = %+v, want 1", sessions)
+			}
+			s := sessions[0]
+			if s.Shell != shell || s.Commands != 5 || s.End.IsZero() || s.InitialDir != e.home {
+				t.Errorf("Session = %+v, want an ended %s session of 5 commands started in %s", s, shell, e.home)
+			}
+		})
+	}
+}
+
+func TestE2ESearch(t *testing.T) {
+	e := newE2E(t)
+	e.shell(t, "bash", e.home,
+		"echo terraform plan",
+		"echo terraform apply",
+		"ls",
+	)
+	database := e.db(t)
+	e.waitForRecords(t, database, 3)
+
+	// Headless, as scripts search
+	out, err := e.retour(t, "pick", "--filter", "terraform apply", "--first")
+	if err != nil {
+		t.Fatalf("pick failed: %v", err)
+	}
+	if out != "echo terraform apply\n" {
+		t.Errorf("pick = %q, want %q", out, "echo terraform apply\n")
+	}
+
+	out, err = e.retour(t, "pick", "--filter", "terraform")
+	if err != nil {
+		t.Fatalf("pick failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	slices.Sort(lines)
+	if !slices.Equal(lines, []string{"echo terraform apply", "echo terraform plan"}) {
+		t.Errorf("pick = %q, want both terraform commands", out)
+	}
+
+	if _, err := e.retour(t, "pick", "--filter", "nothing like it"); err == nil {
+		t.Error("pick without a match succeeded, want an error")
+	}
+
+	// Through the picker, typing a filter and choosing the top match
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 100)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	program := tea.NewProgram(rt.NewUI(rt.NewFilter(records)),
+		tea.WithInput(strings.NewReader("apply\r")),
+		tea.WithOutput(io.Discard),
+		tea.WithoutSignalHandler(),
+	)
+	final, err := program.Run()
+	if err != nil {
+		t.Fatalf("Run() unexpected error = %v", err)
+	}
+	selected := final.(rt.Model).SelectedAll()
+	if len(selected) != 1 || selected[0].CommandLine() != "echo terraform apply" {
+		t.Errorf("Picked %+v, want echo terraform apply", selected)
+	}
+}
+
+func TestE2ERecordStream(t *testing.T) {
+	e := newE2E(t)
+	stream := `{"command": "make test", "working_directory": "/src/app", "exit_status": 2, "session": "ci-41"}
+
+{"command": "go", "arguments": "build ./...", "timestamp": "2024-05-01T10:00:00Z", "session": "ci-41"}
+{"cmd": "typo"}
+not json
+{"command": "deploy --token=abc123", "session": "ci-41"}
+`
+	_, err := e.pipe(t, stream, "record", "--stdin", "--format", "ndjson")
+	if err == nil || !strings.Contains(err.Error(), "line 4: json: unknown field \"cmd\"") || !strings.Contains(err.Error(), "line 5:") {
+		t.Errorf("record --stdin error = %v, want lines 4 and 5 reported", err)
+	}
+
+	records := e.waitForRecords(t, e.db(t), 3)
+	got := map[string]rt.Record{}
+	for _, r := range records {
+		got[r.CommandLine()] = r
+	}
+	if r := got["make test"]; r.ExitStatus != 2 || r.WorkingDirectory != "/src/app" || r.Session != "ci-41" {
+		t.Errorf("make test recorded as %+v", r)
+	}
+	if r := got["go build ./..."]; !r.Timestamp.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("go build recorded at %v", r.Timestamp)
+	}
+	if _, ok := got["deploy --token=REDACTED"]; !ok {
+		t.Errorf("Recorded %v, want the deploy token redacted", got)
+	}
+}
+
+func TestE2ERecordStreamTooLong(t *testing.T) {
+	e := newE2E(t)
+	// The records before a line too long to read are still stored
+	stream := `{"command": "make test"}
+{"command": "make lint"}
+{"command": "make build"}
+{"command": "echo ` + strings.Repeat("x", 2<<20) + `"}
+`
+	_, err := e.pipe(t, stream, "record", "--stdin")
+	if err == nil || !strings.Contains(err.Error(), "token too long") || !strings.Contains(err.Error(), "Recorded 3 records") {
+		t.Errorf("record --stdin of a line too long error = %v, want it reported after 3 records", err)
+	}
+	e.waitForRecords(t, e.db(t), 3)
+}
+
+func TestE2ERecordStreamSignalled(t *testing.T) {
+	e := newE2E(t)
+	cmd := exec.Command(filepath.Join(binDir, "retour"), "record", "--stdin")
+	cmd.Env = e.env()
+	cmd.Dir = e.home
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start record --stdin: %v", err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	// The invalid line is reported once the records before it are queued,
+	// well short of a full batch, and the stream is left open
+	fmt.Fprintln(stdin, `{"command": "make test", "session": "ci-42"}`)
+	fmt.Fprintln(stdin, `{"command": "make lint", "session": "ci-42"}`)
+	fmt.Fprintln(stdin, `not json`)
+	errs := bufio.NewReader(stderr)
+	if line, err := errs.ReadString('\n'); err != nil || !strings.HasPrefix(line, "line 3:") {
+		t.Fatalf("record --stdin reported %q, %v, want line 3", line, err)
+	}
+
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to signal record --stdin: %v", err)
+	}
+	rest, _ := io.ReadAll(errs)
+	var exitErr *exec.ExitError
+	if err := cmd.Wait(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 130 {
+		t.Errorf("record --stdin signalled exited with %v, want status 130", err)
+	}
+	if !strings.Contains(string(rest), "Stopped after recording 2 records") {
+		t.Errorf("record --stdin signalled reported %q, want it stopped after 2 records", rest)
+	}
+	e.waitForRecords(t, e.db(t), 2)
+}
+
+func TestE2EDaemon(t *testing.T) {
+	e := newE2E(t)
+	daemon, socket, output := e.daemon(t)
+
+	e.shell(t, "bash", e.home, "false", "echo one", "echo two")
+	out, err := e.retour(t, "pick", "--filter", "echo")
+	if err != nil {
+		t.Fatalf("pick failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	slices.Sort(lines)
+	if !slices.Equal(lines, []string{"echo one", "echo two"}) {
+		t.Errorf("pick through the daemon = %q, want both echoes", out)
+	}
+
+	if err := daemon.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("Failed to stop daemon: %v", err)
+	}
+	if err := daemon.Wait(); err != nil {
+		t.Fatalf("Daemon exited with %v:\n%s", err, output.String())
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Socket left behind: %v", err)
+	}
+	e.waitForRecords(t, e.db(t), 3)
+}
+
+// lockedBuffer collects a process's output while the test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// daemon starts retour daemon, returning once it listens on its socket
+func (e *e2e) daemon(t *testing.T, args ...string) (daemon *exec.Cmd, socket string, output *lockedBuffer) {
+	t.Helper()
+	socket = filepath.Join(e.home, ".local", "share", "retour", "retour.sock")
+	daemon = exec.Command(filepath.Join(binDir, "retour"), append([]string{"daemon"}, args...)...)
+	daemon.Env = e.env()
+	output = &lockedBuffer{}
+	daemon.Stdout, daemon.Stderr = output, output
+	if err := daemon.Start(); err != nil {
+		t.Fatalf("Failed to start daemon: %v", err)
+	}
+	t.Cleanup(func() { daemon.Process.Kill() })
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(socket); err == nil {
+			return daemon, socket, output
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Daemon did not start listening:\n%s", output.String())
+		}
+	}
+}
+
+func TestE2EDaemonReload(t *testing.T) {
+	e := newE2E(t)
+	daemon, _, output := e.daemon(t)
+
+	// SIGHUP applies the exclusion pattern added since the daemon started
+	configDir := filepath.Join(e.home, ".config", "retour")
+	if err := os.MkdirAll(configDir, 0o700); err != nil {
+		t.Fatalf("Failed to create config directory: %v", err)
+	}
+	e.writeFile(t, filepath.Join(configDir, "config.toml"), "exclusion_patterns = [\"^secret\"]\n")
+	if err := daemon.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Failed to signal daemon: %v", err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); !strings.Contains(output.String(), "Reloaded the config"); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Daemon did not reload the config:\n%s", output.String())
+		}
+	}
+	for _, line := range []string{"secret token", "echo visible"} {
+		if _, err := e.retour(t, "send", "--timeout", "2s", "--", line); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+	}
+
+	// SIGTERM stops it once what it received is stored
+	if err := daemon.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to stop daemon: %v", err)
+	}
+	if err := daemon.Wait(); err != nil {
+		t.Fatalf("Daemon exited with %v:\n%s", err, output.String())
+	}
+	if records := e.waitForRecords(t, e.db(t), 1); records[0].CommandLine() != "echo visible" {
+		t.Errorf("Recorded %+v, want only the command not excluded", records)
+	}
+}
+
+func TestE2EDaemonLimits(t *testing.T) {
+	e := newE2E(t)
+	configDir := filepath.Join(e.home, ".config", "retour")
+	if err := os.MkdirAll(configDir, 0o700); err != nil {
+		t.Fatalf("Failed to create config directory: %v", err)
+	}
+	e.writeFile(t, filepath.Join(configDir, "config.toml"), "[daemon]\nrequests_per_second = 0.01\nburst = 1\n")
+	_, socket, _ := e.daemon(t)
+	for _, line := range []string{"echo one", "echo two"} {
+		if _, err := e.retour(t, "send", "--timeout", "2s", "--", line); err != nil {
+			t.Fatalf("send failed: %v", err)
+		}
+	}
+
+	// This process uses up its limit
+	client := dial(t, socket)
+	search := rt.Search{Result: rt.AllResults}
+	if _, err := client.Search(search); err != nil {
+		t.Fatalf("Search() unexpected error = %v", err)
+	}
+	if _, err := client.Search(search); err == nil || !strings.Contains(err.Error(), "too many requests") {
+		t.Fatalf("Search() beyond the burst error = %v, want too many requests", err)
+	}
+
+	// Other processes each have limits of their own
+	for range 2 {
+		if out, err := e.retour(t, "pick", "--first"); err != nil || strings.TrimSpace(out) != "echo two" {
+			t.Errorf("pick in another process = %q, %v, want echo two", out, err)
+		}
+	}
+}
+
+func TestE2EDaemonGRPC(t *testing.T) {
+	e := newE2E(t)
+	grpcSocket := filepath.Join(e.home, "grpc.sock")
+	daemon, _, output := e.daemon(t, "--grpc", grpcSocket)
+	for deadline := time.Now().Add(10 * time.Second); !strings.Contains(output.String(), "Serving gRPC on "+grpcSocket); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Daemon did not serve gRPC:\n%s", output.String())
+		}
+	}
+
+	client, conn, err := rt.DialGRPC(grpcSocket)
+	if err != nil {
+		t.Fatalf("DialGRPC() unexpected error = %v", err)
+	}
+	defer conn.Close()
+	record := &retourv1.Record{Command: "echo", Arguments: "from an editor", Timestamp: timestamppb.Now(), WorkingDirectory: e.home}
+	if _, err := client.Insert(context.Background(), &retourv1.InsertRequest{Record: record}); err != nil {
+		t.Fatalf("Insert() unexpected error = %v", err)
+	}
+	if out, err := e.retour(t, "pick", "--first"); err != nil || strings.TrimSpace(out) != "echo from an editor" {
+		t.Errorf("pick after a gRPC insert = %q, %v, want echo from an editor", out, err)
+	}
+
+	if err := daemon.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Failed to signal daemon: %v", err)
+	}
+	if err := daemon.Wait(); err != nil {
+		t.Fatalf("Daemon exited with %v:\n%s", err, output.String())
+	}
+	if _, err := os.Stat(grpcSocket); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("gRPC socket after stopping: Stat() error = %v, want not exist", err)
+	}
+}
+
+func TestE2ERerunPropagateExit(t *testing.T) {
+	e := newE2E(t)
+	if err := os.MkdirAll(filepath.Join(e.home, ".local", "share", "retour"), 0o700); err != nil {
+		t.Fatalf("Failed to create database directory: %v", err)
+	}
+	database := e.db(t)
+	original := rt.NewRecord(`sh -c 'echo replayed; exit 3'`, e.home, 3, time.Now())
+	if err := database.Insert(&original); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+	id := fmt.Sprint(original.ID)
+
+	// Without the option the rerun succeeds whatever the command did
+	if _, err := e.retour(t, "rerun", id); err != nil {
+		t.Fatalf("rerun failed: %v", err)
+	}
+
+	out, err := e.retour(t, "rerun", "--propagate-exit", id)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("rerun --propagate-exit error = %v, want exit status 3", err)
+	}
+	// Anything written to stderr follows the exit status in the error
+	if out != "replayed\n" || err.Error() != exitErr.Error()+": " {
+		t.Errorf("rerun --propagate-exit wrote %q with error %q, want only the command's output", out, err)
+	}
+
+	records := e.waitForRecords(t, database, 3)
+	if r := records[2]; r.RerunOf != original.ID || r.ExitStatus != 3 {
+		t.Errorf("Rerun recorded as %+v", r)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import "sync"
+
+// Event is something which happened to the history or the setup, published
+// on a Bus so that the parts of retour which care, such as the picker and
+// the daemon, can react without the part it happened in knowing of them.
+// Events are only seen within the process they happen in. The rollup table
+// is kept in step by triggers rather than events for that reason, as other
+// processes write to the database too.
+type Event interface {
+	event()
+}
+
+// RecordsInserted is published once records are stored, whether recorded,
+// imported, merged or pulled by sync.
+type RecordsInserted struct {
+	// Records are those stored, with their IDs
+	Records []Record
+}
+
+// RecordsDeleted is published once records are removed, whether pruned by
+// the retention policy or removed by doctor --lint --fix.
+type RecordsDeleted struct {
+	// Count is how many were removed
+	Count int
+}
+
+// ConfigReloaded is published when the configuration is read again while
+// retour is running.
+type ConfigReloaded struct {
+	// Config is the configuration now in effect
+	Config *Config
+}
+
+// SyncCompleted is published once a push or pull of sync has finished.
+type SyncCompleted struct {
+	// Remote is where the records were exchanged through
+	Remote string
+	// Pushed and Pulled are how many records were sent and stored
+	Pushed int
+	Pulled int
+}
+
+func (RecordsInserted) event() {}
+func (RecordsDeleted) event()  {}
+func (ConfigReloaded) event()  {}
+func (SyncCompleted) event()   {}
+
+// Bus delivers the events published on it to its subscribers. A nil Bus
+// drops them.
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[int]func(Event)
+	next        int
+}
+
+// NewBus creates a bus without subscribers
+func NewBus() *Bus {
+	return &Bus{subscribers: map[int]func(Event){}}
+}
+
+// Subscribe calls fn with each event published until the returned function
+// is called. Events are delivered in the order they were published, on the
+// publisher's goroutine, so fn must not block or publish itself.
+func (b *Bus) Subscribe(fn func(Event)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// Channel subscribes to the events with a channel holding up to size of
+// them, for subscribers which handle events in their own time. Events
+// published while it is full are dropped.
+func (b *Bus) Channel(size int) (events <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, size)
+	unsubscribe = b.Subscribe(func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	})
+	return ch, unsubscribe
+}
+
+// Publish delivers event to the subscribers
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, fn := range b.subscribers {
+		fn(event)
+	}
+}
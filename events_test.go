@@ -0,0 +1,67 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestBus(t *testing.T) {
+	bus := rt.NewBus()
+	var got []rt.Event
+	unsubscribe := bus.Subscribe(func(e rt.Event) { got = append(got, e) })
+	events, stop := bus.Channel(1)
+	defer stop()
+
+	bus.Publish(rt.RecordsDeleted{Count: 1})
+	bus.Publish(rt.RecordsDeleted{Count: 2})
+	unsubscribe()
+	bus.Publish(rt.RecordsDeleted{Count: 3})
+
+	if len(got) != 2 || got[0] != (rt.RecordsDeleted{Count: 1}) || got[1] != (rt.RecordsDeleted{Count: 2}) {
+		t.Errorf("Subscriber got %v, want the 2 events published before unsubscribing", got)
+	}
+	// The channel holds one event, those published while it is full are dropped
+	if e := <-events; e != (rt.RecordsDeleted{Count: 1}) {
+		t.Errorf("Channel got %v, want the first event", e)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("Channel got %v once full, want it dropped", e)
+	default:
+	}
+
+	var none *rt.Bus
+	none.Publish(rt.RecordsDeleted{Count: 1})
+}
+
+func TestDBEvents(t *testing.T) {
+	database := openTestDB(t)
+	var got []rt.Event
+	database.Events().Subscribe(func(e rt.Event) { got = append(got, e) })
+
+	old := rt.NewRecord("ls", "/tmp", 0, time.Now().Add(-48*time.Hour))
+	if err := database.Insert(&old); err != nil {
+		t.Fatalf("Insert() unexpected error = %v", err)
+	}
+	if _, err := database.Import([]rt.Record{rt.NewRecord("make", "/src", 0, time.Now())}); err != nil {
+		t.Fatalf("Import() unexpected error = %v", err)
+	}
+	if _, err := database.Prune(time.Now().Add(-24 * time.Hour)); err != nil {
+		t.Fatalf("Prune() unexpected error = %v", err)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("Events = %+v, want 2 insertions and a deletion", got)
+	}
+	for i, command := range []string{"ls", "make"} {
+		inserted, ok := got[i].(rt.RecordsInserted)
+		if !ok || len(inserted.Records) != 1 || inserted.Records[0].Command != command || inserted.Records[0].ID == 0 {
+			t.Errorf("Event %d = %+v, want %s inserted with its ID", i, got[i], command)
+		}
+	}
+	if got[2] != (rt.RecordsDeleted{Count: 1}) {
+		t.Errorf("Event 2 = %+v, want 1 record deleted", got[2])
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+)
+
+// ExitClass groups exit statuses by what they usually mean, as the numbers
+// themselves are hard to remember.
+type ExitClass string
+
+const (
+	// SuccessClass is the class of a status of 0
+	SuccessClass ExitClass = "success"
+	// UsageErrorClass is the class of a status of 2, which commands return
+	// when misused, such as given an unknown flag
+	UsageErrorClass ExitClass = "usage-error"
+	// PermissionClass is the class of a status of 126, which shells return
+	// for a command which could not be run, such as one not executable
+	PermissionClass ExitClass = "permission"
+	// NotFoundClass is the class of a status of 127, which shells return for
+	// a command which does not exist
+	NotFoundClass ExitClass = "not-found"
+	// SignalClass is the class of statuses of 128 and above, which shells
+	// return for a command killed by a signal, 128 plus its number
+	SignalClass ExitClass = "signal"
+	// ErrorClass is the class of every other status
+	ErrorClass ExitClass = "error"
+)
+
+// ClassifyExit returns the class of an exit status
+func ClassifyExit(status int) ExitClass {
+	switch {
+	case status == 0:
+		return SuccessClass
+	case status == 2:
+		return UsageErrorClass
+	case status == 126:
+		return PermissionClass
+	case status == 127:
+		return NotFoundClass
+	case status >= 128:
+		return SignalClass
+	}
+	return ErrorClass
+}
+
+// exitClassSQL is the SQL for the class of a record's exit status, as
+// ClassifyExit gives it
+const exitClassSQL = `(CASE
+	WHEN exit_status = 0 THEN 'success'
+	WHEN exit_status = 2 THEN 'usage-error'
+	WHEN exit_status = 126 THEN 'permission'
+	WHEN exit_status = 127 THEN 'not-found'
+	WHEN exit_status >= 128 THEN 'signal'
+	ELSE 'error' END)`
+
+// classPrefix starts a word of the filter text which matches the records
+// whose exit status is of a class, rather than their command lines, so
+// "class:signal make" finds the builds which were interrupted
+const classPrefix = "class:"
+
+// splitClasses separates the class: words from one stage of the filter text,
+// returning the text left and, for each of those words, the classes it
+// names. A word may list alternatives separated by "|", as other words may.
+// Empty alternatives are ignored, so "class:" alone matches every record.
+// Classes are named in lower case, whatever the case of the word.
+func splitClasses(text string) (rest string, classes [][]string) {
+	if !strings.Contains(strings.ToLower(text), classPrefix) {
+		return text, nil
+	}
+
+	var words []string
+	for _, word := range strings.Split(text, " ") {
+		names, ok := strings.CutPrefix(strings.ToLower(word), classPrefix)
+		if !ok {
+			words = append(words, word)
+			continue
+		}
+		var alternatives []string
+		for _, name := range strings.Split(names, "|") {
+			if name != "" {
+				alternatives = append(alternatives, name)
+			}
+		}
+		if len(alternatives) > 0 {
+			classes = append(classes, alternatives)
+		}
+	}
+	return strings.Join(words, " "), classes
+}
+
+// matchesClasses reports whether an exit status is of one of the classes of
+// each class: word. A class matches when its name starts with the name
+// given, so a word still being typed, such as "class:sig", already matches.
+func matchesClasses(status int, classes [][]string) bool {
+	class := string(ClassifyExit(status))
+	for _, alternatives := range classes {
+		matched := false
+		for _, name := range alternatives {
+			if strings.HasPrefix(class, name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
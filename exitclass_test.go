@@ -0,0 +1,31 @@
+package main_test
+
+import (
+	"testing"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestClassifyExit(t *testing.T) {
+	tests := []struct {
+		status int
+		want   rt.ExitClass
+	}{
+		{0, rt.SuccessClass},
+		{1, rt.ErrorClass},
+		{2, rt.UsageErrorClass},
+		{3, rt.ErrorClass},
+		{125, rt.ErrorClass},
+		{126, rt.PermissionClass},
+		{127, rt.NotFoundClass},
+		{128, rt.SignalClass},
+		{130, rt.SignalClass},
+		{255, rt.SignalClass},
+		{-1, rt.ErrorClass},
+	}
+	for _, tt := range tests {
+		if got := rt.ClassifyExit(tt.status); got != tt.want {
+			t.Errorf("ClassifyExit(%d) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}
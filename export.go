@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Export streams every record matching the standard filters to writer,
+// oldest first, flushing it at the end. Records are written as they are read
+// from the database so memory use does not grow with the size of the history.
+func (db *DB) Export(writer RecordWriter, timeRange time.Duration, resultFilter string, scope Scope) error {
+	where, args := filterClause(timeRange, resultFilter, scope)
+	query := `
+	SELECT ` + recordColumns + `
+	FROM history
+	WHERE ` + where + `
+	ORDER BY id`
+
+	if err := db.QueryStream(query, writer.Write, args...); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// runExport implements the export subcommand
+func runExport(config *Config, args []string) (err error) {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "Output format (jsonl, csv, tsv, text, template)")
+	tmpl := flags.String("template", config.Template, "Template records are written with in the template format")
+	out := flags.String("out", "-", "File to write to, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// jsonl is the conventional name for JSON Lines, which the json format produces
+	outputFormat := OutputFormat(*format)
+	if *format == "jsonl" {
+		outputFormat = JSONFormat
+	}
+
+	// Check the format before creating the export file
+	if _, err := newFormatWriter(io.Discard, outputFormat, *tmpl, config.Columns, time.Time{}); err != nil {
+		return err
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("failed to create export file: %w", err)
+		}
+		defer func() {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = file
+	}
+
+	buffered := bufio.NewWriter(w)
+	// Exports are data, so their times are always exact
+	writer, err := newFormatWriter(buffered, outputFormat, *tmpl, config.Columns, time.Time{})
+	if err != nil {
+		return err
+	}
+	err = db.Export(writer,
+		config.TimeRange.Duration(time.Now()),
+		string(config.Result),
+		config.Scope(),
+	)
+	if err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
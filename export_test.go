@@ -0,0 +1,59 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestExport(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now()
+	for i, line := range []string{"first", "second", "third"} {
+		record := rt.NewRecord(line, "/", i%2, now.Add(time.Duration(i)*time.Minute))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		result string
+		want   []string
+	}{
+		{name: "Everything oldest first", result: "all", want: []string{"first", "second", "third"}},
+		{name: "Respects filters", result: "success", want: []string{"first", "third"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, err := rt.NewRecordWriter(&buf, rt.JSONFormat)
+			if err != nil {
+				t.Fatalf("NewRecordWriter() unexpected error = %v", err)
+			}
+			if err := database.Export(writer, 0, tt.result, rt.Scope{}); err != nil {
+				t.Fatalf("Export() unexpected error = %v", err)
+			}
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("Expected %d lines, got %q", len(tt.want), buf.String())
+			}
+			for i, line := range lines {
+				var r rt.Record
+				if err := json.Unmarshal([]byte(line), &r); err != nil {
+					t.Fatalf("Line %d is not valid JSON: %v", i, err)
+				}
+				if r.Command != tt.want[i] {
+					t.Errorf("Line %d command = %q, want %q", i, r.Command, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -1,22 +1,80 @@
 package main
 
 import (
+	"cmp"
+	"regexp"
+	"slices"
 	"strings"
+	"unicode/utf8"
 )
 
-// Filter represents a fuzzy matcher for Record objects
+// MatchMode is how the filter text matches command lines. Whatever the mode,
+// a stage of the filter written 'text matches text exactly and one written
+// /text/ matches it as a regular expression, as in fzf.
+type MatchMode string
+
+const (
+	// SubstringMatch keeps the command lines containing the text, ignoring
+	// case
+	SubstringMatch MatchMode = "substring"
+	// FuzzyMatch keeps the command lines containing the characters of the
+	// text in order, ignoring case, so "gco" matches "git checkout"
+	FuzzyMatch MatchMode = "fuzzy"
+	// ExactMatch keeps the command lines containing the text as typed, case
+	// and all, with "|" taken literally
+	ExactMatch MatchMode = "exact"
+	// RegexMatch keeps the command lines which the text, a Go regular
+	// expression, matches
+	RegexMatch MatchMode = "regex"
+)
+
+// Next returns the mode after m in the order the picker cycles through them
+func (m MatchMode) Next() MatchMode {
+	switch m {
+	case FuzzyMatch:
+		return ExactMatch
+	case ExactMatch:
+		return RegexMatch
+	case RegexMatch:
+		return SubstringMatch
+	default:
+		return FuzzyMatch
+	}
+}
+
+// Filter represents a matcher for Record objects
 type Filter struct {
-	records         []Record // All available records
-	filteredRecords []Record // Records after filtering
-	filter          string   // Current filter text
+	records         []Record      // All available records
+	lines           []string      // Lower case command line of each record, built when first needed
+	filteredRecords []Record      // Records after filtering
+	filter          string        // Current filter text
+	mode            MatchMode     // How the filter text matches
+	stages          []filterStage // Records left by each stage of the filter
+	recent          []filterStage // Stages recently filtered, to refine rather than redo
+	deferred        bool          // Whether changes to the filter text wait for Refresh
+	stale           bool          // Whether the filtered records are out of date
+}
+
+// filterStage is one of the filters chained with ">" and the records left
+// once it has been applied. Keeping them means refining the last stage only
+// filters what the earlier ones left.
+type filterStage struct {
+	base    string // The stages before, as typed, joined by ">"
+	text    string
+	matches []int // Indexes of the records left
 }
 
+// maxRecentStages bounds how many recently filtered stages are kept to be
+// refined, enough for the text typed before backspacing some of it
+const maxRecentStages = 32
+
 // NewFilter creates a new Filter with the given records
 func NewFilter(records []Record) *Filter {
 	return &Filter{
 		records:         records,
 		filteredRecords: records, // Initially show all records
 		filter:          "",      // Initially empty filter
+		mode:            SubstringMatch,
 	}
 }
 
@@ -30,51 +88,485 @@ func (f *Filter) Filter() string {
 	return f.filter
 }
 
-// UpdateFilter updates the filter text and refreshes the filtered records
+// MatchMode returns how the filter text matches
+func (f *Filter) MatchMode() MatchMode {
+	return f.mode
+}
+
+// SetMatchMode changes how the filter text matches and refreshes the
+// filtered records, unless updates are deferred. An empty mode matches
+// substrings.
+func (f *Filter) SetMatchMode(mode MatchMode) {
+	if mode == "" {
+		mode = SubstringMatch
+	}
+	if mode == f.mode {
+		return
+	}
+	// The records left by the stages were matched in the old mode
+	f.mode = mode
+	f.stages = nil
+	f.recent = nil
+	if f.deferred {
+		f.stale = true
+		return
+	}
+	f.refresh()
+}
+
+// Len returns how many records the filter holds, whether or not they match
+// the filter text
+func (f *Filter) Len() int {
+	return len(f.records)
+}
+
+// Append adds records after those already filtered, such as the next page
+// of the history, filtering only them by the current filter text
+func (f *Filter) Append(records []Record) {
+	first := len(f.records)
+	f.records = append(f.records, records...)
+	// Recent results lack the new records, and so can't be refined
+	f.recent = nil
+	if f.lines != nil {
+		for _, record := range records {
+			f.lines = append(f.lines, strings.ToLower(record.CommandLine()))
+		}
+	}
+	if f.stale {
+		// Everything is filtered again when the filter text is refreshed
+		f.stages = nil
+		return
+	}
+	if len(f.stages) == 0 {
+		f.filteredRecords = f.records
+		return
+	}
+
+	added := make([]int, len(records))
+	for i := range added {
+		added[i] = first + i
+	}
+	for i := range f.stages {
+		added = filterLines(f.records, f.lines, added, false, f.stages[i].text, f.mode)
+		f.stages[i].matches = append(f.stages[i].matches, added...)
+	}
+	for _, index := range added {
+		f.filteredRecords = append(f.filteredRecords, f.records[index])
+	}
+}
+
+// Merge adds the records not already held, by ID, among them, keeping the
+// order of the history, most recent first, so that records found out of
+// order, such as matches for the filter text from further back in the
+// history, can be mixed with the pages loaded. Records which all follow
+// those held are appended, otherwise everything is filtered again.
+func (f *Filter) Merge(records []Record) {
+	held := make(map[int64]bool, len(f.records))
+	for _, record := range f.records {
+		held[record.ID] = true
+	}
+	var added []Record
+	for _, record := range records {
+		if !held[record.ID] {
+			held[record.ID] = true
+			added = append(added, record)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	slices.SortFunc(added, compareRecency)
+	if len(f.records) == 0 || compareRecency(f.records[len(f.records)-1], added[0]) < 0 {
+		f.Append(added)
+		return
+	}
+
+	merged := make([]Record, 0, len(f.records)+len(added))
+	i, j := 0, 0
+	for i < len(f.records) && j < len(added) {
+		if compareRecency(f.records[i], added[j]) < 0 {
+			merged = append(merged, f.records[i])
+			i++
+		} else {
+			merged = append(merged, added[j])
+			j++
+		}
+	}
+	merged = append(append(merged, f.records[i:]...), added[j:]...)
+
+	f.records = merged
+	f.lines = nil
+	f.stages = nil
+	f.recent = nil
+	if f.stale {
+		return
+	}
+	f.refresh()
+}
+
+// compareRecency orders records as the history is paged: the starred ones
+// first, then most recent first
+func compareRecency(a, b Record) int {
+	if a.Starred != b.Starred {
+		if a.Starred {
+			return -1
+		}
+		return 1
+	}
+	if c := b.Timestamp.Compare(a.Timestamp); c != 0 {
+		return c
+	}
+	return cmp.Compare(b.ID, a.ID)
+}
+
+// SetStarred sets Starred on the records held which match, as it was just
+// set in the history, leaving them where they are until the history is
+// loaded again.
+func (f *Filter) SetStarred(match func(Record) bool, starred bool) {
+	for _, records := range [][]Record{f.records, f.filteredRecords} {
+		for i := range records {
+			if match(records[i]) {
+				records[i].Starred = starred
+			}
+		}
+	}
+}
+
+// Remove drops the records held which match, filtering those left by the
+// current filter text again
+func (f *Filter) Remove(match func(Record) bool) {
+	f.records = slices.DeleteFunc(slices.Clone(f.records), match)
+	f.lines = nil
+	f.stages = nil
+	f.recent = nil
+	if f.stale {
+		return
+	}
+	f.refresh()
+}
+
+// DeferUpdates makes changes to the filter text wait for Refresh before the
+// records are filtered again, so typing quickly into a huge history only
+// filters it once typing pauses
+func (f *Filter) DeferUpdates(deferred bool) {
+	f.deferred = deferred
+}
+
+// Stale reports whether the filter text has changed since the records were
+// last filtered, which only happens while updates are deferred
+func (f *Filter) Stale() bool {
+	return f.stale
+}
+
+// Refresh filters the records by the filter text if it has changed since
+// they were last filtered
+func (f *Filter) Refresh() {
+	if f.stale {
+		f.refresh()
+	}
+}
+
+// UpdateFilter updates the filter text and refreshes the filtered records,
+// unless updates are deferred
 func (f *Filter) UpdateFilter(filterText string) {
 	f.filter = filterText
+	if f.deferred {
+		f.stale = true
+		return
+	}
+	f.refresh()
+}
 
-	// If filter is empty, show all records
-	if filterText == "" {
+// refresh filters the records by the filter text
+func (f *Filter) refresh() {
+	f.stale = false
+	texts := splitStages(f.filter)
+	if len(texts) == 0 {
+		f.stages = nil
 		f.filteredRecords = f.records
 		return
 	}
+	if f.lines == nil {
+		f.lines = make([]string, len(f.records))
+		for i, record := range f.records {
+			f.lines[i] = strings.ToLower(record.CommandLine())
+		}
+	}
 
-	// Naive implementation: check if record contains the filter string
-	// in either the command or arguments (case insensitive)
-	var filtered []Record
-	lowerFilter := strings.ToLower(filterText)
+	// Each stage refines the records left by the one before, reusing those
+	// left by the stages which have not changed
+	var matches []int
+	var stages []filterStage
+	unchanged := true
+	for i, text := range texts {
+		base := strings.Join(texts[:i], ">")
+		if unchanged && i < len(f.stages) && f.stages[i].text == text {
+			matches = f.stages[i].matches
+		} else {
+			unchanged = false
+			matches = f.filterStage(matches, i == 0, base, text)
+		}
+		stages = append(stages, filterStage{base: base, text: text, matches: matches})
+	}
 
-	for _, record := range f.records {
-		lowerCommand := strings.ToLower(record.Command)
-		lowerArgs := strings.ToLower(record.Arguments)
+	f.stages = stages
+	f.filteredRecords = make([]Record, len(matches))
+	for i, index := range matches {
+		f.filteredRecords[i] = f.records[index]
+	}
+}
 
-		// Check if command or arguments contain the filter string
-		if strings.Contains(lowerCommand, lowerFilter) ||
-			strings.Contains(lowerArgs, lowerFilter) {
-			filtered = append(filtered, record)
+// filterStage returns the indexes of the records matching text among those
+// left by the stages before, all of them for the first stage. As typing
+// usually extends the text, a recent stage whose text this one contains is
+// refined instead, when both match in the same mode and neither lists
+// alternatives nor classes, which could widen the match, nor is a regular
+// expression, which could match anything.
+func (f *Filter) filterStage(left []int, first bool, base, text string) []int {
+	mode, _ := stageMatch(text, f.mode)
+	contains := func(text, recent string) bool {
+		if mode == ExactMatch {
+			return strings.Contains(text, recent)
 		}
+		return strings.Contains(strings.ToLower(text), strings.ToLower(recent))
+	}
+	refinable := func(text string) bool {
+		return !strings.ContainsRune(text, '|') && !strings.Contains(strings.ToLower(text), classPrefix)
 	}
 
-	f.filteredRecords = filtered
+	var narrowest *filterStage
+	for i := range f.recent {
+		recent := &f.recent[i]
+		if recent.base != base {
+			continue
+		}
+		if recent.text == text {
+			return recent.matches
+		}
+		if recentMode, _ := stageMatch(recent.text, f.mode); recentMode == mode && mode != RegexMatch &&
+			refinable(text) && refinable(recent.text) &&
+			contains(text, recent.text) && (narrowest == nil || len(recent.matches) < len(narrowest.matches)) {
+			narrowest = recent
+		}
+	}
+
+	var matches []int
+	if narrowest != nil {
+		matches = filterLines(f.records, f.lines, narrowest.matches, false, text, f.mode)
+	} else {
+		matches = filterLines(f.records, f.lines, left, first, text, f.mode)
+	}
+	if len(f.recent) == maxRecentStages {
+		f.recent = f.recent[1:]
+	}
+	f.recent = append(f.recent, filterStage{base: base, text: text, matches: matches})
+	return matches
 }
 
+// filterLines returns the indexes of the records matching one stage of the
+// filter, in mode unless the stage asks for another, among those at
+// candidates or, if all is set, among every record. lines holds the lower
+// case command line of each record, matched by the modes which ignore case.
+// The class: words of the stage match the records' exit statuses rather than
+// their lines.
+func filterLines(records []Record, lines []string, candidates []int, all bool, filterText string, mode MatchMode) []int {
+	var matches []int
+	filterText, classes := splitClasses(filterText)
+	mode, filterText = stageMatch(filterText, mode)
+	matchesLine := lineMatcher(lines, records, mode, filterText)
+	matchesRecord := func(i int) bool {
+		return matchesLine(i) && (classes == nil || matchesClasses(records[i].ExitStatus, classes))
+	}
+	if all {
+		for i := range lines {
+			if matchesRecord(i) {
+				matches = append(matches, i)
+			}
+		}
+		return matches
+	}
+	for _, i := range candidates {
+		if matchesRecord(i) {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+// lineMatcher returns a function reporting whether the command line of the
+// record at an index matches text in mode. The exact and regex modes match
+// the line as typed, the others its lower case form in lines.
+func lineMatcher(lines []string, records []Record, mode MatchMode, text string) func(int) bool {
+	switch mode {
+	case ExactMatch:
+		return func(i int) bool {
+			return strings.Contains(records[i].CommandLine(), text)
+		}
+	case RegexMatch:
+		re, err := regexp.Compile(text)
+		if err != nil {
+			// An expression still being typed matches nothing until it is whole
+			return func(int) bool { return false }
+		}
+		return func(i int) bool {
+			return re.MatchString(records[i].CommandLine())
+		}
+	case FuzzyMatch:
+		matches := fuzzyMatcher(strings.ToLower(text))
+		return func(i int) bool {
+			return matches(lines[i])
+		}
+	default:
+		// Naive implementation: check if the command line, as typed, contains
+		// the filter string (case insensitive), so text spanning the command and
+		// its arguments such as "git st" matches
+		matches := filterMatcher(strings.ToLower(text))
+		return func(i int) bool {
+			return matches(lines[i])
+		}
+	}
+}
+
+// stageMatch returns the mode one stage of the filter text matches in and the
+// text it matches: mode and the stage itself, unless it is written 'text, to
+// be matched exactly, or /text/, to be matched as a regular expression.
+func stageMatch(stage string, mode MatchMode) (MatchMode, string) {
+	if text, ok := strings.CutPrefix(stage, "'"); ok {
+		return ExactMatch, text
+	}
+	if len(stage) >= 2 && strings.HasPrefix(stage, "/") && strings.HasSuffix(stage, "/") {
+		return RegexMatch, stage[1 : len(stage)-1]
+	}
+	return mode, stage
+}
+
+// splitStages splits filter text into the filters chained with ">", so
+// "git > rebase" finds the rebases among the git commands. Space around
+// each ">" is ignored, as are empty stages, such as one not yet typed.
+func splitStages(filterText string) []string {
+	if !strings.Contains(filterText, ">") {
+		if filterText == "" {
+			return nil
+		}
+		return []string{filterText}
+	}
+
+	var stages []string
+	for _, text := range strings.Split(filterText, ">") {
+		if text = strings.TrimSpace(text); text != "" {
+			stages = append(stages, text)
+		}
+	}
+	return stages
+}
+
+// filterMatcher returns a function reporting whether a command line contains
+// the filter text. A word of the filter may list alternatives separated by
+// "|", so "docker|podman build" matches both "docker build" and
+// "podman build". Empty alternatives are ignored, so a word still being
+// typed, such as "docker|", matches as if the "|" were not there.
+func filterMatcher(filterText string) func(string) bool {
+	if !strings.Contains(filterText, "|") {
+		return func(line string) bool {
+			return strings.Contains(line, filterText)
+		}
+	}
+
+	words := strings.Split(filterText, " ")
+	for i, word := range words {
+		var alternatives []string
+		for _, alternative := range strings.Split(word, "|") {
+			if alternative != "" {
+				alternatives = append(alternatives, quoteAlternative(alternative))
+			}
+		}
+		words[i] = "(?:" + strings.Join(alternatives, "|") + ")"
+	}
+	// Every alternative is quoted, so the pattern always compiles
+	re := regexp.MustCompile(strings.Join(words, " "))
+	return re.MatchString
+}
+
+// fuzzyMatcher returns a function reporting whether a command line holds the
+// characters of the filter text in order, though not necessarily together.
+// Spaces only separate the words, so "git co" matches "git checkout" as
+// "gitco" does, and words may list alternatives as in filterMatcher.
+func fuzzyMatcher(filterText string) func(string) bool {
+	if !strings.Contains(filterText, "|") {
+		chars := []rune(strings.ReplaceAll(filterText, " ", ""))
+		return func(line string) bool {
+			i := 0
+			for _, r := range line {
+				if i == len(chars) {
+					break
+				}
+				if r == chars[i] {
+					i++
+				}
+			}
+			return i == len(chars)
+		}
+	}
+
+	var words []string
+	for _, word := range strings.Fields(filterText) {
+		var alternatives []string
+		for _, alternative := range strings.Split(word, "|") {
+			if alternative != "" {
+				alternatives = append(alternatives, fuzzyPattern(alternative))
+			}
+		}
+		if len(alternatives) > 0 {
+			words = append(words, "(?:"+strings.Join(alternatives, "|")+")")
+		}
+	}
+	// Every character is quoted, so the pattern always compiles
+	re := regexp.MustCompile("(?s)" + strings.Join(words, ".*"))
+	return re.MatchString
+}
+
+// fuzzyPattern returns a pattern matching the characters of an alternative
+// in order, quoted as quoteAlternative quotes them
+func fuzzyPattern(alternative string) string {
+	var chars []string
+	for _, r := range alternative {
+		chars = append(chars, regexp.QuoteMeta(string(r)))
+	}
+	return strings.Join(chars, ".*")
+}
+
+// quoteAlternative quotes an alternative for use in a pattern. Each byte of
+// invalid UTF-8 becomes a replacement character, which is how the pattern
+// sees such bytes in the lines it matches.
+func quoteAlternative(alternative string) string {
+	var quoted strings.Builder
+	for _, r := range alternative {
+		quoted.WriteString(regexp.QuoteMeta(string(r)))
+	}
+	return quoted.String()
+}
+
+// Editing positions are measured in runes rather than bytes so that multi-byte
+// characters can never be split by the cursor.
+
 // InsertTextAtCursor inserts text at the specified cursor position
 func (f *Filter) InsertTextAtCursor(text string, cursorPos int) {
 	if len(text) == 0 {
 		return
 	}
 
+	runes := []rune(f.filter)
+
 	// Ensure cursor position is valid
 	if cursorPos < 0 {
 		cursorPos = 0
 	}
-	if cursorPos > len(f.filter) {
-		cursorPos = len(f.filter)
+	if cursorPos > len(runes) {
+		cursorPos = len(runes)
 	}
 
 	// Insert text at cursor position
-	newFilter := f.filter[:cursorPos] + text + f.filter[cursorPos:]
+	newFilter := string(runes[:cursorPos]) + text + string(runes[cursorPos:])
 	f.UpdateFilter(newFilter)
 }
 
@@ -85,31 +577,39 @@ func (f *Filter) InsertCharAtCursor(char rune, cursorPos int) {
 
 // RemoveCharBeforeCursor removes the character before the specified cursor position
 func (f *Filter) RemoveCharBeforeCursor(cursorPos int) {
-	if cursorPos > 0 && cursorPos <= len(f.filter) {
-		newFilter := f.filter[:cursorPos-1] + f.filter[cursorPos:]
+	runes := []rune(f.filter)
+	if cursorPos > 0 && cursorPos <= len(runes) {
+		newFilter := string(runes[:cursorPos-1]) + string(runes[cursorPos:])
 		f.UpdateFilter(newFilter)
 	}
 }
 
 // RemoveTextBeforeCursor removes text from newPos to the specified cursor position
 func (f *Filter) RemoveTextBeforeCursor(newPos int, cursorPos int) {
+	runes := []rune(f.filter)
 	if newPos < 0 {
 		newPos = 0
 	}
-	if cursorPos > len(f.filter) {
-		cursorPos = len(f.filter)
+	if cursorPos > len(runes) {
+		cursorPos = len(runes)
 	}
 
 	if newPos < cursorPos {
-		newFilter := f.filter[:newPos] + f.filter[cursorPos:]
+		newFilter := string(runes[:newPos]) + string(runes[cursorPos:])
 		f.UpdateFilter(newFilter)
 	}
 }
 
 // RemoveTextAfterCursor removes all text after the specified cursor position
 func (f *Filter) RemoveTextAfterCursor(cursorPos int) {
-	if cursorPos >= 0 && cursorPos <= len(f.filter) {
-		newFilter := f.filter[:cursorPos]
+	runes := []rune(f.filter)
+	if cursorPos >= 0 && cursorPos <= len(runes) {
+		newFilter := string(runes[:cursorPos])
 		f.UpdateFilter(newFilter)
 	}
 }
+
+// FilterLength returns the length of the filter text in runes
+func (f *Filter) FilterLength() int {
+	return utf8.RuneCountInString(f.filter)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"slices"
 	"testing"
 	"time"
 )
@@ -56,6 +57,12 @@ func TestUpdateFilter(t *testing.T) {
 		t.Errorf("Expected command 'find', got '%s'", filter.FilteredRecords()[0].Command)
 	}
 
+	// Test filtering across the command and its arguments
+	filter.UpdateFilter("grep foo")
+	if len(filter.FilteredRecords()) != 1 {
+		t.Errorf("Expected 1 record when filtering by 'grep foo', got %d", len(filter.FilteredRecords()))
+	}
+
 	// Test case insensitivity
 	filter.UpdateFilter("LS")
 	if len(filter.FilteredRecords()) != 1 {
@@ -72,6 +79,195 @@ func TestUpdateFilter(t *testing.T) {
 	}
 }
 
+func TestUpdateFilterAlternatives(t *testing.T) {
+	records := []Record{
+		{ID: 1, Command: "docker", Arguments: "build ."},
+		{ID: 2, Command: "podman", Arguments: "build -t app ."},
+		{ID: 3, Command: "docker", Arguments: "run app"},
+		{ID: 4, Command: "nerdctl", Arguments: "build ."},
+	}
+
+	tests := []struct {
+		filter string
+		want   []int64
+	}{
+		{filter: "docker|podman build", want: []int64{1, 2}},
+		{filter: "Docker|PODMAN", want: []int64{1, 2, 3}},
+		{filter: "docker build|run", want: []int64{1, 3}},
+		{filter: "docker|", want: []int64{1, 3}},
+		{filter: "|", want: []int64{1, 2, 3, 4}},
+		{filter: "kubectl|helm", want: nil},
+		{filter: "build .|-t", want: []int64{1, 2, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			filter := NewFilter(records)
+			filter.UpdateFilter(tt.filter)
+			var got []int64
+			for _, r := range filter.FilteredRecords() {
+				got = append(got, r.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("UpdateFilter(%q) matched %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateFilterMatchModes(t *testing.T) {
+	records := []Record{
+		{ID: 1, Command: "git", Arguments: "checkout main"},
+		{ID: 2, Command: "go", Arguments: "test ./..."},
+		{ID: 3, Command: "echo", Arguments: "Hello|World"},
+		{ID: 4, Command: "grep", Arguments: "TODO notes", ExitStatus: 1},
+	}
+
+	tests := []struct {
+		mode   MatchMode
+		filter string
+		want   []int64
+	}{
+		{mode: SubstringMatch, filter: "gco", want: nil},
+		{mode: FuzzyMatch, filter: "gco", want: []int64{1}},
+		{mode: FuzzyMatch, filter: "GIT MN", want: []int64{1}},
+		{mode: FuzzyMatch, filter: "gtc|gt.", want: []int64{1, 2}},
+		{mode: FuzzyMatch, filter: "class:error gn", want: []int64{4}},
+		{mode: FuzzyMatch, filter: "gco > main", want: []int64{1}},
+		{mode: ExactMatch, filter: "hello|world", want: nil},
+		{mode: ExactMatch, filter: "Hello|World", want: []int64{3}},
+		{mode: RegexMatch, filter: `^g\w+ (checkout|test)`, want: []int64{1, 2}},
+		{mode: RegexMatch, filter: "(?i)todo", want: []int64{4}},
+		{mode: RegexMatch, filter: "main(", want: nil},
+
+		// A stage may ask for its own mode whatever the filter's
+		{mode: SubstringMatch, filter: "'TODO", want: []int64{4}},
+		{mode: SubstringMatch, filter: "'todo", want: nil},
+		{mode: FuzzyMatch, filter: `/^go?\s/`, want: []int64{2}},
+		{mode: SubstringMatch, filter: "todo > /s$/", want: []int64{4}},
+		{mode: SubstringMatch, filter: "/main", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode)+" "+tt.filter, func(t *testing.T) {
+			filter := NewFilter(records)
+			filter.SetMatchMode(tt.mode)
+			filter.UpdateFilter(tt.filter)
+			var got []int64
+			for _, r := range filter.FilteredRecords() {
+				got = append(got, r.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("UpdateFilter(%q) in %s mode matched %v, want %v", tt.filter, tt.mode, got, tt.want)
+			}
+		})
+	}
+
+	// Changing the mode filters again, without refining what the old one left
+	filter := NewFilter(records)
+	filter.UpdateFilter("gco")
+	filter.SetMatchMode(FuzzyMatch)
+	if got := filter.FilteredRecords(); len(got) != 1 || got[0].ID != 1 {
+		t.Errorf("SetMatchMode(%q) matched %+v, want git checkout", FuzzyMatch, got)
+	}
+}
+
+func TestUpdateFilterStages(t *testing.T) {
+	records := []Record{
+		{ID: 1, Command: "git", Arguments: "rebase -i main"},
+		{ID: 2, Command: "git", Arguments: "log --oneline"},
+		{ID: 3, Command: "echo", Arguments: "rebase"},
+		{ID: 4, Command: "git", Arguments: "rebase --continue"},
+		{ID: 5, Command: "echo", Arguments: "hi > out.txt"},
+	}
+
+	tests := []struct {
+		filter string
+		want   []int64
+	}{
+		{filter: "git > rebase", want: []int64{1, 4}},
+		{filter: "git>rebase>continue", want: []int64{4}},
+		{filter: "rebase > git|echo > -i", want: []int64{1}},
+		{filter: "git >", want: []int64{1, 2, 4}},
+		{filter: " > ", want: []int64{1, 2, 3, 4, 5}},
+		{filter: "git > svn", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			filter := NewFilter(records)
+			filter.UpdateFilter(tt.filter)
+			var got []int64
+			for _, r := range filter.FilteredRecords() {
+				got = append(got, r.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("UpdateFilter(%q) matched %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+
+	// Typing and deleting a stage at a time gives the same records as filtering afresh
+	filter := NewFilter(records)
+	for _, text := range []string{"g", "git", "git >", "git > re", "git > reb", "git > re", "git >", "echo > re"} {
+		filter.UpdateFilter(text)
+		fresh := NewFilter(records)
+		fresh.UpdateFilter(text)
+		if !slices.EqualFunc(filter.FilteredRecords(), fresh.FilteredRecords(), func(a, b Record) bool { return a.ID == b.ID }) {
+			t.Errorf("UpdateFilter(%q) after editing matched %+v, want %+v", text, filter.FilteredRecords(), fresh.FilteredRecords())
+		}
+	}
+}
+
+func TestUpdateFilterClasses(t *testing.T) {
+	records := []Record{
+		{ID: 1, Command: "make", Arguments: "build", ExitStatus: 0},
+		{ID: 2, Command: "make", Arguments: "test", ExitStatus: 130},
+		{ID: 3, Command: "mkae", Arguments: "test", ExitStatus: 127},
+		{ID: 4, Command: "make", Arguments: "lint", ExitStatus: 2},
+		{ID: 5, Command: "grep", Arguments: "class:signal notes.txt", ExitStatus: 1},
+	}
+
+	tests := []struct {
+		filter string
+		want   []int64
+	}{
+		{filter: "class:signal", want: []int64{2}},
+		{filter: "class:s", want: []int64{1, 2}},
+		{filter: "make class:success|usage-error", want: []int64{1, 4}},
+		{filter: "class:not-found test", want: []int64{3}},
+		{filter: "CLASS:Error", want: []int64{5}},
+		{filter: "class:", want: []int64{1, 2, 3, 4, 5}},
+		{filter: "class:signal class:error", want: nil},
+		{filter: "test > class:signal", want: []int64{2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			filter := NewFilter(records)
+			filter.UpdateFilter(tt.filter)
+			var got []int64
+			for _, r := range filter.FilteredRecords() {
+				got = append(got, r.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("UpdateFilter(%q) matched %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+
+	// Typing a class after text which it doesn't contain gives the same records as filtering afresh
+	filter := NewFilter(records)
+	for _, text := range []string{"s", "class:s", "class:si", "class:s", "class:su", "te class:su"} {
+		filter.UpdateFilter(text)
+		fresh := NewFilter(records)
+		fresh.UpdateFilter(text)
+		if !slices.EqualFunc(filter.FilteredRecords(), fresh.FilteredRecords(), func(a, b Record) bool { return a.ID == b.ID }) {
+			t.Errorf("UpdateFilter(%q) after editing matched %+v, want %+v", text, filter.FilteredRecords(), fresh.FilteredRecords())
+		}
+	}
+}
+
 func TestTextManipulation(t *testing.T) {
 	records := []Record{
 		{Command: "ls", Arguments: "-la"},
@@ -110,3 +306,132 @@ func TestTextManipulation(t *testing.T) {
 		t.Errorf("Expected filter text ' ', got '%s'", filter.Filter())
 	}
 }
+
+func TestMultiByteTextManipulation(t *testing.T) {
+	filter := NewFilter(nil)
+
+	filter.InsertTextAtCursor("héllo", 0)
+	filter.InsertTextAtCursor("ö", 2)
+	if filter.Filter() != "héöllo" {
+		t.Errorf("Expected filter text 'héöllo', got '%s'", filter.Filter())
+	}
+
+	filter.RemoveCharBeforeCursor(3)
+	if filter.Filter() != "héllo" {
+		t.Errorf("Expected filter text 'héllo', got '%s'", filter.Filter())
+	}
+
+	if filter.FilterLength() != 5 {
+		t.Errorf("Expected filter length 5, got %d", filter.FilterLength())
+	}
+}
+
+func TestRefinedFilter(t *testing.T) {
+	records := []Record{
+		{Command: "git", Arguments: "status"},
+		{Command: "git", Arguments: "stash"},
+		{Command: "ls", Arguments: "-la"},
+		{Command: "go", Arguments: "test ./..."},
+	}
+
+	// Typing, deleting and alternatives reuse and refine earlier results,
+	// which must match filtering afresh
+	filter := NewFilter(records)
+	for _, text := range []string{"g", "gi", "git", "git st", "git sta", "git s", "gi", "git|ls", "git|l", "git", "GIT", "git > st", "git > sta", "git > s", ""} {
+		filter.UpdateFilter(text)
+		fresh := NewFilter(records)
+		fresh.UpdateFilter(text)
+		if !slices.Equal(filter.FilteredRecords(), fresh.FilteredRecords()) {
+			t.Errorf("UpdateFilter(%q) matched %+v, want %+v", text, filter.FilteredRecords(), fresh.FilteredRecords())
+		}
+	}
+
+	// Nor may refining mix up modes
+	for _, mode := range []MatchMode{FuzzyMatch, ExactMatch} {
+		filter := NewFilter(records)
+		filter.SetMatchMode(mode)
+		for _, text := range []string{"s", "'s", "'St", "/s/", "/st?a/", "gt", "gts", "g", "Git", "'Git", "'git"} {
+			filter.UpdateFilter(text)
+			fresh := NewFilter(records)
+			fresh.SetMatchMode(mode)
+			fresh.UpdateFilter(text)
+			if !slices.Equal(filter.FilteredRecords(), fresh.FilteredRecords()) {
+				t.Errorf("UpdateFilter(%q) in %s mode matched %+v, want %+v", text, mode, filter.FilteredRecords(), fresh.FilteredRecords())
+			}
+		}
+	}
+}
+
+func TestDeferredFilter(t *testing.T) {
+	records := []Record{{Command: "ls"}, {Command: "grep"}}
+	filter := NewFilter(records)
+	filter.DeferUpdates(true)
+
+	filter.UpdateFilter("gr")
+	if !filter.Stale() || len(filter.FilteredRecords()) != 2 {
+		t.Fatalf("Expected the records to wait for Refresh, got %+v", filter.FilteredRecords())
+	}
+	filter.Refresh()
+	if filter.Stale() || len(filter.FilteredRecords()) != 1 || filter.FilteredRecords()[0].Command != "grep" {
+		t.Errorf("Expected Refresh to filter the records, got %+v", filter.FilteredRecords())
+	}
+}
+
+func TestFilterAppend(t *testing.T) {
+	first := []Record{{ID: 1, Command: "git", Arguments: "status"}, {ID: 2, Command: "ls"}}
+	next := []Record{{ID: 3, Command: "git", Arguments: "rebase"}, {ID: 4, Command: "git", Arguments: "stash"}}
+
+	for _, text := range []string{"", "git", "git > st", " > "} {
+		filter := NewFilter(first)
+		filter.UpdateFilter(text)
+		filter.Append(next)
+
+		fresh := NewFilter(append(slices.Clone(first), next...))
+		fresh.UpdateFilter(text)
+		if !slices.Equal(filter.FilteredRecords(), fresh.FilteredRecords()) {
+			t.Errorf("Append() with filter %q matched %+v, want %+v", text, filter.FilteredRecords(), fresh.FilteredRecords())
+		}
+
+		// Refining the filter afterwards takes the new records into account
+		filter.UpdateFilter(text + "a")
+		fresh.UpdateFilter(text + "a")
+		if !slices.Equal(filter.FilteredRecords(), fresh.FilteredRecords()) {
+			t.Errorf("UpdateFilter(%q) after Append() matched %+v, want %+v", text+"a", filter.FilteredRecords(), fresh.FilteredRecords())
+		}
+	}
+}
+
+func TestFilterMerge(t *testing.T) {
+	at := func(minute int) time.Time { return time.Date(2025, 1, 1, 0, minute, 0, 0, time.UTC) }
+	loaded := []Record{
+		{ID: 9, Command: "git", Arguments: "push", Timestamp: at(9)},
+		{ID: 7, Command: "ls", Timestamp: at(7)},
+		{ID: 5, Command: "git", Arguments: "pull", Timestamp: at(5)},
+	}
+	found := []Record{
+		{ID: 2, Command: "git", Arguments: "init", Timestamp: at(2)},
+		{ID: 6, Command: "git", Arguments: "status", Timestamp: at(6)},
+		{ID: 5, Command: "git", Arguments: "pull", Timestamp: at(5)},
+	}
+
+	filter := NewFilter(slices.Clone(loaded))
+	filter.UpdateFilter("git")
+	filter.Merge(found)
+
+	var ids []int64
+	for _, r := range filter.FilteredRecords() {
+		ids = append(ids, r.ID)
+	}
+	if want := []int64{9, 6, 5, 2}; !slices.Equal(ids, want) {
+		t.Errorf("Merge() left %v, want %v", ids, want)
+	}
+	if filter.Len() != 5 {
+		t.Errorf("Merge() held %d records, want 5 without duplicates", filter.Len())
+	}
+
+	// Records following those held are appended
+	filter.Merge([]Record{{ID: 1, Command: "git", Arguments: "clone", Timestamp: at(1)}})
+	if got := filter.FilteredRecords(); len(got) != 5 || got[4].ID != 1 {
+		t.Errorf("Merge() of older records left %+v, want them last", got)
+	}
+}
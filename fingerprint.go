@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fingerprint describes the environment a session ran in, to help explain
+// why a command which once worked no longer does.
+type Fingerprint struct {
+	// ShellVersion is the version of the session's shell
+	ShellVersion string `json:"shell_version,omitempty"`
+	// PathHash identifies the session's PATH without storing it, so that a
+	// change to it shows
+	PathHash string `json:"path_hash,omitempty"`
+	// Tools gives the output of each of the configured probes
+	Tools []ToolVersion `json:"tools,omitempty"`
+}
+
+// ToolVersion is what a probe, such as "go version", printed.
+type ToolVersion struct {
+	Probe   string `json:"probe"`
+	Version string `json:"version"`
+}
+
+// IsZero reports whether nothing is known of the environment
+func (f Fingerprint) IsZero() bool {
+	return f.ShellVersion == "" && f.PathHash == "" && len(f.Tools) == 0
+}
+
+const (
+	// probeTimeout bounds how long each probe may take, so a hanging tool
+	// cannot hold up the session start hook
+	probeTimeout = 2 * time.Second
+	// maxProbeOutput bounds how much of a probe's output is kept
+	maxProbeOutput = 100
+)
+
+// TakeFingerprint fingerprints the current environment: the shell version
+// given, a hash of PATH and the first line each probe prints, run with sh at
+// once. A probe which fails is recorded with whatever it printed, or as
+// unavailable.
+func TakeFingerprint(shellVersion string, probes []string) Fingerprint {
+	f := Fingerprint{ShellVersion: shellVersion, PathHash: hashPath(os.Getenv("PATH"))}
+
+	f.Tools = make([]ToolVersion, len(probes))
+	var wg sync.WaitGroup
+	for i, probe := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.Tools[i] = ToolVersion{Probe: probe, Version: runProbe(probe)}
+		}()
+	}
+	wg.Wait()
+	return f
+}
+
+// hashPath returns a short hash of the PATH, empty if there is none
+func hashPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:6])
+}
+
+// runProbe runs a probe and returns the first line it printed
+func runProbe(probe string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	// Tools print their versions to stdout or stderr as they please
+	output, _ := exec.CommandContext(ctx, "sh", "-c", probe).CombinedOutput()
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return truncate(line, maxProbeOutput)
+		}
+	}
+	return "unavailable"
+}
+
+// SetSessionFingerprint stores the fingerprint of the environment the named
+// session runs in
+func (db *DB) SetSessionFingerprint(name string, f Fingerprint) error {
+	encoded, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Exec("UPDATE sessions SET fingerprint = ? WHERE name = ?", string(encoded), name)
+	return err
+}
+
+// SessionFingerprint returns the fingerprint of the environment the named
+// session ran in, the zero Fingerprint if none was taken
+func (db *DB) SessionFingerprint(name string) (Fingerprint, error) {
+	var encoded string
+	err := db.reader.QueryRow("SELECT fingerprint FROM sessions WHERE name = ?", name).Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Fingerprint{}, nil
+	}
+	if err != nil || encoded == "" {
+		return Fingerprint{}, err
+	}
+
+	var f Fingerprint
+	err = json.Unmarshal([]byte(encoded), &f)
+	return f, err
+}
@@ -0,0 +1,58 @@
+package main_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestTakeFingerprint(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin:/bin")
+
+	f := rt.TakeFingerprint("5.9", []string{"echo; echo v1.2; echo v9", "exit 1"})
+	if f.ShellVersion != "5.9" {
+		t.Errorf("ShellVersion = %q, want 5.9", f.ShellVersion)
+	}
+	if len(f.PathHash) != 12 {
+		t.Errorf("PathHash = %q, want 12 hex digits", f.PathHash)
+	}
+	want := []rt.ToolVersion{
+		{Probe: "echo; echo v1.2; echo v9", Version: "v1.2"},
+		{Probe: "exit 1", Version: "unavailable"},
+	}
+	if !reflect.DeepEqual(f.Tools, want) {
+		t.Errorf("Tools = %+v, want %+v", f.Tools, want)
+	}
+
+	t.Setenv("PATH", "/usr/local/bin:/usr/bin:/bin")
+	if other := rt.TakeFingerprint("5.9", nil); other.PathHash == f.PathHash {
+		t.Error("Expected a different PATH to hash differently")
+	}
+}
+
+func TestSessionFingerprint(t *testing.T) {
+	database := openTestDB(t)
+
+	if err := database.StartSession(&rt.Session{Name: "s1", Start: time.Now()}); err != nil {
+		t.Fatalf("StartSession() unexpected error = %v", err)
+	}
+	got, err := database.SessionFingerprint("s1")
+	if err != nil || !got.IsZero() {
+		t.Fatalf("SessionFingerprint() = %+v, %v, want nothing before one is taken", got, err)
+	}
+
+	f := rt.Fingerprint{ShellVersion: "5.2.21", PathHash: "0123456789ab", Tools: []rt.ToolVersion{{Probe: "go version", Version: "go1.24"}}}
+	if err := database.SetSessionFingerprint("s1", f); err != nil {
+		t.Fatalf("SetSessionFingerprint() unexpected error = %v", err)
+	}
+	got, err = database.SessionFingerprint("s1")
+	if err != nil || !reflect.DeepEqual(got, f) {
+		t.Errorf("SessionFingerprint() = %+v, %v, want %+v", got, err, f)
+	}
+
+	if got, err := database.SessionFingerprint("unknown"); err != nil || !got.IsZero() {
+		t.Errorf("SessionFingerprint(unknown) = %+v, %v, want nothing", got, err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FixtureOptions describes the synthetic history GenerateFixture makes.
+type FixtureOptions struct {
+	// Records is how many records to generate
+	Records int
+
+	// Seed seeds the generator, the same seed giving the same history
+	Seed uint64
+
+	// End is when the last command ran, now if zero
+	End time.Time
+}
+
+// fixtureCommand is a command the generator draws from, with the arguments
+// it is run with, most common first
+type fixtureCommand struct {
+	command   string
+	arguments []string
+	failRate  float64       // Chance a run fails
+	duration  time.Duration // Typical time a run takes
+}
+
+// fixtureCommands are the commands of the generated histories, most common
+// first, which a Zipf distribution draws them in proportion to
+var fixtureCommands = []fixtureCommand{
+	{command: "git", arguments: []string{"status", "diff", "log --oneline", "pull", "push", "add -p", `commit -m "wip"`, "checkout main", "rebase -i main", "stash pop"}, failRate: 0.05, duration: 150 * time.Millisecond},
+	{command: "ls", arguments: []string{"", "-la", "-lh", "-1"}, failRate: 0.01, duration: 5 * time.Millisecond},
+	{command: "cd", arguments: []string{"..", "-", "~", "src"}, failRate: 0.02, duration: time.Millisecond},
+	{command: "make", arguments: []string{"", "test", "build", "clean", "install"}, failRate: 0.2, duration: 20 * time.Second},
+	{command: "go", arguments: []string{"test ./...", "build ./...", "vet ./...", "run .", "mod tidy"}, failRate: 0.15, duration: 8 * time.Second},
+	{command: "vim", arguments: []string{"main.go", "README.md", "Makefile", "config.toml"}, failRate: 0, duration: 4 * time.Minute},
+	{command: "grep", arguments: []string{"-rn TODO .", "-i error log.txt", "-rl func ."}, failRate: 0.3, duration: 200 * time.Millisecond},
+	{command: "docker", arguments: []string{"ps", "compose up -d", "compose logs -f", "build -t app .", "images", "system prune"}, failRate: 0.1, duration: 12 * time.Second},
+	{command: "cat", arguments: []string{"README.md", "go.mod", "/etc/hosts", ".env"}, failRate: 0.05, duration: 3 * time.Millisecond},
+	{command: "ssh", arguments: []string{"build-server", "prod-1", "-L 8080:localhost:8080 staging"}, failRate: 0.1, duration: 25 * time.Minute},
+	{command: "kubectl", arguments: []string{"get pods", "logs -f deploy/api", "describe pod api-0", "apply -f k8s/"}, failRate: 0.12, duration: 900 * time.Millisecond},
+	{command: "npm", arguments: []string{"install", "run dev", "test", "run build"}, failRate: 0.18, duration: 30 * time.Second},
+	{command: "curl", arguments: []string{"-s localhost:8080/health", "-I https://example.com", "-sSL https://example.com/install.sh"}, failRate: 0.15, duration: 400 * time.Millisecond},
+	{command: "rm", arguments: []string{"-rf build", "-rf node_modules", "*.tmp"}, failRate: 0.02, duration: 50 * time.Millisecond},
+	{command: "htop", arguments: []string{""}, failRate: 0, duration: 2 * time.Minute},
+	{command: "python3", arguments: []string{"-m venv .venv", "manage.py runserver", "-m pytest", "script.py"}, failRate: 0.2, duration: 6 * time.Second},
+	{command: "terraform", arguments: []string{"plan", "apply", "init", "fmt"}, failRate: 0.25, duration: 45 * time.Second},
+	{command: "systemctl", arguments: []string{"status nginx", "restart nginx", "--user daemon-reload"}, failRate: 0.1, duration: 300 * time.Millisecond},
+	{command: "tar", arguments: []string{"xzf release.tar.gz", "czf backup.tar.gz data"}, failRate: 0.05, duration: 3 * time.Second},
+	{command: "gti", arguments: []string{"status"}, failRate: 1, duration: time.Millisecond},
+}
+
+// fixtureRepos are the git repositories commands run in, most visited
+// first, with the branches checked out in them
+var fixtureRepos = []struct {
+	dir      string
+	branches []string
+	subdirs  []string
+}{
+	{dir: "/home/dev/src/retour", branches: []string{"main", "feature/picker", "fix/paging"}, subdirs: []string{"", "proto"}},
+	{dir: "/home/dev/src/api", branches: []string{"main", "release/2.1"}, subdirs: []string{"", "cmd/server", "internal/store"}},
+	{dir: "/home/dev/src/website", branches: []string{"main", "redesign"}, subdirs: []string{"", "src/components"}},
+	{dir: "/home/dev/src/infra", branches: []string{"main"}, subdirs: []string{"", "k8s", "terraform"}},
+	{dir: "/home/dev/src/dotfiles", branches: []string{"master"}, subdirs: []string{""}},
+}
+
+// fixtureDirs are the directories outside a repository commands run in
+var fixtureDirs = []string{"/home/dev", "/tmp", "/home/dev/Downloads", "/etc/nginx", "/var/log"}
+
+// fixtureHosts are the machines sessions run on, most used first
+var fixtureHosts = []string{"laptop", "laptop", "laptop", "build-server", "desktop"}
+
+// GenerateFixture returns a realistic synthetic history of options.Records
+// records, oldest first, for benchmarks, demonstrations and tests: commands
+// are run with a power-law frequency, in sessions separated by breaks, each
+// on a host and mostly in the directories of a few git repositories. The
+// same options always give the same history.
+func GenerateFixture(options FixtureOptions) []Record {
+	end := options.End
+	if end.IsZero() {
+		end = time.Now()
+	}
+	r := rand.New(rand.NewPCG(options.Seed, options.Seed^0x5eed))
+	commands := rand.NewZipf(r, 1.3, 1, uint64(len(fixtureCommands)-1))
+	repos := rand.NewZipf(r, 1.5, 1, uint64(len(fixtureRepos)-1))
+
+	records := make([]Record, options.Records)
+	var offset time.Duration // Since the first command
+	var session, host, dir, repo, branch string
+	remaining := 0 // Commands left in the session
+	for i := range records {
+		if remaining == 0 {
+			// A new session starts after a break of up to a day
+			if i > 0 {
+				offset += time.Duration(30+r.IntN(24*60)) * time.Minute
+			}
+			remaining = 5 + r.IntN(60)
+			session = fmt.Sprintf("fixture-%d", i)
+			host = fixtureHosts[r.IntN(len(fixtureHosts))]
+			dir, repo, branch = fixtureDir(r, repos)
+		} else if r.IntN(8) == 0 {
+			// Now and then the session moves elsewhere
+			dir, repo, branch = fixtureDir(r, repos)
+		}
+		remaining--
+
+		command := fixtureCommands[commands.Uint64()]
+		arguments := command.arguments[min(r.IntN(len(command.arguments)), r.IntN(len(command.arguments)))]
+		exitStatus := 0
+		if r.Float64() < command.failRate {
+			exitStatus = fixtureExitStatus(r, command.command)
+		}
+		// Durations vary log-normally around the typical one
+		duration := time.Duration(float64(command.duration) * math.Exp(r.NormFloat64()*0.6))
+
+		records[i] = Record{
+			Command:          command.command,
+			Arguments:        arguments,
+			Timestamp:        end.Add(offset),
+			WorkingDirectory: dir,
+			ExitStatus:       exitStatus,
+			Duration:         duration.Round(time.Millisecond),
+			Session:          session,
+			Hostname:         host,
+			Repo:             repo,
+			Branch:           branch,
+		}
+		// The next command follows once this one finishes and the user has
+		// thought for a while
+		offset += duration + time.Duration(1+r.IntN(300))*time.Second
+	}
+
+	// The history is shifted back so that the last command ran at end
+	if len(records) > 0 {
+		shift := end.Sub(records[len(records)-1].Timestamp)
+		for i := range records {
+			records[i].Timestamp = records[i].Timestamp.Add(shift).Round(time.Millisecond)
+		}
+	}
+	return records
+}
+
+// fixtureDir picks the directory a session moves to: mostly somewhere in one
+// of the repositories, drawn by repos, on one of its branches
+func fixtureDir(r *rand.Rand, repos *rand.Zipf) (dir, repo, branch string) {
+	if r.IntN(5) == 0 {
+		return fixtureDirs[r.IntN(len(fixtureDirs))], "", ""
+	}
+	chosen := fixtureRepos[repos.Uint64()]
+	dir = filepath.Join(chosen.dir, chosen.subdirs[r.IntN(len(chosen.subdirs))])
+	return dir, chosen.dir, chosen.branches[r.IntN(len(chosen.branches))]
+}
+
+// fixtureExitStatus picks the status a failed run of command exits with,
+// spread over the exit classes
+func fixtureExitStatus(r *rand.Rand, command string) int {
+	if command == "gti" {
+		return 127
+	}
+	switch n := r.IntN(20); {
+	case n < 14:
+		return 1
+	case n < 17:
+		return 2
+	case n < 19:
+		return 130
+	default:
+		return 126
+	}
+}
+
+// WriteFixture generates a history as GenerateFixture does and imports it
+// into the retour database at path, creating it if need be. Returns the
+// number of records inserted.
+func WriteFixture(path string, options FixtureOptions) (int, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, fmt.Errorf("failed to create database directory: %w", err)
+	}
+	db, err := NewDB(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return db.Import(GenerateFixture(options))
+}
+
+// runGenFixture implements the gen-fixture subcommand, which writes a
+// synthetic history into a database file of its own
+func runGenFixture(config *Config, args []string) error {
+	flags := flag.NewFlagSet("gen-fixture", flag.ContinueOnError)
+	records := flags.Int("records", 10000, "Number of records to generate")
+	seed := flags.Uint64("seed", 1, "Seed of the generator, the same seed giving the same history")
+	out := flags.String("out", "retour-fixture.db", "Database file to write the history into")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *records < 0 {
+		return fmt.Errorf("--records must not be negative, got %d", *records)
+	}
+
+	inserted, err := WriteFixture(*out, FixtureOptions{Records: *records, Seed: *seed})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d records to %s\n", inserted, *out)
+	return nil
+}
+
+// runDemo implements the demo subcommand, which shows the picker over a
+// synthetic history kept in a temporary database, so it can be tried without
+// the shell hooks and without touching the real history
+func runDemo(config *Config, args []string) error {
+	flags := flag.NewFlagSet("demo", flag.ContinueOnError)
+	records := flags.Int("records", 5000, "Number of records in the synthetic history")
+	seed := flags.Uint64("seed", 1, "Seed of the generator, the same seed giving the same history")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *records < 0 {
+		return fmt.Errorf("--records must not be negative, got %d", *records)
+	}
+
+	dir, err := os.MkdirTemp("", "retour-demo")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.db")
+	if _, err := WriteFixture(path, FixtureOptions{Records: *records, Seed: *seed}); err != nil {
+		return err
+	}
+
+	// The picker is set up as configured, but over the demo history alone
+	demo := *config
+	demo.ConnectionString = path
+	demo.Attach = nil
+	demo.EncryptionKeyFile = ""
+	demo.SavedSearch = ""
+	return runInteractive(&demo)
+}
@@ -0,0 +1,74 @@
+package main_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestGenerateFixture(t *testing.T) {
+	end := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	options := rt.FixtureOptions{Records: 5000, Seed: 42, End: end}
+	records := rt.GenerateFixture(options)
+	if len(records) != options.Records {
+		t.Fatalf("GenerateFixture() = %d records, want %d", len(records), options.Records)
+	}
+	if again := rt.GenerateFixture(options); !reflect.DeepEqual(records, again) {
+		t.Error("GenerateFixture() differed for the same seed")
+	}
+	options.Seed = 43
+	if other := rt.GenerateFixture(options); reflect.DeepEqual(records, other) {
+		t.Error("GenerateFixture() was the same for another seed")
+	}
+
+	if last := records[len(records)-1].Timestamp; !last.Equal(end) {
+		t.Errorf("Last timestamp = %v, want %v", last, end)
+	}
+	counts := map[string]int{}
+	sessions := map[string]bool{}
+	failed := 0
+	for i, r := range records {
+		if i > 0 && !r.Timestamp.After(records[i-1].Timestamp) {
+			t.Fatalf("Record %d ran at %v, not after the one before at %v", i, r.Timestamp, records[i-1].Timestamp)
+		}
+		if r.Command == "" || r.WorkingDirectory == "" || r.Session == "" || r.Hostname == "" {
+			t.Fatalf("Record %d = %+v, want a command, directory, session and host", i, r)
+		}
+		counts[r.Command]++
+		sessions[r.Session] = true
+		if r.ExitStatus != 0 {
+			failed++
+		}
+	}
+
+	// Frequency follows a power law: the commonest command far outruns the rest
+	if counts["git"] < 3*counts["make"] || counts["make"] <= counts["tar"] {
+		t.Errorf("Command counts = %v, want git well ahead of make, ahead of tar", counts)
+	}
+	if len(sessions) < 50 {
+		t.Errorf("Generated %d sessions, want the history split into many", len(sessions))
+	}
+	if failed == 0 || failed > len(records)/4 {
+		t.Errorf("Generated %d failures, want some but not most", failed)
+	}
+}
+
+func TestWriteFixture(t *testing.T) {
+	path := t.TempDir() + "/fixtures/history.db"
+	inserted, err := rt.WriteFixture(path, rt.FixtureOptions{Records: 300, Seed: 7})
+	if err != nil || inserted != 300 {
+		t.Fatalf("WriteFixture() = %d, %v, want 300 records", inserted, err)
+	}
+
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer database.Close()
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 0)
+	if err != nil || len(records) != 300 {
+		t.Errorf("QueryFiltered() = %d records, %v, want 300", len(records), err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// flagSet wraps flag.FlagSet so that each option is declared once with both
+// its short and long names, and remembers which options were given
+// explicitly on the command line.
+type flagSet struct {
+	flags *flag.FlagSet
+	// long maps every registered name to the option's long name
+	long map[string]string
+	// set holds the value of each option given on the command line, by long name
+	set map[string]string
+}
+
+func newFlagSet(name string, handling flag.ErrorHandling) *flagSet {
+	return &flagSet{
+		flags: flag.NewFlagSet(name, handling),
+		long:  map[string]string{},
+		set:   map[string]string{},
+	}
+}
+
+// StringVar registers a string option under its long name and, unless short
+// is empty, its short name too.
+func (f *flagSet) StringVar(p *string, short, long, value, usage string) {
+	f.flags.StringVar(p, long, value, usage)
+	f.alias(short, long)
+}
+
+// IntVar registers an int option under its long name and, unless short is
+// empty, its short name too.
+func (f *flagSet) IntVar(p *int, short, long string, value int, usage string) {
+	f.flags.IntVar(p, long, value, usage)
+	f.alias(short, long)
+}
+
+// BoolVar registers a bool option under its long name and, unless short is
+// empty, its short name too.
+func (f *flagSet) BoolVar(p *bool, short, long string, value bool, usage string) {
+	f.flags.BoolVar(p, long, value, usage)
+	f.alias(short, long)
+}
+
+// Var registers an option with a custom value under its long name and, unless
+// short is empty, its short name too. The value's current state is the default.
+func (f *flagSet) Var(value flag.Value, short, long, usage string) {
+	f.flags.Var(value, long, usage)
+	f.alias(short, long)
+}
+
+// alias registers short as another name for the already defined long option
+func (f *flagSet) alias(short, long string) {
+	f.long[long] = long
+	if short == "" {
+		return
+	}
+	option := f.flags.Lookup(long)
+	f.flags.Var(option.Value, short, option.Usage)
+	f.long[short] = long
+}
+
+// Parse parses the arguments and records which options were given
+func (f *flagSet) Parse(args []string) error {
+	if err := f.flags.Parse(args); err != nil {
+		return err
+	}
+	f.flags.Visit(func(option *flag.Flag) {
+		f.set[f.long[option.Name]] = option.Value.String()
+	})
+	return nil
+}
+
+// Args returns the arguments remaining after the options
+func (f *flagSet) Args() []string {
+	return f.flags.Args()
+}
+
+// IsSet reports whether the option with the given long name was given on the
+// command line, under either of its names.
+func (f *flagSet) IsSet(long string) bool {
+	_, ok := f.set[long]
+	return ok
+}
+
+// Set sets the option with the given long name as though it had been given
+// on the command line, without recording it as given.
+func (f *flagSet) Set(long, value string) error {
+	return f.flags.Set(long, value)
+}
+
+// Given returns the long names of the options given on the command line
+func (f *flagSet) Given() []string {
+	names := make([]string, 0, len(f.set))
+	for long := range f.set {
+		names = append(names, long)
+	}
+	return names
+}
+
+// Apply sets the bound variables to the values given on the command line
+// again, overriding any changes made to them since they were parsed, e.g.
+// by lower precedence sources such as the config file.
+func (f *flagSet) Apply() error {
+	for long, value := range f.set {
+		if err := f.flags.Set(long, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typedString adapts a string based type, such as ResultFilter, to flag.Value
+// so the option can be bound to it directly.
+type typedString[T ~string] struct {
+	p *T
+}
+
+func (s typedString[T]) String() string {
+	if s.p == nil {
+		return ""
+	}
+	return string(*s.p)
+}
+
+func (s typedString[T]) Set(value string) error {
+	*s.p = T(value)
+	return nil
+}
+
+// stringList adapts a list of strings to flag.Value, each use of the option
+// adding a value to it. The list is written one value a line, which Set
+// splits again, so that Apply can set it again as a whole.
+type stringList struct {
+	p *[]string
+}
+
+func (s stringList) String() string {
+	if s.p == nil {
+		return ""
+	}
+	return strings.Join(*s.p, "\n")
+}
+
+func (s stringList) Set(value string) error {
+	*s.p = append(*s.p, strings.Split(value, "\n")...)
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// RecordWriter writes records one at a time in a particular output format.
+// It is shared by all of the non-interactive modes so they format records
+// consistently. Flush must be called once all records have been written.
+type RecordWriter interface {
+	Write(r Record) error
+	Flush() error
+}
+
+// NewRecordWriter returns a RecordWriter producing the given format on w.
+func NewRecordWriter(w io.Writer, format OutputFormat) (RecordWriter, error) {
+	switch format {
+	case TextFormat:
+		return &textWriter{w: w, columns: defaultColumns}, nil
+	case JSONFormat:
+		return &jsonWriter{encoder: json.NewEncoder(w)}, nil
+	case CSVFormat:
+		return newDelimitedWriter(w, ','), nil
+	case TSVFormat:
+		return newDelimitedWriter(w, '\t'), nil
+	case TemplateFormat:
+		return nil, fmt.Errorf("the template format needs a template, given with --template")
+	default:
+		return nil, fmt.Errorf("invalid output format: %s", format)
+	}
+}
+
+// NewTemplateWriter returns a RecordWriter executing a text/template over
+// each record on w, e.g. "{{.Timestamp}} {{.Command}} {{.Arguments}}". Each
+// record is written on a line of its own.
+func NewTemplateWriter(w io.Writer, text string) (RecordWriter, error) {
+	tmpl, err := template.New("record").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return &templateWriter{w: w, tmpl: tmpl}, nil
+}
+
+// NewColumnWriter returns a RecordWriter writing the columns of each record
+// to w as a tab separated line, as the text format does with its own. Times
+// are given relative to now, or exactly if now is zero.
+func NewColumnWriter(w io.Writer, columns Columns, now time.Time) RecordWriter {
+	return &textWriter{w: w, columns: columns, now: now}
+}
+
+// newFormatWriter returns the RecordWriter for format, executing tmpl for
+// the template format. The text format shows the columns, or its usual ones
+// if there are none, with times relative to now unless it is zero.
+func newFormatWriter(w io.Writer, format OutputFormat, tmpl string, columns Columns, now time.Time) (RecordWriter, error) {
+	switch format {
+	case TemplateFormat:
+		return NewTemplateWriter(w, tmpl)
+	case TextFormat:
+		if len(columns) == 0 {
+			columns = defaultColumns
+		}
+		return NewColumnWriter(w, columns, now), nil
+	}
+	return NewRecordWriter(w, format)
+}
+
+// WriteRecords writes records to w in the given format
+func WriteRecords(w io.Writer, format OutputFormat, records []Record) error {
+	writer, err := NewRecordWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if err := writer.Write(r); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// textWriter writes one tab separated line of columns per record for reading
+// by people
+type textWriter struct {
+	w       io.Writer
+	columns Columns
+	now     time.Time
+}
+
+func (t *textWriter) Write(r Record) error {
+	_, err := fmt.Fprintln(t.w, strings.Join(t.columns.Render(r, t.now), "\t"))
+	return err
+}
+
+func (t *textWriter) Flush() error {
+	return nil
+}
+
+// templateWriter writes each record as its template renders it
+type templateWriter struct {
+	w    io.Writer
+	tmpl *template.Template
+	line strings.Builder
+}
+
+func (t *templateWriter) Write(r Record) error {
+	t.line.Reset()
+	if err := t.tmpl.Execute(&t.line, r); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(t.line.String(), "\n") {
+		t.line.WriteByte('\n')
+	}
+	_, err := io.WriteString(t.w, t.line.String())
+	return err
+}
+
+func (t *templateWriter) Flush() error {
+	return nil
+}
+
+// jsonWriter writes one JSON object per line
+type jsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonWriter) Write(r Record) error {
+	return j.encoder.Encode(r)
+}
+
+func (j *jsonWriter) Flush() error {
+	return nil
+}
+
+// delimitedHeader names the columns written by delimitedWriter, matching the JSON keys
+var delimitedHeader = []string{
+	"id", "command", "arguments", "timestamp", "working_directory", "exit_status", "duration_ms", "session", "hostname", "rerun_of", "repo", "branch",
+}
+
+// delimitedWriter writes CSV or TSV with a header row, quoting fields as needed
+type delimitedWriter struct {
+	w             *csv.Writer
+	headerWritten bool
+}
+
+func newDelimitedWriter(w io.Writer, separator rune) *delimitedWriter {
+	writer := csv.NewWriter(w)
+	writer.Comma = separator
+	return &delimitedWriter{w: writer}
+}
+
+func (d *delimitedWriter) Write(r Record) error {
+	if err := d.writeHeader(); err != nil {
+		return err
+	}
+
+	return d.w.Write([]string{
+		strconv.FormatInt(r.ID, 10),
+		r.Command,
+		r.Arguments,
+		r.Timestamp.Format(time.RFC3339),
+		r.WorkingDirectory,
+		strconv.Itoa(r.ExitStatus),
+		strconv.FormatInt(r.Duration.Milliseconds(), 10),
+		r.Session,
+		r.Hostname,
+		formatRerunOf(r.RerunOf),
+		r.Repo,
+		r.Branch,
+	})
+}
+
+// Flush writes any buffered rows, including the header when there were no records
+func (d *delimitedWriter) Flush() error {
+	if err := d.writeHeader(); err != nil {
+		return err
+	}
+	d.w.Flush()
+	return d.w.Error()
+}
+
+func (d *delimitedWriter) writeHeader() error {
+	if d.headerWritten {
+		return nil
+	}
+	d.headerWritten = true
+	return d.w.Write(delimitedHeader)
+}
+
+// formatRerunOf renders the ID of the record a command replayed, or nothing
+// for commands typed afresh, matching the JSON which omits it
+func formatRerunOf(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
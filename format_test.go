@@ -0,0 +1,141 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestWriteRecordsJSON(t *testing.T) {
+	records := []rt.Record{
+		{Command: "ls", Timestamp: time.Now().UTC()},
+		{Command: "git", Arguments: "status", Timestamp: time.Now().UTC()},
+	}
+
+	var buf bytes.Buffer
+	if err := rt.WriteRecords(&buf, rt.JSONFormat, records); err != nil {
+		t.Fatalf("WriteRecords() unexpected error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(records) {
+		t.Fatalf("Expected %d lines, got %d", len(records), len(lines))
+	}
+	for i, line := range lines {
+		var r rt.Record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("Line %d is not valid JSON: %v", i, err)
+		}
+		if r.CommandLine() != records[i].CommandLine() {
+			t.Errorf("Line %d command = %q, want %q", i, r.CommandLine(), records[i].CommandLine())
+		}
+	}
+}
+
+func TestWriteRecordsDelimited(t *testing.T) {
+	records := []rt.Record{
+		{
+			ID:               1,
+			Command:          "git",
+			Arguments:        `commit -m "first, second"`,
+			Timestamp:        time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			WorkingDirectory: "/project",
+			ExitStatus:       1,
+			Duration:         2 * time.Second,
+			Session:          "s1",
+			Repo:             "/project",
+			Branch:           "main",
+		},
+	}
+
+	tests := []struct {
+		format rt.OutputFormat
+		want   string
+	}{
+		{
+			format: rt.CSVFormat,
+			want: "id,command,arguments,timestamp,working_directory,exit_status,duration_ms,session,hostname,rerun_of,repo,branch\n" +
+				`1,git,"commit -m ""first, second""",2024-05-01T12:00:00Z,/project,1,2000,s1,,,/project,main` + "\n",
+		},
+		{
+			format: rt.TSVFormat,
+			want: "id\tcommand\targuments\ttimestamp\tworking_directory\texit_status\tduration_ms\tsession\thostname\trerun_of\trepo\tbranch\n" +
+				"1\tgit\t\"commit -m \"\"first, second\"\"\"\t2024-05-01T12:00:00Z\t/project\t1\t2000\ts1\t\t\t/project\tmain\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := rt.WriteRecords(&buf, tt.format, records); err != nil {
+				t.Fatalf("WriteRecords() unexpected error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("WriteRecords() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateWriter(t *testing.T) {
+	records := []rt.Record{
+		{Command: "git", Arguments: "status", ExitStatus: 0, Duration: 2 * time.Second},
+		{Command: "make", ExitStatus: 2},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{name: "One line per record", template: "{{.ExitStatus}} {{.Command}} {{.Arguments}}", want: "0 git status\n2 make \n"},
+		{name: "Methods", template: "{{.CommandLine}} took {{.Duration}}\n", want: "git status took 2s\nmake took 0s\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, err := rt.NewTemplateWriter(&buf, tt.template)
+			if err != nil {
+				t.Fatalf("NewTemplateWriter() unexpected error = %v", err)
+			}
+			for _, r := range records {
+				if err := writer.Write(r); err != nil {
+					t.Fatalf("Write() unexpected error = %v", err)
+				}
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("Wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Fields records don't have are reported rather than written empty
+	writer, err := rt.NewTemplateWriter(&bytes.Buffer{}, "{{.Cmd}}")
+	if err != nil {
+		t.Fatalf("NewTemplateWriter() unexpected error = %v", err)
+	}
+	if err := writer.Write(records[0]); err == nil {
+		t.Error("Write() accepted a template naming a missing field")
+	}
+}
+
+func TestWriteRecordsHeaderOnly(t *testing.T) {
+	var buf bytes.Buffer
+	if err := rt.WriteRecords(&buf, rt.CSVFormat, nil); err != nil {
+		t.Fatalf("WriteRecords() unexpected error = %v", err)
+	}
+	if got := strings.Count(buf.String(), "\n"); got != 1 {
+		t.Errorf("Expected only a header line, got %q", buf.String())
+	}
+}
+
+func TestNewRecordWriterInvalidFormat(t *testing.T) {
+	if _, err := rt.NewRecordWriter(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("Want error for invalid format, got nil")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitInfo returns the root of the git repository containing dir and the
+// branch checked out there. Both are empty outside a repository; the branch
+// is the abbreviated commit when the HEAD is detached. The repository is
+// found by reading .git directly, rather than running git, as it is looked
+// up after every command.
+func GitInfo(dir string) (repo, branch string) {
+	root, gitDir, ok := findRepo(dir)
+	if !ok {
+		return "", ""
+	}
+
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return root, ""
+	}
+	ref := strings.TrimSpace(string(head))
+	if name, ok := strings.CutPrefix(ref, "ref: refs/heads/"); ok {
+		return root, name
+	}
+	if len(ref) > 12 {
+		ref = ref[:12]
+	}
+	return root, ref
+}
+
+// findRepo walks up from dir to the first directory containing .git,
+// returning it and the git directory. In worktrees and submodules .git is a
+// file pointing at the git directory.
+func findRepo(dir string) (root, gitDir string, ok bool) {
+	if dir == "" {
+		return "", "", false
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", false
+	}
+
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		if info, err := os.Stat(dotGit); err == nil {
+			if info.IsDir() {
+				return dir, dotGit, true
+			}
+			if target, ok := readGitFile(dotGit); ok {
+				return dir, target, true
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		dir = parent
+	}
+}
+
+// readGitFile reads the "gitdir: <path>" file git leaves in place of the .git
+// directory, resolving the path relative to the file
+func readGitFile(path string) (string, bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	target, ok := strings.CutPrefix(strings.TrimSpace(string(content)), "gitdir: ")
+	if !ok {
+		return "", false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	return target, true
+}
@@ -0,0 +1,134 @@
+package main_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+// makeRepo creates a directory laid out like a git repository with HEAD
+// holding head
+func makeRepo(t *testing.T, head string) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, ".git"), 0o755); err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, ".git", "HEAD"), []byte(head+"\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write HEAD: %v", err)
+	}
+	return root
+}
+
+func TestGitInfo(t *testing.T) {
+	repo := makeRepo(t, "ref: refs/heads/release-1.4")
+	nested := filepath.Join(repo, "src", "pkg")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	detached := makeRepo(t, "0123456789abcdef0123456789abcdef01234567")
+
+	// A worktree has a .git file pointing at its own git directory
+	worktree := t.TempDir()
+	worktreeGit := filepath.Join(repo, ".git", "worktrees", "feature")
+	if err := os.MkdirAll(worktreeGit, 0o755); err != nil {
+		t.Fatalf("Failed to create worktree: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(worktreeGit, "HEAD"), []byte("ref: refs/heads/feature/x\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write HEAD: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: "+worktreeGit+"\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write .git file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		dir        string
+		wantRepo   string
+		wantBranch string
+	}{
+		{name: "Root", dir: repo, wantRepo: repo, wantBranch: "release-1.4"},
+		{name: "Nested", dir: nested, wantRepo: repo, wantBranch: "release-1.4"},
+		{name: "Detached", dir: detached, wantRepo: detached, wantBranch: "0123456789ab"},
+		{name: "Worktree", dir: worktree, wantRepo: worktree, wantBranch: "feature/x"},
+		{name: "Outside", dir: t.TempDir()},
+		{name: "Unknown", dir: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, branch := rt.GitInfo(tt.dir)
+			if repo != tt.wantRepo || branch != tt.wantBranch {
+				t.Errorf("GitInfo() = %q, %q, want %q, %q", repo, branch, tt.wantRepo, tt.wantBranch)
+			}
+		})
+	}
+}
+
+func TestScopeRepoAndBranch(t *testing.T) {
+	database := openTestDB(t)
+
+	for _, r := range []struct {
+		line   string
+		repo   string
+		branch string
+	}{
+		{"make release", "/src/app", "release-1.4"},
+		{"git cherry-pick abc", "/src/app", "release-1.4"},
+		{"make test", "/src/app", "main"},
+		{"make test", "/src/lib", "release-1.4"},
+		{"ls", "", ""},
+	} {
+		record := rt.NewRecord(r.line, r.repo, 0, time.Now())
+		record.Repo, record.Branch = r.repo, r.branch
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		scope rt.Scope
+		want  int
+	}{
+		{name: "Repo", scope: rt.Scope{Repo: "/src/app"}, want: 3},
+		{name: "Branch", scope: rt.Scope{Branch: "release-1.4"}, want: 3},
+		{name: "Both", scope: rt.Scope{Repo: "/src/app", Branch: "release-1.4"}, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := database.QueryFiltered(0, "all", tt.scope, 0)
+			if err != nil {
+				t.Fatalf("QueryFiltered() unexpected error = %v", err)
+			}
+			if len(records) != tt.want {
+				t.Fatalf("QueryFiltered() = %+v, want %d records", records, tt.want)
+			}
+			for _, r := range records {
+				if (tt.scope.Repo != "" && r.Repo != tt.scope.Repo) || (tt.scope.Branch != "" && r.Branch != tt.scope.Branch) {
+					t.Errorf("QueryFiltered() returned %+v outside %+v", r, tt.scope)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigScopeFindsRepo(t *testing.T) {
+	repo := makeRepo(t, "ref: refs/heads/main")
+	nested := filepath.Join(repo, "src")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	config, err := rt.LoadConfig(makeConfigFile(t), []string{"cmd", "--repo", nested, "--branch", "main"})
+	if err != nil {
+		t.Fatalf("LoadConfig() unexpected error = %v", err)
+	}
+	if got := config.Scope(); got.Repo != repo || got.Branch != "main" {
+		t.Errorf("Scope() = %+v, want repo %q on main", got, repo)
+	}
+}
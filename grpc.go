@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/nuchs/retour/proto/retourv1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The daemon can also serve the History service of proto/retour.proto over
+// gRPC, for editors and remote agents which would rather use a generated
+// client than the JSON line protocol. It listens on a Unix socket of its own,
+// readable only by the user like the first, and shares the daemon's writer,
+// exclusions, redaction and limits.
+
+// historyServer implements the History service for a daemon
+type historyServer struct {
+	retourv1.UnimplementedHistoryServer
+	daemon *Daemon
+}
+
+// newGRPCServer returns a server of d's History service, rate limiting each
+// client process's requests other than inserts as the Unix socket does
+func (d *Daemon) newGRPCServer() *grpc.Server {
+	server := grpc.NewServer(
+		grpc.Creds(peerCredentials{}),
+		grpc.UnaryInterceptor(d.limitGRPC),
+	)
+	retourv1.RegisterHistoryServer(server, &historyServer{daemon: d})
+	return server
+}
+
+// limitGRPC refuses requests from a client which has run out of its rate
+// limit. Inserts are let through, as records are on the Unix socket.
+func (d *Daemon) limitGRPC(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if info.FullMethod != retourv1.History_Insert_FullMethodName && !d.allow(grpcPeerPID(ctx)) {
+		return nil, status.Error(codes.ResourceExhausted, "too many requests, slow down")
+	}
+	return handler(ctx, request)
+}
+
+// Insert stores a record through the daemon's writer, after its exclusion
+// patterns and redaction. An excluded record is answered with ID 0.
+func (s *historyServer) Insert(ctx context.Context, request *retourv1.InsertRequest) (*retourv1.InsertResponse, error) {
+	record := request.GetRecord()
+	if record.GetCommand() == "" || record.GetTimestamp() == nil {
+		return nil, status.Error(codes.InvalidArgument, "a record needs a command and a timestamp")
+	}
+	id, err := s.daemon.record(recordFromProto(record))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &retourv1.InsertResponse{Id: id}, nil
+}
+
+// QueryFiltered returns the most recent records matching the filter, within
+// the daemon's limits
+func (s *historyServer) QueryFiltered(ctx context.Context, request *retourv1.QueryFilteredRequest) (*retourv1.Records, error) {
+	result := ResultFilter(request.GetResult())
+	switch result {
+	case SuccessResults, FailedResults, AllResults:
+		// valid
+	case "":
+		result = AllResults
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid result filter: %s", result)
+	}
+	if request.GetLimit() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must not be negative, got %d", request.GetLimit())
+	}
+
+	records, err := s.daemon.query(ctx, int(request.GetLimit()), func(db *DB, limit int) ([]Record, error) {
+		return db.QueryFiltered(request.GetMaxAge().AsDuration(), string(result), scopeFromProto(request.GetScope()), limit)
+	})
+	if err != nil {
+		return nil, queryStatus(err)
+	}
+	return recordsToProto(records), nil
+}
+
+// Search runs a search as the picker would, within the daemon's limits
+func (s *historyServer) Search(ctx context.Context, request *retourv1.SearchRequest) (*retourv1.Records, error) {
+	search := Search{
+		TimeRange: TimeRange(request.GetTimeRange()),
+		Result:    ResultFilter(request.GetResult()),
+		Scope:     scopeFromProto(request.GetScope()),
+		Unique:    request.GetUnique(),
+		Here:      request.GetHere(),
+		Limit:     int(request.GetLimit()),
+		Filter:    request.GetFilter(),
+		Match:     MatchMode(request.GetMatch()),
+	}
+	if search.Result == "" {
+		search.Result = AllResults
+	}
+	if err := search.Validate(); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	records, err := s.daemon.search(ctx, search)
+	if err != nil {
+		return nil, queryStatus(err)
+	}
+	return recordsToProto(records), nil
+}
+
+// Prune removes the records run before a time, other than the starred ones
+// and those tagged with a keep tag, through the daemon's writer
+func (s *historyServer) Prune(ctx context.Context, request *retourv1.PruneRequest) (*retourv1.PruneResponse, error) {
+	if request.GetBefore() == nil {
+		return nil, status.Error(codes.InvalidArgument, "prune needs a time to prune before")
+	}
+	pruned, err := s.daemon.pruneBefore(request.GetBefore().AsTime())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &retourv1.PruneResponse{Pruned: int64(pruned)}, nil
+}
+
+// queryStatus returns the status a failed query is answered with
+func queryStatus(err error) error {
+	if errors.Is(err, errRequestTimeout) {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// recordFromProto returns the record a request carries
+func recordFromProto(r *retourv1.Record) Record {
+	return Record{
+		Command:          r.GetCommand(),
+		Arguments:        r.GetArguments(),
+		Timestamp:        r.GetTimestamp().AsTime().Local(),
+		WorkingDirectory: r.GetWorkingDirectory(),
+		ExitStatus:       int(r.GetExitStatus()),
+		Duration:         r.GetDuration().AsDuration(),
+		Session:          r.GetSession(),
+		Hostname:         r.GetHostname(),
+		RerunOf:          r.GetRerunOf(),
+		Repo:             r.GetRepo(),
+		Branch:           r.GetBranch(),
+	}
+}
+
+// recordsToProto returns records as a response carries them
+func recordsToProto(records []Record) *retourv1.Records {
+	response := &retourv1.Records{Records: make([]*retourv1.Record, len(records))}
+	for i, r := range records {
+		record := &retourv1.Record{
+			Id:               r.ID,
+			Command:          r.Command,
+			Arguments:        r.Arguments,
+			Timestamp:        timestamppb.New(r.Timestamp),
+			WorkingDirectory: r.WorkingDirectory,
+			ExitStatus:       int32(r.ExitStatus),
+			Session:          r.Session,
+			Hostname:         r.Hostname,
+			RerunOf:          r.RerunOf,
+			Repo:             r.Repo,
+			Branch:           r.Branch,
+			Count:            int64(r.Count),
+			Starred:          r.Starred,
+		}
+		if r.Duration > 0 {
+			record.Duration = durationpb.New(r.Duration)
+		}
+		response.Records[i] = record
+	}
+	return response
+}
+
+// scopeFromProto returns the scope a request carries, the zero value if it
+// has none
+func scopeFromProto(s *retourv1.Scope) Scope {
+	return Scope{
+		Dir:       s.GetDir(),
+		Recursive: s.GetRecursive(),
+		Repo:      s.GetRepo(),
+		Branch:    s.GetBranch(),
+		Starred:   s.GetStarred(),
+		Tag:       s.GetTag(),
+	}
+}
+
+// peerCredentials stands in for TLS on the daemon's gRPC socket, which only
+// the user can connect to, and tells the server each client's process ID so
+// that it can be rate limited as on the Unix socket.
+type peerCredentials struct{}
+
+// peerAuthInfo is what peerCredentials knows of a client
+type peerAuthInfo struct {
+	credentials.CommonAuthInfo
+	pid int
+}
+
+func (peerAuthInfo) AuthType() string { return "peercred" }
+
+func (peerCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return insecure.NewCredentials().ClientHandshake(ctx, authority, conn)
+}
+
+func (peerCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	info := peerAuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity},
+		pid:            peerPID(conn),
+	}
+	return conn, info, nil
+}
+
+func (peerCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (c peerCredentials) Clone() credentials.TransportCredentials { return c }
+
+func (peerCredentials) OverrideServerName(string) error { return nil }
+
+// grpcPeerPID returns the process ID of the client making a request, or 0 if
+// it can't be told
+func grpcPeerPID(ctx context.Context) int {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return 0
+	}
+	info, ok := p.AuthInfo.(peerAuthInfo)
+	if !ok {
+		return 0
+	}
+	return info.pid
+}
+
+// DialGRPC connects to the History service a daemon serves over gRPC on the
+// socket at path. The connection is made when the first request is sent.
+func DialGRPC(path string) (retourv1.HistoryClient, *grpc.ClientConn, error) {
+	conn, err := grpc.NewClient("unix:"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial gRPC socket %s: %w", path, err)
+	}
+	return retourv1.NewHistoryClient(conn), conn, nil
+}
@@ -0,0 +1,193 @@
+package main_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+	"github.com/nuchs/retour/proto/retourv1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// startGRPC serves database over gRPC as well as on the daemon's socket,
+// returning a client of the History service, the gRPC socket's path and a
+// function stopping the daemon
+func startGRPC(t *testing.T, database *rt.DB, configFile string) (retourv1.HistoryClient, string, func() error) {
+	t.Helper()
+	daemon := newDaemon(t, database, configFile)
+	socket := filepath.Join(t.TempDir(), "grpc.sock")
+	listener, err := rt.ListenDaemon(socket)
+	if err != nil {
+		t.Fatalf("ListenDaemon() unexpected error = %v", err)
+	}
+	daemon.EnableGRPC(listener)
+	_, stop := serveDaemon(t, daemon)
+
+	client, conn, err := rt.DialGRPC(socket)
+	if err != nil {
+		t.Fatalf("DialGRPC() unexpected error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return client, socket, stop
+}
+
+// insert sends a record of line run at timestamp over gRPC, returning its ID
+func insert(t *testing.T, client retourv1.HistoryClient, line string, timestamp time.Time) int64 {
+	t.Helper()
+	command, arguments := rt.SplitCommandLine(line)
+	response, err := client.Insert(context.Background(), &retourv1.InsertRequest{Record: &retourv1.Record{
+		Command:          command,
+		Arguments:        arguments,
+		Timestamp:        timestamppb.New(timestamp),
+		WorkingDirectory: "/tmp",
+		Duration:         durationpb.New(time.Second),
+	}})
+	if err != nil {
+		t.Fatalf("Insert(%q) unexpected error = %v", line, err)
+	}
+	return response.GetId()
+}
+
+// commandLines returns the command lines of the records in a response
+func commandLines(records *retourv1.Records) []string {
+	var lines []string
+	for _, r := range records.GetRecords() {
+		rec := rt.Record{Command: r.GetCommand(), Arguments: r.GetArguments()}
+		lines = append(lines, rec.CommandLine())
+	}
+	return lines
+}
+
+func TestGRPCInsertAndSearch(t *testing.T) {
+	database := openTestDB(t)
+	client, socket, stop := startGRPC(t, database, "exclusion_patterns = [\"^sudo\"]\n[daemon]\nmax_results = 2\n")
+	ctx := context.Background()
+
+	now := time.Now()
+	if id := insert(t, client, "sudo reboot", now); id != 0 {
+		t.Errorf("Insert() of an excluded command = ID %d, want 0", id)
+	}
+	insert(t, client, "make build", now.Add(-3*time.Hour))
+	insert(t, client, "go test ./...", now.Add(-2*time.Hour))
+	if id := insert(t, client, "mysql --password=hunter2", now.Add(-time.Hour)); id == 0 {
+		t.Error("Insert() stored the mysql command without an ID")
+	}
+
+	records, err := client.Search(ctx, &retourv1.SearchRequest{Filter: "mysql"})
+	if err != nil {
+		t.Fatalf("Search() unexpected error = %v", err)
+	}
+	if got := commandLines(records); len(got) != 1 || got[0] != "mysql --password=REDACTED" {
+		t.Errorf("Search() = %q, want the redacted mysql command", got)
+	}
+	if d := records.GetRecords()[0].GetDuration().AsDuration(); d != time.Second {
+		t.Errorf("Search() duration = %v, want 1s", d)
+	}
+
+	// Both queries are held to max_results
+	records, err = client.QueryFiltered(ctx, &retourv1.QueryFilteredRequest{})
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	if got := commandLines(records); len(got) != 2 || got[0] != "mysql --password=REDACTED" || got[1] != "go test ./..." {
+		t.Errorf("QueryFiltered() = %q, want the two most recent commands", got)
+	}
+	records, err = client.QueryFiltered(ctx, &retourv1.QueryFilteredRequest{MaxAge: durationpb.New(150 * time.Minute), Limit: 5})
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	if got := commandLines(records); len(got) != 2 {
+		t.Errorf("QueryFiltered() within 150 minutes = %q, want two commands", got)
+	}
+	if records, err := client.Search(ctx, &retourv1.SearchRequest{}); err != nil || len(records.GetRecords()) != 2 {
+		t.Errorf("Search() = %d records, %v, want 2", len(records.GetRecords()), err)
+	}
+	checkStored(t, database, 3)
+
+	// Invalid requests are refused as such
+	for name, call := range map[string]func() error{
+		"Insert without a command": func() error {
+			_, err := client.Insert(ctx, &retourv1.InsertRequest{Record: &retourv1.Record{Timestamp: timestamppb.Now()}})
+			return err
+		},
+		"QueryFiltered of an unknown result": func() error {
+			_, err := client.QueryFiltered(ctx, &retourv1.QueryFilteredRequest{Result: "sometimes"})
+			return err
+		},
+		"Search here without a directory": func() error {
+			_, err := client.Search(ctx, &retourv1.SearchRequest{Here: true})
+			return err
+		},
+		"Prune without a time": func() error {
+			_, err := client.Prune(ctx, &retourv1.PruneRequest{})
+			return err
+		},
+	} {
+		if code := status.Code(call()); code != codes.InvalidArgument {
+			t.Errorf("%s: code = %v, want InvalidArgument", name, code)
+		}
+	}
+
+	// The gRPC socket goes when the daemon stops
+	if err := stop(); err != nil {
+		t.Fatalf("stop() unexpected error = %v", err)
+	}
+	if _, err := os.Stat(socket); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("gRPC socket after stopping: Stat() error = %v, want not exist", err)
+	}
+}
+
+func TestGRPCPrune(t *testing.T) {
+	database := openTestDB(t)
+	client, _, _ := startGRPC(t, database, "keep_tags = [\"keep\"]\n")
+	ctx := context.Background()
+
+	old := time.Now().AddDate(0, 0, -30)
+	insert(t, client, "echo expired", old)
+	starred := insert(t, client, "echo starred", old)
+	kept := insert(t, client, "echo kept", old)
+	insert(t, client, "echo recent", time.Now())
+	if err := database.SetStarred(starred, true); err != nil {
+		t.Fatalf("SetStarred() unexpected error = %v", err)
+	}
+	if err := database.Tag(kept, "keep"); err != nil {
+		t.Fatalf("Tag() unexpected error = %v", err)
+	}
+
+	response, err := client.Prune(ctx, &retourv1.PruneRequest{Before: timestamppb.New(time.Now().AddDate(0, 0, -7))})
+	if err != nil {
+		t.Fatalf("Prune() unexpected error = %v", err)
+	}
+	if response.GetPruned() != 1 {
+		t.Errorf("Prune() = %d pruned, want 1", response.GetPruned())
+	}
+	checkStored(t, database, 3)
+}
+
+func TestGRPCLimits(t *testing.T) {
+	database := openTestDB(t)
+	client, _, _ := startGRPC(t, database, "[daemon]\nrequests_per_second = 0.01\nburst = 1\n")
+	ctx := context.Background()
+
+	if _, err := client.Search(ctx, &retourv1.SearchRequest{}); err != nil {
+		t.Fatalf("Search() unexpected error = %v", err)
+	}
+	if _, err := client.QueryFiltered(ctx, &retourv1.QueryFilteredRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("QueryFiltered() beyond the burst error = %v, want ResourceExhausted", err)
+	}
+
+	// Records are stored however many searches were made
+	for range 3 {
+		if id := insert(t, client, "echo kept", time.Now()); id == 0 {
+			t.Error("Insert() beyond the burst stored no record")
+		}
+	}
+	checkStored(t, database, 3)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// IgnorePattern returns the exclusion pattern which ignores a command line:
+// the line itself, matched whole.
+func IgnorePattern(line string) string {
+	return "^" + regexp.QuoteMeta(line) + "$"
+}
+
+// DeleteMatching removes the records whose command lines match any of the
+// patterns, as Excluded matches them, returning how many were removed. Reruns
+// of them are kept, as if they had been typed afresh. Only this database's
+// records are removed, not those of attached ones.
+func (db *DB) DeleteMatching(patterns []string) (int, error) {
+	if _, err := Excluded("", patterns); err != nil {
+		return 0, err
+	}
+	if err := db.checkMutable("ignore", "remove records matching "+strings.Join(patterns, ", ")); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Command text may be encrypted, so it is matched once read
+	rows, err := tx.Query("SELECT id, command, COALESCE(arguments, '') FROM main.history")
+	if err != nil {
+		return 0, err
+	}
+	var matched []int64
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.ID, &r.Command, &r.Arguments); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := db.openRecord(&r); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to decrypt record %d: %w", r.ID, err)
+		}
+		if excluded, _ := Excluded(r.CommandLine(), patterns); excluded {
+			matched = append(matched, r.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, id := range matched {
+		if _, err := tx.Exec("UPDATE main.history SET rerun_of = NULL WHERE rerun_of = ?", id); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("DELETE FROM main.history WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if len(matched) > 0 {
+		db.events.Publish(RecordsDeleted{Count: len(matched)})
+	}
+	return len(matched), nil
+}
+
+// AddExclusionPattern adds pattern to the exclusion patterns of the config
+// file at path, creating the file if it doesn't exist. The rest of the file
+// is left as it was written.
+func AddExclusionPattern(path, pattern string) error {
+	if _, err := Excluded("", []string{pattern}); err != nil {
+		return err
+	}
+	text, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	edited, err := addExclusionPattern(string(text), pattern)
+	if err != nil {
+		return fmt.Errorf("failed to add to config file %s: %w", path, err)
+	}
+	if edited == string(text) {
+		return nil
+	}
+
+	// The file is replaced whole, so a failed write cannot leave half of it
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), ".config-*.toml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.WriteString(edited); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// tableHeader matches the line starting a TOML table
+var tableHeader = regexp.MustCompile(`^\s*\[\[?\s*[\w."' -]+\s*\]\]?\s*(#.*)?$`)
+
+// addExclusionPattern returns the text of a config file with pattern added
+// to its exclusion patterns: at the end of the exclusion_patterns array, or
+// in one of its own before the first table, as top-level keys must come
+// before tables. Text already holding pattern is returned as it is.
+func addExclusionPattern(text, pattern string) (string, error) {
+	var before struct {
+		Patterns []string `toml:"exclusion_patterns"`
+	}
+	if _, err := toml.Decode(text, &before); err != nil {
+		return "", err
+	}
+	if slices.Contains(before.Patterns, pattern) {
+		return text, nil
+	}
+
+	value := tomlString(pattern)
+	var edited string
+	if line := keyLine(text, toml.Key{"exclusion_patterns"}); line > 0 {
+		start := 0
+		for range line - 1 {
+			start += strings.IndexByte(text[start:], '\n') + 1
+		}
+		end, last, ok := arrayEnd(text, start)
+		if !ok {
+			return "", errors.New("exclusion_patterns is not an array")
+		}
+		separator := ", "
+		if text[last] == '[' || text[last] == ',' {
+			separator = " "
+		}
+		if text[last] == '[' && end == last+1 {
+			separator = ""
+		}
+		lineStart := strings.LastIndexByte(text[:end], '\n') + 1
+		if strings.TrimSpace(text[lineStart:end]) == "" && lineStart > last {
+			// The array ends on a line of its own, so the pattern gets one too
+			indent := text[lineStart:end] + "  "
+			comma := ""
+			if text[last] != '[' && text[last] != ',' {
+				comma = ","
+			}
+			edited = text[:last+1] + comma + text[last+1:lineStart] + indent + value + ",\n" + text[lineStart:]
+		} else {
+			edited = text[:end] + separator + value + text[end:]
+		}
+	} else {
+		entry := "exclusion_patterns = [" + value + "]\n"
+		lines := strings.SplitAfter(text, "\n")
+		i := slices.IndexFunc(lines, tableHeader.MatchString)
+		switch {
+		case i >= 0:
+			edited = strings.Join(lines[:i], "") + entry + "\n" + strings.Join(lines[i:], "")
+		case text == "" || strings.HasSuffix(text, "\n"):
+			edited = text + entry
+		default:
+			edited = text + "\n" + entry
+		}
+	}
+
+	// Whatever the file holds, the edit must have added the pattern alone
+	var after struct {
+		Patterns []string `toml:"exclusion_patterns"`
+	}
+	if _, err := toml.Decode(edited, &after); err != nil || !slices.Equal(after.Patterns, append(before.Patterns, pattern)) {
+		return "", errors.New("exclusion_patterns could not be edited")
+	}
+	return edited, nil
+}
+
+// arrayEnd finds the end of the array assigned on the line of text starting
+// at start: the index of its closing bracket and that of the last character
+// before it which is not space or a comment. Strings and comments are
+// skipped, so brackets within them are not counted.
+func arrayEnd(text string, start int) (end, last int, ok bool) {
+	i := strings.IndexByte(text[start:], '=')
+	if i < 0 {
+		return 0, 0, false
+	}
+	i += start + 1
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t') {
+		i++
+	}
+	if i >= len(text) || text[i] != '[' {
+		return 0, 0, false
+	}
+
+	depth := 0
+	for ; i < len(text); i++ {
+		switch c := text[i]; c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return i, last, true
+			}
+		case '#':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			continue
+		case '"', '\'':
+			i++
+			for i < len(text) && text[i] != c {
+				if c == '"' && text[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		last = i
+	}
+	return 0, 0, false
+}
+
+// tomlString writes s as a TOML string: a literal one, in which backslashes
+// need no escaping, unless s holds characters which only a basic one can
+func tomlString(s string) string {
+	if !strings.ContainsFunc(s, func(r rune) bool { return r == '\'' || r < ' ' && r != '\t' || r == 0x7f }) {
+		return "'" + s + "'"
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < ' ' && r != '\t' || r == 0x7f:
+			fmt.Fprintf(&b, `\u%04X`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// ignoreCommands returns an Ignorer which removes the commands matching a
+// pattern from db and adds the pattern to the exclusion patterns of config
+// and its file, so that they are not recorded again. The history is changed
+// first, so a history which cannot be leaves the file alone.
+func ignoreCommands(db *DB, config *Config) Ignorer {
+	return func(pattern string) (int, error) {
+		deleted, err := db.DeleteMatching([]string{pattern})
+		if err != nil {
+			return 0, err
+		}
+		if err := AddExclusionPattern(config.file, pattern); err != nil {
+			return deleted, err
+		}
+		config.ExclusionPatterns = append(config.ExclusionPatterns, pattern)
+		return deleted, nil
+	}
+}
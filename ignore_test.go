@@ -0,0 +1,153 @@
+package main_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	rt "github.com/nuchs/retour"
+)
+
+func TestDBDeleteMatching(t *testing.T) {
+	database := openTestDB(t)
+	now := time.Now()
+	var ids []int64
+	for i, line := range []string{"ls", "export TOKEN=secret", "ls -la", "export TOKEN=secret"} {
+		record := rt.NewRecord(line, "/", 0, now.Add(time.Duration(i-5)*time.Minute))
+		if i == 3 {
+			record.RerunOf = ids[1]
+		}
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+		ids = append(ids, record.ID)
+	}
+	rerun := rt.NewRecord("ls", "/", 0, now)
+	rerun.RerunOf = ids[1]
+	if err := database.Insert(&rerun); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+
+	// The pattern is matched whole, so ls -la stays
+	deleted, err := database.DeleteMatching([]string{rt.IgnorePattern("export TOKEN=secret"), rt.IgnorePattern("ls")})
+	if err != nil {
+		t.Fatalf("DeleteMatching() unexpected error = %v", err)
+	}
+	if deleted != 4 {
+		t.Errorf("DeleteMatching() = %d, want 4", deleted)
+	}
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	if len(records) != 1 || records[0].CommandLine() != "ls -la" {
+		t.Errorf("QueryFiltered() after deleting = %+v, want only ls -la", records)
+	}
+
+	if _, err := database.DeleteMatching([]string{"("}); err == nil {
+		t.Error("DeleteMatching() of an invalid pattern succeeded")
+	}
+	database.SetImmutable(true)
+	if _, err := database.DeleteMatching([]string{"ls"}); !errors.Is(err, rt.ErrImmutable) {
+		t.Errorf("DeleteMatching() on immutable history error = %v, want %v", err, rt.ErrImmutable)
+	}
+}
+
+func TestAddExclusionPattern(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "missing file",
+			want: "exclusion_patterns = ['^ls$']\n",
+		},
+		{
+			name: "no patterns",
+			text: "filter_mode = \"global\"",
+			want: "filter_mode = \"global\"\nexclusion_patterns = ['^ls$']\n",
+		},
+		{
+			name: "before the first table",
+			text: "filter_mode = \"global\"\n\n[keys]\nup = [\"ctrl+k\"]\n",
+			want: "filter_mode = \"global\"\n\nexclusion_patterns = ['^ls$']\n\n[keys]\nup = [\"ctrl+k\"]\n",
+		},
+		{
+			name: "inline array",
+			text: "exclusion_patterns = [\"^cd\"] # noisy\n",
+			want: "exclusion_patterns = [\"^cd\", '^ls$'] # noisy\n",
+		},
+		{
+			name: "empty array",
+			text: "exclusion_patterns = []\n",
+			want: "exclusion_patterns = ['^ls$']\n",
+		},
+		{
+			name: "multi-line array",
+			text: "exclusion_patterns = [\n    \"^cd\", # ] noisy\n    \"^pwd\"\n]\n",
+			want: "exclusion_patterns = [\n    \"^cd\", # ] noisy\n    \"^pwd\",\n  '^ls$',\n]\n",
+		},
+		{
+			name: "already there",
+			text: "exclusion_patterns = ['^ls$']\n",
+			want: "exclusion_patterns = ['^ls$']\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "retour", "config.toml")
+			if tt.text != "" {
+				if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(tt.text), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := rt.AddExclusionPattern(path, rt.IgnorePattern("ls")); err != nil {
+				t.Fatalf("AddExclusionPattern() unexpected error = %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("AddExclusionPattern() wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Patterns needing escapes survive the trip through the file
+	path := filepath.Join(t.TempDir(), "config.toml")
+	patterns := []string{rt.IgnorePattern(`echo 'a\b'`), "^say \"hi\"\t"}
+	for _, pattern := range patterns {
+		if err := rt.AddExclusionPattern(path, pattern); err != nil {
+			t.Fatalf("AddExclusionPattern() unexpected error = %v", err)
+		}
+	}
+	var config struct {
+		Patterns []string `toml:"exclusion_patterns"`
+	}
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		t.Fatalf("Failed to decode the config file: %v", err)
+	}
+	if !slices.Equal(config.Patterns, patterns) {
+		t.Errorf("exclusion_patterns = %q, want %q", config.Patterns, patterns)
+	}
+
+	if err := rt.AddExclusionPattern(path, "("); err == nil {
+		t.Error("AddExclusionPattern() of an invalid pattern succeeded")
+	}
+	if err := os.WriteFile(path, []byte("exclusion_patterns = \"^cd\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.AddExclusionPattern(path, "^ls$"); err == nil {
+		t.Error("AddExclusionPattern() to a string rather than an array succeeded")
+	}
+}
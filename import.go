@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoryParser converts a history file into records.
+type HistoryParser func(r io.Reader, options ParseOptions) ([]Record, error)
+
+// ParseOptions controls how a history file is parsed.
+type ParseOptions struct {
+	// Fallback is given to entries which carry no timestamp of their own,
+	// typically the file's modification time, as a best effort
+	Fallback time.Time
+
+	// Timestamps is how the file writes its timestamps, by default Unix
+	// time in seconds as the shells write them
+	Timestamps TimestampFormat
+}
+
+// importBatchSize is how many records are imported in each transaction,
+// bounding the work an interrupted import loses
+const importBatchSize = 1000
+
+// parsers maps the format names accepted by the import subcommand to parsers
+var parsers = map[string]HistoryParser{
+	"bash": ParseBashHistory,
+	"zsh":  ParseZshHistory,
+	"fish": ParseFishHistory,
+}
+
+// ParseBashHistory parses a bash history file. Both plain files, with one
+// command per line, and files written with HISTTIMEFORMAT set, where each
+// command is preceded by a "#<timestamp>" line, are understood. In the latter
+// all lines up to the next timestamp belong to one (multi-line) command.
+// Commands without a timestamp inherit the one before them, or the fallback.
+func ParseBashHistory(r io.Reader, options ParseOptions) ([]Record, error) {
+	var records []Record
+	timestamp := options.Fallback
+	var pending []string
+	timestamped := false
+
+	flush := func() {
+		if len(pending) > 0 {
+			records = append(records, NewRecord(strings.Join(pending, "\n"), "", 0, timestamp))
+		}
+		pending = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if at, ok := parseBashTimestamp(line, options.Timestamps); ok {
+			flush()
+			timestamp = at
+			timestamped = true
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		// Without timestamps there is no way to tell where a multi-line
+		// command ends, so every line stands alone
+		if !timestamped {
+			flush()
+		}
+		pending = append(pending, line)
+	}
+	flush()
+
+	return records, scanner.Err()
+}
+
+// parseBashTimestamp recognises the "#<unix time>" lines bash writes when
+// HISTTIMEFORMAT is set, or timestamp lines in another format
+func parseBashTimestamp(line string, format TimestampFormat) (time.Time, bool) {
+	if len(line) < 2 || line[0] != '#' {
+		return time.Time{}, false
+	}
+	at, err := format.Parse(line[1:])
+	return at, err == nil
+}
+
+// zshExtendedEntry matches the ": <start>:<elapsed seconds>;<command>" prefix
+// zsh writes when EXTENDED_HISTORY is set. The start is usually Unix time but
+// may be in another format, which can itself contain colons.
+var zshExtendedEntry = regexp.MustCompile(`(?s)^: *([^;]*?):(\d+);(.*)$`)
+
+// ParseZshHistory parses a zsh history file, with or without EXTENDED_HISTORY.
+// Extended entries keep their start time and duration; plain entries are
+// given the fallback. Multi-line commands, which zsh writes with a backslash
+// at the end of every line but the last, are rejoined.
+func ParseZshHistory(r io.Reader, options ParseOptions) ([]Record, error) {
+	var records []Record
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	emit := func(text string) {
+		timestamp, duration := options.Fallback, time.Duration(0)
+		if match := zshExtendedEntry.FindStringSubmatch(text); match != nil {
+			start, startErr := options.Timestamps.Parse(match[1])
+			elapsed, elapsedErr := strconv.ParseInt(match[2], 10, 64)
+			if startErr == nil && elapsedErr == nil {
+				timestamp = start
+				duration = time.Duration(elapsed) * time.Second
+				text = match[3]
+			}
+		}
+
+		if strings.TrimSpace(text) == "" {
+			return
+		}
+		record := NewRecord(text, "", 0, timestamp)
+		record.Duration = duration
+		records = append(records, record)
+	}
+
+	var entry []string
+	for scanner.Scan() {
+		line := unmetafy(scanner.Bytes())
+
+		if strings.HasSuffix(line, "\\") {
+			entry = append(entry, strings.TrimSuffix(line, "\\"))
+			continue
+		}
+		emit(strings.Join(append(entry, line), "\n"))
+		entry = nil
+	}
+
+	// A file cut short may end part way through a multi-line entry
+	if len(entry) > 0 {
+		emit(strings.Join(entry, "\n"))
+	}
+
+	return records, scanner.Err()
+}
+
+// zshMeta marks a metafied byte in zsh history files
+const zshMeta = 0x83
+
+// unmetafy reverses zsh's encoding of history files, in which bytes that
+// clash with its internal tokens are written as zshMeta followed by the
+// byte XOR 32
+func unmetafy(line []byte) string {
+	out := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		if line[i] == zshMeta && i+1 < len(line) {
+			i++
+			out = append(out, line[i]^32)
+			continue
+		}
+		out = append(out, line[i])
+	}
+	return string(out)
+}
+
+// ParseFishHistory parses fish's history file, a restricted YAML in which each
+// entry is a "- cmd:" line followed by indented "when:" and "paths:" fields.
+// The paths fish records are the files a command referred to, not where it
+// ran, so they are not kept. Entries without a "when:" are given the fallback.
+func ParseFishHistory(r io.Reader, options ParseOptions) ([]Record, error) {
+	var records []Record
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if cmd, ok := strings.CutPrefix(line, "- cmd: "); ok {
+			if cmd = unescapeFish(cmd); strings.TrimSpace(cmd) != "" {
+				records = append(records, NewRecord(cmd, "", 0, options.Fallback))
+			}
+			continue
+		}
+
+		when, ok := strings.CutPrefix(strings.TrimSpace(line), "when: ")
+		if !ok || len(records) == 0 {
+			continue
+		}
+		if at, err := options.Timestamps.Parse(when); err == nil {
+			records[len(records)-1].Timestamp = at
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// unescapeFish reverses the escaping fish applies to commands in its history
+// file, where newlines are written as \n and backslashes as \\
+func unescapeFish(cmd string) string {
+	var b strings.Builder
+	for i := 0; i < len(cmd); i++ {
+		if cmd[i] == '\\' && i+1 < len(cmd) {
+			switch cmd[i+1] {
+			case 'n':
+				b.WriteByte('\n')
+				i++
+				continue
+			case '\\':
+				b.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+		b.WriteByte(cmd[i])
+	}
+	return b.String()
+}
+
+// Import inserts records in a single transaction, skipping any which are
+// already stored with the same command, arguments and timestamp, so importing
+// the same file twice is harmless. Returns the number of records inserted.
+func (db *DB) Import(records []Record) (int, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	inserted, err := db.importRecords(tx, records)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	db.publishInserted(inserted)
+	return len(inserted), nil
+}
+
+// ImportSource identifies the file an import reads, and its content, so an
+// interrupted import can be resumed.
+type ImportSource struct {
+	// Path is the absolute path of the file
+	Path string
+
+	// Hash is the SHA-256 of the file's content, in hex
+	Hash string
+}
+
+// NewImportSource hashes the file at path to identify it for resuming
+func NewImportSource(path string) (ImportSource, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return ImportSource{}, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return ImportSource{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return ImportSource{}, err
+	}
+	return ImportSource{Path: path, Hash: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// ImportProgress returns how many of the records read from source an earlier
+// import has already dealt with. An import of the file with different content,
+// e.g. because the shell has since appended to it, does not count, so a
+// changed file is imported from the start, relying on Import skipping
+// duplicates.
+func (db *DB) ImportProgress(source ImportSource) (int, error) {
+	var offset int
+	err := db.conn.QueryRow(`
+	SELECT offset FROM import_progress
+	WHERE path = ? AND hash = ?`, source.Path, source.Hash).Scan(&offset)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return offset, err
+}
+
+// ImportBatch is like Import but also records, in the same transaction, that
+// the records read from source up to offset have been dealt with. Importing a
+// large file a batch at a time means an interrupted import loses at most one
+// batch and can be resumed from ImportProgress.
+func (db *DB) ImportBatch(records []Record, source ImportSource, offset int) (int, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	inserted, err := db.importRecords(tx, records)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO import_progress (path, hash, offset, updated)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT (path) DO UPDATE SET
+		hash = excluded.hash,
+		offset = excluded.offset,
+		updated = excluded.updated`, source.Path, source.Hash, offset, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	db.publishInserted(inserted)
+	return len(inserted), nil
+}
+
+// importRecords inserts the records which are not already stored, returning
+// those inserted with their IDs
+func (db *DB) importRecords(tx *sql.Tx, records []Record) ([]Record, error) {
+	exists, err := tx.Prepare(`
+	SELECT COUNT(*) FROM history
+	WHERE timestamp = ? AND command = ? AND COALESCE(arguments, '') = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer exists.Close()
+
+	insert, err := tx.Prepare(insertRecord)
+	if err != nil {
+		return nil, err
+	}
+	defer insert.Close()
+
+	var inserted []Record
+	for _, r := range records {
+		command, arguments := db.seal(r.Command), db.seal(r.Arguments)
+		var count int
+		if err := exists.QueryRow(r.Timestamp, command, arguments).Scan(&count); err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			continue
+		}
+
+		if err := ensureSession(tx, r); err != nil {
+			return nil, err
+		}
+		result, err := insert.Exec(
+			command,
+			r.Timestamp,
+			r.WorkingDirectory,
+			r.ExitStatus,
+			arguments,
+			r.Duration.Milliseconds(),
+			r.Session,
+			r.Hostname,
+			r.Repo,
+			r.Branch,
+			frecency(time.Since(r.Timestamp)),
+			r.RerunOf,
+			r.Session,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if r.ID, err = result.LastInsertId(); err != nil {
+			return nil, err
+		}
+		inserted = append(inserted, r)
+	}
+
+	return inserted, nil
+}
+
+// parseHistoryFile parses the history file at path, reading timestamps in the
+// given format and giving entries without one the file's modification time
+func parseHistoryFile(parse HistoryParser, path string, timestamps TimestampFormat) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return parse(file, ParseOptions{Fallback: info.ModTime(), Timestamps: timestamps})
+}
+
+// runImport implements the import subcommand
+func runImport(config *Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	layout := flags.String("timestamp-format", "unix", "How the file writes timestamps: unix, a strftime format or a Go layout")
+	zone := flags.String("assume-timezone", "", "Time zone of timestamps which do not give one [default: local]")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: retour import [--timestamp-format f] [--assume-timezone tz] <format> <file>")
+	}
+
+	timestamps, err := NewTimestampFormat(*layout, *zone)
+	if err != nil {
+		return err
+	}
+
+	format, path := flags.Arg(0), flags.Arg(1)
+	var parsed []Record
+	if parse, ok := parsers[format]; ok {
+		parsed, err = parseHistoryFile(parse, path, timestamps)
+	} else if read, ok := readers[format]; ok {
+		if timestamps != (TimestampFormat{}) {
+			return fmt.Errorf("%s databases store their own timestamps, --timestamp-format and --assume-timezone only apply to history files", format)
+		}
+		parsed, err = read(path)
+	} else {
+		return fmt.Errorf("unsupported import format: %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s history: %w", format, err)
+	}
+
+	source, err := NewImportSource(path)
+	if err != nil {
+		return err
+	}
+	redactor, err := NewRedactor(config.Redaction)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	done, err := db.ImportProgress(source)
+	if err != nil {
+		return err
+	}
+	switch {
+	case done >= len(parsed) && done > 0:
+		fmt.Printf("Already imported all %d records\n", len(parsed))
+		return nil
+	case done > 0:
+		fmt.Printf("Resuming after %d records\n", done)
+	}
+
+	// A signal stops the import between batches, so it can be resumed
+	ctx, stop := signal.NotifyContext(context.Background(), shutdownSignals...)
+	defer stop()
+
+	inserted, considered := 0, 0
+	for start := done; start < len(parsed); start += importBatchSize {
+		if ctx.Err() != nil {
+			fmt.Printf("Stopped after %d of %d records, importing again resumes\n", start, len(parsed))
+			return ExitStatusError{Status: 130}
+		}
+		end := min(start+importBatchSize, len(parsed))
+
+		var batch []Record
+		for _, r := range parsed[start:end] {
+			excluded, err := Excluded(r.CommandLine(), config.ExclusionPatterns)
+			if err != nil {
+				return err
+			}
+			if !excluded && redactor.RedactRecord(&r) {
+				batch = append(batch, r)
+			}
+		}
+
+		n, err := db.ImportBatch(batch, source, end)
+		if err != nil {
+			return fmt.Errorf("failed to import records: %w", err)
+		}
+		inserted += n
+		considered += len(batch)
+	}
+
+	fmt.Printf("Imported %d of %d records\n", inserted, considered)
+	return nil
+}
@@ -0,0 +1,425 @@
+package main_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestParseBashHistory(t *testing.T) {
+	fallback := time.Unix(1600000000, 0)
+
+	tests := []struct {
+		name     string
+		history  string
+		wantCmds []string
+		wantTime []int64
+	}{
+		{
+			name:     "Plain",
+			history:  "ls -la\n\ngit status\n",
+			wantCmds: []string{"ls -la", "git status"},
+			wantTime: []int64{1600000000, 1600000000},
+		},
+		{
+			name:     "Timestamped",
+			history:  "#1700000000\nls -la\n#1700000060\nfor f in *; do\n  echo $f\ndone\n",
+			wantCmds: []string{"ls -la", "for f in *; do\n  echo $f\ndone"},
+			wantTime: []int64{1700000000, 1700000060},
+		},
+		{
+			name:     "Plain then timestamped",
+			history:  "old command\n#1700000000\nnew command\n",
+			wantCmds: []string{"old command", "new command"},
+			wantTime: []int64{1600000000, 1700000000},
+		},
+		{
+			name:     "Comment is not a timestamp",
+			history:  "#not a timestamp\n",
+			wantCmds: []string{"#not a timestamp"},
+			wantTime: []int64{1600000000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := rt.ParseBashHistory(strings.NewReader(tt.history), rt.ParseOptions{Fallback: fallback})
+			if err != nil {
+				t.Fatalf("ParseBashHistory() unexpected error = %v", err)
+			}
+			if len(records) != len(tt.wantCmds) {
+				t.Fatalf("Got %d records %v, want %d", len(records), records, len(tt.wantCmds))
+			}
+			for i, r := range records {
+				if r.CommandLine() != tt.wantCmds[i] {
+					t.Errorf("Record %d = %q, want %q", i, r.CommandLine(), tt.wantCmds[i])
+				}
+				if r.Timestamp.Unix() != tt.wantTime[i] {
+					t.Errorf("Record %d timestamp = %d, want %d", i, r.Timestamp.Unix(), tt.wantTime[i])
+				}
+			}
+		})
+	}
+}
+
+func TestImportDeduplicates(t *testing.T) {
+	database := openTestDB(t)
+
+	records, err := rt.ParseBashHistory(strings.NewReader("#1700000000\nls\n#1700000060\ngit status\n"), rt.ParseOptions{Fallback: time.Now()})
+	if err != nil {
+		t.Fatalf("ParseBashHistory() unexpected error = %v", err)
+	}
+
+	inserted, err := database.Import(records)
+	if err != nil {
+		t.Fatalf("Import() unexpected error = %v", err)
+	}
+	if inserted != 2 {
+		t.Errorf("Expected 2 records inserted, got %d", inserted)
+	}
+
+	inserted, err = database.Import(records)
+	if err != nil {
+		t.Fatalf("Import() unexpected error = %v", err)
+	}
+	if inserted != 0 {
+		t.Errorf("Expected re-import to insert nothing, got %d", inserted)
+	}
+
+	all, err := database.QueryFiltered(0, "all", rt.Scope{}, 10)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	if len(all) != 2 {
+		t.Errorf("Expected 2 records stored, got %d", len(all))
+	}
+}
+
+func TestParseZshHistory(t *testing.T) {
+	fallback := time.Unix(1600000000, 0)
+
+	tests := []struct {
+		name         string
+		history      string
+		wantCmds     []string
+		wantTime     []int64
+		wantDuration []time.Duration
+	}{
+		{
+			name:         "Plain",
+			history:      "ls -la\ngit status\n",
+			wantCmds:     []string{"ls -la", "git status"},
+			wantTime:     []int64{1600000000, 1600000000},
+			wantDuration: []time.Duration{0, 0},
+		},
+		{
+			name:         "Extended",
+			history:      ": 1700000000:0;ls -la\n: 1700000010:12;make build\n",
+			wantCmds:     []string{"ls -la", "make build"},
+			wantTime:     []int64{1700000000, 1700000010},
+			wantDuration: []time.Duration{0, 12 * time.Second},
+		},
+		{
+			name:         "Multi-line",
+			history:      ": 1700000000:3;for f in *; do\\\n  echo $f\\\ndone\n: 1700000005:0;pwd\n",
+			wantCmds:     []string{"for f in *; do\n  echo $f\ndone", "pwd"},
+			wantTime:     []int64{1700000000, 1700000005},
+			wantDuration: []time.Duration{3 * time.Second, 0},
+		},
+		{
+			name:         "Truncated multi-line",
+			history:      ": 1700000000:0;echo one\\\n",
+			wantCmds:     []string{"echo one\n"},
+			wantTime:     []int64{1700000000},
+			wantDuration: []time.Duration{0},
+		},
+		{
+			name:         "Metafied",
+			history:      ": 1700000000:0;echo caf\xc3\x83\x89\n",
+			wantCmds:     []string{"echo café"},
+			wantTime:     []int64{1700000000},
+			wantDuration: []time.Duration{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := rt.ParseZshHistory(strings.NewReader(tt.history), rt.ParseOptions{Fallback: fallback})
+			if err != nil {
+				t.Fatalf("ParseZshHistory() unexpected error = %v", err)
+			}
+			if len(records) != len(tt.wantCmds) {
+				t.Fatalf("Got %d records %v, want %d", len(records), records, len(tt.wantCmds))
+			}
+			for i, r := range records {
+				if r.CommandLine() != strings.TrimSpace(tt.wantCmds[i]) {
+					t.Errorf("Record %d = %q, want %q", i, r.CommandLine(), tt.wantCmds[i])
+				}
+				if r.Timestamp.Unix() != tt.wantTime[i] {
+					t.Errorf("Record %d timestamp = %d, want %d", i, r.Timestamp.Unix(), tt.wantTime[i])
+				}
+				if r.Duration != tt.wantDuration[i] {
+					t.Errorf("Record %d duration = %v, want %v", i, r.Duration, tt.wantDuration[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseFishHistory(t *testing.T) {
+	fallback := time.Unix(1600000000, 0)
+	history := `- cmd: git status
+  when: 1700000000
+- cmd: vim notes.txt
+  when: 1700000060
+  paths:
+    - notes.txt
+- cmd: echo one\ntwo \\ three
+  when: 1700000120
+- cmd: ls
+`
+
+	records, err := rt.ParseFishHistory(strings.NewReader(history), rt.ParseOptions{Fallback: fallback})
+	if err != nil {
+		t.Fatalf("ParseFishHistory() unexpected error = %v", err)
+	}
+
+	want := []struct {
+		line string
+		when int64
+	}{
+		{"git status", 1700000000},
+		{"vim notes.txt", 1700000060},
+		{"echo one\ntwo \\ three", 1700000120},
+		{"ls", 1600000000},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("Got %d records %v, want %d", len(records), records, len(want))
+	}
+	for i, r := range records {
+		if r.CommandLine() != want[i].line {
+			t.Errorf("Record %d = %q, want %q", i, r.CommandLine(), want[i].line)
+		}
+		if r.Timestamp.Unix() != want[i].when {
+			t.Errorf("Record %d timestamp = %d, want %d", i, r.Timestamp.Unix(), want[i].when)
+		}
+	}
+}
+
+func TestReadAtuinHistory(t *testing.T) {
+	path := makeForeignDB(t, `
+	CREATE TABLE history (
+		id TEXT PRIMARY KEY,
+		timestamp INTEGER NOT NULL,
+		duration INTEGER NOT NULL,
+		exit INTEGER NOT NULL,
+		command TEXT NOT NULL,
+		cwd TEXT NOT NULL,
+		session TEXT NOT NULL,
+		hostname TEXT NOT NULL,
+		deleted_at INTEGER
+	);
+	INSERT INTO history VALUES
+		('a', 1700000000000000000, 2500000000, 0, 'cargo build --release', '/src', 's1', 'box:me', NULL),
+		('b', 1700000060000000000, -1, 101, 'cargo test', '/src', 's1', 'box:me', NULL),
+		('c', 1700000120000000000, 1000, 0, 'rm secrets', '/', 's2', 'box:me', 1700000200000000000);`)
+
+	records, err := rt.ReadAtuinHistory(path)
+	if err != nil {
+		t.Fatalf("ReadAtuinHistory() unexpected error = %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Got %d records %v, want 2", len(records), records)
+	}
+
+	first := records[0]
+	if first.CommandLine() != "cargo build --release" || first.WorkingDirectory != "/src" ||
+		first.Session != "s1" || first.Hostname != "box:me" {
+		t.Errorf("First record = %+v", first)
+	}
+	if first.Timestamp.Unix() != 1700000000 || first.Duration != 2500*time.Millisecond {
+		t.Errorf("First record timing = %v, %v", first.Timestamp, first.Duration)
+	}
+
+	second := records[1]
+	if second.ExitStatus != 101 || second.Duration != 0 {
+		t.Errorf("Second record = %+v, want exit 101 and unknown duration", second)
+	}
+}
+
+func TestReadAtuinHistoryNotAtuin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "other.db")
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	database.Close()
+
+	if _, err := rt.ReadAtuinHistory(path); err == nil {
+		t.Error("ReadAtuinHistory() of a retour database succeeded, want error")
+	}
+}
+
+func TestReadMcflyHistory(t *testing.T) {
+	path := makeForeignDB(t, `
+	CREATE TABLE commands (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		cmd TEXT NOT NULL,
+		cmd_tpl TEXT,
+		session_id TEXT NOT NULL,
+		when_run INTEGER NOT NULL,
+		exit_code INTEGER NOT NULL,
+		selected INTEGER NOT NULL,
+		dir TEXT,
+		old_dir TEXT
+	);
+	INSERT INTO commands (cmd, session_id, when_run, exit_code, selected, dir) VALUES
+		('make test', 'm1', 1700000060, 2, 0, '/src'),
+		('git pull', 'm1', 1700000000, 0, 1, NULL);`)
+
+	records, err := rt.ReadMcflyHistory(path)
+	if err != nil {
+		t.Fatalf("ReadMcflyHistory() unexpected error = %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Got %d records %v, want 2", len(records), records)
+	}
+
+	if r := records[0]; r.CommandLine() != "git pull" || r.Timestamp.Unix() != 1700000000 || r.WorkingDirectory != "" {
+		t.Errorf("First record = %+v, want git pull run first", r)
+	}
+	if r := records[1]; r.ExitStatus != 2 || r.WorkingDirectory != "/src" || r.Session != "m1" {
+		t.Errorf("Second record = %+v", r)
+	}
+}
+
+func TestReadZshHistdbHistory(t *testing.T) {
+	path := makeForeignDB(t, `
+	CREATE TABLE commands (id INTEGER PRIMARY KEY AUTOINCREMENT, argv TEXT, UNIQUE(argv) ON CONFLICT IGNORE);
+	CREATE TABLE places (id INTEGER PRIMARY KEY AUTOINCREMENT, host TEXT, dir TEXT, UNIQUE(host, dir) ON CONFLICT IGNORE);
+	CREATE TABLE history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session INT,
+		command_id INT REFERENCES commands (id),
+		place_id INT REFERENCES places (id),
+		exit_status INT,
+		start_time INT,
+		duration INT
+	);
+	INSERT INTO commands (argv) VALUES ('ls -la'), ('sleep 100');
+	INSERT INTO places (host, dir) VALUES ('box', '/home/me');
+	INSERT INTO history (session, command_id, place_id, exit_status, start_time, duration) VALUES
+		(42, 1, 1, 0, 1700000000, 1),
+		(42, 2, 1, NULL, 1700000010, NULL),
+		(43, 1, 1, 1, 1700000020, 0);`)
+
+	records, err := rt.ReadZshHistdbHistory(path)
+	if err != nil {
+		t.Fatalf("ReadZshHistdbHistory() unexpected error = %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Got %d records %v, want 3", len(records), records)
+	}
+
+	first := records[0]
+	if first.CommandLine() != "ls -la" || first.WorkingDirectory != "/home/me" || first.Hostname != "box" ||
+		first.Session != "42" || first.Duration != time.Second {
+		t.Errorf("First record = %+v", first)
+	}
+	if r := records[1]; r.CommandLine() != "sleep 100" || r.ExitStatus != 0 || r.Duration != 0 {
+		t.Errorf("Unfinished record = %+v", r)
+	}
+	if r := records[2]; r.ExitStatus != 1 || r.Session != "43" {
+		t.Errorf("Third record = %+v", r)
+	}
+}
+
+// makeForeignDB creates a SQLite database by running the given statements,
+// standing in for another tool's history database, and returns its path
+func makeForeignDB(t *testing.T, statements string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "foreign.db")
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Exec(statements); err != nil {
+		t.Fatalf("Failed to populate database: %v", err)
+	}
+	return path
+}
+
+func TestImportProgress(t *testing.T) {
+	database := openTestDB(t)
+
+	path := filepath.Join(t.TempDir(), ".bash_history")
+	history := "#1700000000\nls\n#1700000060\ngit status\n#1700000120\nmake\n"
+	if err := os.WriteFile(path, []byte(history), 0o600); err != nil {
+		t.Fatalf("Failed to write history: %v", err)
+	}
+	records, err := rt.ParseBashHistory(strings.NewReader(history), rt.ParseOptions{Fallback: time.Now()})
+	if err != nil {
+		t.Fatalf("ParseBashHistory() unexpected error = %v", err)
+	}
+
+	source, err := rt.NewImportSource(path)
+	if err != nil {
+		t.Fatalf("NewImportSource() unexpected error = %v", err)
+	}
+	checkProgress(t, database, source, 0)
+
+	// An import interrupted after the first batch resumes after it
+	if _, err := database.ImportBatch(records[:2], source, 2); err != nil {
+		t.Fatalf("ImportBatch() unexpected error = %v", err)
+	}
+	checkProgress(t, database, source, 2)
+
+	inserted, err := database.ImportBatch(records[2:], source, 3)
+	if err != nil {
+		t.Fatalf("ImportBatch() unexpected error = %v", err)
+	}
+	if inserted != 1 {
+		t.Errorf("ImportBatch() inserted %d, want 1", inserted)
+	}
+	checkProgress(t, database, source, 3)
+
+	// Once the shell appends to the file it is imported from the start,
+	// without duplicating what was already imported
+	if err := os.WriteFile(path, []byte(history+"#1700000180\npwd\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write history: %v", err)
+	}
+	changed, err := rt.NewImportSource(path)
+	if err != nil {
+		t.Fatalf("NewImportSource() unexpected error = %v", err)
+	}
+	if changed.Hash == source.Hash {
+		t.Fatal("NewImportSource() hash unchanged after appending to the file")
+	}
+	checkProgress(t, database, changed, 0)
+
+	inserted, err = database.ImportBatch(records, changed, 3)
+	if err != nil {
+		t.Fatalf("ImportBatch() unexpected error = %v", err)
+	}
+	if inserted != 0 {
+		t.Errorf("ImportBatch() inserted %d duplicates", inserted)
+	}
+}
+
+func checkProgress(t *testing.T, database *rt.DB, source rt.ImportSource, want int) {
+	t.Helper()
+	got, err := database.ImportProgress(source)
+	if err != nil {
+		t.Fatalf("ImportProgress() unexpected error = %v", err)
+	}
+	if got != want {
+		t.Errorf("ImportProgress() = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// HistoryReader reads the records from another tool's history database. Unlike
+// the flat files handled by a HistoryParser, databases must be opened by path.
+type HistoryReader func(path string) ([]Record, error)
+
+// readers maps the database formats accepted by the import subcommand to readers
+var readers = map[string]HistoryReader{
+	"atuin":      ReadAtuinHistory,
+	"mcfly":      ReadMcflyHistory,
+	"zsh-histdb": ReadZshHistdbHistory,
+}
+
+// readForeignHistory opens another tool's SQLite database without modifying
+// it, runs query and builds a record from each row with scan. Rows giving an
+// empty command are skipped. Name identifies the tool in errors.
+func readForeignHistory(path, name, query string, scan func(*sql.Rows) (Record, error)) ([]Record, error) {
+	conn, err := sql.Open(sqliteDriver, "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("unrecognised %s database: %w", name, err)
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		record, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		if record.Command != "" {
+			records = append(records, record)
+		}
+	}
+
+	return records, rows.Err()
+}
+
+// ReadAtuinHistory reads the history of an Atuin database, usually
+// ~/.local/share/atuin/history.db. Atuin stores times and durations in
+// nanoseconds, with a negative duration when it is unknown. Entries deleted
+// in Atuin are skipped.
+func ReadAtuinHistory(path string) ([]Record, error) {
+	return readForeignHistory(path, "Atuin", `
+	SELECT timestamp, duration, exit, command, cwd, session, hostname
+	FROM history
+	WHERE deleted_at IS NULL
+	ORDER BY timestamp`, func(rows *sql.Rows) (Record, error) {
+		var timestamp, duration int64
+		var exitStatus int
+		var line, cwd, session, hostname string
+		if err := rows.Scan(&timestamp, &duration, &exitStatus, &line, &cwd, &session, &hostname); err != nil {
+			return Record{}, err
+		}
+
+		record := NewRecord(line, cwd, exitStatus, time.Unix(0, timestamp))
+		record.Duration = max(time.Duration(duration), 0)
+		record.Session = session
+		record.Hostname = hostname
+		return record, nil
+	})
+}
+
+// ReadMcflyHistory reads the history of a mcfly database, usually
+// ~/.local/share/mcfly/history.db. Mcfly records when commands were run, in
+// seconds, but not how long they took.
+func ReadMcflyHistory(path string) ([]Record, error) {
+	return readForeignHistory(path, "mcfly", `
+	SELECT cmd, COALESCE(dir, ''), exit_code, when_run, session_id
+	FROM commands
+	ORDER BY when_run, id`, func(rows *sql.Rows) (Record, error) {
+		var line, dir, session string
+		var exitStatus int
+		var whenRun int64
+		if err := rows.Scan(&line, &dir, &exitStatus, &whenRun, &session); err != nil {
+			return Record{}, err
+		}
+
+		record := NewRecord(line, dir, exitStatus, time.Unix(whenRun, 0))
+		record.Session = session
+		return record, nil
+	})
+}
+
+// ReadZshHistdbHistory reads the history of a zsh-histdb database, usually
+// ~/.histdb/zsh-history.db, which normalises commands and places into their
+// own tables. Times and durations are in seconds; commands still running
+// when the shell exited have no duration or exit status.
+func ReadZshHistdbHistory(path string) ([]Record, error) {
+	return readForeignHistory(path, "zsh-histdb", `
+	SELECT commands.argv, COALESCE(places.dir, ''), COALESCE(places.host, ''),
+		COALESCE(history.exit_status, 0), history.start_time,
+		COALESCE(history.duration, 0), COALESCE(history.session, 0)
+	FROM history
+	JOIN commands ON commands.id = history.command_id
+	LEFT JOIN places ON places.id = history.place_id
+	ORDER BY history.start_time, history.id`, func(rows *sql.Rows) (Record, error) {
+		var line, dir, host string
+		var exitStatus int
+		var start, duration, session int64
+		if err := rows.Scan(&line, &dir, &host, &exitStatus, &start, &duration, &session); err != nil {
+			return Record{}, err
+		}
+
+		record := NewRecord(line, dir, exitStatus, time.Unix(start, 0))
+		record.Duration = max(time.Duration(duration)*time.Second, 0)
+		record.Session = strconv.FormatInt(session, 10)
+		record.Hostname = host
+		return record, nil
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxStreamLine is the longest line accepted in a record stream
+const maxStreamLine = 1 << 20
+
+// errStreamStopped ends the reading of a record stream stopped by a signal
+var errStreamStopped = errors.New("record stream stopped")
+
+// LineError reports a line of a record stream which could not be recorded.
+type LineError struct {
+	// Line is the line number, counting from 1
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// ParseNDJSON reads records from newline delimited JSON, one object per line
+// in the form written by export --format json. The command may be given as
+// the whole command line, leaving arguments out. A missing timestamp is taken
+// to be now and record IDs are ignored, the database assigns its own. Blank
+// lines are skipped.
+//
+// fn is called with each record in turn, or with a *LineError for a line
+// which is not a valid record, so the rest of the stream can still be read.
+// Reading stops at the first error returned by fn, which is returned, or at a
+// line longer than maxStreamLine, which cannot be skipped.
+func ParseNDJSON(r io.Reader, fn func(Record, error) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStreamLine)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		record, err := parseStreamRecord(line)
+		if err != nil {
+			err = &LineError{Line: n, Err: err}
+		}
+		if err := fn(record, err); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// parseStreamRecord decodes and validates one line of a record stream
+func parseStreamRecord(line []byte) (Record, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	var j recordJSON
+	if err := decoder.Decode(&j); err != nil {
+		return Record{}, err
+	}
+	if decoder.More() {
+		return Record{}, errors.New("more than one value on the line")
+	}
+
+	record := j.record()
+	record.ID, record.Count = 0, 0
+	record.Command, record.Arguments = SplitCommandLine(record.CommandLine())
+	switch {
+	case record.Command == "":
+		return Record{}, errors.New("missing command")
+	case record.Duration < 0:
+		return Record{}, fmt.Errorf("negative duration %d", j.DurationMillis)
+	}
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now()
+	}
+	return record, nil
+}
+
+// recordStream implements record --stdin, storing the records read from r
+// and reporting the lines which could not be to errs. The stream is read to
+// the end whatever errors are found, but an error is returned once it has
+// been if any line failed. A signal, or an error reading the stream, stops
+// the reading, storing the records read so far rather than losing those not
+// yet written in a batch.
+func recordStream(config *Config, r io.Reader, errs io.Writer) error {
+	redactor, err := NewRedactor(config.Redaction)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// An unknown hostname is recorded as empty rather than failing the stream
+	hostname, _ := os.Hostname()
+	writer := NewWriter(db, DefaultWriterOptions())
+
+	// The stream is read in the background, as a read from a pipe cannot be
+	// interrupted. mu guards the counts and stopped, which once set keeps
+	// any more records being added.
+	var mu sync.Mutex
+	recorded, skipped, failed := 0, 0, 0
+	stopped := false
+	done := make(chan error, 1)
+	go func() {
+		done <- ParseNDJSON(r, func(record Record, err error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if stopped {
+				return errStreamStopped
+			}
+			if err != nil {
+				fmt.Fprintln(errs, err)
+				failed++
+				return nil
+			}
+
+			excluded, err := Excluded(record.CommandLine(), config.ExclusionPatterns)
+			if err != nil {
+				return err
+			}
+			if excluded || !redactor.RedactRecord(&record) {
+				skipped++
+				return nil
+			}
+
+			if record.Hostname == "" {
+				record.Hostname = hostname
+			}
+			if record.Repo == "" && record.Branch == "" {
+				record.Repo, record.Branch = GitInfo(record.WorkingDirectory)
+			}
+			recorded++
+			return writer.Add(record)
+		})
+	}()
+
+	signalled := make(chan struct{})
+	defer onSignal(func() { close(signalled) }, shutdownSignals...)()
+	select {
+	case err = <-done:
+	case <-signalled:
+		mu.Lock()
+		stopped = true
+		mu.Unlock()
+	}
+	// Whatever ended the reading, a line too long to read or a batch which
+	// failed to store, the records queued before it are stored
+	if flushErr := writer.Flush(); flushErr != nil {
+		return errors.Join(err, flushErr)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if stopped {
+		fmt.Fprintf(errs, "Stopped after recording %d records, skipped %d, %d invalid\n", recorded, skipped, failed)
+		return ExitStatusError{Status: 130}
+	}
+	fmt.Fprintf(errs, "Recorded %d records, skipped %d, %d invalid\n", recorded, skipped, failed)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d invalid records", failed)
+	}
+	return nil
+}
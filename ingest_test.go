@@ -0,0 +1,78 @@
+package main_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestParseNDJSON(t *testing.T) {
+	input := strings.Join([]string{
+		`{"command": "git", "arguments": "status", "timestamp": "2024-05-01T10:00:00Z", "exit_status": 1, "duration_ms": 1500}`,
+		``,
+		`{"id": 7, "command": "make  test", "working_directory": "/src"}`,
+		`{"command": ""}`,
+		`{"command": "ls", "shell": "bash"}`,
+		`{"command": "ls", "duration_ms": -1}`,
+		`{"command": "ls"} {"command": "pwd"}`,
+		`{"command": "ls"`,
+	}, "\n")
+
+	var records []rt.Record
+	var lineErrors []string
+	err := rt.ParseNDJSON(strings.NewReader(input), func(r rt.Record, err error) error {
+		if err != nil {
+			var lineErr *rt.LineError
+			if !errors.As(err, &lineErr) {
+				t.Fatalf("ParseNDJSON() error %v is not a LineError", err)
+			}
+			lineErrors = append(lineErrors, err.Error())
+			return nil
+		}
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ParseNDJSON() unexpected error = %v", err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("ParseNDJSON() records = %+v, want 2", records)
+	}
+	first := records[0]
+	if first.CommandLine() != "git status" || first.ExitStatus != 1 || first.Duration != 1500*time.Millisecond ||
+		!first.Timestamp.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("First record = %+v", first)
+	}
+	second := records[1]
+	if second.ID != 0 || second.Command != "make" || second.Arguments != "test" || second.WorkingDirectory != "/src" ||
+		time.Since(second.Timestamp) > time.Minute {
+		t.Errorf("Second record = %+v, want make test without an ID, timestamped now", second)
+	}
+
+	want := []string{
+		"line 4: missing command",
+		`line 5: json: unknown field "shell"`,
+		"line 6: negative duration -1",
+		"line 7: more than one value on the line",
+		"line 8: unexpected EOF",
+	}
+	if strings.Join(lineErrors, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Line errors = %q, want %q", lineErrors, want)
+	}
+}
+
+func TestParseNDJSONStops(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	err := rt.ParseNDJSON(strings.NewReader("{\"command\": \"a\"}\n{\"command\": \"b\"}\n"), func(rt.Record, error) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("ParseNDJSON() = %v after %d calls, want stop after 1", err, calls)
+	}
+}
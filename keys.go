@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Action is something the picker does when one of its keys is pressed.
+type Action string
+
+const (
+	// UpAction moves the highlight to the record above
+	UpAction Action = "up"
+	// DownAction moves the highlight to the record below
+	DownAction Action = "down"
+	// SelectAction emits the selection
+	SelectAction Action = "select"
+	// DeleteAction deletes the character of the filter text before the
+	// text cursor
+	DeleteAction Action = "delete"
+	// PreviewAction shows or hides the preview pane
+	PreviewAction Action = "preview"
+	// QuitAction leaves the picker without selecting anything
+	QuitAction Action = "quit"
+	// ResultAction cycles the result filter through all, succeeded and
+	// failed commands
+	ResultAction Action = "result"
+	// TimeRangeAction cycles the time range through all time, today,
+	// yesterday and the last week
+	TimeRangeAction Action = "time_range"
+	// ScopeAction cycles the directories searched through anywhere, the
+	// working directory and the tree below it
+	ScopeAction Action = "scope"
+	// CopyAction copies the highlighted command to the clipboard
+	CopyAction Action = "copy"
+	// StarAction stars or unstars the highlighted command
+	StarAction Action = "star"
+	// TagAction asks for a tag to tag the highlighted command with
+	TagAction Action = "tag"
+	// IgnoreAction deletes the highlighted command from the history and
+	// excludes it from then on, once confirmed
+	IgnoreAction Action = "ignore"
+	// MatchAction cycles through the ways the filter text matches commands
+	MatchAction Action = "match"
+)
+
+// Keymap binds the picker's actions to keys, from the [keys] section of the
+// config file. Keys are named as by bubbletea, e.g. "up", "ctrl+j", "alt+k",
+// "enter", "tab" or "esc", or are a single character, which can then no
+// longer be typed into the filter. Keys not bound to an action keep their
+// usual meaning.
+type Keymap struct {
+	Up      []string `toml:"up"`
+	Down    []string `toml:"down"`
+	Select  []string `toml:"select"`
+	Delete  []string `toml:"delete"`
+	Preview []string `toml:"preview"`
+	Quit    []string `toml:"quit"`
+
+	Result    []string `toml:"result"`
+	TimeRange []string `toml:"time_range"`
+	Scope     []string `toml:"scope"`
+	Copy      []string `toml:"copy"`
+	Star      []string `toml:"star"`
+	Tag       []string `toml:"tag"`
+	Ignore    []string `toml:"ignore"`
+	Match     []string `toml:"match"`
+}
+
+// DefaultKeymap returns the keys used unless configured otherwise
+func DefaultKeymap() Keymap {
+	return Keymap{
+		Up:      []string{"up", "ctrl+p"},
+		Down:    []string{"down", "ctrl+n"},
+		Select:  []string{"enter"},
+		Delete:  []string{"backspace"},
+		Preview: []string{"tab"},
+		Quit:    []string{"ctrl+c"},
+
+		Result:    []string{"alt+r"},
+		TimeRange: []string{"alt+t"},
+		Scope:     []string{"alt+d"},
+		Copy:      []string{"ctrl+y"},
+		Star:      []string{"alt+s"},
+		Tag:       []string{"alt+g"},
+		Ignore:    []string{"alt+i"},
+		Match:     []string{"alt+m"},
+	}
+}
+
+// bindings returns the keys bound to each action, in order
+func (k Keymap) bindings() []struct {
+	action Action
+	keys   []string
+} {
+	return []struct {
+		action Action
+		keys   []string
+	}{
+		{UpAction, k.Up},
+		{DownAction, k.Down},
+		{SelectAction, k.Select},
+		{DeleteAction, k.Delete},
+		{PreviewAction, k.Preview},
+		{QuitAction, k.Quit},
+		{ResultAction, k.Result},
+		{TimeRangeAction, k.TimeRange},
+		{ScopeAction, k.Scope},
+		{CopyAction, k.Copy},
+		{StarAction, k.Star},
+		{TagAction, k.Tag},
+		{IgnoreAction, k.Ignore},
+		{MatchAction, k.Match},
+	}
+}
+
+// Validate reports keys which are not named as bubbletea names them and keys
+// bound to more than one action.
+func (k Keymap) Validate() error {
+	bound := map[string]Action{}
+	for _, binding := range k.bindings() {
+		for _, key := range binding.keys {
+			name := normaliseKeyName(key)
+			if !validKeyName(name) {
+				return fmt.Errorf("invalid key %q for %s", key, binding.action)
+			}
+			if other, ok := bound[name]; ok && other != binding.action {
+				return fmt.Errorf("key %q is bound to both %s and %s", key, other, binding.action)
+			}
+			bound[name] = binding.action
+		}
+	}
+	return nil
+}
+
+// action returns the action the key pressed is bound to, empty if none
+func (k Keymap) action(key tea.KeyMsg) Action {
+	pressed := key.String()
+	for _, binding := range k.bindings() {
+		for _, name := range binding.keys {
+			if normaliseKeyName(name) == pressed {
+				return binding.action
+			}
+		}
+	}
+	return ""
+}
+
+// normaliseKeyName writes a key as bubbletea does, which names the space
+// bar " "
+func normaliseKeyName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "space" {
+		return " "
+	}
+	if rest, ok := strings.CutPrefix(name, "alt+"); ok && rest == "space" {
+		return "alt+ "
+	}
+	return name
+}
+
+// keyNames holds the names bubbletea gives the keys other than characters
+var keyNames = func() map[string]bool {
+	names := map[string]bool{}
+	for k := tea.KeyF20; k <= 127; k++ {
+		if name := k.String(); name != "" && k != tea.KeyRunes {
+			names[name] = true
+		}
+	}
+	return names
+}()
+
+// validKeyName reports whether a normalised key names a key bubbletea
+// reports, optionally with Alt held
+func validKeyName(name string) bool {
+	name = strings.TrimPrefix(name, "alt+")
+	return keyNames[name] || utf8.RuneCountInString(name) == 1
+}
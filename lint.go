@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// LintProblem names a way in which a record is malformed, as old importers
+// could leave them.
+type LintProblem string
+
+const (
+	// ZeroTimestamp marks a record without a plausible time, one before 1980
+	ZeroTimestamp LintProblem = "zero timestamp"
+	// EmptyCommand marks a record whose command is empty or only spaces
+	EmptyCommand LintProblem = "empty command"
+	// InvalidUTF8 marks a record whose command, arguments or directory are
+	// not valid UTF-8
+	InvalidUTF8 LintProblem = "invalid UTF-8"
+	// AbsurdDuration marks a record which took less than no time or more
+	// than maxPlausibleDuration
+	AbsurdDuration LintProblem = "absurd duration"
+)
+
+// maxPlausibleDuration is the longest a command is believed to have run,
+// longer durations having been recorded in the wrong unit
+const maxPlausibleDuration = 365 * 24 * time.Hour
+
+// zeroTimestamp is true for the records of table h without a plausible
+// time. Times are stored as text, compared as such rather than with the
+// column's numeric affinity, but old importers stored Unix times, for which
+// 315532800 is the start of 1980.
+const zeroTimestamp = `(h.timestamp IS NULL OR CASE typeof(h.timestamp)
+	WHEN 'text' THEN CAST(h.timestamp AS TEXT) < '1980'
+	ELSE h.timestamp < 315532800 END)`
+
+// LintFinding is a problem Lint found with a record.
+type LintFinding struct {
+	// ID is the record's ID
+	ID int64
+	// Problem is what is wrong with it
+	Problem LintProblem
+	// Detail shows the malformed value
+	Detail string
+	// Fix describes what FixLint did about it, empty if it was left alone
+	Fix string
+}
+
+// Lint looks for malformed records, with a zero timestamp, an empty command,
+// text which isn't valid UTF-8 or an absurd duration, returning a finding
+// for each problem of each record in the order of their IDs.
+func (db *DB) Lint() ([]LintFinding, error) {
+	return db.lint(db.reader)
+}
+
+// FixLint normalises the records Lint finds, returning its findings with
+// what was done about each: records without a command are removed, zero
+// timestamps become those of the nearest record before them, or else after
+// them, invalid UTF-8 is replaced by U+FFFD and absurd durations become 0,
+// i.e. unknown.
+func (db *DB) FixLint() ([]LintFinding, error) {
+	if err := db.checkMutable("lint", "normalise malformed records"); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	findings, err := db.lint(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := map[int64]bool{}
+	for i, finding := range findings {
+		if removed[finding.ID] {
+			findings[i].Fix = "removed"
+			continue
+		}
+		fix, err := db.fixFinding(tx, finding)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fix record %d: %w", finding.ID, err)
+		}
+		findings[i].Fix = fix
+		if finding.Problem == EmptyCommand {
+			removed[finding.ID] = true
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if len(removed) > 0 {
+		db.events.Publish(RecordsDeleted{Count: len(removed)})
+	}
+	return findings, nil
+}
+
+// linter is what lint runs its query on, the database or a transaction
+type linter interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// lint scans every record for the problems Lint looks for
+func (db *DB) lint(q linter) ([]LintFinding, error) {
+	rows, err := q.Query(`
+	SELECT h.id, h.command, COALESCE(h.arguments, ''), COALESCE(h.working_directory, ''),
+		CAST(h.timestamp AS TEXT), ` + zeroTimestamp + `, h.duration
+	FROM history h
+	ORDER BY h.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []LintFinding
+	for rows.Next() {
+		var id, duration int64
+		var command, arguments, directory string
+		var timestamp sql.NullString
+		var zero bool
+		if err := rows.Scan(&id, &command, &arguments, &directory, &timestamp, &zero, &duration); err != nil {
+			return nil, err
+		}
+		if command, err = db.open(command); err != nil {
+			return nil, fmt.Errorf("failed to decrypt record %d: %w", id, err)
+		}
+		if arguments, err = db.open(arguments); err != nil {
+			return nil, fmt.Errorf("failed to decrypt record %d: %w", id, err)
+		}
+
+		if zero {
+			findings = append(findings, LintFinding{ID: id, Problem: ZeroTimestamp, Detail: fmt.Sprintf("%q", timestamp.String)})
+		}
+		if strings.TrimSpace(command) == "" {
+			findings = append(findings, LintFinding{ID: id, Problem: EmptyCommand, Detail: fmt.Sprintf("%q", command)})
+		}
+		for _, text := range []string{command, arguments, directory} {
+			if !utf8.ValidString(text) {
+				findings = append(findings, LintFinding{ID: id, Problem: InvalidUTF8, Detail: fmt.Sprintf("%q", text)})
+				break
+			}
+		}
+		if duration < 0 || duration > maxPlausibleDuration.Milliseconds() {
+			findings = append(findings, LintFinding{ID: id, Problem: AbsurdDuration, Detail: fmt.Sprintf("%dms", duration)})
+		}
+	}
+	return findings, rows.Err()
+}
+
+// fixFinding normalises the record of a finding, returning what was done,
+// empty if nothing could be
+func (db *DB) fixFinding(tx *sql.Tx, finding LintFinding) (string, error) {
+	switch finding.Problem {
+	case EmptyCommand:
+		// Reruns of the record are kept, as if they had been typed afresh
+		if _, err := tx.Exec("UPDATE history SET rerun_of = NULL WHERE rerun_of = ?", finding.ID); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec("DELETE FROM history WHERE id = ?", finding.ID); err != nil {
+			return "", err
+		}
+		return "removed", nil
+
+	case ZeroTimestamp:
+		// The neighbour's time is copied as stored, whether text or a number
+		var timestamp any
+		err := tx.QueryRow(`
+		SELECT COALESCE(
+			(SELECT h.timestamp FROM history h WHERE h.id < ?1 AND NOT `+zeroTimestamp+` ORDER BY h.id DESC LIMIT 1),
+			(SELECT h.timestamp FROM history h WHERE h.id > ?1 AND NOT `+zeroTimestamp+` ORDER BY h.id LIMIT 1))`,
+			finding.ID).Scan(&timestamp)
+		if err != nil || timestamp == nil {
+			return "", err
+		}
+		if _, err := tx.Exec("UPDATE history SET timestamp = ? WHERE id = ?", timestamp, finding.ID); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("set to %v", timestamp), nil
+
+	case InvalidUTF8:
+		var command, arguments, directory string
+		err := tx.QueryRow(`
+		SELECT command, COALESCE(arguments, ''), COALESCE(working_directory, '')
+		FROM history WHERE id = ?`, finding.ID).Scan(&command, &arguments, &directory)
+		if err != nil {
+			return "", err
+		}
+		if command, err = db.open(command); err != nil {
+			return "", err
+		}
+		if arguments, err = db.open(arguments); err != nil {
+			return "", err
+		}
+		_, err = tx.Exec("UPDATE history SET command = ?, arguments = ?, working_directory = ? WHERE id = ?",
+			db.seal(strings.ToValidUTF8(command, "\uFFFD")),
+			db.seal(strings.ToValidUTF8(arguments, "\uFFFD")),
+			strings.ToValidUTF8(directory, "\uFFFD"),
+			finding.ID)
+		if err != nil {
+			return "", err
+		}
+		return "replaced the invalid bytes", nil
+
+	case AbsurdDuration:
+		if _, err := tx.Exec("UPDATE history SET duration = 0 WHERE id = ?", finding.ID); err != nil {
+			return "", err
+		}
+		return "set to unknown", nil
+	}
+	return "", nil
+}
+
+// writeLintReport lists the problems found with the records and, unless
+// they were fixed, how to fix them
+func writeLintReport(w io.Writer, findings []LintFinding, fixed bool) {
+	if len(findings) == 0 {
+		fmt.Fprintln(w, "No malformed records found")
+		return
+	}
+
+	fmt.Fprintln(w, "Malformed records:")
+	left := 0
+	for _, finding := range findings {
+		line := fmt.Sprintf("  %d: %s %s", finding.ID, finding.Problem, finding.Detail)
+		if fixed {
+			fix := finding.Fix
+			if fix == "" {
+				fix = "left, nothing to fix it from"
+				left++
+			}
+			line += ", " + fix
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	if fixed {
+		fmt.Fprintf(w, "\nFixed %d of %d problems\n", len(findings)-left, len(findings))
+		return
+	}
+	fmt.Fprintf(w, "\nFound %d problems, to fix them run:\n", len(findings))
+	fmt.Fprintln(w, "  retour doctor --lint --fix")
+}
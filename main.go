@@ -1,66 +1,372 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
 )
 
+// commands maps subcommand names to their implementations
+var commands = map[string]func(config *Config, args []string) error{
+	"audit":        runAudit,
+	"complete":     runComplete,
+	"complete-arg": runCompleteArg,
+	"config":       runConfig,
+	"daemon":       runDaemon,
+	"demo":         runDemo,
+	"dirs":         runDirs,
+	"doctor":       runDoctor,
+	"encrypt":      runEncrypt,
+	"export":       runExport,
+	"gen-fixture":  runGenFixture,
+	"import":       runImport,
+	"init":         runInit,
+	"merge":        runMerge,
+	"pick":         runPick,
+	"prompt-info":  runPromptInfo,
+	"record":       runRecord,
+	"rerun":        runRerun,
+	"searches":     runSearches,
+	"send":         runSend,
+	"session":      runSession,
+	"suggest":      runSuggest,
+	"stats":        runStats,
+	"suggest-next": runSuggestNext,
+	"sync":         runSync,
+}
+
+// ExitStatusError ends the run with the exit status of a command run on the
+// user's behalf, printing nothing
+type ExitStatusError struct {
+	Status int
+}
+
+func (e ExitStatusError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
 func main() {
-	// Create some test data
-	records := []Record{
-		{
-			Command:          "ls",
-			Arguments:        "-la",
-			Timestamp:        time.Now().Add(-1 * time.Hour),
-			WorkingDirectory: "/home/user",
-			ExitStatus:       0,
-		},
-		{
-			Command:          "git",
-			Arguments:        "status",
-			Timestamp:        time.Now().Add(-2 * time.Hour),
-			WorkingDirectory: "/home/user/project",
-			ExitStatus:       0,
-		},
-		{
-			Command:          "make",
-			Arguments:        "build",
-			Timestamp:        time.Now().Add(-3 * time.Hour),
-			WorkingDirectory: "/home/user/project",
-			ExitStatus:       1,
-		},
-		{
-			Command:          "vim",
-			Arguments:        "main.go",
-			Timestamp:        time.Now().Add(-4 * time.Hour),
-			WorkingDirectory: "/home/user/project",
-			ExitStatus:       0,
-		},
-		{
-			Command:          "go",
-			Arguments:        "test ./...",
-			Timestamp:        time.Now().Add(-5 * time.Hour),
-			WorkingDirectory: "/home/user/project",
-			ExitStatus:       0,
-		},
-	}
-
-	// Create and run the UI
+	if err := run(os.Args); err != nil {
+		var exit ExitStatusError
+		if errors.As(err, &exit) {
+			os.Exit(exit.Status)
+		}
+		fmt.Fprintf(os.Stderr, "retour: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	begin := time.Now()
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return fmt.Errorf("failed to find home directory: %w", err)
+	}
+
+	config, err := LoadConfig(os.DirFS(home), args)
+	if err != nil {
+		return err
+	}
+	for _, warning := range config.Warnings() {
+		fmt.Fprintf(os.Stderr, "retour: warning: %s\n", warning)
+	}
+	if err := SetLanguage(config.Language); err != nil {
+		return err
+	}
+	if config.Trace {
+		tracer = NewTracer(begin)
+		tracer.Record("config load", begin)
+		defer func() {
+			tracer.Report(os.Stderr)
+			tracer = nil
+		}()
+	}
+
+	// Relative database and config file paths are relative to the home
+	// directory, like the defaults. Without a database file to sit beside,
+	// the daemon's socket is where it would be for the default.
+	if !filepath.IsAbs(config.file) {
+		config.file = filepath.Join(home, config.file)
+	}
+	switch {
+	case IsPostgres(config.ConnectionString):
+		if config.Socket == "" {
+			config.Socket = filepath.Join(home, filepath.Dir(getDefaultDBPath()), "retour.sock")
+		}
+	case !filepath.IsAbs(config.ConnectionString):
+		config.ConnectionString = filepath.Join(home, config.ConnectionString)
+	}
+
+	if config.Command != "" {
+		command, ok := commands[config.Command]
+		if !ok {
+			return errors.New(trf("unknown command %q", config.Command))
+		}
+		if config.ReadOnly && changesHistory(config.Command, config.Args) {
+			return errors.New(trf("%s changes the history, which --read-only forbids", commandName(config)))
+		}
+		if len(config.Attach) > 0 && changesHistory(config.Command, config.Args) {
+			return errors.New(trf("%s changes the history, which cannot be done with --attach", commandName(config)))
+		}
+		return command(config, config.Args)
+	}
+
+	switch config.Mode {
+	case QueryMode:
+		return runQuery(config, os.Stdout)
+	default:
+		return runInteractive(config)
+	}
+}
+
+// changesHistory reports whether the subcommand given with args may change
+// the history, and so cannot be run read-only
+func changesHistory(command string, args []string) bool {
+	switch command {
+	case "daemon", "encrypt", "import", "merge", "record", "rerun", "send", "sync":
+		return true
+	case "searches", "session":
+		return len(args) > 0 && args[0] != "list"
+	case "doctor":
+		return slices.Contains(args, "--fix") || slices.Contains(args, "-fix")
+	default:
+		return false
+	}
+}
+
+// openDB opens the history database, creating its directory if necessary,
+// or only opens an existing one when the config is read-only, and attaches
+// the databases given with --attach
+func openDB(config *Config) (*DB, error) {
+	defer tracer.Span("db open")()
+	if IsPostgres(config.ConnectionString) {
+		return nil, errors.New(trf("%s needs a SQLite database, a PostgreSQL one only supports recording and searching", commandName(config)))
+	}
+	var db *DB
+	var err error
+	if config.ReadOnly {
+		db, err = NewDBReadOnly(config.ConnectionString, config.Pragmas)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(config.ConnectionString), 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create database directory: %w", err)
+		}
+		db, err = NewDBWithPragmas(config.ConnectionString, config.Pragmas)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Attach(config.Attach); err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.SetImmutable(config.Immutable)
+	db.SetKeepTags(config.KeepTags)
+	if config.EncryptionKeyFile != "" {
+		secret, err := LoadEncryptionKey(config.EncryptionKeyFile)
+		if err == nil {
+			err = db.SetEncryptionKey(secret)
+		}
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// openStorage opens where the history is kept, for the commands which need
+// no more of it than Storage offers: a PostgreSQL database if the connection
+// string is a postgres:// URL, otherwise the SQLite database.
+func openStorage(config *Config) (Storage, error) {
+	if IsPostgres(config.ConnectionString) {
+		if len(config.Attach) > 0 {
+			return nil, errors.New("--attach needs a SQLite database")
+		}
+		defer tracer.Span("db open")()
+		return NewPostgres(config.ConnectionString)
+	}
+	return openDB(config)
+}
+
+// commandName names the command being run, for messages
+func commandName(config *Config) string {
+	switch {
+	case config.Command != "":
+		return "retour " + config.Command
+	case config.Mode == QueryMode:
+		return "query mode"
+	default:
+		return "retour"
+	}
+}
+
+// runInit prints the integration script for the requested shell
+func runInit(config *Config, args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+	var options InitOptions
+	flags.BoolVar(&options.BindCtrlR, "ctrl-r", false, "Bind Ctrl-R to the search widget")
+	flags.BoolVar(&options.Daemon, "daemon", false, "Send commands to the daemon rather than recording them directly")
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: retour init <bash|zsh> [--ctrl-r] [--daemon]")
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	script, err := InitScript(args[0], options)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Print(script)
+	return err
+}
+
+// runQuery executes the user's SQL query and prints the matching records
+func runQuery(config *Config, w io.Writer) error {
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	buffered := bufio.NewWriter(w)
+	writer, err := newFormatWriter(buffered, config.Format, config.Template, config.Columns, config.relativeTo())
+	if err != nil {
+		return err
+	}
+
+	// Rows are written as they are read so huge results need not fit in memory
+	endQuery := tracer.Span("query")
+	if config.AllowWrite {
+		err = db.QueryStream(config.Query, writer.Write)
+	} else {
+		err = db.QueryStreamReadOnly(config.Query, writer.Write)
+	}
+	endQuery()
+	if err != nil {
+		return fmt.Errorf("query failed: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// runInteractive shows the picker over the filtered history and emits the
+// selected command according to the configured output mode
+func runInteractive(config *Config) error {
+	store, err := openStorage(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	// Previews, warnings and saved searches need the SQLite database
+	db, _ := store.(*DB)
+
+	// The picker applies the filter text itself, so it can be edited
+	search, err := resolveSearch(db, config)
+	if err != nil {
+		return err
+	}
+	filterText := search.Filter
+	search.Filter = ""
+	endQuery := tracer.Span("first query")
+	records, err := searchStorage(store, search)
+	endQuery()
+	if err != nil {
+		return fmt.Errorf("failed to load history: %w", err)
+	}
+
+	// The mouse wheel moves through the list. In shell mode stdout is
+	// captured by the shell, so draw on stderr instead.
+	options := []tea.ProgramOption{tea.WithMouseCellMotion()}
+	terminal := os.Stdout
+	if config.Output == ShellOutput {
+		terminal = os.Stderr
+		lipgloss.SetDefaultRenderer(lipgloss.NewRenderer(os.Stderr))
+		options = append(options, tea.WithOutput(os.Stderr))
+	}
+
+	endFilter := tracer.Span("filter")
 	filter := NewFilter(records)
-	p := tea.NewProgram(NewUI(filter))
+	filter.SetMatchMode(search.Match)
+	filter.UpdateFilter(filterText)
+	endFilter()
+
+	// Each command's database is shown when others are attached
+	columns := config.Columns
+	if len(columns) == 0 && len(config.Attach) > 0 {
+		columns = append(Columns{{Name: "source"}}, pickerColumns...)
+	}
+	ui := NewUI(filter).WithColumns(columns).WithAbsoluteTime(config.AbsoluteTime).
+		WithReadOnly(config.ReadOnly).WithKeys(config.Keys).WithTheme(config.Theme).WithSearch(search).
+		WithClipboard(SystemClipboard(terminal))
+	if db != nil {
+		ui = ui.WithContext(func(r Record) ([]Record, []Record, error) {
+			return db.SessionContext(r, 5)
+		}).WithFingerprints(db.SessionFingerprint).
+			WithDangerCheck(dangerCheck(db, config.DangerousPatterns)).WithSearches(db, search).
+			WithPaging(db.searchPages(search), search.Limit).WithStars(db.SetStarred).WithTags(db.Tag).
+			WithIgnore(ignoreCommands(db, config))
+		if config.SearchHistory {
+			ui = ui.WithHistorySearch(db.searchMatches(search))
+		}
+		events, unsubscribe := db.Events().Channel(16)
+		defer unsubscribe()
+		ui = ui.WithEvents(events)
+	}
+
+	// bubbletea restores the terminal on SIGINT and SIGTERM, but SIGHUP
+	// would leave it in raw mode
+	p := tea.NewProgram(ui, options...)
+	stopHangup := onSignal(p.Quit, syscall.SIGHUP)
 	m, err := p.Run()
+	stopHangup()
+	if errors.Is(err, tea.ErrInterrupted) {
+		return ExitStatusError{Status: 130}
+	}
 	if err != nil {
-		fmt.Printf("Error running program: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("error running program: %w", err)
 	}
 
-	// Get the selected record if any
-	if model, ok := m.(Model); ok {
-		if record, ok := model.Selected(); ok {
-			fmt.Printf("Selected: %s %s\n", record.Command, record.Arguments)
-		}
+	model, ok := m.(Model)
+	if !ok {
+		return nil
+	}
+	selected := model.SelectedAll()
+	if len(selected) == 0 {
+		return nil
+	}
+	if config.Exec || config.ExecHere {
+		return execSelected(store, config, selected)
+	}
+
+	lines := make([]string, len(selected))
+	for i, record := range selected {
+		lines[i] = record.CommandLine()
+	}
+	output := strings.Join(lines, config.Join.Separator())
+	if config.WithID {
+		output = fmt.Sprintf("%d\t%s", selected[0].ID, output)
+	}
+
+	if config.Output == ShellOutput {
+		_, err = fmt.Print(output)
+	} else {
+		_, err = fmt.Println(output)
 	}
+	return err
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// catalogs holds the translations of the user facing messages, by language
+// and then by the English message. A message missing from a catalog is shown
+// in English, so a translation can be added a few messages at a time. To add
+// a language, add its catalog here, keyed by its ISO 639-1 code.
+var catalogs = map[string]map[string]string{
+	"fr": {
+		// Picker
+		"Loading...":         "Chargement...",
+		"Window too small":   "Fenêtre trop petite",
+		"Filter: ":           "Filtre : ",
+		"Save search as: ":   "Enregistrer la recherche sous : ",
+		"Emit anyway? [y/N]": "Émettre quand même ? [o/N]",
+		"Saved searches: Enter runs one, Esc goes back": "Recherches enregistrées : Entrée en lance une, Échap revient",
+		"Could not check the selection: %v":             "Impossible de vérifier la sélection : %v",
+		"Could not save the search: %v":                 "Impossible d'enregistrer la recherche : %v",
+		"Saved the search as %q":                        "Recherche enregistrée sous %q",
+		"Could not load the saved searches: %v":         "Impossible de charger les recherches enregistrées : %v",
+		"No searches are saved, Ctrl-S saves this one":  "Aucune recherche enregistrée, Ctrl-S enregistre celle-ci",
+		"Could not run search %q: %v":                   "Impossible de lancer la recherche %q : %v",
+		"Could not search the rest of the history: %v":  "Impossible de chercher dans le reste de l'historique : %v",
+		"Could not load more history: %v":               "Impossible de charger plus d'historique : %v",
+		"The history is read-only":                      "L'historique est en lecture seule",
+		"Search %q":                                     "Recherche %q",
+		"Could not change the search: %v":               "Impossible de changer la recherche : %v",
+		"Could not copy to the clipboard: %v":           "Impossible de copier dans le presse-papiers : %v",
+		"Copied %q":                                     "%q copiée",
+		"Could not star %q: %v":                         "Impossible d'ajouter %q aux favoris : %v",
+		"Starred %q":                                    "%q ajoutée aux favoris",
+		"Unstarred %q":                                  "%q retirée des favoris",
+		"Delete and ignore commands matching %s?":       "Supprimer et ignorer les commandes correspondant à %s ?",
+		"Ignore them? [y/N]":                            "Les ignorer ? [o/N]",
+		"Could not ignore %s: %v":                       "Impossible d'ignorer %s : %v",
+		"Ignoring %s from now on, %d records deleted":   "%s ignorée désormais, %d enregistrements supprimés",
+		"Tag %q with: ":                                 "Étiqueter %q avec : ",
+		"Could not tag %q: %v":                          "Impossible d'étiqueter %q : %v",
+		"Tagged %q with %s":                             "%q étiquetée %s",
+		"Today":                                         "Aujourd'hui",
+		"Yesterday":                                     "Hier",
+		"Last week":                                     "Semaine dernière",
+		"All time":                                      "Depuis toujours",
+		"Succeeded":                                     "Réussies",
+		"Failed":                                        "Échouées",
+		"All results":                                   "Tous les résultats",
+		"Here in %s":                                    "Ici dans %s",
+		"Under %s":                                      "Sous %s",
+		"In %s":                                         "Dans %s",
+		"All directories":                               "Tous les répertoires",
+		"Repo %s":                                       "Dépôt %s",
+		"Branch %s":                                     "Branche %s",
+		"Starred":                                       "Favoris",
+		"Fuzzy":                                         "Approximative",
+		"Exact":                                         "Exacte",
+		"Regex":                                         "Expression régulière",
+		"Tag %s":                                        "Étiquette %s",
+		"%d/%s shown":                                   "%d/%s affichées",
+		"Command:":                                      "Commande :",
+		"Directory:":                                    "Répertoire :",
+		"Time:":                                         "Heure :",
+		"Exit:":                                         "Sortie :",
+		"Duration:":                                     "Durée :",
+		"Session:":                                      "Session :",
+		"Runs:":                                         "Exécutions :",
+		"Rerun of:":                                     "Relance de :",
+		"Repo:":                                         "Dépôt :",
+		"Branch:":                                       "Branche :",
+		"Timeline:":                                     "Chronologie :",
+		"Environment:":                                  "Environnement :",
+		"unknown":                                       "inconnue",
+		"just now":                                      "à l'instant",
+		"%dm ago":                                       "il y a %d min",
+		"%dh ago":                                       "il y a %d h",
+		"yesterday %s":                                  "hier %s",
+		"Mon":                                           "lun.",
+		"Tue":                                           "mar.",
+		"Wed":                                           "mer.",
+		"Thu":                                           "jeu.",
+		"Fri":                                           "ven.",
+		"Sat":                                           "sam.",
+		"Sun":                                           "dim.",
+
+		// Confirmations and errors
+		"never run before":            "jamais exécutée",
+		"last run %s in %s, exit %d":  "dernière exécution le %s dans %s, sortie %d",
+		"run %d times, %d failed; %s": "exécutée %d fois, %d échecs ; %s",
+		"%s is marked dangerous: %s":  "%s est marquée dangereuse : %s",
+		"Run anyway?":                 "L'exécuter quand même ?",
+		"[y/N]":                       "[o/N]",
+		"y":                           "o",
+		"not running %q":              "%q n'est pas exécutée",
+		"unknown command %q":          "commande inconnue %q",
+		"%s changes the history, which --read-only forbids":                                  "%s modifie l'historique, ce que --read-only interdit",
+		"%s needs a SQLite database, a PostgreSQL one only supports recording and searching": "%s nécessite une base SQLite, une base PostgreSQL ne permet que d'enregistrer et de rechercher",
+	},
+}
+
+// catalog translates the messages of the current run, nil to show them in
+// English
+var catalog map[string]string
+
+// SetLanguage shows the messages in language, a code such as fr, from then
+// on. An empty language is taken from the locale in LC_ALL, LC_MESSAGES or
+// LANG, falling back to English when there is no catalog for it. An error is
+// returned if a language given explicitly has no catalog.
+func SetLanguage(language string) error {
+	if language == "" {
+		catalog = catalogs[localeLanguage()]
+		return nil
+	}
+	if language == "en" {
+		catalog = nil
+		return nil
+	}
+	translations, ok := catalogs[language]
+	if !ok {
+		return fmt.Errorf("no translation for language %q, available: en, %s", language, strings.Join(languages(), ", "))
+	}
+	catalog = translations
+	return nil
+}
+
+// localeLanguage returns the language of the locale the environment asks for
+// messages in, e.g. fr for fr_FR.UTF-8
+func localeLanguage() string {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(name); locale != "" {
+			language, _, _ := strings.Cut(locale, "_")
+			language, _, _ = strings.Cut(language, ".")
+			return strings.ToLower(language)
+		}
+	}
+	return ""
+}
+
+// languages returns the languages with a catalog, in order
+func languages() []string {
+	var codes []string
+	for code := range catalogs {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	return codes
+}
+
+// tr returns message in the current language
+func tr(message string) string {
+	if translation, ok := catalog[message]; ok {
+		return translation
+	}
+	return message
+}
+
+// trf formats according to format translated into the current language
+func trf(format string, args ...interface{}) string {
+	return fmt.Sprintf(tr(format), args...)
+}
@@ -0,0 +1,55 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	rt "github.com/nuchs/retour"
+)
+
+func TestSetLanguage(t *testing.T) {
+	t.Cleanup(func() { rt.SetLanguage("en") })
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LC_MESSAGES", "")
+
+	tests := []struct {
+		language string
+		lang     string
+		want     string
+	}{
+		{"fr", "", "jamais exécutée"},
+		{"en", "fr_FR.UTF-8", "never run before"},
+		{"", "fr_FR.UTF-8", "jamais exécutée"},
+		{"", "de_DE.UTF-8", "never run before"},
+		{"", "C", "never run before"},
+	}
+	for _, tt := range tests {
+		t.Setenv("LANG", tt.lang)
+		if err := rt.SetLanguage(tt.language); err != nil {
+			t.Fatalf("SetLanguage(%q) unexpected error = %v", tt.language, err)
+		}
+		if got := (rt.Outcomes{}).String(); got != tt.want {
+			t.Errorf("With language %q and LANG %q, got %q, want %q", tt.language, tt.lang, got, tt.want)
+		}
+	}
+
+	if err := rt.SetLanguage("xx"); err == nil {
+		t.Error("SetLanguage() accepted a language without a catalog")
+	}
+}
+
+func TestTranslatedPicker(t *testing.T) {
+	if err := rt.SetLanguage("fr"); err != nil {
+		t.Fatalf("SetLanguage() unexpected error = %v", err)
+	}
+	t.Cleanup(func() { rt.SetLanguage("en") })
+
+	records := []rt.Record{rt.NewRecord("ls -la", "/tmp", 0, time.Now())}
+	model, _ := rt.NewUI(rt.NewFilter(records)).Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	view := model.View()
+	if !strings.Contains(view, "Filtre : ") {
+		t.Errorf("View() does not show the filter prompt in French:\n%s", view)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerPID returns the process ID of the client at the other end of conn, as
+// the kernel reports it with SO_PEERCRED, or 0 if it can't be told
+func peerPID(conn net.Conn) int {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return 0
+	}
+	return int(cred.Pid)
+}
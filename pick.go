@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runPick implements the pick subcommand, which prints what the picker would
+// offer for the filter text without showing it, so scripts can select from
+// history the way a user would.
+func runPick(config *Config, args []string) error {
+	flags := flag.NewFlagSet("pick", flag.ContinueOnError)
+	filter := flags.String("filter", config.Filter, "Text the command line must contain")
+	first := flags.Bool("first", false, "Print only the top ranked match")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("usage: retour [options] pick [--filter text] [--first]")
+	}
+
+	search, err := config.Search()
+	if err != nil {
+		return err
+	}
+	search.Filter = *filter
+
+	matches, err := pick(config, search)
+	if err != nil {
+		return fmt.Errorf("failed to load history: %w", err)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no command matches %q", *filter)
+	}
+	if *first {
+		matches = matches[:1]
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	for _, r := range matches {
+		if config.WithID {
+			fmt.Fprintf(out, "%d\t", r.ID)
+		}
+		fmt.Fprintln(out, r.CommandLine())
+	}
+	return out.Flush()
+}
+
+// pick runs the search through the daemon if one is running, otherwise
+// against the database
+func pick(config *Config, search Search) ([]Record, error) {
+	if client := dialDaemon(config); client != nil {
+		defer client.Close()
+		return client.Search(search)
+	}
+
+	store, err := openStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	return searchStorage(store, search)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// IsPostgres reports whether a connection string names a PostgreSQL database
+// rather than a SQLite file.
+func IsPostgres(connectionString string) bool {
+	return strings.HasPrefix(connectionString, "postgres://") ||
+		strings.HasPrefix(connectionString, "postgresql://")
+}
+
+// Postgres keeps the history in a PostgreSQL database, so a team can share
+// it. It offers recording and searching, but none of the SQLite database's
+// extras such as sessions, encryption or saved searches.
+type Postgres struct {
+	conn *sql.DB
+}
+
+var _ Storage = (*Postgres)(nil)
+
+// NewPostgres connects to the PostgreSQL database at connectionString, a
+// postgres:// URL, and creates the history table if it doesn't exist.
+func NewPostgres(connectionString string) (*Postgres, error) {
+	conn, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	pg := &Postgres{conn: conn}
+	endSchema := tracer.Span("schema check")
+	err = pg.ensureSchema()
+	endSchema()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to ensure schema: %w", err)
+	}
+	return pg, nil
+}
+
+// Close closes the connections to the database
+func (pg *Postgres) Close() error {
+	return pg.conn.Close()
+}
+
+// ensureSchema creates the history table and its indexes if they don't exist
+func (pg *Postgres) ensureSchema() error {
+	_, err := pg.conn.Exec(`
+	CREATE TABLE IF NOT EXISTS history (
+		id BIGSERIAL PRIMARY KEY,
+		command TEXT NOT NULL,
+		timestamp TIMESTAMPTZ NOT NULL,
+		working_directory TEXT,
+		exit_status INTEGER NOT NULL,
+		arguments TEXT,
+		duration BIGINT NOT NULL DEFAULT 0,
+		session TEXT NOT NULL DEFAULT '',
+		hostname TEXT NOT NULL DEFAULT '',
+		rerun_of BIGINT REFERENCES history(id) ON DELETE SET NULL,
+		repo TEXT NOT NULL DEFAULT '',
+		branch TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_command ON history(command);
+	CREATE INDEX IF NOT EXISTS idx_timestamp ON history(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_working_directory ON history(working_directory);
+	CREATE INDEX IF NOT EXISTS idx_session ON history(session);
+	CREATE INDEX IF NOT EXISTS idx_repo ON history(repo, branch);`)
+	return err
+}
+
+// Insert stores a record, setting its ID. A rerun of a record which no
+// longer exists is stored as organic.
+func (pg *Postgres) Insert(record *Record) error {
+	return pg.conn.QueryRow(`
+	INSERT INTO history (command, timestamp, working_directory, exit_status, arguments, duration, session, hostname, repo, branch, rerun_of)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, (SELECT id FROM history WHERE id = $11))
+	RETURNING id`,
+		record.Command,
+		record.Timestamp,
+		record.WorkingDirectory,
+		record.ExitStatus,
+		record.Arguments,
+		record.Duration.Milliseconds(),
+		record.Session,
+		record.Hostname,
+		record.Repo,
+		record.Branch,
+		record.RerunOf,
+	).Scan(&record.ID)
+}
+
+// Query executes a SQL query and returns the results as records, matching
+// columns to fields by name as DB.Query does. Parameters may be written as
+// ? as for SQLite, or as $1, $2 and so on.
+func (pg *Postgres) Query(query string, args ...interface{}) ([]Record, error) {
+	rows, err := pg.conn.Query(rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	var r Record
+	var stored storedFields
+	targets := scanTargets(columns, &r, &stored)
+	for rows.Next() {
+		r, stored = Record{}, storedFields{}
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		stored.apply(&r)
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// QueryFiltered returns the most recent records matching the filters, as
+// described for DB.QueryFiltered
+func (pg *Postgres) QueryFiltered(timeRange time.Duration, resultFilter string, scope Scope, limit int) ([]Record, error) {
+	where, args := filterClause(timeRange, resultFilter, scope)
+	query := `
+	SELECT ` + recordColumns + `
+	FROM history
+	WHERE ` + where + `
+	ORDER BY timestamp DESC`
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	return pg.Query(query, args...)
+}
+
+// QueryUnique is like QueryFiltered but collapses runs of the same command
+// line into one record, as described for DB.QueryUnique
+func (pg *Postgres) QueryUnique(timeRange time.Duration, resultFilter string, scope Scope, limit int) ([]Record, error) {
+	where, args := filterClause(timeRange, resultFilter, scope)
+	query := `
+	SELECT ` + recordColumns + `, count
+	FROM (
+		SELECT *,
+			COUNT(*) OVER line AS count,
+			ROW_NUMBER() OVER (line ORDER BY timestamp DESC, id DESC) AS latest
+		FROM history
+		WHERE ` + where + `
+		WINDOW line AS (PARTITION BY command, COALESCE(arguments, ''))
+	) AS lines
+	WHERE latest = 1
+	ORDER BY timestamp DESC`
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	return pg.Query(query, args...)
+}
+
+// QuerySuggested ranks the command lines run in the scope's directory tree
+// for use there, as described for DB.QuerySuggested. Scores are worked out
+// from the timestamps as the query runs, as nothing decays stored ones.
+func (pg *Postgres) QuerySuggested(timeRange time.Duration, resultFilter string, scope Scope, limit int) ([]Record, error) {
+	scope.Recursive = true
+	where, args := filterClause(timeRange, resultFilter, scope)
+	args = append([]interface{}{filepath.Clean(scope.Dir)}, args...)
+	query := `
+	SELECT ` + recordColumns + `, count
+	FROM (
+		SELECT *,
+			COUNT(*) OVER line AS count,
+			ROW_NUMBER() OVER (line ORDER BY timestamp DESC, id DESC) AS latest,
+			SUM(CASE WHEN working_directory = ? THEN 1 ELSE 0 END) OVER line AS here,
+			SUM(1.0 / (1.0 + EXTRACT(EPOCH FROM now() - timestamp) / 86400)) OVER line AS score
+		FROM history
+		WHERE ` + where + `
+		WINDOW line AS (PARTITION BY command, COALESCE(arguments, ''))
+	) AS lines
+	WHERE latest = 1
+	ORDER BY here > 0 DESC, score DESC, timestamp DESC`
+
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	return pg.Query(query, args...)
+}
+
+// Prune removes the records run before the given time, returning how many
+// were removed. Reruns of them are kept as if they had been typed afresh.
+func (pg *Postgres) Prune(before time.Time) (int, error) {
+	result, err := pg.conn.Exec("DELETE FROM history WHERE timestamp < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := result.RowsAffected()
+	return int(pruned), err
+}
+
+// rebind rewrites the ? parameters of a query written for SQLite as the $1,
+// $2 and so on PostgreSQL expects. Question marks within quoted strings and
+// identifiers are left alone.
+func rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	var quote byte
+	// Quotes and ? are ASCII, so the query need not be valid UTF-8
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
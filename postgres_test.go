@@ -0,0 +1,85 @@
+package main_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestIsPostgres(t *testing.T) {
+	tests := map[string]bool{
+		"postgres://retour@db.example.com/history":   true,
+		"postgresql://localhost/history?sslmode=off": true,
+		"/home/me/.local/share/retour/history.db":    false,
+		"postgres.db": false,
+	}
+	for connectionString, want := range tests {
+		if got := rt.IsPostgres(connectionString); got != want {
+			t.Errorf("IsPostgres(%q) = %v, want %v", connectionString, got, want)
+		}
+	}
+}
+
+// TestPostgres needs a database it may fill and empty, given as a
+// postgres:// URL in RETOUR_TEST_POSTGRES
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("RETOUR_TEST_POSTGRES")
+	if url == "" {
+		t.Skip("Set RETOUR_TEST_POSTGRES to a PostgreSQL database to test against it")
+	}
+	store, err := rt.NewPostgres(url)
+	if err != nil {
+		t.Fatalf("NewPostgres() unexpected error = %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Prune(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Prune() unexpected error = %v", err)
+	}
+
+	now := time.Now()
+	var old rt.Record
+	for i, line := range []string{"make build", "make test", "make test", "ls"} {
+		record := rt.NewRecord(line, "/src", i%2, now.Add(time.Duration(i-4)*time.Hour))
+		if i == 0 {
+			record.Timestamp = now.AddDate(0, -2, 0)
+		}
+		if i == 2 {
+			record.RerunOf = old.ID
+			record.WorkingDirectory = "/src/app"
+		}
+		if err := store.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+		if i == 0 {
+			old = record
+		}
+	}
+
+	records, err := store.QueryFiltered(24*time.Hour, "all", rt.Scope{Dir: "/src"}, 10)
+	if err != nil || len(records) != 2 || records[0].CommandLine() != "ls" {
+		t.Errorf("QueryFiltered() = %+v, %v, want ls then make test", records, err)
+	}
+	unique, err := store.QueryUnique(0, "all", rt.Scope{}, 10)
+	if err != nil || len(unique) != 3 || unique[1].Count != 2 {
+		t.Errorf("QueryUnique() = %+v, %v, want make test twice", unique, err)
+	}
+	suggested, err := store.QuerySuggested(0, "all", rt.Scope{Dir: "/src/app"}, 10)
+	if err != nil || len(suggested) != 1 || suggested[0].CommandLine() != "make test" {
+		t.Errorf("QuerySuggested() = %+v, %v, want make test", suggested, err)
+	}
+	byID, err := store.Query("SELECT id, command, arguments, rerun_of FROM history WHERE id = ?", old.ID)
+	if err != nil || len(byID) != 1 || byID[0].CommandLine() != "make build" {
+		t.Errorf("Query() = %+v, %v, want make build", byID, err)
+	}
+
+	pruned, err := store.Prune(now.AddDate(0, -1, 0))
+	if err != nil || pruned != 1 {
+		t.Errorf("Prune() = %d, %v, want 1 record removed", pruned, err)
+	}
+	reruns, err := store.Query("SELECT id, rerun_of FROM history WHERE rerun_of IS NOT NULL")
+	if err != nil || len(reruns) != 0 {
+		t.Errorf("Reruns of pruned records = %+v, %v, want none", reruns, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// PromptInfo summarises recent activity for display in the shell prompt.
+type PromptInfo struct {
+	// Last is the most recently recorded command, valid if HasLast is set
+	Last    Record
+	HasLast bool
+
+	// DirCount and DirFailures count the commands run in the directory
+	DirCount    int
+	DirFailures int
+}
+
+// PromptInfo gathers the prompt summary for a session and directory using
+// only indexed lookups, so it is cheap enough to run for every prompt.
+// An empty session considers commands from all sessions.
+func (db *DB) PromptInfo(session string, dir string) (PromptInfo, error) {
+	var info PromptInfo
+
+	query := "SELECT " + recordColumns + " FROM history"
+	var args []interface{}
+	if session != "" {
+		query += " WHERE session = ?"
+		args = append(args, session)
+	}
+	query += " ORDER BY id DESC LIMIT 1"
+
+	records, err := db.Query(query, args...)
+	if err != nil {
+		return info, err
+	}
+	if len(records) > 0 {
+		info.Last = records[0]
+		info.HasLast = true
+	}
+
+	var failures sql.NullInt64
+	err = db.reader.QueryRow(
+		"SELECT COUNT(*), SUM(exit_status != 0) FROM history WHERE working_directory = ?", dir,
+	).Scan(&info.DirCount, &failures)
+	if err != nil {
+		return info, err
+	}
+	info.DirFailures = int(failures.Int64)
+
+	return info, nil
+}
+
+// String formats the summary for embedding in a prompt, e.g. "✗ 2 1.5s | 128 here, 3 failed".
+func (p PromptInfo) String() string {
+	var parts []string
+
+	if p.HasLast {
+		status := "✓"
+		if p.Last.ExitStatus != 0 {
+			status = fmt.Sprintf("✗ %d", p.Last.ExitStatus)
+		}
+		if p.Last.Duration > 0 {
+			status += " " + p.Last.Duration.Round(100*time.Millisecond).String()
+		}
+		parts = append(parts, status)
+	}
+
+	dir := fmt.Sprintf("%d here", p.DirCount)
+	if p.DirFailures > 0 {
+		dir += fmt.Sprintf(", %d failed", p.DirFailures)
+	}
+	parts = append(parts, dir)
+
+	return strings.Join(parts, " | ")
+}
+
+// runPromptInfo implements the prompt-info subcommand
+func runPromptInfo(config *Config, args []string) error {
+	flags := flag.NewFlagSet("prompt-info", flag.ContinueOnError)
+	session := flags.String("session", "", "Only consider the last command from this session")
+	dir := flags.String("cwd", "", "Directory to report on [default: current directory]")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*dir = wd
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	info, err := db.PromptInfo(*session, *dir)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Println(info)
+	return err
+}
@@ -0,0 +1,47 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestPromptInfo(t *testing.T) {
+	database := openTestDB(t)
+
+	for _, r := range []rt.Record{
+		{Command: "make", WorkingDirectory: "/project", ExitStatus: 2, Session: "a", Duration: 1500 * time.Millisecond},
+		{Command: "ls", WorkingDirectory: "/project", ExitStatus: 0, Session: "a"},
+		{Command: "git", WorkingDirectory: "/other", ExitStatus: 1, Session: "b", Duration: 250 * time.Millisecond},
+	} {
+		r.Timestamp = time.Now()
+		if err := database.Insert(&r); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		session string
+		dir     string
+		want    string
+	}{
+		{name: "Any session", session: "", dir: "/project", want: "✗ 1 300ms | 2 here, 1 failed"},
+		{name: "Own session", session: "a", dir: "/project", want: "✓ | 2 here, 1 failed"},
+		{name: "Unknown directory", session: "a", dir: "/nowhere", want: "✓ | 0 here"},
+		{name: "Unknown session", session: "c", dir: "/other", want: "1 here, 1 failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := database.PromptInfo(tt.session, tt.dir)
+			if err != nil {
+				t.Fatalf("PromptInfo() unexpected error = %v", err)
+			}
+			if got := info.String(); got != tt.want {
+				t.Errorf("PromptInfo() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,805 @@
+// The service `retour daemon --grpc` serves for tooling such as editors and
+// remote agents, alongside the JSON line protocol on its Unix socket. Keep it
+// in step with Storage, Record, Scope and Search as they change, and
+// regenerate the Go code in retourv1 from the repository root with:
+//
+//   protoc -I proto --go_out=proto/retourv1 --go_opt=paths=source_relative \
+//     --go-grpc_out=proto/retourv1 --go-grpc_opt=paths=source_relative \
+//     proto/retour.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: retour.proto
+
+package retourv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Record struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	Id               int64                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Command          string                 `protobuf:"bytes,2,opt,name=command,proto3" json:"command,omitempty"`
+	Arguments        string                 `protobuf:"bytes,3,opt,name=arguments,proto3" json:"arguments,omitempty"`
+	Timestamp        *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	WorkingDirectory string                 `protobuf:"bytes,5,opt,name=working_directory,json=workingDirectory,proto3" json:"working_directory,omitempty"`
+	ExitStatus       int32                  `protobuf:"varint,6,opt,name=exit_status,json=exitStatus,proto3" json:"exit_status,omitempty"`
+	// Zero if unknown
+	Duration *durationpb.Duration `protobuf:"bytes,7,opt,name=duration,proto3" json:"duration,omitempty"`
+	Session  string               `protobuf:"bytes,8,opt,name=session,proto3" json:"session,omitempty"`
+	Hostname string               `protobuf:"bytes,9,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	// Zero if the command was typed afresh
+	RerunOf int64  `protobuf:"varint,10,opt,name=rerun_of,json=rerunOf,proto3" json:"rerun_of,omitempty"`
+	Repo    string `protobuf:"bytes,11,opt,name=repo,proto3" json:"repo,omitempty"`
+	Branch  string `protobuf:"bytes,12,opt,name=branch,proto3" json:"branch,omitempty"`
+	// Runs of the command line, set by unique searches
+	Count int64 `protobuf:"varint,13,opt,name=count,proto3" json:"count,omitempty"`
+	// Pinned above the rest of the history in the picker
+	Starred       bool `protobuf:"varint,14,opt,name=starred,proto3" json:"starred,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Record) Reset() {
+	*x = Record{}
+	mi := &file_retour_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Record) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Record) ProtoMessage() {}
+
+func (x *Record) ProtoReflect() protoreflect.Message {
+	mi := &file_retour_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Record.ProtoReflect.Descriptor instead.
+func (*Record) Descriptor() ([]byte, []int) {
+	return file_retour_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Record) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Record) GetCommand() string {
+	if x != nil {
+		return x.Command
+	}
+	return ""
+}
+
+func (x *Record) GetArguments() string {
+	if x != nil {
+		return x.Arguments
+	}
+	return ""
+}
+
+func (x *Record) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+func (x *Record) GetWorkingDirectory() string {
+	if x != nil {
+		return x.WorkingDirectory
+	}
+	return ""
+}
+
+func (x *Record) GetExitStatus() int32 {
+	if x != nil {
+		return x.ExitStatus
+	}
+	return 0
+}
+
+func (x *Record) GetDuration() *durationpb.Duration {
+	if x != nil {
+		return x.Duration
+	}
+	return nil
+}
+
+func (x *Record) GetSession() string {
+	if x != nil {
+		return x.Session
+	}
+	return ""
+}
+
+func (x *Record) GetHostname() string {
+	if x != nil {
+		return x.Hostname
+	}
+	return ""
+}
+
+func (x *Record) GetRerunOf() int64 {
+	if x != nil {
+		return x.RerunOf
+	}
+	return 0
+}
+
+func (x *Record) GetRepo() string {
+	if x != nil {
+		return x.Repo
+	}
+	return ""
+}
+
+func (x *Record) GetBranch() string {
+	if x != nil {
+		return x.Branch
+	}
+	return ""
+}
+
+func (x *Record) GetCount() int64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *Record) GetStarred() bool {
+	if x != nil {
+		return x.Starred
+	}
+	return false
+}
+
+type Scope struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Empty for all directories
+	Dir       string `protobuf:"bytes,1,opt,name=dir,proto3" json:"dir,omitempty"`
+	Recursive bool   `protobuf:"varint,2,opt,name=recursive,proto3" json:"recursive,omitempty"`
+	Repo      string `protobuf:"bytes,3,opt,name=repo,proto3" json:"repo,omitempty"`
+	Branch    string `protobuf:"bytes,4,opt,name=branch,proto3" json:"branch,omitempty"`
+	// Only the starred records
+	Starred bool `protobuf:"varint,5,opt,name=starred,proto3" json:"starred,omitempty"`
+	// Only the records tagged with it, empty for all
+	Tag           string `protobuf:"bytes,6,opt,name=tag,proto3" json:"tag,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Scope) Reset() {
+	*x = Scope{}
+	mi := &file_retour_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Scope) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Scope) ProtoMessage() {}
+
+func (x *Scope) ProtoReflect() protoreflect.Message {
+	mi := &file_retour_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Scope.ProtoReflect.Descriptor instead.
+func (*Scope) Descriptor() ([]byte, []int) {
+	return file_retour_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Scope) GetDir() string {
+	if x != nil {
+		return x.Dir
+	}
+	return ""
+}
+
+func (x *Scope) GetRecursive() bool {
+	if x != nil {
+		return x.Recursive
+	}
+	return false
+}
+
+func (x *Scope) GetRepo() string {
+	if x != nil {
+		return x.Repo
+	}
+	return ""
+}
+
+func (x *Scope) GetBranch() string {
+	if x != nil {
+		return x.Branch
+	}
+	return ""
+}
+
+func (x *Scope) GetStarred() bool {
+	if x != nil {
+		return x.Starred
+	}
+	return false
+}
+
+func (x *Scope) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+type InsertRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Record        *Record                `protobuf:"bytes,1,opt,name=record,proto3" json:"record,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InsertRequest) Reset() {
+	*x = InsertRequest{}
+	mi := &file_retour_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InsertRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InsertRequest) ProtoMessage() {}
+
+func (x *InsertRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_retour_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InsertRequest.ProtoReflect.Descriptor instead.
+func (*InsertRequest) Descriptor() ([]byte, []int) {
+	return file_retour_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *InsertRequest) GetRecord() *Record {
+	if x != nil {
+		return x.Record
+	}
+	return nil
+}
+
+type InsertResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The ID the record was stored with
+	Id            int64 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *InsertResponse) Reset() {
+	*x = InsertResponse{}
+	mi := &file_retour_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *InsertResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*InsertResponse) ProtoMessage() {}
+
+func (x *InsertResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_retour_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use InsertResponse.ProtoReflect.Descriptor instead.
+func (*InsertResponse) Descriptor() ([]byte, []int) {
+	return file_retour_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *InsertResponse) GetId() int64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type QueryFilteredRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Only records newer than this long ago, unset for all
+	MaxAge *durationpb.Duration `protobuf:"bytes,1,opt,name=max_age,json=maxAge,proto3" json:"max_age,omitempty"`
+	// success, failed or all
+	Result string `protobuf:"bytes,2,opt,name=result,proto3" json:"result,omitempty"`
+	Scope  *Scope `protobuf:"bytes,3,opt,name=scope,proto3" json:"scope,omitempty"`
+	// 0 for all
+	Limit         int32 `protobuf:"varint,4,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *QueryFilteredRequest) Reset() {
+	*x = QueryFilteredRequest{}
+	mi := &file_retour_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QueryFilteredRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QueryFilteredRequest) ProtoMessage() {}
+
+func (x *QueryFilteredRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_retour_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QueryFilteredRequest.ProtoReflect.Descriptor instead.
+func (*QueryFilteredRequest) Descriptor() ([]byte, []int) {
+	return file_retour_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *QueryFilteredRequest) GetMaxAge() *durationpb.Duration {
+	if x != nil {
+		return x.MaxAge
+	}
+	return nil
+}
+
+func (x *QueryFilteredRequest) GetResult() string {
+	if x != nil {
+		return x.Result
+	}
+	return ""
+}
+
+func (x *QueryFilteredRequest) GetScope() *Scope {
+	if x != nil {
+		return x.Scope
+	}
+	return nil
+}
+
+func (x *QueryFilteredRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type SearchRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// today, yesterday, thelastweek or alltime
+	TimeRange string `protobuf:"bytes,1,opt,name=time_range,json=timeRange,proto3" json:"time_range,omitempty"`
+	// success, failed or all
+	Result string `protobuf:"bytes,2,opt,name=result,proto3" json:"result,omitempty"`
+	Scope  *Scope `protobuf:"bytes,3,opt,name=scope,proto3" json:"scope,omitempty"`
+	Unique bool   `protobuf:"varint,4,opt,name=unique,proto3" json:"unique,omitempty"`
+	Here   bool   `protobuf:"varint,5,opt,name=here,proto3" json:"here,omitempty"`
+	// 0 for all
+	Limit int32 `protobuf:"varint,6,opt,name=limit,proto3" json:"limit,omitempty"`
+	// Text typed into the picker, empty for all
+	Filter string `protobuf:"bytes,7,opt,name=filter,proto3" json:"filter,omitempty"`
+	// How the filter matches: substring, fuzzy, exact or regex, empty for
+	// substring
+	Match         string `protobuf:"bytes,8,opt,name=match,proto3" json:"match,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SearchRequest) Reset() {
+	*x = SearchRequest{}
+	mi := &file_retour_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SearchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SearchRequest) ProtoMessage() {}
+
+func (x *SearchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_retour_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SearchRequest.ProtoReflect.Descriptor instead.
+func (*SearchRequest) Descriptor() ([]byte, []int) {
+	return file_retour_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *SearchRequest) GetTimeRange() string {
+	if x != nil {
+		return x.TimeRange
+	}
+	return ""
+}
+
+func (x *SearchRequest) GetResult() string {
+	if x != nil {
+		return x.Result
+	}
+	return ""
+}
+
+func (x *SearchRequest) GetScope() *Scope {
+	if x != nil {
+		return x.Scope
+	}
+	return nil
+}
+
+func (x *SearchRequest) GetUnique() bool {
+	if x != nil {
+		return x.Unique
+	}
+	return false
+}
+
+func (x *SearchRequest) GetHere() bool {
+	if x != nil {
+		return x.Here
+	}
+	return false
+}
+
+func (x *SearchRequest) GetLimit() int32 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+func (x *SearchRequest) GetFilter() string {
+	if x != nil {
+		return x.Filter
+	}
+	return ""
+}
+
+func (x *SearchRequest) GetMatch() string {
+	if x != nil {
+		return x.Match
+	}
+	return ""
+}
+
+type PruneRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Before        *timestamppb.Timestamp `protobuf:"bytes,1,opt,name=before,proto3" json:"before,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PruneRequest) Reset() {
+	*x = PruneRequest{}
+	mi := &file_retour_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PruneRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PruneRequest) ProtoMessage() {}
+
+func (x *PruneRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_retour_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PruneRequest.ProtoReflect.Descriptor instead.
+func (*PruneRequest) Descriptor() ([]byte, []int) {
+	return file_retour_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *PruneRequest) GetBefore() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Before
+	}
+	return nil
+}
+
+type PruneResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// How many records were removed
+	Pruned        int64 `protobuf:"varint,1,opt,name=pruned,proto3" json:"pruned,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PruneResponse) Reset() {
+	*x = PruneResponse{}
+	mi := &file_retour_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PruneResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PruneResponse) ProtoMessage() {}
+
+func (x *PruneResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_retour_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PruneResponse.ProtoReflect.Descriptor instead.
+func (*PruneResponse) Descriptor() ([]byte, []int) {
+	return file_retour_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *PruneResponse) GetPruned() int64 {
+	if x != nil {
+		return x.Pruned
+	}
+	return 0
+}
+
+type Records struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Records       []*Record              `protobuf:"bytes,1,rep,name=records,proto3" json:"records,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Records) Reset() {
+	*x = Records{}
+	mi := &file_retour_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Records) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Records) ProtoMessage() {}
+
+func (x *Records) ProtoReflect() protoreflect.Message {
+	mi := &file_retour_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Records.ProtoReflect.Descriptor instead.
+func (*Records) Descriptor() ([]byte, []int) {
+	return file_retour_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *Records) GetRecords() []*Record {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+var File_retour_proto protoreflect.FileDescriptor
+
+const file_retour_proto_rawDesc = "" +
+	"\n" +
+	"\fretour.proto\x12\tretour.v1\x1a\x1egoogle/protobuf/duration.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\xbc\x03\n" +
+	"\x06Record\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\x12\x18\n" +
+	"\acommand\x18\x02 \x01(\tR\acommand\x12\x1c\n" +
+	"\targuments\x18\x03 \x01(\tR\targuments\x128\n" +
+	"\ttimestamp\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\ttimestamp\x12+\n" +
+	"\x11working_directory\x18\x05 \x01(\tR\x10workingDirectory\x12\x1f\n" +
+	"\vexit_status\x18\x06 \x01(\x05R\n" +
+	"exitStatus\x125\n" +
+	"\bduration\x18\a \x01(\v2\x19.google.protobuf.DurationR\bduration\x12\x18\n" +
+	"\asession\x18\b \x01(\tR\asession\x12\x1a\n" +
+	"\bhostname\x18\t \x01(\tR\bhostname\x12\x19\n" +
+	"\brerun_of\x18\n" +
+	" \x01(\x03R\arerunOf\x12\x12\n" +
+	"\x04repo\x18\v \x01(\tR\x04repo\x12\x16\n" +
+	"\x06branch\x18\f \x01(\tR\x06branch\x12\x14\n" +
+	"\x05count\x18\r \x01(\x03R\x05count\x12\x18\n" +
+	"\astarred\x18\x0e \x01(\bR\astarred\"\x8f\x01\n" +
+	"\x05Scope\x12\x10\n" +
+	"\x03dir\x18\x01 \x01(\tR\x03dir\x12\x1c\n" +
+	"\trecursive\x18\x02 \x01(\bR\trecursive\x12\x12\n" +
+	"\x04repo\x18\x03 \x01(\tR\x04repo\x12\x16\n" +
+	"\x06branch\x18\x04 \x01(\tR\x06branch\x12\x18\n" +
+	"\astarred\x18\x05 \x01(\bR\astarred\x12\x10\n" +
+	"\x03tag\x18\x06 \x01(\tR\x03tag\":\n" +
+	"\rInsertRequest\x12)\n" +
+	"\x06record\x18\x01 \x01(\v2\x11.retour.v1.RecordR\x06record\" \n" +
+	"\x0eInsertResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x03R\x02id\"\xa0\x01\n" +
+	"\x14QueryFilteredRequest\x122\n" +
+	"\amax_age\x18\x01 \x01(\v2\x19.google.protobuf.DurationR\x06maxAge\x12\x16\n" +
+	"\x06result\x18\x02 \x01(\tR\x06result\x12&\n" +
+	"\x05scope\x18\x03 \x01(\v2\x10.retour.v1.ScopeR\x05scope\x12\x14\n" +
+	"\x05limit\x18\x04 \x01(\x05R\x05limit\"\xde\x01\n" +
+	"\rSearchRequest\x12\x1d\n" +
+	"\n" +
+	"time_range\x18\x01 \x01(\tR\ttimeRange\x12\x16\n" +
+	"\x06result\x18\x02 \x01(\tR\x06result\x12&\n" +
+	"\x05scope\x18\x03 \x01(\v2\x10.retour.v1.ScopeR\x05scope\x12\x16\n" +
+	"\x06unique\x18\x04 \x01(\bR\x06unique\x12\x12\n" +
+	"\x04here\x18\x05 \x01(\bR\x04here\x12\x14\n" +
+	"\x05limit\x18\x06 \x01(\x05R\x05limit\x12\x16\n" +
+	"\x06filter\x18\a \x01(\tR\x06filter\x12\x14\n" +
+	"\x05match\x18\b \x01(\tR\x05match\"B\n" +
+	"\fPruneRequest\x122\n" +
+	"\x06before\x18\x01 \x01(\v2\x1a.google.protobuf.TimestampR\x06before\"'\n" +
+	"\rPruneResponse\x12\x16\n" +
+	"\x06pruned\x18\x01 \x01(\x03R\x06pruned\"6\n" +
+	"\aRecords\x12+\n" +
+	"\arecords\x18\x01 \x03(\v2\x11.retour.v1.RecordR\arecords2\x82\x02\n" +
+	"\aHistory\x12=\n" +
+	"\x06Insert\x12\x18.retour.v1.InsertRequest\x1a\x19.retour.v1.InsertResponse\x12D\n" +
+	"\rQueryFiltered\x12\x1f.retour.v1.QueryFilteredRequest\x1a\x12.retour.v1.Records\x126\n" +
+	"\x06Search\x12\x18.retour.v1.SearchRequest\x1a\x12.retour.v1.Records\x12:\n" +
+	"\x05Prune\x12\x17.retour.v1.PruneRequest\x1a\x18.retour.v1.PruneResponseB(Z&github.com/nuchs/retour/proto/retourv1b\x06proto3"
+
+var (
+	file_retour_proto_rawDescOnce sync.Once
+	file_retour_proto_rawDescData []byte
+)
+
+func file_retour_proto_rawDescGZIP() []byte {
+	file_retour_proto_rawDescOnce.Do(func() {
+		file_retour_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_retour_proto_rawDesc), len(file_retour_proto_rawDesc)))
+	})
+	return file_retour_proto_rawDescData
+}
+
+var file_retour_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_retour_proto_goTypes = []any{
+	(*Record)(nil),                // 0: retour.v1.Record
+	(*Scope)(nil),                 // 1: retour.v1.Scope
+	(*InsertRequest)(nil),         // 2: retour.v1.InsertRequest
+	(*InsertResponse)(nil),        // 3: retour.v1.InsertResponse
+	(*QueryFilteredRequest)(nil),  // 4: retour.v1.QueryFilteredRequest
+	(*SearchRequest)(nil),         // 5: retour.v1.SearchRequest
+	(*PruneRequest)(nil),          // 6: retour.v1.PruneRequest
+	(*PruneResponse)(nil),         // 7: retour.v1.PruneResponse
+	(*Records)(nil),               // 8: retour.v1.Records
+	(*timestamppb.Timestamp)(nil), // 9: google.protobuf.Timestamp
+	(*durationpb.Duration)(nil),   // 10: google.protobuf.Duration
+}
+var file_retour_proto_depIdxs = []int32{
+	9,  // 0: retour.v1.Record.timestamp:type_name -> google.protobuf.Timestamp
+	10, // 1: retour.v1.Record.duration:type_name -> google.protobuf.Duration
+	0,  // 2: retour.v1.InsertRequest.record:type_name -> retour.v1.Record
+	10, // 3: retour.v1.QueryFilteredRequest.max_age:type_name -> google.protobuf.Duration
+	1,  // 4: retour.v1.QueryFilteredRequest.scope:type_name -> retour.v1.Scope
+	1,  // 5: retour.v1.SearchRequest.scope:type_name -> retour.v1.Scope
+	9,  // 6: retour.v1.PruneRequest.before:type_name -> google.protobuf.Timestamp
+	0,  // 7: retour.v1.Records.records:type_name -> retour.v1.Record
+	2,  // 8: retour.v1.History.Insert:input_type -> retour.v1.InsertRequest
+	4,  // 9: retour.v1.History.QueryFiltered:input_type -> retour.v1.QueryFilteredRequest
+	5,  // 10: retour.v1.History.Search:input_type -> retour.v1.SearchRequest
+	6,  // 11: retour.v1.History.Prune:input_type -> retour.v1.PruneRequest
+	3,  // 12: retour.v1.History.Insert:output_type -> retour.v1.InsertResponse
+	8,  // 13: retour.v1.History.QueryFiltered:output_type -> retour.v1.Records
+	8,  // 14: retour.v1.History.Search:output_type -> retour.v1.Records
+	7,  // 15: retour.v1.History.Prune:output_type -> retour.v1.PruneResponse
+	12, // [12:16] is the sub-list for method output_type
+	8,  // [8:12] is the sub-list for method input_type
+	8,  // [8:8] is the sub-list for extension type_name
+	8,  // [8:8] is the sub-list for extension extendee
+	0,  // [0:8] is the sub-list for field type_name
+}
+
+func init() { file_retour_proto_init() }
+func file_retour_proto_init() {
+	if File_retour_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_retour_proto_rawDesc), len(file_retour_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_retour_proto_goTypes,
+		DependencyIndexes: file_retour_proto_depIdxs,
+		MessageInfos:      file_retour_proto_msgTypes,
+	}.Build()
+	File_retour_proto = out.File
+	file_retour_proto_goTypes = nil
+	file_retour_proto_depIdxs = nil
+}
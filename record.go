@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// NewRecord builds a Record for a command line executed in dir at the given time.
+func NewRecord(line string, dir string, exitStatus int, at time.Time) Record {
+	command, arguments := SplitCommandLine(line)
+	return Record{
+		Command:          command,
+		Arguments:        arguments,
+		Timestamp:        at,
+		WorkingDirectory: dir,
+		ExitStatus:       exitStatus,
+	}
+}
+
+// recordJSON is the JSON representation of a Record
+type recordJSON struct {
+	ID               int64     `json:"id"`
+	Command          string    `json:"command"`
+	Arguments        string    `json:"arguments"`
+	Timestamp        time.Time `json:"timestamp"`
+	WorkingDirectory string    `json:"working_directory"`
+	ExitStatus       int       `json:"exit_status"`
+	DurationMillis   int64     `json:"duration_ms"`
+	Session          string    `json:"session"`
+	Hostname         string    `json:"hostname"`
+	RerunOf          int64     `json:"rerun_of,omitempty"`
+	Repo             string    `json:"repo"`
+	Branch           string    `json:"branch"`
+	Count            int       `json:"count,omitempty"`
+	Source           string    `json:"source,omitempty"`
+}
+
+// MarshalJSON encodes the record using the history column names, with the
+// duration in milliseconds.
+func (r Record) MarshalJSON() ([]byte, error) {
+	return json.Marshal(recordJSON{
+		ID:               r.ID,
+		Command:          r.Command,
+		Arguments:        r.Arguments,
+		Timestamp:        r.Timestamp,
+		WorkingDirectory: r.WorkingDirectory,
+		ExitStatus:       r.ExitStatus,
+		DurationMillis:   r.Duration.Milliseconds(),
+		Session:          r.Session,
+		Hostname:         r.Hostname,
+		RerunOf:          r.RerunOf,
+		Repo:             r.Repo,
+		Branch:           r.Branch,
+		Count:            r.Count,
+		Source:           r.Source,
+	})
+}
+
+// UnmarshalJSON decodes a record encoded by MarshalJSON.
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var j recordJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*r = j.record()
+	return nil
+}
+
+// record converts the JSON representation back to a Record
+func (j recordJSON) record() Record {
+	return Record{
+		ID:               j.ID,
+		Command:          j.Command,
+		Arguments:        j.Arguments,
+		Timestamp:        j.Timestamp,
+		WorkingDirectory: j.WorkingDirectory,
+		ExitStatus:       j.ExitStatus,
+		Duration:         time.Duration(j.DurationMillis) * time.Millisecond,
+		Session:          j.Session,
+		Hostname:         j.Hostname,
+		RerunOf:          j.RerunOf,
+		Repo:             j.Repo,
+		Branch:           j.Branch,
+		Count:            j.Count,
+		Source:           j.Source,
+	}
+}
+
+// Excluded reports whether the command line matches any of the exclusion patterns.
+// An error is returned if one of the patterns is not a valid regular expression.
+func Excluded(line string, patterns []string) (bool, error) {
+	return matchesAny(line, patterns, "exclusion")
+}
+
+// matchesAny reports whether the line matches any of the patterns, which are
+// described as kind in errors
+func matchesAny(line string, patterns []string, kind string) (bool, error) {
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s pattern %q: %w", kind, pattern, err)
+		}
+		if re.MatchString(line) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// runRecord implements the record subcommand which the shell hooks call after
+// every command to store it in the history database.
+func runRecord(config *Config, args []string) error {
+	flags := flag.NewFlagSet("record", flag.ContinueOnError)
+	hook := addHookFlags(flags)
+	stdin := flags.Bool("stdin", false, "Read records to store from standard input rather than the arguments")
+	format := flags.String("format", "ndjson", "Format of the records read with --stdin (ndjson)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *stdin {
+		if flags.NArg() > 0 {
+			return fmt.Errorf("usage: retour record --stdin [--format ndjson]")
+		}
+		if *format != "ndjson" {
+			return fmt.Errorf("unsupported record format: %q", *format)
+		}
+		return recordStream(config, os.Stdin, os.Stderr)
+	}
+
+	line := strings.TrimSpace(strings.Join(flags.Args(), " "))
+	if line == "" {
+		return nil
+	}
+
+	excluded, err := Excluded(line, config.ExclusionPatterns)
+	if err != nil {
+		return err
+	}
+	if excluded {
+		return nil
+	}
+
+	redactor, err := NewRedactor(config.Redaction)
+	if err != nil {
+		return err
+	}
+	line, keep := redactor.Redact(line)
+	if !keep {
+		return nil
+	}
+
+	record := hook.record(line)
+	if client := dialDaemon(config); client != nil {
+		defer client.Close()
+		return client.Record(&record)
+	}
+
+	store, err := openStorage(config)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Insert(&record); err != nil {
+		return err
+	}
+	// Without a daemon to decay the scores, whoever records next does
+	if db, ok := store.(*DB); ok {
+		_, err = db.DecayIfStale(decayInterval)
+	}
+	return err
+}
+
+// hookFlags are the flags the shell hooks describe a finished command with
+type hookFlags struct {
+	exitStatus *int
+	dir        *string
+	duration   *int64
+	session    *string
+	rerunOf    *int64
+}
+
+// addHookFlags defines the shell hooks' flags on flags
+func addHookFlags(flags *flag.FlagSet) *hookFlags {
+	return &hookFlags{
+		exitStatus: flags.Int("exit", 0, "Exit status of the command"),
+		dir:        flags.String("cwd", "", "Working directory the command ran in"),
+		duration:   flags.Int64("duration", 0, "How long the command ran for in milliseconds"),
+		session:    flags.String("session", "", "Identifier of the shell session"),
+		rerunOf:    flags.Int64("rerun-of", 0, "ID of the record the command was replayed from, 0 if none"),
+	}
+}
+
+// record builds the record of line from the flags
+func (h *hookFlags) record(line string) Record {
+	// The hooks run once the command has finished, so work back to its start
+	elapsed := time.Duration(*h.duration) * time.Millisecond
+	record := NewRecord(line, *h.dir, *h.exitStatus, time.Now().Add(-elapsed))
+	record.Duration = elapsed
+	record.Session = *h.session
+	record.RerunOf = *h.rerunOf
+	// An unknown hostname is recorded as empty rather than failing the hook
+	record.Hostname, _ = os.Hostname()
+	record.Repo, record.Branch = GitInfo(*h.dir)
+	return record
+}
+
+// defaultSendTimeout is how long send waits for the daemon unless told otherwise
+const defaultSendTimeout = 250 * time.Millisecond
+
+// runSend implements the send subcommand, a lighter record for the shell
+// hooks which only ships the command to the daemon. Nothing is reported if
+// the daemon cannot be reached or does not answer in time: the command is
+// dropped rather than holding up the prompt.
+func runSend(config *Config, args []string) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	hook := addHookFlags(flags)
+	timeout := flags.Duration("timeout", defaultSendTimeout, "How long to wait for the daemon before dropping the command")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	line := strings.TrimSpace(strings.Join(flags.Args(), " "))
+	if line == "" {
+		return nil
+	}
+	Send(config.SocketPath(), hook.record(line), *timeout)
+	return nil
+}
@@ -0,0 +1,118 @@
+package main_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestNewRecord(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantCmd  string
+		wantArgs string
+	}{
+		{
+			name:     "Command with arguments",
+			line:     "git commit -m 'message'",
+			wantCmd:  "git",
+			wantArgs: "commit -m 'message'",
+		},
+		{
+			name:     "Command only",
+			line:     "ls",
+			wantCmd:  "ls",
+			wantArgs: "",
+		},
+		{
+			name:     "Surrounding whitespace",
+			line:     "  make   build  ",
+			wantCmd:  "make",
+			wantArgs: "build",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			record := rt.NewRecord(tt.line, "/tmp", 2, now)
+
+			if record.Command != tt.wantCmd {
+				t.Errorf("Command = %q, want %q", record.Command, tt.wantCmd)
+			}
+			if record.Arguments != tt.wantArgs {
+				t.Errorf("Arguments = %q, want %q", record.Arguments, tt.wantArgs)
+			}
+			if record.WorkingDirectory != "/tmp" || record.ExitStatus != 2 || !record.Timestamp.Equal(now) {
+				t.Errorf("Unexpected record context %+v", record)
+			}
+		})
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	patterns := []string{"^sudo", "password"}
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{line: "sudo reboot", want: true},
+		{line: "mysql --password=secret", want: true},
+		{line: "ls -la", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			got, err := rt.Excluded(tt.line, patterns)
+			if err != nil {
+				t.Fatalf("Excluded() unexpected error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Excluded(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := rt.Excluded("ls", []string{"("}); err == nil {
+		t.Error("Want error for invalid pattern, got nil")
+	}
+}
+
+func TestRecordJSON(t *testing.T) {
+	record := rt.Record{
+		ID:               7,
+		Command:          "make",
+		Arguments:        "build",
+		Timestamp:        time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC),
+		WorkingDirectory: "/project",
+		ExitStatus:       2,
+		Duration:         1500 * time.Millisecond,
+		Session:          "s1",
+		Hostname:         "box",
+		Repo:             "/project",
+		Branch:           "main",
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("Marshal() unexpected error = %v", err)
+	}
+	want := `{"id":7,"command":"make","arguments":"build","timestamp":"2024-05-01T12:30:00Z",` +
+		`"working_directory":"/project","exit_status":2,"duration_ms":1500,"session":"s1","hostname":"box",` +
+		`"repo":"/project","branch":"main"}`
+	if string(data) != want {
+		t.Errorf("Marshal() = %s, want %s", data, want)
+	}
+
+	var decoded rt.Record
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal() unexpected error = %v", err)
+	}
+	if decoded != record {
+		t.Errorf("Unmarshal() = %+v, want %+v", decoded, record)
+	}
+}
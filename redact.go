@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// RedactionAction is what happens to a command line containing a secret.
+type RedactionAction string
+
+const (
+	// ScrubSecrets stores the command with each secret replaced
+	ScrubSecrets RedactionAction = "scrub"
+	// SkipSecrets does not store the command at all
+	SkipSecrets RedactionAction = "skip"
+	// KeepSecrets stores the command unchanged
+	KeepSecrets RedactionAction = "off"
+)
+
+// Redacted replaces each secret in a scrubbed command line
+const Redacted = "REDACTED"
+
+// Redaction configures how secrets are kept out of the history, from the
+// [redaction] section of the config file.
+type Redaction struct {
+	// Action is what happens to commands containing a secret
+	Action RedactionAction `toml:"action"`
+
+	// Builtin enables the built in patterns for common secrets
+	Builtin bool `toml:"builtin"`
+
+	// Patterns are further regular expressions matching secrets. When a
+	// pattern has a group only the text it captures is the secret, so the
+	// rest of the match, e.g. the name of a flag, is kept.
+	Patterns []string `toml:"patterns"`
+}
+
+// DefaultRedaction returns the redaction used unless configured otherwise
+func DefaultRedaction() Redaction {
+	return Redaction{Action: ScrubSecrets, Builtin: true}
+}
+
+// builtinSecrets match the secrets most commonly typed on the command line
+var builtinSecrets = []string{
+	// AWS access key IDs
+	`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`,
+	// GitHub and Slack tokens
+	`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,}|xox[abprs]-[A-Za-z0-9-]{10,})\b`,
+	// Flags such as --password=x, --api-key x or --client-secret "x"
+	`(?i)--?[a-z0-9-]*(?:password|passwd|secret|token|api[-_]?key)[= ]((?:"[^"]*"|'[^']*'|[^\s"'])+)`,
+	// Variables such as AWS_SECRET_ACCESS_KEY=x or GITHUB_TOKEN=x
+	`(?i)\b[a-z0-9_]*(?:password|passwd|secret|token|api_?key)[a-z0-9_]*=((?:"[^"]*"|'[^']*'|[^\s"'])+)`,
+	// Authorization headers
+	`(?i)authorization:\s*(?:bearer|basic|token)\s+([^\s"']+)`,
+	// Passwords in URLs
+	`://[^/\s:@]+:([^/\s@]+)@`,
+}
+
+// Redactor finds secrets in command lines.
+type Redactor struct {
+	action   RedactionAction
+	patterns []*regexp.Regexp
+}
+
+// NewRedactor compiles the redaction's patterns. An error is returned if one
+// of them is not a valid regular expression.
+func NewRedactor(redaction Redaction) (*Redactor, error) {
+	redactor := &Redactor{action: redaction.Action}
+	if redaction.Action == KeepSecrets {
+		return redactor, nil
+	}
+
+	var patterns []string
+	if redaction.Builtin {
+		patterns = append(patterns, builtinSecrets...)
+	}
+	for _, pattern := range append(patterns, redaction.Patterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+		redactor.patterns = append(redactor.patterns, re)
+	}
+	return redactor, nil
+}
+
+// Redact returns the command line to store, with its secrets scrubbed, and
+// false if it should not be stored at all.
+func (r *Redactor) Redact(line string) (string, bool) {
+	for _, re := range r.patterns {
+		matches := re.FindAllStringSubmatchIndex(line, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		if r.action == SkipSecrets {
+			return "", false
+		}
+		line = scrub(line, matches)
+	}
+	return line, true
+}
+
+// RedactRecord scrubs the secrets from a record's command line, returning
+// false if it should not be stored at all.
+func (r *Redactor) RedactRecord(record *Record) bool {
+	line := record.CommandLine()
+	redacted, keep := r.Redact(line)
+	if keep && redacted != line {
+		record.Command, record.Arguments = SplitCommandLine(redacted)
+	}
+	return keep
+}
+
+// scrub replaces each match in line, or only its first group when it has one
+func scrub(line string, matches [][]int) string {
+	var scrubbed []byte
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) > 2 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		scrubbed = append(scrubbed, line[last:start]...)
+		scrubbed = append(scrubbed, Redacted...)
+		last = end
+	}
+	return string(append(scrubbed, line[last:]...))
+}
@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+// FormatRelative formats t for people as how long before now it was, e.g.
+// "just now", "5m ago", "2h ago" or "yesterday 14:02", growing coarser with
+// age until only the date is given for times in earlier years. Times after
+// now are given exactly, as clocks disagree.
+func FormatRelative(t, now time.Time) string {
+	t = t.In(now.Location())
+	age := now.Sub(t)
+	today := startOfDay(now)
+
+	switch {
+	case age < 0:
+		return t.Format(time.DateTime)
+	case age < time.Minute:
+		return tr("just now")
+	case age < time.Hour:
+		return trf("%dm ago", int(age/time.Minute))
+	case !t.Before(today):
+		return trf("%dh ago", int(age/time.Hour))
+	case !t.Before(today.AddDate(0, 0, -1)):
+		return trf("yesterday %s", t.Format("15:04"))
+	case !t.Before(today.AddDate(0, 0, -6)):
+		return tr(t.Format("Mon")) + " " + t.Format("15:04")
+	case t.Year() == now.Year():
+		return t.Format("01-02 15:04")
+	default:
+		return t.Format(time.DateOnly)
+	}
+}
+
+// startOfDay returns midnight at the start of t's day, in t's time zone
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,56 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestFormatRelative(t *testing.T) {
+	// A Wednesday afternoon
+	now := time.Date(2024, 3, 13, 15, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name string
+		t    time.Time
+		want string
+	}{
+		{"Seconds ago", now.Add(-20 * time.Second), "just now"},
+		{"Minutes ago", now.Add(-5*time.Minute - 10*time.Second), "5m ago"},
+		{"Hours ago today", now.Add(-2*time.Hour - 15*time.Minute), "2h ago"},
+		{"Just after midnight", time.Date(2024, 3, 13, 0, 5, 0, 0, time.Local), "15h ago"},
+		{"Yesterday", time.Date(2024, 3, 12, 23, 50, 0, 0, time.Local), "yesterday 23:50"},
+		{"Earlier this week", time.Date(2024, 3, 10, 9, 0, 0, 0, time.Local), "Sun 09:00"},
+		{"Six days ago", time.Date(2024, 3, 7, 14, 2, 0, 0, time.Local), "Thu 14:02"},
+		{"A week ago", time.Date(2024, 3, 6, 14, 2, 0, 0, time.Local), "03-06 14:02"},
+		{"Last year", time.Date(2023, 12, 31, 23, 0, 0, 0, time.Local), "2023-12-31"},
+		{"In the future", now.Add(time.Hour), "2024-03-13 16:30:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rt.FormatRelative(tt.t, now); got != tt.want {
+				t.Errorf("FormatRelative() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatRelativeTranslated(t *testing.T) {
+	if err := rt.SetLanguage("fr"); err != nil {
+		t.Fatalf("SetLanguage() unexpected error = %v", err)
+	}
+	t.Cleanup(func() { rt.SetLanguage("en") })
+
+	now := time.Date(2024, 3, 13, 15, 30, 0, 0, time.Local)
+	for when, want := range map[time.Time]string{
+		now.Add(-2 * time.Hour):                         "il y a 2 h",
+		time.Date(2024, 3, 12, 14, 2, 0, 0, time.Local): "hier 14:02",
+		time.Date(2024, 3, 10, 9, 0, 0, 0, time.Local):  "dim. 09:00",
+	} {
+		if got := rt.FormatRelative(when, now); got != want {
+			t.Errorf("FormatRelative(%v) = %q, want %q", when, got, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Get returns the record with the given ID.
+func (db *DB) Get(id int64) (Record, error) {
+	return getRecord(db, id)
+}
+
+// getRecord is Get for any storage
+func getRecord(store Storage, id int64) (Record, error) {
+	records, err := store.Query(`SELECT `+recordColumns+` FROM history WHERE id = ?`, id)
+	if err != nil {
+		return Record{}, err
+	}
+	if len(records) == 0 {
+		return Record{}, fmt.Errorf("no record with id %d", id)
+	}
+	return records[0], nil
+}
+
+// runRerun implements the rerun subcommand, which runs a recorded command
+// again in the current directory and records it as a rerun of the original.
+// With --propagate-exit it stands in for the command in scripts, leaving its
+// output alone and exiting with its exit status.
+func runRerun(config *Config, args []string) error {
+	flags := flag.NewFlagSet("rerun", flag.ContinueOnError)
+	session := flags.String("session", "", "Identifier of the shell session to record the rerun in")
+	yes := flags.Bool("yes", false, "Run commands marked dangerous without asking")
+	propagate := flags.Bool("propagate-exit", false, "Exit with the command's exit status and print nothing of retour's own")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: retour rerun [--yes] [--propagate-exit] <id>")
+	}
+	id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid record id %q", flags.Arg(0))
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	original, err := db.Get(id)
+	if err != nil {
+		return err
+	}
+	line := original.CommandLine()
+
+	if check := dangerCheck(db, config.DangerousPatterns); check != nil && !*yes {
+		warning, err := check([]Record{original})
+		if err != nil {
+			return err
+		}
+		if warning != "" && !confirm(os.Stdin, os.Stderr, warning, tr("Run anyway?")) {
+			return errors.New(trf("not running %q", line))
+		}
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if !*propagate {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	start := time.Now()
+	exitStatus, shellStatus, err := replay(line, dir)
+	if err != nil {
+		return err
+	}
+	if err := recordRerun(db, config, original, line, dir, exitStatus, start, *session); err != nil {
+		return err
+	}
+	if *propagate && shellStatus != 0 {
+		return ExitStatusError{Status: shellStatus}
+	}
+	return nil
+}
+
+// replay runs line with the user's shell in dir, reading and writing
+// retour's own input and output. It returns the exit status to record and
+// the one a shell would give, which counts a command killed by a signal as
+// 128 plus the signal.
+func replay(line, dir string) (exitStatus, shellStatus int, err error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.Command(shell, "-c", line)
+	cmd.Dir = dir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	// Ctrl-C and the like are for the command, retour waits to record how
+	// it ended, as a shell would
+	defer onSignal(func() {}, shutdownSignals...)()
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return 0, 0, fmt.Errorf("failed to run %q: %w", line, err)
+		}
+		exitStatus = exitErr.ExitCode()
+		shellStatus = exitStatus
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			shellStatus = 128 + int(status.Signal())
+		}
+	}
+	return exitStatus, shellStatus, nil
+}
+
+// execSelected runs the commands selected in the picker one after another,
+// each in the directory it ran in, or the current one with --exec-here or
+// if that is unknown, and records each as a rerun. It fails with the exit
+// status of the last, as a shell would.
+func execSelected(store Storage, config *Config, selected []Record) error {
+	here, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	status := 0
+	for _, original := range selected {
+		dir := original.WorkingDirectory
+		if config.ExecHere || dir == "" {
+			dir = here
+		}
+		line := original.CommandLine()
+		fmt.Fprintln(os.Stderr, line)
+
+		start := time.Now()
+		exitStatus, shellStatus, err := replay(line, dir)
+		if err != nil {
+			return err
+		}
+		if err := recordRerun(store, config, original, line, dir, exitStatus, start, ""); err != nil {
+			return err
+		}
+		status = shellStatus
+	}
+	if status != 0 {
+		return ExitStatusError{Status: status}
+	}
+	return nil
+}
+
+// recordRerun records the rerun of original as line, run in dir, unless the
+// exclusion patterns or redaction leave it out
+func recordRerun(store Storage, config *Config, original Record, line, dir string, exitStatus int, start time.Time, session string) error {
+	excluded, err := Excluded(line, config.ExclusionPatterns)
+	if err != nil || excluded {
+		return err
+	}
+	redactor, err := NewRedactor(config.Redaction)
+	if err != nil {
+		return err
+	}
+	line, keep := redactor.Redact(line)
+	if !keep {
+		return nil
+	}
+
+	record := NewRecord(line, dir, exitStatus, start)
+	record.Duration = time.Since(start)
+	record.Session = session
+	record.RerunOf = original.ID
+	// An unknown hostname is recorded as empty rather than failing the rerun
+	record.Hostname, _ = os.Hostname()
+	return store.Insert(&record)
+}
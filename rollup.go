@@ -0,0 +1,103 @@
+package main
+
+// The rollup table counts the commands run each day in each directory, so
+// the usage overview reads a row per command and directory a day rather than
+// one per command run. Triggers keep it in step with the history whichever
+// way records arrive, whether recorded directly, by the daemon, imported or
+// merged, and as records are pruned or encrypted.
+const rollupSchema = `
+	CREATE TABLE IF NOT EXISTS rollup (
+		day TEXT NOT NULL,
+		command TEXT NOT NULL,
+		dir TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		failures INTEGER NOT NULL,
+		total_duration INTEGER NOT NULL,
+		PRIMARY KEY (day, command, dir)
+	);
+
+	CREATE TRIGGER IF NOT EXISTS rollup_insert AFTER INSERT ON history BEGIN
+		INSERT INTO rollup (day, command, dir, count, failures, total_duration)
+		VALUES (COALESCE(date(NEW.timestamp, 'localtime'), ''), NEW.command, COALESCE(NEW.working_directory, ''),
+			1, NEW.exit_status != 0, NEW.duration)
+		ON CONFLICT (day, command, dir) DO UPDATE SET
+			count = count + 1,
+			failures = failures + excluded.failures,
+			total_duration = total_duration + excluded.total_duration;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS rollup_delete AFTER DELETE ON history BEGIN
+		UPDATE rollup SET
+			count = count - 1,
+			failures = failures - (OLD.exit_status != 0),
+			total_duration = total_duration - OLD.duration
+		WHERE day = COALESCE(date(OLD.timestamp, 'localtime'), '')
+			AND command = OLD.command
+			AND dir = COALESCE(OLD.working_directory, '');
+		DELETE FROM rollup
+		WHERE day = COALESCE(date(OLD.timestamp, 'localtime'), '')
+			AND command = OLD.command
+			AND dir = COALESCE(OLD.working_directory, '')
+			AND count <= 0;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS rollup_update
+	AFTER UPDATE OF command, timestamp, working_directory, exit_status, duration ON history BEGIN
+		UPDATE rollup SET
+			count = count - 1,
+			failures = failures - (OLD.exit_status != 0),
+			total_duration = total_duration - OLD.duration
+		WHERE day = COALESCE(date(OLD.timestamp, 'localtime'), '')
+			AND command = OLD.command
+			AND dir = COALESCE(OLD.working_directory, '');
+		DELETE FROM rollup
+		WHERE day = COALESCE(date(OLD.timestamp, 'localtime'), '')
+			AND command = OLD.command
+			AND dir = COALESCE(OLD.working_directory, '')
+			AND count <= 0;
+		INSERT INTO rollup (day, command, dir, count, failures, total_duration)
+		VALUES (COALESCE(date(NEW.timestamp, 'localtime'), ''), NEW.command, COALESCE(NEW.working_directory, ''),
+			1, NEW.exit_status != 0, NEW.duration)
+		ON CONFLICT (day, command, dir) DO UPDATE SET
+			count = count + 1,
+			failures = failures + excluded.failures,
+			total_duration = total_duration + excluded.total_duration;
+	END;`
+
+// ensureRollup creates the rollup table and the triggers maintaining it,
+// filling it from the records already stored when it is new.
+func (db *DB) ensureRollup() error {
+	var exists bool
+	if err := db.conn.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'rollup'").Scan(&exists); err != nil {
+		return err
+	}
+	if _, err := db.conn.Exec(rollupSchema); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return db.rebuildRollup()
+}
+
+// rebuildRollup counts the rollup table afresh from the history
+func (db *DB) rebuildRollup() error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM rollup"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+	INSERT INTO rollup (day, command, dir, count, failures, total_duration)
+	SELECT COALESCE(date(timestamp, 'localtime'), ''), command, COALESCE(working_directory, ''),
+		COUNT(*), COUNT(*) FILTER (WHERE exit_status != 0), SUM(duration)
+	FROM history
+	GROUP BY 1, 2, 3`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
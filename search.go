@@ -0,0 +1,336 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Search describes the history the picker offers: which records to load, how
+// to rank them and the text they must match. It is what a search sent to the
+// daemon carries.
+type Search struct {
+	TimeRange TimeRange    `json:"time_range"`
+	Result    ResultFilter `json:"result"`
+	Scope     Scope        `json:"scope"`
+
+	// Unique collapses repeated command lines into one record with a count
+	Unique bool `json:"unique"`
+
+	// Here ranks the commands run in the scope's directory, which must be
+	// set, and the tree below it first
+	Here bool `json:"here"`
+
+	// Limit is the maximum number of records loaded, 0 for all
+	Limit int `json:"limit"`
+
+	// Filter is text typed into the picker, which the records returned
+	// match, empty for all
+	Filter string `json:"filter,omitempty"`
+
+	// Match is how the filter text matches, empty for substrings
+	Match MatchMode `json:"match,omitempty"`
+}
+
+// Validate checks the search is one the picker could make
+func (s Search) Validate() error {
+	switch s.TimeRange {
+	case Today, Yesterday, LastWeek, AllTime, "":
+		// valid, empty is all time
+	default:
+		return fmt.Errorf("invalid time range: %s", s.TimeRange)
+	}
+
+	switch s.Result {
+	case SuccessResults, FailedResults, AllResults:
+		// valid
+	default:
+		return fmt.Errorf("invalid result filter: %s", s.Result)
+	}
+
+	switch s.Match {
+	case SubstringMatch, FuzzyMatch, ExactMatch, RegexMatch, "":
+		// valid, empty is substrings
+	default:
+		return fmt.Errorf("invalid match mode: %s", s.Match)
+	}
+
+	if s.Limit < 0 {
+		return fmt.Errorf("limit must not be negative, got %d", s.Limit)
+	}
+	if s.Here && s.Scope.Dir == "" {
+		return errors.New("a search for here needs a directory")
+	}
+	return nil
+}
+
+// String describes the search briefly, leaving out what it shares with a
+// search of everything
+func (s Search) String() string {
+	var parts []string
+	if s.Filter != "" {
+		parts = append(parts, fmt.Sprintf("%q", s.Filter))
+	}
+	if s.Match != "" && s.Match != SubstringMatch {
+		parts = append(parts, string(s.Match))
+	}
+	if s.TimeRange != "" && s.TimeRange != AllTime {
+		parts = append(parts, string(s.TimeRange))
+	}
+	if s.Result != "" && s.Result != AllResults {
+		parts = append(parts, string(s.Result))
+	}
+	switch {
+	case s.Here:
+		parts = append(parts, "here in "+s.Scope.Dir)
+	case s.Scope.Dir != "" && s.Scope.Recursive:
+		parts = append(parts, "under "+s.Scope.Dir)
+	case s.Scope.Dir != "":
+		parts = append(parts, "in "+s.Scope.Dir)
+	}
+	if s.Scope.Repo != "" {
+		parts = append(parts, "repo "+s.Scope.Repo)
+	}
+	if s.Scope.Branch != "" {
+		parts = append(parts, "branch "+s.Scope.Branch)
+	}
+	if s.Scope.Starred {
+		parts = append(parts, "starred")
+	}
+	if s.Scope.Tag != "" {
+		parts = append(parts, "tag "+s.Scope.Tag)
+	}
+	if s.Unique {
+		parts = append(parts, "unique")
+	}
+	if len(parts) == 0 {
+		return "everything"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Search returns the search the settings describe, without any filter text.
+// Suggestions for here are for the current directory unless a working
+// directory was given.
+func (c *Config) Search() (Search, error) {
+	search := Search{
+		TimeRange: c.TimeRange,
+		Result:    c.Result,
+		Scope:     c.Scope(),
+		Unique:    c.Unique,
+		Here:      c.Here,
+		Limit:     c.Limit,
+		Match:     c.Match,
+	}
+	if search.Here && search.Scope.Dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return Search{}, err
+		}
+		search.Scope.Dir = wd
+	}
+	return search, nil
+}
+
+// Search loads the records the search describes, best first, keeping those
+// matching its filter text as the picker would.
+func (db *DB) Search(search Search) ([]Record, error) {
+	return searchStorage(db, search)
+}
+
+// searchStorage is Search for any storage
+func searchStorage(store Storage, search Search) ([]Record, error) {
+	query := store.QueryFiltered
+	switch {
+	case search.Here:
+		query = store.QuerySuggested
+	case search.Unique:
+		query = store.QueryUnique
+	}
+
+	records, err := query(
+		search.TimeRange.Duration(time.Now()),
+		string(search.Result),
+		search.Scope,
+		search.Limit,
+	)
+	if err != nil || search.Filter == "" {
+		return records, err
+	}
+
+	filter := NewFilter(records)
+	filter.SetMatchMode(search.Match)
+	filter.UpdateFilter(search.Filter)
+	return filter.FilteredRecords(), nil
+}
+
+// searchPages returns a loader of the pages of records following those
+// Search loads, nil if it loads them all at once: the unique and here modes
+// rank command lines over the whole history.
+func (db *DB) searchPages(search Search) PageLoader {
+	if search.Unique || search.Here {
+		return nil
+	}
+	return func(after *Record, limit int) ([]Record, error) {
+		return db.QueryFilteredAfter(search.TimeRange.Duration(time.Now()), string(search.Result), search.Scope, after, limit)
+	}
+}
+
+// searchMatches returns a searcher of the records Search would load which
+// match filter text, nil where there is none: in the unique and here modes,
+// which are not paged, and when command text is encrypted, as SQL cannot see it.
+func (db *DB) searchMatches(search Search) HistorySearcher {
+	if search.Unique || search.Here || db.cipher != nil {
+		return nil
+	}
+	return func(filterText string, mode MatchMode, limit int) ([]Record, error) {
+		return db.QueryMatching(search.TimeRange.Duration(time.Now()), string(search.Result), search.Scope, filterText, mode, limit)
+	}
+}
+
+// resolveSearch returns the search the picker starts with: the one saved
+// under the name given with --search, which replaces the search settings,
+// or the one the settings describe. Filter text given on the command line
+// replaces that of a saved search. Searches are only saved in the SQLite
+// database, db, which is nil for other storage.
+func resolveSearch(db *DB, config *Config) (Search, error) {
+	if config.SavedSearch == "" {
+		search, err := config.Search()
+		search.Filter = config.Filter
+		return search, err
+	}
+	if db == nil {
+		return Search{}, errors.New("saved searches need a SQLite database")
+	}
+
+	search, err := db.SavedSearch(config.SavedSearch)
+	if err != nil {
+		return Search{}, err
+	}
+	if config.Filter != "" {
+		search.Filter = config.Filter
+	}
+	return search, nil
+}
+
+// SavedSearch is a search stored under a name to be run again.
+type SavedSearch struct {
+	Name    string
+	Search  Search
+	Updated time.Time
+}
+
+// SaveSearch stores search under name, replacing any search saved under the
+// name before.
+func (db *DB) SaveSearch(name string, search Search) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return errors.New("a saved search needs a name")
+	}
+	if err := search.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(search)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.conn.Exec(`
+	INSERT INTO saved_searches (name, search, updated)
+	VALUES (?, ?, ?)
+	ON CONFLICT (name) DO UPDATE SET
+		search = excluded.search,
+		updated = excluded.updated`, name, string(data), time.Now())
+	return err
+}
+
+// SavedSearch returns the search saved under name.
+func (db *DB) SavedSearch(name string) (Search, error) {
+	var data string
+	err := db.reader.QueryRow("SELECT search FROM saved_searches WHERE name = ?", name).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Search{}, fmt.Errorf("no search is saved as %q", name)
+	}
+	if err != nil {
+		return Search{}, err
+	}
+
+	var search Search
+	if err := json.Unmarshal([]byte(data), &search); err != nil {
+		return Search{}, fmt.Errorf("saved search %q is corrupt: %w", name, err)
+	}
+	return search, nil
+}
+
+// SavedSearches returns the saved searches in order of name.
+func (db *DB) SavedSearches() ([]SavedSearch, error) {
+	rows, err := db.reader.Query("SELECT name, search, updated FROM saved_searches ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var searches []SavedSearch
+	for rows.Next() {
+		var saved SavedSearch
+		var data string
+		if err := rows.Scan(&saved.Name, &data, &saved.Updated); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &saved.Search); err != nil {
+			return nil, fmt.Errorf("saved search %q is corrupt: %w", saved.Name, err)
+		}
+		searches = append(searches, saved)
+	}
+	return searches, rows.Err()
+}
+
+// DeleteSavedSearch removes the search saved under name.
+func (db *DB) DeleteSavedSearch(name string) error {
+	result, err := db.conn.Exec("DELETE FROM saved_searches WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no search is saved as %q", name)
+	}
+	return err
+}
+
+// runSearches implements the searches subcommand, which lists or deletes
+// saved searches
+func runSearches(config *Config, args []string) error {
+	flags := flag.NewFlagSet("searches", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch {
+	case flags.NArg() == 0 || flags.NArg() == 1 && flags.Arg(0) == "list":
+		searches, err := db.SavedSearches()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, saved := range searches {
+			fmt.Fprintf(w, "%s\t%s\n", saved.Name, saved.Search)
+		}
+		return w.Flush()
+	case flags.NArg() == 2 && flags.Arg(0) == "delete":
+		return db.DeleteSavedSearch(flags.Arg(1))
+	default:
+		return fmt.Errorf("usage: retour searches [list|delete <name>]")
+	}
+}
@@ -0,0 +1,78 @@
+package main_test
+
+import (
+	"testing"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestSavedSearches(t *testing.T) {
+	database := openTestDB(t)
+
+	failing := rt.Search{TimeRange: rt.Today, Result: rt.FailedResults, Filter: "make"}
+	if err := database.SaveSearch(" broken ", failing); err != nil {
+		t.Fatalf("SaveSearch() unexpected error = %v", err)
+	}
+	if err := database.SaveSearch("all", rt.Search{Result: rt.AllResults, Unique: true}); err != nil {
+		t.Fatalf("SaveSearch() unexpected error = %v", err)
+	}
+	got, err := database.SavedSearch("broken")
+	if err != nil || got != failing {
+		t.Errorf("SavedSearch() = %+v, %v, want %+v", got, err, failing)
+	}
+
+	// Saving under a name again replaces the search
+	failing.Filter = "go test"
+	if err := database.SaveSearch("broken", failing); err != nil {
+		t.Fatalf("SaveSearch() unexpected error = %v", err)
+	}
+	searches, err := database.SavedSearches()
+	if err != nil {
+		t.Fatalf("SavedSearches() unexpected error = %v", err)
+	}
+	if len(searches) != 2 || searches[0].Name != "all" || searches[1].Search != failing {
+		t.Errorf("SavedSearches() = %+v, want all then the replaced broken", searches)
+	}
+
+	for name, search := range map[string]rt.Search{
+		"":        {Result: rt.AllResults},
+		"invalid": {Result: "sometimes"},
+	} {
+		if err := database.SaveSearch(name, search); err == nil {
+			t.Errorf("SaveSearch(%q, %+v) succeeded, want an error", name, search)
+		}
+	}
+
+	if err := database.DeleteSavedSearch("broken"); err != nil {
+		t.Fatalf("DeleteSavedSearch() unexpected error = %v", err)
+	}
+	if _, err := database.SavedSearch("broken"); err == nil {
+		t.Error("SavedSearch() of a deleted search succeeded, want an error")
+	}
+	if err := database.DeleteSavedSearch("broken"); err == nil {
+		t.Error("DeleteSavedSearch() twice succeeded, want an error")
+	}
+}
+
+func TestSearchString(t *testing.T) {
+	tests := []struct {
+		search rt.Search
+		want   string
+	}{
+		{search: rt.Search{Result: rt.AllResults}, want: "everything"},
+		{
+			search: rt.Search{Filter: "git", TimeRange: rt.Today, Result: rt.FailedResults, Unique: true},
+			want:   `"git", today, failed, unique`,
+		},
+		{
+			search: rt.Search{Result: rt.AllResults, Here: true, Scope: rt.Scope{Dir: "/src"}},
+			want:   "here in /src",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.search.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Session describes a shell session which commands were recorded from.
+type Session struct {
+	// ID is the unique identifier for this session in the database
+	ID int64
+
+	// Name is the identifier the shell hooks generate for the session and
+	// pass with every record
+	Name string
+
+	// Host is the machine the session ran on
+	Host string
+
+	// Shell is the shell the session ran, e.g. zsh
+	Shell string
+
+	// TTY is the terminal the session was attached to
+	TTY string
+
+	// Start is when the session began
+	Start time.Time
+
+	// End is when the session finished, zero while it is still running
+	End time.Time
+
+	// InitialDir is the working directory the session started in
+	InitialDir string
+
+	// LastActive is when the session last started or recorded a command
+	LastActive time.Time
+
+	// Commands is the number of records from the session. It is only filled
+	// in when listing sessions.
+	Commands int
+}
+
+// SessionStatus describes whether a session's shell is still running.
+type SessionStatus string
+
+const (
+	// LiveSession is a session which has not ended and was recently active
+	LiveSession SessionStatus = "live"
+	// EndedSession is a session whose shell reported its exit
+	EndedSession SessionStatus = "ended"
+	// StaleSession is a session which never reported its exit but has been
+	// inactive for so long its shell has probably gone, e.g. after a crash
+	StaleSession SessionStatus = "stale"
+)
+
+// Status reports whether the session is live, ended or, having been inactive
+// for longer than staleAfter, stale.
+func (s Session) Status(now time.Time, staleAfter time.Duration) SessionStatus {
+	switch {
+	case !s.End.IsZero():
+		return EndedSession
+	case now.Sub(s.lastSeen()) > staleAfter:
+		return StaleSession
+	default:
+		return LiveSession
+	}
+}
+
+// Duration returns how long the session ran for. Live sessions are still
+// running at now; stale sessions are taken to have ended when last active.
+func (s Session) Duration(now time.Time, staleAfter time.Duration) time.Duration {
+	switch s.Status(now, staleAfter) {
+	case EndedSession:
+		return s.End.Sub(s.Start)
+	case StaleSession:
+		return s.lastSeen().Sub(s.Start)
+	default:
+		return now.Sub(s.Start)
+	}
+}
+
+// lastSeen returns the last time the session is known to have been running
+func (s Session) lastSeen() time.Time {
+	if s.LastActive.After(s.Start) {
+		return s.LastActive
+	}
+	return s.Start
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// ensureSession adds the record's session to the sessions table if this is
+// the first time it has been seen, e.g. because the shell was set up before
+// the hooks registered sessions, or the record was imported. What is known
+// about the session is taken from the record. Either way the session's last
+// activity is brought up to the record's time.
+func ensureSession(conn execer, record Record) error {
+	if record.Session == "" {
+		return nil
+	}
+	_, err := conn.Exec(`
+	INSERT INTO sessions (name, host, start_time, initial_cwd, last_active)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (name) DO UPDATE SET last_active = excluded.last_active
+	WHERE last_active IS NULL OR julianday(excluded.last_active) > julianday(last_active)`,
+		record.Session, record.Hostname, record.Timestamp, record.WorkingDirectory, record.Timestamp)
+	return err
+}
+
+// StartSession registers a new session, setting its ID. Starting a session
+// which is already registered, because its commands were recorded first,
+// fills in the details the records could not provide.
+func (db *DB) StartSession(session *Session) error {
+	_, err := db.conn.Exec(`
+	INSERT INTO sessions (name, host, shell, tty, start_time, initial_cwd, last_active)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (name) DO UPDATE SET
+		host = excluded.host,
+		shell = excluded.shell,
+		tty = excluded.tty,
+		start_time = CASE WHEN julianday(excluded.start_time) < julianday(start_time)
+			THEN excluded.start_time ELSE start_time END,
+		initial_cwd = excluded.initial_cwd`,
+		session.Name, session.Host, session.Shell, session.TTY, session.Start, session.InitialDir, session.Start)
+	if err != nil {
+		return err
+	}
+
+	return db.conn.QueryRow("SELECT id FROM sessions WHERE name = ?", session.Name).Scan(&session.ID)
+}
+
+// EndSession records that the named session finished at the given time.
+// Sessions which already ended are left alone.
+func (db *DB) EndSession(name string, at time.Time) error {
+	_, err := db.conn.Exec(`
+	UPDATE sessions SET end_time = ?
+	WHERE name = ? AND end_time IS NULL`, at, name)
+	return err
+}
+
+// Sessions returns up to limit sessions, most recently started first, with
+// the number of commands recorded from each.
+func (db *DB) Sessions(limit int) ([]Session, error) {
+	rows, err := db.reader.Query(`
+	SELECT sessions.id, name, host, shell, tty, start_time, end_time, initial_cwd, last_active,
+		(SELECT COUNT(*) FROM history WHERE history.session_id = sessions.id)
+	FROM sessions
+	ORDER BY start_time DESC, sessions.id DESC
+	LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		var end, lastActive sql.NullTime
+		err := rows.Scan(&s.ID, &s.Name, &s.Host, &s.Shell, &s.TTY, &s.Start, &end, &s.InitialDir, &lastActive, &s.Commands)
+		if err != nil {
+			return nil, err
+		}
+		s.End = end.Time
+		s.LastActive = lastActive.Time
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// runSession implements the session subcommand
+func runSession(config *Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: retour session start|end|list [flags]")
+	}
+
+	switch args[0] {
+	case "start":
+		return runSessionStart(config, args[1:])
+	case "end":
+		return runSessionEnd(config, args[1:])
+	case "list":
+		return runSessionList(config, args[1:])
+	default:
+		return fmt.Errorf("unknown session action %q", args[0])
+	}
+}
+
+// runSessionStart registers a session, called by the shell hooks as the
+// shell starts
+func runSessionStart(config *Config, args []string) error {
+	flags := flag.NewFlagSet("session start", flag.ContinueOnError)
+	name := flags.String("session", "", "Identifier of the shell session")
+	shell := flags.String("shell", "", "Shell the session runs")
+	tty := flags.String("tty", "", "Terminal the session is attached to")
+	dir := flags.String("cwd", "", "Working directory the session started in")
+	shellVersion := flags.String("shell-version", "", "Version of the shell, fingerprinted with the environment")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return fmt.Errorf("usage: retour session start --session <id> [flags]")
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// An unknown hostname is recorded as empty rather than failing the hook
+	host, _ := os.Hostname()
+	err = db.StartSession(&Session{
+		Name:       *name,
+		Host:       host,
+		Shell:      *shell,
+		TTY:        *tty,
+		Start:      time.Now(),
+		InitialDir: *dir,
+	})
+	if err != nil || !config.Fingerprint {
+		return err
+	}
+	// The hooks run this in the background, so the probes don't delay the
+	// prompt
+	return db.SetSessionFingerprint(*name, TakeFingerprint(*shellVersion, config.FingerprintProbes))
+}
+
+// runSessionEnd closes a session, called by the shell hooks as the shell exits
+func runSessionEnd(config *Config, args []string) error {
+	flags := flag.NewFlagSet("session end", flag.ContinueOnError)
+	name := flags.String("session", "", "Identifier of the shell session")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return fmt.Errorf("usage: retour session end --session <id>")
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.EndSession(*name, time.Now())
+}
+
+// runSessionList prints the most recent sessions
+func runSessionList(config *Config, args []string) error {
+	flags := flag.NewFlagSet("session list", flag.ContinueOnError)
+	count := flags.Int("n", 20, "Number of sessions to list")
+	staleAfter := flags.Duration("stale-after", 24*time.Hour, "Inactivity after which an unended session is considered dead")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	sessions, err := db.Sessions(*count)
+	if err != nil {
+		return err
+	}
+	return writeSessions(os.Stdout, sessions, time.Now(), *staleAfter)
+}
+
+// writeSessions renders the sessions as an aligned table
+func writeSessions(w io.Writer, sessions []Session, now time.Time, staleAfter time.Duration) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "STARTED\tSTATUS\tDURATION\tCOMMANDS\tSHELL\tHOST\tTTY\tDIRECTORY\tSESSION")
+	for _, s := range sessions {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			s.Start.Local().Format(time.DateTime),
+			s.Status(now, staleAfter),
+			s.Duration(now, staleAfter).Round(time.Second),
+			s.Commands, s.Shell, s.Host, s.TTY, s.InitialDir, s.Name)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,211 @@
+package main_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestStartSession(t *testing.T) {
+	database := openTestDB(t)
+
+	start := time.Now().Add(-time.Hour)
+	session := rt.Session{Name: "s1", Host: "box", Shell: "zsh", TTY: "/dev/pts/3", Start: start, InitialDir: "/home/me"}
+	if err := database.StartSession(&session); err != nil {
+		t.Fatalf("StartSession() unexpected error = %v", err)
+	}
+	if session.ID == 0 {
+		t.Error("StartSession() did not set the ID")
+	}
+
+	for _, line := range []string{"ls", "pwd"} {
+		record := rt.NewRecord(line, "/home/me", 0, time.Now())
+		record.Session = "s1"
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	sessions, err := database.Sessions(10)
+	if err != nil {
+		t.Fatalf("Sessions() unexpected error = %v", err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("Sessions() = %+v, want 1 session", sessions)
+	}
+	got := sessions[0]
+	if got.ID != session.ID || got.Shell != "zsh" || got.TTY != "/dev/pts/3" || got.InitialDir != "/home/me" ||
+		got.Commands != 2 || !got.End.IsZero() || !got.Start.Equal(start) {
+		t.Errorf("Session = %+v", got)
+	}
+}
+
+func TestInsertRegistersSession(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now()
+	for i, name := range []string{"old", "new", "new"} {
+		record := rt.NewRecord("ls", "/tmp", 0, now.Add(time.Duration(i)*time.Minute))
+		record.Session = name
+		record.Hostname = "box"
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	// The hook registering a session after its first command fills in the
+	// details without losing its true start
+	late := rt.Session{Name: "new", Shell: "bash", Start: now.Add(time.Hour)}
+	if err := database.StartSession(&late); err != nil {
+		t.Fatalf("StartSession() unexpected error = %v", err)
+	}
+
+	sessions, err := database.Sessions(10)
+	if err != nil {
+		t.Fatalf("Sessions() unexpected error = %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Sessions() = %+v, want 2 sessions", sessions)
+	}
+	if s := sessions[0]; s.Name != "new" || s.Commands != 2 || s.Shell != "bash" || !s.Start.Equal(now.Add(time.Minute)) {
+		t.Errorf("Newest session = %+v", s)
+	}
+	if s := sessions[1]; s.Name != "old" || s.Commands != 1 || s.Host != "box" || s.InitialDir != "/tmp" {
+		t.Errorf("Oldest session = %+v", s)
+	}
+}
+
+func TestSessionsBackfilled(t *testing.T) {
+	path := t.TempDir() + "/old.db"
+
+	// Create a database from before sessions had their own table
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = conn.Exec(`
+	CREATE TABLE history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		command TEXT NOT NULL,
+		timestamp DATETIME NOT NULL,
+		working_directory TEXT,
+		exit_status INTEGER NOT NULL,
+		arguments TEXT,
+		duration INTEGER NOT NULL DEFAULT 0,
+		session TEXT NOT NULL DEFAULT ''
+	);
+	INSERT INTO history (command, timestamp, working_directory, exit_status, arguments, session) VALUES
+		('ls', '2024-01-01 00:00:00', '/', 0, '', 'a'),
+		('pwd', '2024-01-01 00:01:00', '/', 0, '', 'a'),
+		('ls', '2024-01-01 00:02:00', '/', 0, '', '');
+	`)
+	conn.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to open old database: %v", err)
+	}
+	defer database.Close()
+
+	sessions, err := database.Sessions(10)
+	if err != nil {
+		t.Fatalf("Sessions() unexpected error = %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Name != "a" || sessions[0].Commands != 2 {
+		t.Errorf("Sessions() = %+v, want session a with 2 commands", sessions)
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now()
+	for i, name := range []string{"closed", "open"} {
+		session := rt.Session{Name: name, Start: now.Add(-time.Hour)}
+		if err := database.StartSession(&session); err != nil {
+			t.Fatalf("StartSession() unexpected error = %v", err)
+		}
+		record := rt.NewRecord("ls", "/", 0, now.Add(time.Duration(i-30)*time.Minute))
+		record.Session = name
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	if err := database.EndSession("closed", now); err != nil {
+		t.Fatalf("EndSession() unexpected error = %v", err)
+	}
+	// Ending again must not move the end time
+	if err := database.EndSession("closed", now.Add(time.Hour)); err != nil {
+		t.Fatalf("EndSession() unexpected error = %v", err)
+	}
+
+	sessions, err := database.Sessions(10)
+	if err != nil {
+		t.Fatalf("Sessions() unexpected error = %v", err)
+	}
+	byName := map[string]rt.Session{}
+	for _, s := range sessions {
+		byName[s.Name] = s
+	}
+
+	if closed := byName["closed"]; !closed.End.Equal(now) || closed.Duration(now, time.Hour) != time.Hour {
+		t.Errorf("Closed session = %+v, want ended an hour after it started", closed)
+	}
+	if open := byName["open"]; !open.End.IsZero() || !open.LastActive.Equal(now.Add(-29*time.Minute)) {
+		t.Errorf("Open session = %+v, want last active at its command", open)
+	}
+}
+
+func TestSessionStatus(t *testing.T) {
+	now := time.Now()
+	start := now.Add(-48 * time.Hour)
+
+	tests := []struct {
+		name         string
+		session      rt.Session
+		wantStatus   rt.SessionStatus
+		wantDuration time.Duration
+	}{
+		{
+			name:         "Ended",
+			session:      rt.Session{Start: start, End: start.Add(time.Hour), LastActive: start.Add(time.Minute)},
+			wantStatus:   rt.EndedSession,
+			wantDuration: time.Hour,
+		},
+		{
+			name:         "Live",
+			session:      rt.Session{Start: start, LastActive: now.Add(-time.Hour)},
+			wantStatus:   rt.LiveSession,
+			wantDuration: 48 * time.Hour,
+		},
+		{
+			name:         "Stale",
+			session:      rt.Session{Start: start, LastActive: start.Add(2 * time.Hour)},
+			wantStatus:   rt.StaleSession,
+			wantDuration: 2 * time.Hour,
+		},
+		{
+			name:         "Stale without activity",
+			session:      rt.Session{Start: start},
+			wantStatus:   rt.StaleSession,
+			wantDuration: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.session.Status(now, 24*time.Hour); got != tt.wantStatus {
+				t.Errorf("Status() = %v, want %v", got, tt.wantStatus)
+			}
+			if got := tt.session.Duration(now, 24*time.Hour); got != tt.wantDuration {
+				t.Errorf("Duration() = %v, want %v", got, tt.wantDuration)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Package shell generates the integration scripts which hook retour into the
+// user's shell. The scripts record every command as it finishes and provide a
+// search widget which splices the selected command into the line editor.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// zshScript is evaluated by zsh via `eval "$(retour init zsh)"`
+const zshScript = `# retour shell integration for zsh
+autoload -Uz add-zsh-hook
+zmodload zsh/datetime
+
+_retour_session="$$-$EPOCHSECONDS"
+
+_retour_preexec() {
+  _retour_cmd=$1
+  _retour_cwd=$PWD
+  _retour_start=$EPOCHREALTIME
+  _retour_cmd_rerun_of=${_retour_rerun_of:-0}
+  unset _retour_rerun_of
+}
+
+_retour_precmd() {
+  local exit_status=$?
+  [[ -z $_retour_cmd ]] && return
+  local duration
+  printf -v duration '%.0f' $(( (EPOCHREALTIME - _retour_start) * 1000 ))
+  retour record --exit "$exit_status" --cwd "$_retour_cwd" \
+    --duration "$duration" --session "$_retour_session" \
+    --rerun-of "$_retour_cmd_rerun_of" -- "$_retour_cmd" &!
+  unset _retour_cmd _retour_cwd _retour_start _retour_cmd_rerun_of
+}
+
+add-zsh-hook preexec _retour_preexec
+add-zsh-hook precmd _retour_precmd
+
+retour session start --session "$_retour_session" --shell zsh \
+  --shell-version "$ZSH_VERSION" --tty "$TTY" --cwd "$PWD" &!
+
+_retour_exit() {
+  retour session end --session "$_retour_session"
+}
+add-zsh-hook zshexit _retour_exit
+
+# The search functions remember which record was picked so that the command,
+# edited or not, is recorded as a rerun of it.
+
+# retour-search pushes the selected command onto the buffer stack so it is
+# ready for editing at the next prompt.
+retour-search() {
+  local selected
+  selected=$(retour --output shell --with-id </dev/tty)
+  if [[ -n $selected ]]; then
+    _retour_rerun_of=${selected%%$'\t'*}
+    print -z -- "${selected#*$'\t'}"
+  fi
+}
+
+# retour-search-widget replaces the line editor buffer with the selected
+# command, using the current buffer as the initial filter.
+# Bind it with: bindkey '^X^R' retour-search-widget
+retour-search-widget() {
+  local selected
+  selected=$(retour --output shell --with-id --filter "$BUFFER" </dev/tty)
+  if [[ -n $selected ]]; then
+    _retour_rerun_of=${selected%%$'\t'*}
+    BUFFER=${selected#*$'\t'}
+    CURSOR=${#BUFFER}
+  fi
+  zle reset-prompt
+}
+zle -N retour-search-widget
+
+# History strategy for zsh-autosuggestions. Enable it with:
+# ZSH_AUTOSUGGEST_STRATEGY=(retour history)
+_zsh_autosuggest_strategy_retour() {
+  typeset -g suggestion
+  suggestion=$(retour complete --prefix "$1" 2>/dev/null)
+}
+`
+
+// bashScript is evaluated by bash via `eval "$(retour init bash)"`
+const bashScript = `# retour shell integration for bash
+_retour_last_histcmd=
+_retour_session="$$-${EPOCHSECONDS:-$(date +%s)}"
+
+# Expanding PS0 just before a command runs records its start time in
+# microseconds as a side effect of evaluating the array subscript.
+PS0="${PS0}"'${_retour_ps0[_retour_start=${EPOCHREALTIME/./}]}'
+
+_retour_prompt_command() {
+  local exit_status=$?
+  local duration=0
+  if [[ -n $_retour_start && -n $EPOCHREALTIME ]]; then
+    duration=$(( (${EPOCHREALTIME/./} - _retour_start) / 1000 ))
+  fi
+  _retour_start=
+  local entry
+  entry=$(HISTTIMEFORMAT= builtin history 1)
+  local histcmd=${entry%%[^ 0-9]*}
+  if [[ -n $histcmd && $histcmd != "$_retour_last_histcmd" ]]; then
+    _retour_last_histcmd=$histcmd
+    local cmd=${entry#"$histcmd"}
+    cmd=${cmd#"${cmd%%[! ]*}"}
+    [[ -n $_retour_last_histcmd_seen ]] &&
+      (retour record --exit "$exit_status" --cwd "${_retour_cwd:-$PWD}" \
+        --duration "$duration" --session "$_retour_session" \
+        --rerun-of "${_retour_rerun_of:-0}" -- "$cmd" >/dev/null 2>&1 &)
+  fi
+  _retour_rerun_of=
+  _retour_last_histcmd_seen=1
+  # The next command starts here, wherever it leaves the shell
+  _retour_cwd=$PWD
+  return $exit_status
+}
+
+PROMPT_COMMAND="_retour_prompt_command${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+
+# tty prints "not a tty" when there is none
+_retour_tty=$(tty 2>/dev/null) || _retour_tty=
+(retour session start --session "$_retour_session" --shell bash \
+  --shell-version "$BASH_VERSION" --tty "$_retour_tty" --cwd "$PWD" >/dev/null 2>&1 &)
+
+# bash has a single EXIT trap, so an existing one is left in place and the
+# session is instead reported stale once it has been idle long enough
+_retour_exit() {
+  retour session end --session "$_retour_session" >/dev/null 2>&1
+}
+[[ -z $(trap -p EXIT) ]] && trap _retour_exit EXIT
+
+# retour-search replaces the readline buffer with the selected command, using
+# the current buffer as the initial filter. The picked record is remembered so
+# the command, edited or not, is recorded as a rerun of it.
+# Bind it with: bind -x '"\C-x\C-r": retour-search'
+retour-search() {
+  local selected
+  selected=$(retour --output shell --with-id --filter "$READLINE_LINE" </dev/tty)
+  if [[ -n $selected ]]; then
+    _retour_rerun_of=${selected%%$'\t'*}
+    READLINE_LINE=${selected#*$'\t'}
+    READLINE_POINT=${#READLINE_LINE}
+  fi
+}
+`
+
+// zshCtrlR replaces the history search binding in both emacs and vi insert mode
+const zshCtrlR = `
+bindkey -M emacs '^R' retour-search-widget
+bindkey -M viins '^R' retour-search-widget
+`
+
+// bashCtrlR replaces readline's reverse-search-history binding
+const bashCtrlR = `
+bind -x '"\C-r": retour-search'
+`
+
+// InitOptions controls the optional parts of the integration script.
+type InitOptions struct {
+	// BindCtrlR replaces the shell's Ctrl-R history search with retour's picker
+	BindCtrlR bool
+
+	// Daemon ships commands to the daemon with send rather than storing them
+	// with record, dropping them if the daemon is not running
+	Daemon bool
+}
+
+// InitScript returns the integration script for the named shell.
+func InitScript(shell string, options InitOptions) (string, error) {
+	var script, ctrlR string
+	switch shell {
+	case "zsh":
+		script, ctrlR = zshScript, zshCtrlR
+	case "bash":
+		script, ctrlR = bashScript, bashCtrlR
+	default:
+		return "", fmt.Errorf("unsupported shell: %q", shell)
+	}
+
+	if options.Daemon {
+		script = strings.ReplaceAll(script, "retour record ", "retour send ")
+	}
+	if options.BindCtrlR {
+		script += ctrlR
+	}
+	return script, nil
+}
+
+// shellQuote quotes s so that a POSIX shell reads it back as a single literal word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,88 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestInitScript(t *testing.T) {
+	tests := []struct {
+		shell string
+		want  []string
+	}{
+		{
+			shell: "zsh",
+			want:  []string{"retour record", "retour session start", "retour session end", "print -z", "BUFFER=", "--output shell", `--filter "$BUFFER"`},
+		},
+		{
+			shell: "bash",
+			want:  []string{"retour record", "retour session start", "retour session end", "READLINE_LINE=", "--output shell", `--filter "$READLINE_LINE"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.shell, func(t *testing.T) {
+			script, err := rt.InitScript(tt.shell, rt.InitOptions{})
+			if err != nil {
+				t.Fatalf("InitScript() unexpected error = %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(script, want) {
+					t.Errorf("Script does not contain %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestInitScriptUnsupportedShell(t *testing.T) {
+	if _, err := rt.InitScript("tcsh", rt.InitOptions{}); err == nil {
+		t.Error("Want error for unsupported shell, got nil")
+	}
+}
+
+func TestInitScriptCtrlR(t *testing.T) {
+	tests := []struct {
+		shell string
+		want  string
+	}{
+		{shell: "zsh", want: "bindkey -M emacs '^R' retour-search-widget"},
+		{shell: "bash", want: `bind -x '"\C-r": retour-search'`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.shell, func(t *testing.T) {
+			plain, err := rt.InitScript(tt.shell, rt.InitOptions{})
+			if err != nil {
+				t.Fatalf("InitScript() unexpected error = %v", err)
+			}
+			if strings.Contains(plain, tt.want) {
+				t.Errorf("Ctrl-R bound without opting in")
+			}
+
+			bound, err := rt.InitScript(tt.shell, rt.InitOptions{BindCtrlR: true})
+			if err != nil {
+				t.Fatalf("InitScript() unexpected error = %v", err)
+			}
+			if !strings.Contains(bound, tt.want) {
+				t.Errorf("Script does not contain %q", tt.want)
+			}
+		})
+	}
+}
+
+func TestInitScriptDaemon(t *testing.T) {
+	for _, shell := range []string{"zsh", "bash"} {
+		t.Run(shell, func(t *testing.T) {
+			script, err := rt.InitScript(shell, rt.InitOptions{Daemon: true})
+			if err != nil {
+				t.Fatalf("InitScript() unexpected error = %v", err)
+			}
+			if !strings.Contains(script, "retour send --exit") || strings.Contains(script, "retour record") {
+				t.Errorf("Script records commands rather than sending them to the daemon")
+			}
+		})
+	}
+}
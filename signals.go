@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// shutdownSignals ask retour to stop. Rather than dying where it stands, it
+// finishes the write under way, closes the database and restores the
+// terminal, so a signal never leaves the history half written.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// onSignal calls fn, once, if one of sigs arrives before the returned
+// function is called, which stops watching for them. Until then the signals
+// no longer have their usual effect.
+func onSignal(fn func(), sigs ...os.Signal) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sigs...)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-signals:
+			fn()
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// reloadOnHangup reads the config again with load each time SIGHUP arrives,
+// until ctx is done, publishing it on events for whatever is running to
+// apply. A config which fails to load is reported and the one in use kept.
+func reloadOnHangup(ctx context.Context, events *Bus, load func() (*Config, error)) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangups)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangups:
+			}
+			config, err := load()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "retour: not reloading the config: %v\n", err)
+				continue
+			}
+			events.Publish(ConfigReloaded{Config: config})
+			fmt.Fprintln(os.Stderr, "Reloaded the config")
+		}
+	}()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// SparkStyle selects the characters sparklines are drawn with.
+type SparkStyle string
+
+const (
+	// AutoSparks picks the best style the terminal can show
+	AutoSparks SparkStyle = "auto"
+	// BrailleSparks packs two values into each braille character
+	BrailleSparks SparkStyle = "braille"
+	// BlockSparks draws a block element character per value
+	BlockSparks SparkStyle = "block"
+	// ASCIISparks draws with plain ASCII for terminals without Unicode
+	ASCIISparks SparkStyle = "ascii"
+)
+
+// sparkLevels are the characters of each style, from empty to full
+var sparkLevels = map[SparkStyle][]rune{
+	BlockSparks: []rune(" ▁▂▃▄▅▆▇█"),
+	ASCIISparks: []rune(" .,:-=+*#"),
+}
+
+// brailleDots are the dots filling the left and right columns of a braille
+// character, from the bottom up
+var brailleDots = [2][4]rune{
+	{0x40, 0x04, 0x02, 0x01},
+	{0x80, 0x20, 0x10, 0x08},
+}
+
+// Sparkline draws values as a line of bars scaled to the largest of them.
+// Any value above zero shows, however small next to the largest.
+func Sparkline(values []float64, style SparkStyle) string {
+	if style == AutoSparks {
+		style = detectSparkStyle()
+	}
+	peak := 0.0
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+
+	var s strings.Builder
+	if style == BrailleSparks {
+		for i := 0; i < len(values); i += 2 {
+			char := rune(0x2800)
+			for column := 0; column < 2 && i+column < len(values); column++ {
+				for dot := range sparkLevel(values[i+column], peak, 4) {
+					char |= brailleDots[column][dot]
+				}
+			}
+			s.WriteRune(char)
+		}
+		return s.String()
+	}
+
+	levels := sparkLevels[style]
+	for _, v := range values {
+		s.WriteRune(levels[sparkLevel(v, peak, len(levels)-1)])
+	}
+	return s.String()
+}
+
+// sparkLevel scales v against peak to one of levels steps above empty
+func sparkLevel(v, peak float64, levels int) int {
+	if v <= 0 || peak <= 0 {
+		return 0
+	}
+	return max(1, int(math.Round(v/peak*float64(levels))))
+}
+
+// detectSparkStyle picks block characters where the locale is UTF-8 and the
+// terminal can draw them, which neither the Linux console nor a dumb
+// terminal reliably can, and ASCII elsewhere
+func detectSparkStyle() SparkStyle {
+	switch os.Getenv("TERM") {
+	case "", "dumb", "linux":
+		return ASCIISparks
+	}
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if locale := os.Getenv(name); locale != "" {
+			locale = strings.ToLower(locale)
+			if strings.Contains(locale, "utf-8") || strings.Contains(locale, "utf8") {
+				return BlockSparks
+			}
+			return ASCIISparks
+		}
+	}
+	return ASCIISparks
+}
+
+// parseSparkStyle checks that text names a sparkline style
+func parseSparkStyle(text string) (SparkStyle, error) {
+	switch style := SparkStyle(text); style {
+	case AutoSparks, BrailleSparks, BlockSparks, ASCIISparks:
+		return style, nil
+	default:
+		return "", fmt.Errorf("invalid sparkline style %q, want auto, braille, block or ascii", text)
+	}
+}
+
+// DayActivity sums up the commands run on a day.
+type DayActivity struct {
+	// Day is midnight at the start of the day, local time
+	Day      time.Time
+	Count    int
+	Failures int
+	// Duration is how long the day's commands took altogether
+	Duration time.Duration
+}
+
+// MeanDuration returns how long the day's commands took on average
+func (d DayActivity) MeanDuration() time.Duration {
+	if d.Count == 0 {
+		return 0
+	}
+	return d.Duration / time.Duration(d.Count)
+}
+
+// DailyActivity returns the activity on each of the days up to and including
+// the one containing until, oldest first, from the daily rollup. Days without
+// commands are included, empty.
+func (db *DB) DailyActivity(days int, until time.Time) ([]DayActivity, error) {
+	until = until.Local()
+	last := time.Date(until.Year(), until.Month(), until.Day(), 0, 0, 0, 0, time.Local)
+	first := last.AddDate(0, 0, 1-days)
+
+	activity := make([]DayActivity, days)
+	for i := range activity {
+		activity[i].Day = first.AddDate(0, 0, i)
+	}
+
+	rows, err := db.reader.Query(`
+	SELECT day, SUM(count), SUM(failures), SUM(total_duration)
+	FROM rollup
+	WHERE day BETWEEN ? AND ?
+	GROUP BY day`, first.Format(time.DateOnly), last.Format(time.DateOnly))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day string
+		var a DayActivity
+		var duration int64
+		if err := rows.Scan(&day, &a.Count, &a.Failures, &duration); err != nil {
+			return nil, err
+		}
+		a.Day, err = time.ParseInLocation(time.DateOnly, day, time.Local)
+		if err != nil {
+			return nil, err
+		}
+		a.Duration = time.Duration(duration) * time.Millisecond
+		// Days are counted from the first, as daylight saving time changes
+		// the length of some
+		i := int(math.Round(a.Day.Sub(first).Hours() / 24))
+		activity[i] = a
+	}
+	return activity, rows.Err()
+}
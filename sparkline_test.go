@@ -0,0 +1,103 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestSparkline(t *testing.T) {
+	values := []float64{0, 1, 4, 8, 2}
+
+	tests := []struct {
+		style rt.SparkStyle
+		want  string
+	}{
+		{rt.BlockSparks, " ▁▄█▂"},
+		{rt.ASCIISparks, " .-#,"},
+		// Two values to a character, filling the columns from the bottom
+		{rt.BrailleSparks, "⢀⣼⡀"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.style), func(t *testing.T) {
+			if got := rt.Sparkline(values, tt.style); got != tt.want {
+				t.Errorf("Sparkline() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := rt.Sparkline([]float64{0, 0}, rt.BlockSparks); got != "  " {
+		t.Errorf("Sparkline() of nothing = %q, want blanks", got)
+	}
+}
+
+func TestSparklineAuto(t *testing.T) {
+	tests := []struct {
+		term string
+		lang string
+		want string
+	}{
+		{"xterm-256color", "en_GB.UTF-8", "▁█"},
+		{"xterm-256color", "C", ".#"},
+		{"linux", "en_GB.UTF-8", ".#"},
+		{"dumb", "en_GB.utf8", ".#"},
+	}
+
+	t.Setenv("LC_ALL", "")
+	t.Setenv("LC_CTYPE", "")
+	for _, tt := range tests {
+		t.Setenv("TERM", tt.term)
+		t.Setenv("LANG", tt.lang)
+		if got := rt.Sparkline([]float64{1, 8}, rt.AutoSparks); got != tt.want {
+			t.Errorf("With TERM %q and LANG %q, Sparkline() = %q, want %q", tt.term, tt.lang, got, tt.want)
+		}
+	}
+}
+
+func TestDailyActivity(t *testing.T) {
+	database := openTestDB(t)
+
+	today := time.Date(2024, 3, 10, 15, 0, 0, 0, time.Local)
+	for _, r := range []struct {
+		daysAgo  int
+		status   int
+		duration time.Duration
+	}{
+		{0, 0, time.Second},
+		{0, 1, 3 * time.Second},
+		{2, 0, time.Second},
+		// Before the days asked for
+		{5, 0, time.Second},
+	} {
+		record := rt.NewRecord("make", "/work", r.status, today.AddDate(0, 0, -r.daysAgo))
+		record.Duration = r.duration
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	activity, err := database.DailyActivity(3, today)
+	if err != nil {
+		t.Fatalf("DailyActivity() unexpected error = %v", err)
+	}
+
+	want := []rt.DayActivity{
+		{Day: time.Date(2024, 3, 8, 0, 0, 0, 0, time.Local), Count: 1, Duration: time.Second},
+		{Day: time.Date(2024, 3, 9, 0, 0, 0, 0, time.Local)},
+		{Day: time.Date(2024, 3, 10, 0, 0, 0, 0, time.Local), Count: 2, Failures: 1, Duration: 4 * time.Second},
+	}
+	if len(activity) != len(want) {
+		t.Fatalf("DailyActivity() returned %d days, want %d", len(activity), len(want))
+	}
+	for i := range want {
+		if !activity[i].Day.Equal(want[i].Day) || activity[i].Count != want[i].Count ||
+			activity[i].Failures != want[i].Failures || activity[i].Duration != want[i].Duration {
+			t.Errorf("Day %d = %+v, want %+v", i, activity[i], want[i])
+		}
+	}
+	if got := activity[2].MeanDuration(); got != 2*time.Second {
+		t.Errorf("MeanDuration() = %v, want 2s", got)
+	}
+}
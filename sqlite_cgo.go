@@ -0,0 +1,44 @@
+//go:build !modernc
+
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// dsn returns the connection string with the pragmas added as the driver's
+// parameters, so they apply to each connection the pool opens rather than
+// only the first. Read only connections only wait for locks, the rest of the
+// pragmas concern writing.
+func (p Pragmas) dsn(connectionString string, readOnly bool) string {
+	params := url.Values{}
+	params.Set("_busy_timeout", strconv.Itoa(p.BusyTimeout))
+	if readOnly {
+		params.Set("_query_only", "true")
+	} else {
+		params.Set("_journal_mode", p.JournalMode)
+		params.Set("_synchronous", p.Synchronous)
+		params.Set("_foreign_keys", strconv.FormatBool(p.ForeignKeys))
+	}
+
+	separator := "?"
+	if strings.Contains(connectionString, "?") {
+		separator = "&"
+	}
+	return connectionString + separator + params.Encode()
+}
+
+// sqliteCode returns the primary SQLite result code err carries, 0 if it
+// didn't come from SQLite
+func sqliteCode(err error) int {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return 0
+	}
+	return int(sqliteErr.Code)
+}
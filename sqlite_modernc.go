@@ -0,0 +1,62 @@
+//go:build modernc
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"modernc.org/sqlite"
+)
+
+// Building with the modernc tag uses modernc.org/sqlite, which is written in
+// Go, so retour can be built as a static binary without a C toolchain. It is
+// registered under the name mattn/go-sqlite3 uses, which it replaces.
+func init() {
+	sql.Register(sqliteDriver, &sqlite.Driver{})
+}
+
+// dsn returns the connection string with the pragmas added as the driver's
+// parameters, so they apply to each connection the pool opens rather than
+// only the first. Read only connections only wait for locks, the rest of the
+// pragmas concern writing. Times are stored in the format mattn/go-sqlite3
+// uses, so either build can read a database the other wrote.
+func (p Pragmas) dsn(connectionString string, readOnly bool) string {
+	foreignKeys := "0"
+	if p.ForeignKeys {
+		foreignKeys = "1"
+	}
+
+	// The busy timeout comes first so it applies while the others wait for
+	// locks
+	params := url.Values{}
+	params.Add("_pragma", "busy_timeout("+strconv.Itoa(p.BusyTimeout)+")")
+	if readOnly {
+		params.Add("_pragma", "query_only(1)")
+	} else {
+		params.Add("_pragma", "journal_mode("+p.JournalMode+")")
+		params.Add("_pragma", "synchronous("+p.Synchronous+")")
+		params.Add("_pragma", "foreign_keys("+foreignKeys+")")
+	}
+	params.Set("_time_format", "sqlite")
+
+	separator := "?"
+	if strings.Contains(connectionString, "?") {
+		separator = "&"
+	}
+	return connectionString + separator + params.Encode()
+}
+
+// sqliteCode returns the primary SQLite result code err carries, 0 if it
+// didn't come from SQLite
+func sqliteCode(err error) int {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return 0
+	}
+	// The primary code is the low byte of an extended one
+	return sqliteErr.Code() & 0xff
+}
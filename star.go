@@ -0,0 +1,31 @@
+package main
+
+import "fmt"
+
+// SetStarred stars or unstars the record with the given ID, which pins it
+// above the rest of the history in the picker. Unstarring a record unstars
+// every run of its command line, so a line shown once with its count, starred
+// because one of its runs is, can be unstarred from any of them. Starring
+// changes nothing that was recorded, so it may be done while the history is
+// immutable, but only to this database's records, not those of attached ones.
+func (db *DB) SetStarred(id int64, starred bool) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	query := "UPDATE main.history SET starred = 1 WHERE id = ?"
+	if !starred {
+		query = `
+		UPDATE main.history SET starred = 0
+		WHERE (command, COALESCE(arguments, '')) =
+			(SELECT command, COALESCE(arguments, '') FROM main.history WHERE id = ?)`
+	}
+	result, err := db.conn.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no record with id %d", id)
+	}
+	return err
+}
@@ -0,0 +1,83 @@
+package main_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestDBSetStarred(t *testing.T) {
+	database := openTestDB(t)
+	now := time.Now()
+	var ids []int64
+	for i, line := range []string{"ls", "make", "git status", "ls", "pwd"} {
+		record := rt.NewRecord(line, "/", 0, now.Add(time.Duration(i-5)*time.Minute))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+		ids = append(ids, record.ID)
+	}
+	lines := func(records []rt.Record) []string {
+		var lines []string
+		for _, r := range records {
+			lines = append(lines, r.CommandLine())
+		}
+		return lines
+	}
+
+	// A starred command is pinned above more recent ones, in pages too
+	if err := database.SetStarred(ids[1], true); err != nil {
+		t.Fatalf("SetStarred() unexpected error = %v", err)
+	}
+	records, err := database.QueryFiltered(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	if want := []string{"make", "pwd", "ls", "git status", "ls"}; !slices.Equal(lines(records), want) || !records[0].Starred || records[1].Starred {
+		t.Errorf("QueryFiltered() = %+v, want %q with make starred", records, want)
+	}
+	page, err := database.QueryFilteredAfter(0, "all", rt.Scope{}, &records[0], 2)
+	if err != nil {
+		t.Fatalf("QueryFilteredAfter() unexpected error = %v", err)
+	}
+	if want := []string{"pwd", "ls"}; !slices.Equal(lines(page), want) {
+		t.Errorf("QueryFilteredAfter() after the starred record = %q, want %q", lines(page), want)
+	}
+	starred, err := database.QueryFiltered(0, "all", rt.Scope{Starred: true}, 0)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	if want := []string{"make"}; !slices.Equal(lines(starred), want) {
+		t.Errorf("QueryFiltered() of the starred = %q, want %q", lines(starred), want)
+	}
+
+	// A command line is starred if any of its runs is
+	if err := database.SetStarred(ids[0], true); err != nil {
+		t.Fatalf("SetStarred() unexpected error = %v", err)
+	}
+	unique, err := database.QueryUnique(0, "all", rt.Scope{}, 0)
+	if err != nil {
+		t.Fatalf("QueryUnique() unexpected error = %v", err)
+	}
+	if want := []string{"ls", "make", "pwd", "git status"}; !slices.Equal(lines(unique), want) || !unique[0].Starred || unique[0].ID != ids[3] {
+		t.Errorf("QueryUnique() = %+v, want %q with the latest ls starred", unique, want)
+	}
+
+	// Unstarring any run unstars the command line
+	if err := database.SetStarred(ids[3], false); err != nil {
+		t.Fatalf("SetStarred() unexpected error = %v", err)
+	}
+	starred, err = database.QueryFiltered(0, "all", rt.Scope{Starred: true}, 0)
+	if err != nil {
+		t.Fatalf("QueryFiltered() unexpected error = %v", err)
+	}
+	if want := []string{"make"}; !slices.Equal(lines(starred), want) {
+		t.Errorf("QueryFiltered() of the starred after unstarring ls = %q, want %q", lines(starred), want)
+	}
+
+	if err := database.SetStarred(1000, true); err == nil {
+		t.Error("SetStarred() of a missing record succeeded")
+	}
+}
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Count pairs a name with the number of times it occurred.
+type Count struct {
+	Name  string
+	Count int
+}
+
+// UsageStats gives an overview of everything recorded.
+type UsageStats struct {
+	Total     int
+	Succeeded int
+	Failed    int
+	// Commands counts each command, without its arguments, most run first
+	Commands []Count
+	// Directories counts the commands run in each directory, busiest first
+	Directories []Count
+	// Hours counts the commands run in each hour of the day, local time,
+	// busiest first
+	Hours []Count
+	// Weekdays counts the commands run on each day of the week, local time,
+	// busiest first
+	Weekdays []Count
+	// ExitClasses counts the commands whose exit status was of each class,
+	// most common first
+	ExitClasses []Count
+	// Sample is n when the counts were estimated from every nth command, 0
+	// when they are exact
+	Sample int
+}
+
+// UsageStats aggregates the whole history, keeping the top entries of each
+// breakdown.
+func (db *DB) UsageStats(top int) (UsageStats, error) {
+	return db.SampledUsageStats(top, 1)
+}
+
+// SampledUsageStats estimates UsageStats from every nth command recorded,
+// scaling the counts up, so the overview of a history of tens of millions of
+// commands still appears promptly. An n of 1 aggregates every command, from
+// the daily rollup where it can. The rollup only covers this database, so
+// with others attached every command is aggregated from the history. Each
+// aggregate is a scan of its own, so they run at once, each on its own
+// connection from the pool.
+func (db *DB) SampledUsageStats(top int, n int) (UsageStats, error) {
+	if n < 1 {
+		return UsageStats{}, fmt.Errorf("sample must be at least 1, got %d", n)
+	}
+	stats := UsageStats{}
+	// Every breakdown but the hours can be counted from the daily rollup
+	totals := `
+		SELECT COALESCE(SUM(count), 0), COALESCE(SUM(count - failures), 0), COALESCE(SUM(failures), 0)
+		FROM rollup`
+	commands := "SELECT command, SUM(count) AS count FROM rollup GROUP BY command"
+	directories := "SELECT dir, SUM(count) AS count FROM rollup WHERE dir != '' GROUP BY dir"
+	weekdays := "SELECT strftime('%w', day) AS weekday, SUM(count) AS count FROM rollup WHERE weekday IS NOT NULL GROUP BY weekday"
+	history := "history"
+	if n > 1 || db.attached {
+		if n > 1 {
+			history = fmt.Sprintf("(SELECT * FROM history WHERE id %% %d = 0) AS history", n)
+			stats.Sample = n
+		}
+		totals = `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE exit_status = 0), COUNT(*) FILTER (WHERE exit_status != 0)
+		FROM ` + history
+		commands = `
+		SELECT command, COUNT(*) AS count
+		FROM ` + history + `
+		GROUP BY command`
+		directories = `
+		SELECT COALESCE(working_directory, ''), COUNT(*) AS count
+		FROM ` + history + `
+		WHERE COALESCE(working_directory, '') != ''
+		GROUP BY working_directory`
+		weekdays = `
+		SELECT strftime('%w', timestamp, 'localtime') AS weekday, COUNT(*) AS count
+		FROM ` + history + `
+		WHERE weekday IS NOT NULL
+		GROUP BY weekday`
+	}
+
+	var g errgroup.Group
+	g.Go(func() error {
+		return db.reader.QueryRow(totals).Scan(&stats.Total, &stats.Succeeded, &stats.Failed)
+	})
+
+	breakdowns := []struct {
+		counts *[]Count
+		query  string
+	}{
+		{&stats.Commands, commands},
+		{&stats.Directories, directories},
+		{&stats.Hours, `
+		SELECT strftime('%H:00', timestamp, 'localtime') AS hour, COUNT(*) AS count
+		FROM ` + history + `
+		WHERE hour IS NOT NULL
+		GROUP BY hour`},
+		{&stats.Weekdays, `
+		SELECT CASE weekday
+			WHEN '0' THEN 'Sunday' WHEN '1' THEN 'Monday' WHEN '2' THEN 'Tuesday'
+			WHEN '3' THEN 'Wednesday' WHEN '4' THEN 'Thursday' WHEN '5' THEN 'Friday'
+			WHEN '6' THEN 'Saturday' END, count
+		FROM (` + weekdays + `)`},
+		{&stats.ExitClasses, `
+		SELECT ` + exitClassSQL + ` AS class, COUNT(*) AS count
+		FROM ` + history + `
+		GROUP BY class`},
+	}
+	for _, b := range breakdowns {
+		g.Go(func() error {
+			counts, err := db.topCounts(b.query, top)
+			for i := range counts {
+				counts[i].Count *= n
+			}
+			*b.counts = counts
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return UsageStats{}, err
+	}
+	stats.Total *= n
+	stats.Succeeded *= n
+	stats.Failed *= n
+
+	// Encrypted commands are counted by their encrypted text
+	for i, c := range stats.Commands {
+		var err error
+		if stats.Commands[i].Name, err = db.open(c.Name); err != nil {
+			return UsageStats{}, err
+		}
+	}
+	if db.cipher != nil {
+		sort.SliceStable(stats.Commands, func(i, j int) bool {
+			a, b := stats.Commands[i], stats.Commands[j]
+			return a.Count > b.Count || (a.Count == b.Count && a.Name < b.Name)
+		})
+	}
+
+	return stats, nil
+}
+
+// topCounts runs a query selecting name and count columns and returns the
+// top rows, most frequent first and alphabetically among equals
+func (db *DB) topCounts(query string, top int) ([]Count, error) {
+	rows, err := db.reader.Query("SELECT * FROM ("+query+") ORDER BY 2 DESC, 1 LIMIT ?", top)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []Count
+	for rows.Next() {
+		var c Count
+		if err := rows.Scan(&c.Name, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	return counts, rows.Err()
+}
+
+// FlagStats breaks down how a command is used.
+type FlagStats struct {
+	// Subcommands counts the first non-flag argument, e.g. "commit" for git
+	Subcommands []Count
+	// Flags counts each flag, with any "=value" suffix removed
+	Flags []Count
+}
+
+// FlagStats tokenizes every recorded use of command and counts the
+// subcommands and flags passed to it, most used first.
+func (db *DB) FlagStats(command string) (FlagStats, error) {
+	rows, err := db.reader.Query("SELECT COALESCE(arguments, '') FROM history WHERE command = ?", db.seal(command))
+	if err != nil {
+		return FlagStats{}, err
+	}
+	defer rows.Close()
+
+	subcommands := map[string]int{}
+	flags := map[string]int{}
+	for rows.Next() {
+		var arguments string
+		if err := rows.Scan(&arguments); err != nil {
+			return FlagStats{}, err
+		}
+		if arguments, err = db.open(arguments); err != nil {
+			return FlagStats{}, err
+		}
+
+		seenSubcommand := false
+		for _, word := range Tokenize(arguments) {
+			switch {
+			case word == "--" || word == "-":
+				// end of options or stdin, neither is interesting
+			case strings.HasPrefix(word, "-"):
+				name, _, _ := strings.Cut(word, "=")
+				flags[name]++
+			case !seenSubcommand:
+				subcommands[word]++
+				seenSubcommand = true
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return FlagStats{}, err
+	}
+
+	return FlagStats{Subcommands: sortCounts(subcommands), Flags: sortCounts(flags)}, nil
+}
+
+// DirStats summarises how commands fared within a directory tree.
+type DirStats struct {
+	Succeeded int
+	Failed    int
+	// ExitStatuses counts each exit status, most common first
+	ExitStatuses []Count
+	// ExitClasses counts the exit statuses of each class, most common first
+	ExitClasses []Count
+	// FailingCommands counts the command lines which failed, most often first
+	FailingCommands []Count
+}
+
+// DirStats aggregates the exit statuses of the commands run in dir or any
+// directory below it.
+func (db *DB) DirStats(dir string) (DirStats, error) {
+	inTree, treeArgs := treeClause(dir)
+
+	var stats DirStats
+	rows, err := db.reader.Query(`
+	SELECT exit_status, COUNT(*)
+	FROM history
+	WHERE `+inTree+`
+	GROUP BY exit_status`, treeArgs...)
+	if err != nil {
+		return DirStats{}, err
+	}
+	defer rows.Close()
+
+	statuses := map[string]int{}
+	classes := map[string]int{}
+	for rows.Next() {
+		var status, count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return DirStats{}, err
+		}
+		statuses[strconv.Itoa(status)] = count
+		classes[string(ClassifyExit(status))] += count
+		if status == 0 {
+			stats.Succeeded += count
+		} else {
+			stats.Failed += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return DirStats{}, err
+	}
+	stats.ExitStatuses = sortCounts(statuses)
+	stats.ExitClasses = sortCounts(classes)
+
+	failing := map[string]int{}
+	err = db.QueryStream(`
+	SELECT command, COALESCE(arguments, '') AS arguments
+	FROM history
+	WHERE exit_status != 0 AND `+inTree, func(r Record) error {
+		failing[r.CommandLine()]++
+		return nil
+	}, treeArgs...)
+	if err != nil {
+		return DirStats{}, err
+	}
+	stats.FailingCommands = sortCounts(failing)
+
+	return stats, nil
+}
+
+// RerunStats separates commands typed afresh from those replayed from history.
+type RerunStats struct {
+	Organic int
+	Reruns  int
+	// Commands counts the command lines replayed, most often first
+	Commands []Count
+}
+
+// RerunStats counts how many commands were reruns of earlier records and
+// which command lines were replayed.
+func (db *DB) RerunStats() (RerunStats, error) {
+	var stats RerunStats
+	err := db.reader.QueryRow(`
+	SELECT COUNT(*) FILTER (WHERE rerun_of IS NULL), COUNT(*) FILTER (WHERE rerun_of IS NOT NULL)
+	FROM history`).Scan(&stats.Organic, &stats.Reruns)
+	if err != nil {
+		return RerunStats{}, err
+	}
+
+	replayed := map[string]int{}
+	err = db.QueryStream(`
+	SELECT command, COALESCE(arguments, '') AS arguments
+	FROM history
+	WHERE rerun_of IS NOT NULL`, func(r Record) error {
+		replayed[r.CommandLine()]++
+		return nil
+	})
+	if err != nil {
+		return RerunStats{}, err
+	}
+	stats.Commands = sortCounts(replayed)
+
+	return stats, nil
+}
+
+// RepoStats summarises the activity in a git repository.
+type RepoStats struct {
+	// Repo is the root of the repository
+	Repo     string
+	Commands int
+	Failed   int
+	// ActiveDays counts the days, local time, commands were run in it
+	ActiveDays int
+	// Tools counts the commands run in it, without their arguments, most run
+	// first
+	Tools []Count
+}
+
+// RepoStats summarises the activity in each git repository commands were
+// recorded in, busiest first. Commands run outside a repository, or recorded
+// before repositories were, are left out.
+func (db *DB) RepoStats() ([]RepoStats, error) {
+	rows, err := db.reader.Query(`
+	SELECT repo, COUNT(*), COUNT(*) FILTER (WHERE exit_status != 0),
+		COUNT(DISTINCT date(timestamp, 'localtime'))
+	FROM history
+	WHERE repo != ''
+	GROUP BY repo
+	ORDER BY COUNT(*) DESC, repo`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []RepoStats
+	index := map[string]int{}
+	for rows.Next() {
+		var repo RepoStats
+		if err := rows.Scan(&repo.Repo, &repo.Commands, &repo.Failed, &repo.ActiveDays); err != nil {
+			return nil, err
+		}
+		index[repo.Repo] = len(stats)
+		stats = append(stats, repo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Encrypted commands are sealed the same way each time, so they are
+	// counted before being decrypted
+	tools := make([]map[string]int, len(stats))
+	rows, err = db.reader.Query(`
+	SELECT repo, command, COUNT(*)
+	FROM history
+	WHERE repo != ''
+	GROUP BY repo, command`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var repo, command string
+		var count int
+		if err := rows.Scan(&repo, &command, &count); err != nil {
+			return nil, err
+		}
+		if command, err = db.open(command); err != nil {
+			return nil, err
+		}
+		i := index[repo]
+		if tools[i] == nil {
+			tools[i] = map[string]int{}
+		}
+		tools[i][command] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range stats {
+		stats[i].Tools = sortCounts(tools[i])
+	}
+	return stats, nil
+}
+
+// sortCounts converts a map of counts to a slice, most frequent first and
+// alphabetically among equals
+func sortCounts(counts map[string]int) []Count {
+	sorted := make([]Count, 0, len(counts))
+	for name, count := range counts {
+		sorted = append(sorted, Count{Name: name, Count: count})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// writeCounts renders a titled, aligned table of at most limit counts
+func writeCounts(w io.Writer, title string, counts []Count, limit int) error {
+	if _, err := fmt.Fprintln(w, title); err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	for i, c := range counts {
+		if i == limit {
+			break
+		}
+		fmt.Fprintf(table, "  %s\t%d\t\n", c.Name, c.Count)
+	}
+	return table.Flush()
+}
+
+// runStats implements the stats subcommand
+func runStats(config *Config, args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	flagsOf := flags.String("flags", "", "Break down the flags and subcommands passed to this command")
+	dir := flags.String("dir", "", "Break down exit statuses of commands run in this directory tree")
+	reruns := flags.Bool("reruns", false, "Break down how many commands were replayed from history")
+	repos := flags.Bool("repos", false, "Summarise the activity in each git repository")
+	top := flags.Int("n", 10, "Number of rows to show in each table")
+	sample := flags.Int("sample", 1, "Estimate the overview from every nth command, for huge histories")
+	days := flags.Int("days", 30, "Number of days the activity trends cover")
+	sparks := flags.String("sparks", string(AutoSparks), "Characters the trends are drawn with (auto, braille, block, ascii)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	style, err := parseSparkStyle(*sparks)
+	if err != nil {
+		return err
+	}
+	if *days < 1 {
+		return fmt.Errorf("days must be at least 1, got %d", *days)
+	}
+	views := 0
+	for _, chosen := range []bool{*flagsOf != "", *dir != "", *reruns, *repos} {
+		if chosen {
+			views++
+		}
+	}
+	if views > 1 || views > 0 && *sample != 1 {
+		return fmt.Errorf("usage: retour stats [--sample <n> | --flags <command> | --dir <path> | --reruns | --repos]")
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch {
+	case views == 0:
+		return writeUsageStats(os.Stdout, db, *top, *sample, *days, style)
+	case *dir != "":
+		return writeDirStats(os.Stdout, db, *dir, *top)
+	case *reruns:
+		return writeRerunStats(os.Stdout, db, *top)
+	case *repos:
+		return writeRepoStats(os.Stdout, db, *top)
+	}
+
+	stats, err := db.FlagStats(*flagsOf)
+	if err != nil {
+		return err
+	}
+
+	if err := writeCounts(os.Stdout, "Subcommands of "+*flagsOf, stats.Subcommands, *top); err != nil {
+		return err
+	}
+	return writeCounts(os.Stdout, "Flags of "+*flagsOf, stats.Flags, *top)
+}
+
+// writeUsageStats renders the overview of the whole history, estimated from
+// every sample-th command unless sample is 1, with the trends over the last
+// days drawn in style
+func writeUsageStats(w io.Writer, db *DB, top int, sample int, days int, style SparkStyle) error {
+	stats, err := db.SampledUsageStats(top, sample)
+	if err != nil {
+		return err
+	}
+
+	// Estimates are marked as such throughout
+	about, estimated := "", ""
+	if stats.Sample > 0 {
+		about, estimated = "About ", " (estimated)"
+		if _, err := fmt.Fprintf(w, "Estimated from 1 in %d commands\n", stats.Sample); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s%d commands recorded, %d succeeded (%s), %d failed (%s)\n", about,
+		stats.Total, stats.Succeeded, percent(stats.Succeeded, stats.Total),
+		stats.Failed, percent(stats.Failed, stats.Total)); err != nil {
+		return err
+	}
+	if err := writeTrends(w, db, days, style); err != nil {
+		return err
+	}
+
+	tables := []struct {
+		title  string
+		counts []Count
+	}{
+		{"Top commands", stats.Commands},
+		{"Top directories", stats.Directories},
+		{"Busiest hours", stats.Hours},
+		{"Busiest days", stats.Weekdays},
+		{"Exit classes", stats.ExitClasses},
+	}
+	for _, table := range tables {
+		if err := writeCounts(w, table.title+estimated, table.counts, top); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTrends draws sparklines of the commands run each day and how long they
+// took on average over the last days, with the busiest and slowest day
+func writeTrends(w io.Writer, db *DB, days int, style SparkStyle) error {
+	activity, err := db.DailyActivity(days, time.Now())
+	if err != nil {
+		return err
+	}
+
+	counts := make([]float64, len(activity))
+	durations := make([]float64, len(activity))
+	busiest, slowest := activity[0], activity[0]
+	for i, day := range activity {
+		counts[i] = float64(day.Count)
+		durations[i] = float64(day.MeanDuration())
+		if day.Count > busiest.Count {
+			busiest = day
+		}
+		if day.MeanDuration() > slowest.MeanDuration() {
+			slowest = day
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "Last %d days\n", days); err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "  Commands\t%s\t", Sparkline(counts, style))
+	if busiest.Count > 0 {
+		fmt.Fprintf(table, "peak %d on %s", busiest.Count, busiest.Day.Format(time.DateOnly))
+	}
+	fmt.Fprintf(table, "\n  Mean duration\t%s\t", Sparkline(durations, style))
+	if slowest.MeanDuration() > 0 {
+		fmt.Fprintf(table, "peak %s on %s", slowest.MeanDuration().Round(time.Millisecond), slowest.Day.Format(time.DateOnly))
+	}
+	fmt.Fprintln(table)
+	return table.Flush()
+}
+
+// percent formats part as a percentage of total, to the nearest whole number
+func percent(part, total int) string {
+	if total == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.0f%%", 100*float64(part)/float64(total))
+}
+
+// writeDirStats renders the exit status breakdown for the tree rooted at dir
+func writeDirStats(w io.Writer, db *DB, dir string, top int) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	stats, err := db.DirStats(dir)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "%s: %d succeeded, %d failed\n", dir, stats.Succeeded, stats.Failed); err != nil {
+		return err
+	}
+	if err := writeCounts(w, "Exit classes", stats.ExitClasses, top); err != nil {
+		return err
+	}
+	if err := writeCounts(w, "Exit statuses", stats.ExitStatuses, top); err != nil {
+		return err
+	}
+	return writeCounts(w, "Most failed commands", stats.FailingCommands, top)
+}
+
+// writeRerunStats renders the split between organic and replayed commands
+func writeRerunStats(w io.Writer, db *DB, top int) error {
+	stats, err := db.RerunStats()
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "%d typed, %d rerun from history\n", stats.Organic, stats.Reruns); err != nil {
+		return err
+	}
+	return writeCounts(w, "Most rerun commands", stats.Commands, top)
+}
+
+// repoTools is how many of the commands most run in each repository are shown
+const repoTools = 3
+
+// writeRepoStats renders the activity in the top busiest repositories
+func writeRepoStats(w io.Writer, db *DB, top int) error {
+	stats, err := db.RepoStats()
+	if err != nil {
+		return err
+	}
+	if len(stats) == 0 {
+		_, err := fmt.Fprintln(w, "No commands were recorded in a git repository")
+		return err
+	}
+
+	if _, err := fmt.Fprintln(w, "Repositories"); err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "  Repository\tCommands\tFailed\tActive days\tTop tools")
+	for i, repo := range stats {
+		if i == top {
+			break
+		}
+		var tools []string
+		for _, tool := range repo.Tools[:min(repoTools, len(repo.Tools))] {
+			tools = append(tools, fmt.Sprintf("%s (%d)", tool.Name, tool.Count))
+		}
+		fmt.Fprintf(table, "  %s\t%d\t%d (%s)\t%d\t%s\n", repo.Repo, repo.Commands,
+			repo.Failed, percent(repo.Failed, repo.Commands), repo.ActiveDays, strings.Join(tools, ", "))
+	}
+	return table.Flush()
+}
@@ -0,0 +1,295 @@
+package main_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestFlagStats(t *testing.T) {
+	database := openTestDB(t)
+
+	for _, line := range []string{
+		`git commit -m "message"`,
+		`git commit --amend --no-edit`,
+		`git status -s`,
+		`git push --force-with-lease=origin/main`,
+		`git push -- origin`,
+		`ls -la`,
+	} {
+		record := rt.NewRecord(line, "/", 0, time.Now())
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	stats, err := database.FlagStats("git")
+	if err != nil {
+		t.Fatalf("FlagStats() unexpected error = %v", err)
+	}
+
+	wantSubcommands := []rt.Count{{"commit", 2}, {"push", 2}, {"status", 1}}
+	wantFlags := []rt.Count{{"--amend", 1}, {"--force-with-lease", 1}, {"--no-edit", 1}, {"-m", 1}, {"-s", 1}}
+
+	checkCounts(t, "Subcommands", stats.Subcommands, wantSubcommands)
+	checkCounts(t, "Flags", stats.Flags, wantFlags)
+}
+
+func checkCounts(t *testing.T, name string, got []rt.Count, want []rt.Count) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s = %v, want %v", name, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s[%d] = %v, want %v", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestDirStats(t *testing.T) {
+	database := openTestDB(t)
+
+	for _, h := range []struct {
+		line string
+		dir  string
+		exit int
+	}{
+		{"make test", "/work/flaky", 2},
+		{"make test", "/work/flaky/sub", 2},
+		{"make test", "/work/flaky", 0},
+		{"go vet ./...", "/work/flaky", 1},
+		{"ls", "/work/flaky", 0},
+		{"make test", "/work/flakyother", 2},
+		{"make test", "/elsewhere", 2},
+	} {
+		record := rt.NewRecord(h.line, h.dir, h.exit, time.Now())
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	stats, err := database.DirStats("/work/flaky/")
+	if err != nil {
+		t.Fatalf("DirStats() unexpected error = %v", err)
+	}
+
+	if stats.Succeeded != 2 || stats.Failed != 3 {
+		t.Errorf("Succeeded, Failed = %d, %d, want 2, 3", stats.Succeeded, stats.Failed)
+	}
+	checkCounts(t, "ExitStatuses", stats.ExitStatuses, []rt.Count{{"0", 2}, {"2", 2}, {"1", 1}})
+	checkCounts(t, "ExitClasses", stats.ExitClasses, []rt.Count{{"success", 2}, {"usage-error", 2}, {"error", 1}})
+	checkCounts(t, "FailingCommands", stats.FailingCommands, []rt.Count{{"make test", 2}, {"go vet ./...", 1}})
+}
+
+func TestRerunStats(t *testing.T) {
+	database := openTestDB(t)
+
+	original := rt.NewRecord("make test", "/src", 1, time.Now())
+	if err := database.Insert(&original); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+	for _, line := range []string{"make test", "make test", "ls", "make build"} {
+		record := rt.NewRecord(line, "/src", 0, time.Now())
+		if line != "ls" {
+			record.RerunOf = original.ID
+		}
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	stats, err := database.RerunStats()
+	if err != nil {
+		t.Fatalf("RerunStats() unexpected error = %v", err)
+	}
+	if stats.Organic != 2 || stats.Reruns != 3 {
+		t.Errorf("Organic, Reruns = %d, %d, want 2, 3", stats.Organic, stats.Reruns)
+	}
+	checkCounts(t, "Commands", stats.Commands, []rt.Count{{"make test", 2}, {"make build", 1}})
+}
+
+func TestRepoStats(t *testing.T) {
+	database := openTestDB(t)
+
+	monday := time.Date(2024, 3, 4, 14, 5, 0, 0, time.Local)
+	for _, r := range []struct {
+		line string
+		repo string
+		exit int
+		at   time.Time
+	}{
+		{"go test ./...", "/src/retour", 1, monday},
+		{"go test ./...", "/src/retour", 0, monday.Add(time.Minute)},
+		{"git commit -m x", "/src/retour", 0, monday.AddDate(0, 0, 1)},
+		{"make", "/src/other", 2, monday},
+		{"ls", "", 0, monday},
+	} {
+		record := rt.NewRecord(r.line, r.repo, r.exit, r.at)
+		record.Repo = r.repo
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	stats, err := database.RepoStats()
+	if err != nil {
+		t.Fatalf("RepoStats() unexpected error = %v", err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("RepoStats() = %+v, want the 2 repositories", stats)
+	}
+	retour := stats[0]
+	if retour.Repo != "/src/retour" || retour.Commands != 3 || retour.Failed != 1 || retour.ActiveDays != 2 {
+		t.Errorf("RepoStats()[0] = %+v, want /src/retour with 3 commands, 1 failed, over 2 days", retour)
+	}
+	checkCounts(t, "Tools", retour.Tools, []rt.Count{{"go", 2}, {"git", 1}})
+	if other := stats[1]; other.Repo != "/src/other" || other.Commands != 1 || other.Failed != 1 || other.ActiveDays != 1 {
+		t.Errorf("RepoStats()[1] = %+v, want /src/other with its failed command", other)
+	}
+}
+
+func TestUsageStats(t *testing.T) {
+	database := openTestDB(t)
+
+	// Monday 14:xx and Tuesday 09:xx, local time
+	monday := time.Date(2024, 3, 4, 14, 5, 0, 0, time.Local)
+	tuesday := time.Date(2024, 3, 5, 9, 30, 0, 0, time.Local)
+	for _, r := range []struct {
+		line   string
+		dir    string
+		status int
+		at     time.Time
+	}{
+		{"git status", "/work/a", 0, monday},
+		{"git commit -m x", "/work/a", 0, monday.Add(time.Minute)},
+		{"make test", "/work/b", 2, monday.Add(2 * time.Minute)},
+		{"ls", "/work/a", 0, tuesday},
+	} {
+		record := rt.NewRecord(r.line, r.dir, r.status, r.at)
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	stats, err := database.UsageStats(2)
+	if err != nil {
+		t.Fatalf("UsageStats() unexpected error = %v", err)
+	}
+
+	if stats.Total != 4 || stats.Succeeded != 3 || stats.Failed != 1 {
+		t.Errorf("Total, Succeeded, Failed = %d, %d, %d, want 4, 3, 1", stats.Total, stats.Succeeded, stats.Failed)
+	}
+	checkCounts(t, "Commands", stats.Commands, []rt.Count{{"git", 2}, {"ls", 1}})
+	checkCounts(t, "Directories", stats.Directories, []rt.Count{{"/work/a", 3}, {"/work/b", 1}})
+	checkCounts(t, "Hours", stats.Hours, []rt.Count{{"14:00", 3}, {"09:00", 1}})
+	checkCounts(t, "Weekdays", stats.Weekdays, []rt.Count{{"Monday", 3}, {"Tuesday", 1}})
+	checkCounts(t, "ExitClasses", stats.ExitClasses, []rt.Count{{"success", 3}, {"usage-error", 1}})
+}
+
+func TestSampledUsageStats(t *testing.T) {
+	database := openTestDB(t)
+	for i := range 100 {
+		line := "git status"
+		if i%3 == 0 {
+			line = "make"
+		}
+		record := rt.NewRecord(line, "/src", i%5, time.Now())
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	exact, err := database.SampledUsageStats(5, 1)
+	if err != nil {
+		t.Fatalf("SampledUsageStats() unexpected error = %v", err)
+	}
+	if exact.Sample != 0 || exact.Total != 100 {
+		t.Errorf("SampledUsageStats(1) = %d commands, sample %d, want all 100 exactly", exact.Total, exact.Sample)
+	}
+
+	sampled, err := database.SampledUsageStats(5, 10)
+	if err != nil {
+		t.Fatalf("SampledUsageStats() unexpected error = %v", err)
+	}
+	if sampled.Sample != 10 || sampled.Total != 100 {
+		t.Errorf("SampledUsageStats(10) = %d commands, sample %d, want 100 estimated from 1 in 10", sampled.Total, sampled.Sample)
+	}
+	if len(sampled.Commands) != 2 || sampled.Commands[0].Name != "git" || sampled.Commands[0].Count%10 != 0 {
+		t.Errorf("SampledUsageStats(10) commands = %+v, want git first in multiples of 10", sampled.Commands)
+	}
+
+	if _, err := database.SampledUsageStats(5, 0); err == nil {
+		t.Error("SampledUsageStats(0) succeeded, want an error")
+	}
+}
+
+func TestUsageStatsRollup(t *testing.T) {
+	path := t.TempDir() + "/history.db"
+	database, err := rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	monday := time.Date(2024, 3, 4, 14, 5, 0, 0, time.Local)
+	tuesday := time.Date(2024, 3, 5, 9, 30, 0, 0, time.Local)
+	for _, r := range []struct {
+		line   string
+		status int
+		at     time.Time
+	}{
+		{"git status", 0, monday},
+		{"make test", 2, monday.Add(time.Minute)},
+		{"git status", 0, tuesday},
+		{"make test", 2, tuesday.Add(time.Minute)},
+		{"make test", 0, tuesday.Add(2 * time.Minute)},
+	} {
+		record := rt.NewRecord(r.line, "/work", r.status, r.at)
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	// Pruned records drop out of the rollup
+	if _, err := database.Prune(tuesday); err != nil {
+		t.Fatalf("Prune() unexpected error = %v", err)
+	}
+	check := func(database *rt.DB) {
+		t.Helper()
+		stats, err := database.UsageStats(5)
+		if err != nil {
+			t.Fatalf("UsageStats() unexpected error = %v", err)
+		}
+		if stats.Total != 3 || stats.Succeeded != 2 || stats.Failed != 1 {
+			t.Errorf("Total, Succeeded, Failed = %d, %d, %d, want 3, 2, 1", stats.Total, stats.Succeeded, stats.Failed)
+		}
+		checkCounts(t, "Commands", stats.Commands, []rt.Count{{"make", 2}, {"git", 1}})
+		checkCounts(t, "Weekdays", stats.Weekdays, []rt.Count{{"Tuesday", 3}})
+	}
+	check(database)
+	database.Close()
+
+	// A database from before the rollup has it filled in from its history
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec(`
+	DROP TRIGGER rollup_insert;
+	DROP TRIGGER rollup_delete;
+	DROP TRIGGER rollup_update;
+	DROP TABLE rollup;
+	PRAGMA user_version = 1;`); err != nil {
+		t.Fatalf("Failed to drop rollup: %v", err)
+	}
+
+	database, err = rt.NewDB(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer database.Close()
+	check(database)
+}
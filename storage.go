@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Storage is where the history is kept. The code recording and selecting
+// commands depends on it rather than on DB, so that other backends, such as
+// an in-memory store for tests, can stand in for the SQLite database.
+type Storage interface {
+	// Insert stores a record, setting its ID
+	Insert(record *Record) error
+
+	// Query returns the records a SQL query over the history selects
+	Query(query string, args ...interface{}) ([]Record, error)
+
+	// QueryFiltered returns the most recent records matching the filters
+	QueryFiltered(timeRange time.Duration, resultFilter string, scope Scope, limit int) ([]Record, error)
+
+	// QueryUnique is like QueryFiltered but returns each command line once
+	QueryUnique(timeRange time.Duration, resultFilter string, scope Scope, limit int) ([]Record, error)
+
+	// QuerySuggested is like QueryUnique but ranks the command lines run in
+	// the scope's directory tree first
+	QuerySuggested(timeRange time.Duration, resultFilter string, scope Scope, limit int) ([]Record, error)
+
+	// Prune removes the records run before a time, other than those kept
+	// for good, returning how many
+	Prune(before time.Time) (int, error)
+
+	// Close releases the storage
+	Close() error
+}
+
+var _ Storage = (*DB)(nil)
+
+// Prune removes the records run before the given time, returning how many
+// were removed. Starred records and those tagged with a keep tag, see
+// SetKeepTags, are kept however old they are. It is how the daemon enforces
+// the retention period, so it goes ahead even while the history is
+// immutable, but is then audited. Only this database's records are removed,
+// not those of attached ones.
+func (db *DB) Prune(before time.Time) (int, error) {
+	if db.immutable {
+		detail := fmt.Sprintf("remove records run before %s", before.Format(time.RFC3339))
+		if err := db.audit("prune", detail, true); err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	expired := "timestamp < ? AND NOT starred"
+	args := []interface{}{before}
+	if len(db.keepTags) > 0 {
+		expired += " AND id NOT IN (SELECT record_id FROM main.tags WHERE tag IN (?" + strings.Repeat(", ?", len(db.keepTags)-1) + "))"
+		for _, tag := range db.keepTags {
+			args = append(args, tag)
+		}
+	}
+
+	// Reruns of pruned records are kept, as if they had been typed afresh
+	_, err = tx.Exec(`
+	UPDATE main.history SET rerun_of = NULL
+	WHERE rerun_of IN (SELECT id FROM main.history WHERE `+expired+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec("DELETE FROM main.history WHERE "+expired, args...)
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if pruned > 0 {
+		db.events.Publish(RecordsDeleted{Count: int(pruned)})
+	}
+	return int(pruned), nil
+}
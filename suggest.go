@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Suggestion is a command line proposed from history along with how often it
+// was seen in the relevant context.
+type Suggestion struct {
+	CommandLine string
+	Count       int
+}
+
+// SuggestNext returns the commands most often run straight after last within
+// the same session, most likely first. Follow-ups seen in dir rank above those
+// seen elsewhere, so suggestions favour the current project.
+func (db *DB) SuggestNext(last string, dir string, limit int) ([]Suggestion, error) {
+	command, arguments := SplitCommandLine(last)
+	command, arguments = db.seal(command), db.seal(arguments)
+
+	rows, err := db.reader.Query(`
+	WITH pairs AS (
+		SELECT command, COALESCE(arguments, '') AS arguments, working_directory,
+			LAG(command) OVER session AS prev_command,
+			COALESCE(LAG(arguments) OVER session, '') AS prev_arguments
+		FROM history
+		WINDOW session AS (PARTITION BY session ORDER BY id)
+	)
+	SELECT command, arguments, COUNT(*) AS n
+	FROM pairs
+	WHERE prev_command = ? AND prev_arguments = ?
+	GROUP BY command, arguments
+	ORDER BY SUM(working_directory = ?) DESC, n DESC
+	LIMIT ?
+	`, command, arguments, dir, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suggestions []Suggestion
+	for rows.Next() {
+		var r Record
+		var s Suggestion
+		if err := rows.Scan(&r.Command, &r.Arguments, &s.Count); err != nil {
+			return nil, err
+		}
+		if err := db.openRecord(&r); err != nil {
+			return nil, err
+		}
+		s.CommandLine = r.CommandLine()
+		suggestions = append(suggestions, s)
+	}
+
+	return suggestions, rows.Err()
+}
+
+// runSuggestNext implements the suggest-next subcommand
+func runSuggestNext(config *Config, args []string) error {
+	flags := flag.NewFlagSet("suggest-next", flag.ContinueOnError)
+	last := flags.String("last", "", "The command that was just run [default: the most recent record]")
+	session := flags.String("session", "", "Session to take the most recent record from")
+	dir := flags.String("cwd", "", "Current directory [default: working directory]")
+	count := flags.Int("n", 5, "Number of suggestions to return")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*dir = wd
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *last == "" {
+		info, err := db.PromptInfo(*session, *dir)
+		if err != nil {
+			return err
+		}
+		if !info.HasLast {
+			return nil
+		}
+		*last = info.Last.CommandLine()
+	}
+
+	suggestions, err := db.SuggestNext(*last, *dir, *count)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range suggestions {
+		fmt.Println(s.CommandLine)
+	}
+	return nil
+}
+
+// runSuggest implements the suggest subcommand
+func runSuggest(config *Config, args []string) error {
+	flags := flag.NewFlagSet("suggest", flag.ContinueOnError)
+	dir := flags.String("cwd", "", "Directory to suggest commands for [default: working directory]")
+	count := flags.Int("n", 10, "Number of suggestions to return")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*dir = wd
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	records, err := db.QuerySuggested(config.TimeRange.Duration(time.Now()), string(config.Result), Scope{Dir: *dir}, *count)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		fmt.Println(r.CommandLine())
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main_test
+
+import (
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestSuggestNext(t *testing.T) {
+	database := openTestDB(t)
+
+	sessions := []struct {
+		session string
+		dir     string
+		lines   []string
+	}{
+		{session: "a", dir: "/elsewhere", lines: []string{"git add .", "git commit", "git add .", "git commit"}},
+		{session: "b", dir: "/project", lines: []string{"git add .", "git status"}},
+		// The next session must not see "git add ." as the predecessor of "ls"
+		{session: "c", dir: "/project", lines: []string{"ls"}},
+	}
+	for _, s := range sessions {
+		for _, line := range s.lines {
+			record := rt.NewRecord(line, s.dir, 0, time.Now())
+			record.Session = s.session
+			if err := database.Insert(&record); err != nil {
+				t.Fatalf("Failed to insert record: %v", err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		last string
+		dir  string
+		want []string
+	}{
+		{name: "Most frequent first", last: "git add .", dir: "/elsewhere", want: []string{"git commit", "git status"}},
+		{name: "Current directory first", last: "git add .", dir: "/project", want: []string{"git status", "git commit"}},
+		{name: "Unknown command", last: "vim", dir: "/project", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suggestions, err := database.SuggestNext(tt.last, tt.dir, 5)
+			if err != nil {
+				t.Fatalf("SuggestNext() unexpected error = %v", err)
+			}
+			if len(suggestions) != len(tt.want) {
+				t.Fatalf("Got %d suggestions %v, want %v", len(suggestions), suggestions, tt.want)
+			}
+			for i, want := range tt.want {
+				if suggestions[i].CommandLine != want {
+					t.Errorf("Suggestion %d = %q, want %q", i, suggestions[i].CommandLine, want)
+				}
+			}
+		})
+	}
+}
+
+func TestQuerySuggested(t *testing.T) {
+	database := openTestDB(t)
+
+	now := time.Now()
+	for _, r := range []struct {
+		line string
+		dir  string
+		age  time.Duration
+	}{
+		{"make build", "/project", 48 * time.Hour},
+		{"make build", "/project", 24 * time.Hour},
+		{"go test ./...", "/project/pkg", time.Hour},
+		{"go test ./...", "/project/pkg", time.Minute},
+		{"git status", "/project", 72 * time.Hour},
+		// Neither another project nor one sharing the prefix is suggested
+		{"ls", "/elsewhere", time.Minute},
+		{"npm test", "/project-two", time.Minute},
+	} {
+		record := rt.NewRecord(r.line, r.dir, 0, now.Add(-r.age))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	records, err := database.QuerySuggested(0, "all", rt.Scope{Dir: "/project"}, 10)
+	if err != nil {
+		t.Fatalf("QuerySuggested() unexpected error = %v", err)
+	}
+
+	want := []struct {
+		line  string
+		count int
+	}{
+		{"make build", 2},
+		{"git status", 1},
+		{"go test ./...", 2},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("QuerySuggested() = %+v, want %d records", records, len(want))
+	}
+	for i, w := range want {
+		if records[i].CommandLine() != w.line || records[i].Count != w.count {
+			t.Errorf("Record %d = %q ×%d, want %q ×%d", i, records[i].CommandLine(), records[i].Count, w.line, w.count)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Sync shares the history between machines through a remote holding a log
+// per host. Each log is newline delimited JSON in the form written by export
+// --format json and only its own host appends to it, so pushes never
+// conflict. Pulling reads the other hosts' logs from where the last pull
+// stopped and stores the records not already held, matching them by host,
+// session and timestamp.
+//
+// With a sync key each line of a log is encrypted before it leaves the
+// machine, so the remote only sees how many records each host pushed.
+
+// sealedPayloadPrefix marks a line of a log holding an encrypted record
+const sealedPayloadPrefix = "retour-sync1:"
+
+// ErrNoSyncKey is returned when an encrypted log is pulled without a key.
+var ErrNoSyncKey = errors.New("sync log is encrypted, set sync_key_file in the config file to read it")
+
+// ErrWrongSyncKey is returned when an encrypted log cannot be decrypted with
+// the configured key.
+var ErrWrongSyncKey = errors.New("sync log was encrypted with a different key")
+
+// payloadCipher encrypts the records in a log with AES-GCM. Unlike the
+// history's textCipher the nonce is random, as nothing needs to compare the
+// encrypted records, and the log's name is authenticated with each record so
+// the remote cannot move them between hosts.
+type payloadCipher struct {
+	aead cipher.AEAD
+}
+
+// seal encrypts a record's line of JSON for a log
+func (c *payloadCipher) seal(line []byte, log string) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	rand.Read(nonce)
+	sealed := c.aead.Seal(nonce, nonce, line, []byte(log))
+	return []byte(sealedPayloadPrefix + base64.RawStdEncoding.EncodeToString(sealed))
+}
+
+// open decrypts a line sealed by seal, reporting false if it is not
+// encrypted text at all
+func (c *payloadCipher) open(line []byte, log string) ([]byte, bool, error) {
+	encoded, ok := bytes.CutPrefix(line, []byte(sealedPayloadPrefix))
+	if !ok {
+		return nil, false, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(string(encoded))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return nil, false, nil
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ciphertext, []byte(log))
+	if err != nil {
+		return nil, true, ErrWrongSyncKey
+	}
+	return plain, true, nil
+}
+
+// SetSyncKey encrypts the records sync pushes with a key derived from
+// secret, and decrypts those it pulls. Other hosts must use the same secret.
+// Records in a log which are not encrypted are then refused, as anyone with
+// access to the remote could have written them.
+func (db *DB) SetSyncKey(secret []byte) error {
+	aead, err := newAEAD(secret, "retour sync encryption")
+	if err != nil {
+		return fmt.Errorf("failed to derive sync key: %w", err)
+	}
+	db.syncCipher = &payloadCipher{aead: aead}
+	return nil
+}
+
+// syncLogSuffix ends the name of every log on a remote
+const syncLogSuffix = ".ndjson"
+
+// unsafeLogChars matches characters of a hostname which are not used in the
+// name of its log
+var unsafeLogChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// syncLog returns the name of the log holding the records run on hostname
+func syncLog(hostname string) string {
+	return unsafeLogChars.ReplaceAllString(hostname, "_") + syncLogSuffix
+}
+
+// SyncRemote is somewhere the hosts' logs are exchanged through.
+type SyncRemote interface {
+	// String identifies the remote, so how far it has been synced can be
+	// remembered
+	String() string
+
+	// Logs lists the names of the logs the remote holds
+	Logs() ([]string, error)
+
+	// Read returns the content of a log from offset onwards
+	Read(log string, offset int64) ([]byte, error)
+
+	// Append adds data to the end of a log, creating it if need be
+	Append(log string, data []byte) error
+}
+
+// ParseRemote parses a remote given either as a directory, such as one
+// shared by a file syncing service, or as host:dir for a directory on
+// another machine reached with ssh. A relative dir is taken from the home
+// directory there.
+func ParseRemote(spec string) (SyncRemote, error) {
+	if spec == "" {
+		return nil, errors.New("no remote to sync with, set sync_remote or pass --remote")
+	}
+
+	host, dir, found := strings.Cut(spec, ":")
+	if found && host != "" && !strings.Contains(host, "/") {
+		if strings.HasPrefix(host, "-") || dir == "" {
+			return nil, fmt.Errorf("invalid remote %q, want host:dir", spec)
+		}
+		return SSHRemote{Host: host, Dir: dir}, nil
+	}
+
+	dir, err := filepath.Abs(spec)
+	if err != nil {
+		return nil, err
+	}
+	return DirRemote(dir), nil
+}
+
+// DirRemote is a remote in a local directory.
+type DirRemote string
+
+func (r DirRemote) String() string {
+	return string(r)
+}
+
+// Logs lists the logs in the directory, none if it does not exist yet
+func (r DirRemote) Logs() ([]string, error) {
+	entries, err := os.ReadDir(string(r))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), syncLogSuffix) {
+			logs = append(logs, entry.Name())
+		}
+	}
+	return logs, nil
+}
+
+// Read returns the content of a log from offset onwards
+func (r DirRemote) Read(log string, offset int64) ([]byte, error) {
+	file, err := os.Open(filepath.Join(string(r), log))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(file)
+}
+
+// Append adds data to the end of a log, readable only by the user
+func (r DirRemote) Append(log string, data []byte) error {
+	if err := os.MkdirAll(string(r), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(string(r), log), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// SSHRemote is a remote in a directory on another machine, reached by
+// running POSIX shell commands there with ssh.
+type SSHRemote struct {
+	Host string
+	Dir  string
+}
+
+func (r SSHRemote) String() string {
+	return r.Host + ":" + r.Dir
+}
+
+// Logs lists the logs in the directory, none if it does not exist yet
+func (r SSHRemote) Logs() ([]string, error) {
+	dir := shellQuote(r.Dir)
+	out, err := r.run(nil, "if [ -d "+dir+" ]; then ls -1 "+dir+"; fi")
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []string
+	for _, name := range strings.Split(string(out), "\n") {
+		if strings.HasSuffix(name, syncLogSuffix) {
+			logs = append(logs, name)
+		}
+	}
+	return logs, nil
+}
+
+// Read returns the content of a log from offset onwards
+func (r SSHRemote) Read(log string, offset int64) ([]byte, error) {
+	return r.run(nil, fmt.Sprintf("tail -c +%d %s", offset+1, shellQuote(r.path(log))))
+}
+
+// Append adds data to the end of a log, readable only by the user
+func (r SSHRemote) Append(log string, data []byte) error {
+	_, err := r.run(data, fmt.Sprintf("umask 077 && mkdir -p %s && cat >> %s", shellQuote(r.Dir), shellQuote(r.path(log))))
+	return err
+}
+
+// path returns the path of a log on the other machine
+func (r SSHRemote) path(log string) string {
+	return strings.TrimSuffix(r.Dir, "/") + "/" + log
+}
+
+// run runs command on the other machine with input as its standard input,
+// returning its output
+func (r SSHRemote) run(input []byte, command string) ([]byte, error) {
+	cmd := exec.Command("ssh", "--", r.Host, command)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ssh %s failed: %w: %s", r.Host, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// syncPosition returns how far the log on remote has been synced: the ID of
+// the last record pushed for the host's own log, or the number of bytes
+// pulled for the others
+func (db *DB) syncPosition(remote SyncRemote, log string) (int64, error) {
+	var position int64
+	err := db.conn.QueryRow(`
+	SELECT position FROM sync_progress
+	WHERE remote = ? AND log = ?`, remote.String(), log).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return position, err
+}
+
+// setSyncPosition records how far the log on remote has been synced
+func setSyncPosition(conn execer, remote SyncRemote, log string, position int64) error {
+	_, err := conn.Exec(`
+	INSERT INTO sync_progress (remote, log, position, updated)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT (remote, log) DO UPDATE SET
+		position = excluded.position,
+		updated = excluded.updated`, remote.String(), log, position, time.Now())
+	return err
+}
+
+// SyncPush appends the records run on hostname since the last push to the
+// host's log on remote, returning how many there were. Records stored
+// without a hostname are taken to have been run on this one.
+func (db *DB) SyncPush(remote SyncRemote, hostname string) (int, error) {
+	if hostname == "" {
+		return 0, errors.New("cannot sync without a hostname")
+	}
+	log := syncLog(hostname)
+	last, err := db.syncPosition(remote, log)
+	if err != nil {
+		return 0, err
+	}
+
+	var data bytes.Buffer
+	pushed := 0
+	err = db.QueryStream(`
+	SELECT `+recordColumns+`
+	FROM history
+	WHERE id > ? AND hostname IN (?, '')
+	ORDER BY id`, func(r Record) error {
+		if r.Hostname == "" {
+			r.Hostname = hostname
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if db.syncCipher != nil {
+			line = db.syncCipher.seal(line, log)
+		}
+		data.Write(line)
+		data.WriteByte('\n')
+		last = r.ID
+		pushed++
+		return nil
+	}, last, hostname)
+	if err != nil || pushed == 0 {
+		return 0, err
+	}
+
+	if err := remote.Append(log, data.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := setSyncPosition(db.conn, remote, log, last); err != nil {
+		return 0, err
+	}
+	db.events.Publish(SyncCompleted{Remote: remote.String(), Pushed: pushed})
+	return pushed, nil
+}
+
+// SyncPull stores the records in the other hosts' logs on remote which were
+// added since the last pull and are not already held. It returns how many
+// were stored and how many lines could not be read as records, which are
+// skipped.
+func (db *DB) SyncPull(remote SyncRemote, hostname string) (pulled int, invalid int, err error) {
+	if hostname == "" {
+		return 0, 0, errors.New("cannot sync without a hostname")
+	}
+	logs, err := remote.Logs()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	own := syncLog(hostname)
+	for _, log := range logs {
+		if log == own {
+			continue
+		}
+		n, bad, err := db.pullLog(remote, log)
+		if err != nil {
+			return pulled, invalid, fmt.Errorf("failed to pull %s: %w", log, err)
+		}
+		pulled += n
+		invalid += bad
+	}
+	db.events.Publish(SyncCompleted{Remote: remote.String(), Pulled: pulled})
+	return pulled, invalid, nil
+}
+
+// pullLog stores the records added to a log since it was last pulled
+func (db *DB) pullLog(remote SyncRemote, log string) (pulled int, invalid int, err error) {
+	offset, err := db.syncPosition(remote, log)
+	if err != nil {
+		return 0, 0, err
+	}
+	data, err := remote.Read(log, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The log's host may be part way through appending a line
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end == 0 {
+		return 0, 0, nil
+	}
+
+	payload, invalid, err := db.openPayload(data[:end], log)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var records []Record
+	err = ParseNDJSON(bytes.NewReader(payload), func(r Record, err error) error {
+		if err != nil {
+			invalid++
+			return nil
+		}
+		if r.Hostname == "" {
+			r.Hostname = strings.TrimSuffix(log, syncLogSuffix)
+		}
+		// Record IDs mean nothing outside the database they came from
+		r.RerunOf = 0
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	merged, err := db.mergeRecords(tx, records)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := setSyncPosition(tx, remote, log, offset+int64(end)); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	db.publishInserted(merged)
+	return len(merged), invalid, nil
+}
+
+// openPayload decrypts the lines of a log read by a pull, returning the
+// records' JSON and how many lines were refused: those not encrypted when a
+// key is set. A line which cannot be decrypted stops the pull, so the log is
+// read again once the right key is set.
+func (db *DB) openPayload(data []byte, log string) (payload []byte, invalid int, err error) {
+	if db.syncCipher == nil {
+		if bytes.Contains(data, []byte(sealedPayloadPrefix)) {
+			return nil, 0, ErrNoSyncKey
+		}
+		return data, 0, nil
+	}
+
+	for line := range bytes.Lines(data) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		plain, sealed, err := db.syncCipher.open(line, log)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !sealed {
+			invalid++
+			continue
+		}
+		payload = append(append(payload, plain...), '\n')
+	}
+	return payload, invalid, nil
+}
+
+// mergeRecords stores the records not already held, matching them by host,
+// session and timestamp, returning those stored
+func (db *DB) mergeRecords(tx *sql.Tx, records []Record) ([]Record, error) {
+	exists, err := tx.Prepare(`
+	SELECT COUNT(*) FROM history
+	WHERE hostname = ? AND session = ? AND timestamp = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer exists.Close()
+
+	var merged []Record
+	for _, r := range records {
+		var count int
+		if err := exists.QueryRow(r.Hostname, r.Session, r.Timestamp).Scan(&count); err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			continue
+		}
+		if err := db.insert(tx, &r); err != nil {
+			return nil, err
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+// runSync implements the sync subcommand
+func runSync(config *Config, args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	spec := flags.String("remote", config.SyncRemote, "Directory, or host:dir reached with ssh, to sync through")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	push, pull := true, true
+	switch {
+	case flags.NArg() > 1:
+		return fmt.Errorf("usage: retour sync [--remote remote] [push|pull]")
+	case flags.Arg(0) == "push":
+		pull = false
+	case flags.Arg(0) == "pull":
+		push = false
+	case flags.Arg(0) != "":
+		return fmt.Errorf("unknown sync direction: %q", flags.Arg(0))
+	}
+
+	remote, err := ParseRemote(*spec)
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to find the hostname: %w", err)
+	}
+
+	db, err := openDB(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if config.SyncKeyFile != "" {
+		secret, err := LoadEncryptionKey(config.SyncKeyFile)
+		if err != nil {
+			return err
+		}
+		if err := db.SetSyncKey(secret); err != nil {
+			return err
+		}
+	}
+
+	if push {
+		pushed, err := db.SyncPush(remote, hostname)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pushed %d records\n", pushed)
+	}
+	if pull {
+		pulled, invalid, err := db.SyncPull(remote, hostname)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pulled %d records, %d invalid\n", pulled, invalid)
+	}
+	return nil
+}
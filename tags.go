@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The tags table labels records with words, such as deploy, to find them by
+// with --tag. A trigger removes a record's tags along with it, however it is
+// deleted.
+const tagsSchema = `
+	CREATE TABLE IF NOT EXISTS tags (
+		record_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (record_id, tag)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_tag ON tags(tag);
+
+	CREATE TRIGGER IF NOT EXISTS tags_delete AFTER DELETE ON history BEGIN
+		DELETE FROM tags WHERE record_id = OLD.id;
+	END;`
+
+// checkTag returns tag without surrounding whitespace, or an error if it is
+// not a single word
+func checkTag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", fmt.Errorf("a tag needs a name")
+	}
+	if strings.ContainsFunc(tag, unicode.IsSpace) {
+		return "", fmt.Errorf("a tag must be a single word, got %q", tag)
+	}
+	return tag, nil
+}
+
+// Tag labels the record with the given ID with tag, a single word, so that
+// it can be found with --tag. Tagging a record twice with the same tag does
+// nothing. Only this database's records can be tagged, not those of attached
+// ones, and tags change nothing that was recorded, so records may be tagged
+// while the history is immutable.
+func (db *DB) Tag(id int64, tag string) error {
+	tag, err := checkTag(tag)
+	if err != nil {
+		return err
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	var exists bool
+	if err := db.conn.QueryRow("SELECT COUNT(*) > 0 FROM main.history WHERE id = ?", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no record with id %d", id)
+	}
+	_, err = db.conn.Exec("INSERT OR IGNORE INTO main.tags (record_id, tag) VALUES (?, ?)", id, tag)
+	return err
+}
+
+// SetKeepTags sets the tags, such as keep, which exempt the records tagged
+// with them from pruning, along with the starred ones, so that valued
+// commands survive the retention policy however old they grow.
+func (db *DB) SetKeepTags(tags []string) {
+	db.keepTags = tags
+}
+
+// Untag removes tag from the record with the given ID and from every other
+// run of its command line, as the unique mode shows a line tagged through
+// any of its runs.
+func (db *DB) Untag(id int64, tag string) error {
+	tag, err := checkTag(tag)
+	if err != nil {
+		return err
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	result, err := db.conn.Exec(`
+	DELETE FROM main.tags
+	WHERE tag = ? AND record_id IN (
+		SELECT id FROM main.history
+		WHERE (command, COALESCE(arguments, '')) =
+			(SELECT command, COALESCE(arguments, '') FROM main.history WHERE id = ?))`, tag, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("record %d is not tagged %s", id, tag)
+	}
+	return err
+}
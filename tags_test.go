@@ -0,0 +1,89 @@
+package main_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestDBTag(t *testing.T) {
+	database := openTestDB(t)
+	now := time.Now()
+	var ids []int64
+	for i, line := range []string{"kubectl apply -f k8s/", "make", "kubectl apply -f k8s/", "ls"} {
+		record := rt.NewRecord(line, "/", 0, now.Add(time.Duration(i-4)*time.Minute))
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+		ids = append(ids, record.ID)
+	}
+	tagged := func(tag string) []int64 {
+		t.Helper()
+		records, err := database.QueryFiltered(0, "all", rt.Scope{Tag: tag}, 0)
+		if err != nil {
+			t.Fatalf("QueryFiltered() unexpected error = %v", err)
+		}
+		var got []int64
+		for _, r := range records {
+			got = append(got, r.ID)
+		}
+		return got
+	}
+
+	for _, id := range []int64{ids[0], ids[2], ids[1]} {
+		if err := database.Tag(id, " deploy "); err != nil {
+			t.Fatalf("Tag() unexpected error = %v", err)
+		}
+	}
+	if err := database.Tag(ids[1], "build"); err != nil {
+		t.Fatalf("Tag() unexpected error = %v", err)
+	}
+	// Tagging twice changes nothing
+	if err := database.Tag(ids[1], "build"); err != nil {
+		t.Fatalf("Tag() again unexpected error = %v", err)
+	}
+	if got, want := tagged("deploy"), []int64{ids[2], ids[1], ids[0]}; !slices.Equal(got, want) {
+		t.Errorf("Records tagged deploy = %v, want %v", got, want)
+	}
+	if got, want := tagged("build"), []int64{ids[1]}; !slices.Equal(got, want) {
+		t.Errorf("Records tagged build = %v, want %v", got, want)
+	}
+
+	// Untagging a run untags its command line
+	if err := database.Untag(ids[2], "deploy"); err != nil {
+		t.Fatalf("Untag() unexpected error = %v", err)
+	}
+	if got, want := tagged("deploy"), []int64{ids[1]}; !slices.Equal(got, want) {
+		t.Errorf("Records tagged deploy after untagging kubectl = %v, want %v", got, want)
+	}
+	if err := database.Untag(ids[3], "deploy"); err == nil {
+		t.Error("Untag() of an untagged record succeeded")
+	}
+
+	// Tags other than the keep tags go with their records, which the keep
+	// tags exempt from pruning
+	if err := database.Tag(ids[0], "keep"); err != nil {
+		t.Fatalf("Tag() unexpected error = %v", err)
+	}
+	database.SetKeepTags([]string{"keep"})
+	if _, err := database.Prune(now.Add(-2*time.Minute - time.Second)); err != nil {
+		t.Fatalf("Prune() unexpected error = %v", err)
+	}
+	if got := tagged("build"); len(got) != 0 {
+		t.Errorf("Records tagged build after pruning them = %v, want none", got)
+	}
+	if got, want := tagged("keep"), []int64{ids[0]}; !slices.Equal(got, want) {
+		t.Errorf("Records tagged keep after pruning = %v, want %v kept", got, want)
+	}
+
+	for _, tag := range []string{"", "two words"} {
+		if err := database.Tag(ids[3], tag); err == nil {
+			t.Errorf("Tag(%q) succeeded", tag)
+		}
+	}
+	if err := database.Tag(1000, "deploy"); err == nil {
+		t.Error("Tag() of a missing record succeeded")
+	}
+}
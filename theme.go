@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Theme sets the picker's colours, from the [theme] section of the config
+// file. Colours are ANSI colour numbers, 0 to 255, or hex codes such as
+// #ff5f87. Those left empty come from the preset.
+type Theme struct {
+	// Preset names the colours the others override, empty for the default
+	Preset string `toml:"preset"`
+	// Selected colours the highlighted record and the labels of the preview
+	Selected string `toml:"selected"`
+	// Normal colours the other records and the preview
+	Normal string `toml:"normal"`
+	// Failed colours the records of commands which failed
+	Failed string `toml:"failed"`
+	// Filter colours the filter text and the prompts
+	Filter string `toml:"filter"`
+	// NoColor shows everything in the terminal's own colours, as does
+	// setting NO_COLOR in the environment
+	NoColor bool `toml:"no_color"`
+}
+
+// themePresets holds the colours of each preset
+var themePresets = map[string]Theme{
+	"default": {Selected: "205", Normal: "252", Failed: "167", Filter: "205"},
+	"light":   {Selected: "162", Normal: "236", Failed: "160", Filter: "162"},
+	"ocean":   {Selected: "39", Normal: "252", Failed: "209", Filter: "45"},
+	"mono":    {Selected: "255", Normal: "250", Failed: "244", Filter: "255"},
+}
+
+// colourPattern matches the colours a theme may give
+var colourPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{6}|#[0-9a-fA-F]{3}|25[0-5]|2[0-4][0-9]|1[0-9][0-9]|[1-9]?[0-9])$`)
+
+// Validate reports an unknown preset or a colour which is not a colour
+// number or hex code
+func (t Theme) Validate() error {
+	if _, ok := themePresets[t.preset()]; !ok {
+		return fmt.Errorf("unknown preset %q, available: %s", t.Preset, strings.Join(presetNames(), ", "))
+	}
+	for _, colour := range []struct{ name, value string }{
+		{"selected", t.Selected},
+		{"normal", t.Normal},
+		{"failed", t.Failed},
+		{"filter", t.Filter},
+	} {
+		if colour.value != "" && !colourPattern.MatchString(colour.value) {
+			return fmt.Errorf("invalid %s colour %q, give a number from 0 to 255 or a hex code", colour.name, colour.value)
+		}
+	}
+	return nil
+}
+
+// preset returns the name of the preset the theme starts from
+func (t Theme) preset() string {
+	if t.Preset == "" {
+		return "default"
+	}
+	return t.Preset
+}
+
+// Resolved returns the theme with the colours it leaves empty taken from its
+// preset
+func (t Theme) Resolved() Theme {
+	preset := themePresets[t.preset()]
+	resolved := t
+	for _, colour := range []struct {
+		value    *string
+		fallback string
+	}{
+		{&resolved.Selected, preset.Selected},
+		{&resolved.Normal, preset.Normal},
+		{&resolved.Failed, preset.Failed},
+		{&resolved.Filter, preset.Filter},
+	} {
+		if *colour.value == "" {
+			*colour.value = colour.fallback
+		}
+	}
+	return resolved
+}
+
+// presetNames returns the names of the presets, in order
+func presetNames() []string {
+	var names []string
+	for name := range themePresets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// styles are the lipgloss styles the picker renders with
+type styles struct {
+	input    lipgloss.Style // The filter input and the prompts
+	header   lipgloss.Style // The bar atop the list showing the search
+	selected lipgloss.Style // The highlighted record
+	normal   lipgloss.Style // The other records
+	failed   lipgloss.Style // The other records of commands which failed
+	preview  lipgloss.Style // The preview pane, separated from the list by a rule
+	label    lipgloss.Style // The field labels in the preview pane
+	context  lipgloss.Style // Neighbouring commands in the preview timeline
+	warning  lipgloss.Style // The confirmation asked before emitting a dangerous command
+}
+
+// newStyles builds the picker's styles in the colours of theme
+func newStyles(theme Theme) styles {
+	theme = theme.Resolved()
+	colour := func(c string) lipgloss.Style {
+		if theme.NoColor {
+			return lipgloss.NewStyle()
+		}
+		return lipgloss.NewStyle().Foreground(lipgloss.Color(c))
+	}
+	return styles{
+		input:    colour(theme.Filter),
+		header:   colour(theme.Normal).Reverse(true),
+		selected: colour(theme.Selected).Bold(true),
+		normal:   colour(theme.Normal),
+		failed:   colour(theme.Failed),
+		preview:  colour(theme.Normal).BorderStyle(lipgloss.NormalBorder()).BorderTop(true),
+		label:    colour(theme.Selected),
+		context:  colour("244"),
+		warning:  colour("196").Bold(true),
+	}
+}
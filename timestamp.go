@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimestampFormat describes how the timestamps in a history file are written.
+// The zero value reads Unix times in seconds, as the shells write them.
+type TimestampFormat struct {
+	// Layout is a Go reference time layout, e.g. "2006-01-02 15:04:05".
+	// Empty means Unix time in seconds.
+	Layout string
+
+	// Location is the time zone assumed for timestamps which do not give
+	// one, nil for the local time zone
+	Location *time.Location
+}
+
+// NewTimestampFormat creates a format from the import options. The layout
+// may be "unix", a strftime format such as "%Y-%m-%d %H:%M:%S", as used in
+// HISTTIMEFORMAT, or a Go reference time layout. The zone is an IANA time
+// zone name, such as "Europe/Paris", "UTC" or "Local"; empty means local.
+func NewTimestampFormat(layout, zone string) (TimestampFormat, error) {
+	var format TimestampFormat
+
+	switch {
+	case layout == "" || layout == "unix":
+	case strings.Contains(layout, "%"):
+		converted, err := strftimeLayout(layout)
+		if err != nil {
+			return TimestampFormat{}, err
+		}
+		format.Layout = converted
+	default:
+		format.Layout = layout
+	}
+
+	if zone != "" {
+		location, err := time.LoadLocation(zone)
+		if err != nil {
+			return TimestampFormat{}, fmt.Errorf("unknown time zone %q: %w", zone, err)
+		}
+		format.Location = location
+	}
+
+	return format, nil
+}
+
+// Parse reads a timestamp written in the format
+func (f TimestampFormat) Parse(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if f.Layout == "" {
+		seconds, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if seconds < 0 {
+			return time.Time{}, fmt.Errorf("negative unix time: %d", seconds)
+		}
+		return time.Unix(seconds, 0), nil
+	}
+
+	location := f.Location
+	if location == nil {
+		location = time.Local
+	}
+	return time.ParseInLocation(f.Layout, s, location)
+}
+
+// strftimeDirectives maps the strftime conversions understood to the
+// equivalent Go layout elements
+var strftimeDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'p': "PM",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'j': "002",
+	'z': "-0700",
+	'Z': "MST",
+	'F': "2006-01-02",
+	'T': "15:04:05",
+	'D': "01/02/06",
+	'R': "15:04",
+	'%': "%",
+}
+
+// strftimeLayout converts a strftime format to a Go reference time layout
+func strftimeLayout(format string) (string, error) {
+	var layout strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			layout.WriteByte(format[i])
+			continue
+		}
+		if i+1 == len(format) {
+			return "", fmt.Errorf("timestamp format %q ends with a lone %%", format)
+		}
+		i++
+		element, ok := strftimeDirectives[format[i]]
+		if !ok {
+			return "", fmt.Errorf("unsupported conversion %%%c in timestamp format %q", format[i], format)
+		}
+		layout.WriteString(element)
+	}
+	return layout.String(), nil
+}
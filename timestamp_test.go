@@ -0,0 +1,137 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestTimestampFormat(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skipf("Time zone database unavailable: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		layout string
+		zone   string
+		input  string
+		want   time.Time
+	}{
+		{name: "Unix", layout: "unix", input: "1700000000", want: time.Unix(1700000000, 0)},
+		{name: "Default is unix", input: "1700000000", want: time.Unix(1700000000, 0)},
+		{
+			name:   "Strftime",
+			layout: "%Y-%m-%d %H:%M:%S",
+			zone:   "UTC",
+			input:  "2024-03-05 14:22:01",
+			want:   time.Date(2024, 3, 5, 14, 22, 1, 0, time.UTC),
+		},
+		{
+			name:   "Strftime shorthands",
+			layout: "%F %T",
+			zone:   "Europe/Paris",
+			input:  "2024-03-05 14:22:01",
+			want:   time.Date(2024, 3, 5, 14, 22, 1, 0, paris),
+		},
+		{
+			name:   "Day first",
+			layout: "%d/%m/%Y %H:%M",
+			zone:   "UTC",
+			input:  "05/03/2024 14:22",
+			want:   time.Date(2024, 3, 5, 14, 22, 0, 0, time.UTC),
+		},
+		{
+			name:   "Go layout",
+			layout: "Jan 2 2006 15:04",
+			zone:   "UTC",
+			input:  "Mar 5 2024 14:22",
+			want:   time.Date(2024, 3, 5, 14, 22, 0, 0, time.UTC),
+		},
+		{
+			name:   "Zone in timestamp wins",
+			layout: "%Y-%m-%dT%H:%M:%S%z",
+			zone:   "Europe/Paris",
+			input:  "2024-03-05T14:22:01+0000",
+			want:   time.Date(2024, 3, 5, 14, 22, 1, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := rt.NewTimestampFormat(tt.layout, tt.zone)
+			if err != nil {
+				t.Fatalf("NewTimestampFormat() unexpected error = %v", err)
+			}
+			got, err := format.Parse(tt.input)
+			if err != nil {
+				t.Fatalf("Parse() unexpected error = %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadTimestampFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		zone    string
+		wantErr string
+	}{
+		{name: "Unsupported conversion", layout: "%Y %Q", wantErr: "unsupported conversion %Q"},
+		{name: "Trailing percent", layout: "%Y %", wantErr: "ends with a lone %"},
+		{name: "Unknown zone", zone: "Mars/Olympus_Mons", wantErr: "unknown time zone"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := rt.NewTimestampFormat(tt.layout, tt.zone)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewTimestampFormat() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseWithTimestampFormat(t *testing.T) {
+	format, err := rt.NewTimestampFormat("%Y-%m-%d %H:%M:%S", "UTC")
+	if err != nil {
+		t.Fatalf("NewTimestampFormat() unexpected error = %v", err)
+	}
+	options := rt.ParseOptions{Fallback: time.Unix(0, 0), Timestamps: format}
+	want := time.Date(2024, 3, 5, 14, 22, 1, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		parse   rt.HistoryParser
+		history string
+	}{
+		{name: "Bash", parse: rt.ParseBashHistory, history: "#2024-03-05 14:22:01\ngit status\n"},
+		{name: "Zsh", parse: rt.ParseZshHistory, history: ": 2024-03-05 14:22:01:3;git status\n"},
+		{name: "Fish", parse: rt.ParseFishHistory, history: "- cmd: git status\n  when: 2024-03-05 14:22:01\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := tt.parse(strings.NewReader(tt.history), options)
+			if err != nil {
+				t.Fatalf("Parse unexpected error = %v", err)
+			}
+			if len(records) != 1 {
+				t.Fatalf("Got %d records %v, want 1", len(records), records)
+			}
+			if records[0].CommandLine() != "git status" {
+				t.Errorf("Command = %q, want %q", records[0].CommandLine(), "git status")
+			}
+			if !records[0].Timestamp.Equal(want) {
+				t.Errorf("Timestamp = %v, want %v", records[0].Timestamp, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Tokenize splits a command line into words the way a POSIX shell would for
+// simple commands: whitespace separates words, single quotes preserve text
+// literally, double quotes allow backslash escapes and a backslash outside
+// quotes escapes the next character. Unterminated quotes run to the end of
+// the input rather than being treated as an error, since recorded history
+// often contains half-typed commands.
+func Tokenize(line string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		case r == '\'':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '\''; i++ {
+				word.WriteRune(runes[i])
+			}
+
+		case r == '"':
+			inWord = true
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune(`"\$`+"`", runes[i+1]) {
+					i++
+				}
+				word.WriteRune(runes[i])
+			}
+
+		case r == '\\':
+			if i+1 < len(runes) {
+				inWord = true
+				i++
+				word.WriteRune(runes[i])
+			}
+
+		default:
+			inWord = true
+			word.WriteRune(r)
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
@@ -0,0 +1,39 @@
+package main_test
+
+import (
+	"testing"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{name: "Empty", line: "", want: nil},
+		{name: "Plain words", line: "get pods  -n kube-system", want: []string{"get", "pods", "-n", "kube-system"}},
+		{name: "Single quotes", line: `commit -m 'fix the "thing"'`, want: []string{"commit", "-m", `fix the "thing"`}},
+		{name: "Double quotes with escapes", line: `echo "a \"b\" \$c \d"`, want: []string{"echo", `a "b" $c \d`}},
+		{name: "Backslash escape", line: `ls my\ file`, want: []string{"ls", "my file"}},
+		{name: "Adjacent quotes join", line: `--name='a'"b"c`, want: []string{"--name=abc"}},
+		{name: "Empty quotes", line: `printf ''`, want: []string{"printf", ""}},
+		{name: "Unterminated quote", line: `echo "unfinished business`, want: []string{"echo", "unfinished business"}},
+		{name: "Trailing backslash", line: `echo \`, want: []string{"echo"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rt.Tokenize(tt.line)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Tokenize(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("Tokenize(%q)[%d] = %q, want %q", tt.line, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
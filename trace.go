@@ -0,0 +1,109 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Tracer records how long the stages of a run take, so that latency in the
+// path from Ctrl-R to the picker appearing can be measured. Spans are
+// reported in the order they began, so nested spans follow their parent.
+type Tracer struct {
+	start time.Time
+
+	mu    sync.Mutex
+	spans []Span
+	seen  map[string]bool
+}
+
+// Span is a stage of a run, timed from the start of the run
+type Span struct {
+	Name     string
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// tracer traces the current run, nil unless --trace was given
+var tracer *Tracer
+
+// NewTracer returns a tracer for a run which started at start
+func NewTracer(start time.Time) *Tracer {
+	return &Tracer{start: start, seen: map[string]bool{}}
+}
+
+// Span begins a span named name, returning the function which ends it. A nil
+// tracer records nothing.
+func (t *Tracer) Span(name string) func() {
+	if t == nil {
+		return func() {}
+	}
+	begin := time.Now()
+	return func() { t.Record(name, begin) }
+}
+
+// Record records a span named name which began at begin and ends now
+func (t *Tracer) Record(name string, begin time.Time) {
+	if t == nil {
+		return
+	}
+	end := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seen[name] = true
+	t.spans = append(t.spans, Span{
+		Name:     name,
+		Start:    begin.Sub(t.start),
+		Duration: end.Sub(begin),
+	})
+}
+
+// First records a span named name from the start of the run to now, unless
+// one was recorded already, to time the first of repeated events such as
+// renders.
+func (t *Tracer) First(name string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	seen := t.seen[name]
+	t.mu.Unlock()
+	if !seen {
+		t.Record(name, t.start)
+	}
+}
+
+// Spans returns the spans recorded, in the order they began
+func (t *Tracer) Spans() []Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := make([]Span, len(t.spans))
+	copy(spans, t.spans)
+	// Spans are recorded as they end, so a parent follows its children
+	slices.SortStableFunc(spans, func(a, b Span) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+	return spans
+}
+
+// Report writes the spans recorded to w with their offset and duration
+func (t *Tracer) Report(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "span\tstart\tduration\n")
+	for _, span := range t.Spans() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", span.Name, formatTraceDuration(span.Start), formatTraceDuration(span.Duration))
+	}
+	fmt.Fprintf(tw, "total\t\t%s\n", formatTraceDuration(time.Since(t.start)))
+	return tw.Flush()
+}
+
+// formatTraceDuration formats d in milliseconds, precise enough to compare runs
+func formatTraceDuration(d time.Duration) string {
+	return fmt.Sprintf("%.2fms", float64(d)/float64(time.Millisecond))
+}
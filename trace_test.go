@@ -0,0 +1,49 @@
+package main_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestTracer(t *testing.T) {
+	tracer := rt.NewTracer(time.Now())
+
+	endOpen := tracer.Span("db open")
+	tracer.Span("schema check")()
+	endOpen()
+	tracer.First("first render")
+	tracer.First("first render")
+
+	spans := tracer.Spans()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	if got := strings.Join(names, ", "); got != "first render, db open, schema check" {
+		t.Fatalf("Spans() = %s, want each span once in the order begun", got)
+	}
+	if spans[0].Start != 0 {
+		t.Errorf("First() span starts at %v, want the start of the run", spans[0].Start)
+	}
+	if spans[1].Duration < spans[2].Duration {
+		t.Errorf("Span %+v is shorter than the span %+v within it", spans[1], spans[2])
+	}
+
+	var report strings.Builder
+	if err := tracer.Report(&report); err != nil {
+		t.Fatalf("Report() unexpected error = %v", err)
+	}
+	for _, want := range []string{"schema check", "first render", "total", "ms"} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("Report() = %q, want it to contain %q", report.String(), want)
+		}
+	}
+
+	// Tracing is off without a tracer
+	var off *rt.Tracer
+	off.Span("db open")()
+	off.First("first render")
+}
@@ -4,35 +4,212 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 )
 
-// Style definitions
-var (
-	// Style for the filter input at the bottom
-	inputStyle = lipgloss.NewStyle().
-			Foreground(lipgloss.Color("205"))
+// ContextLoader fetches the commands run before and after a record in its
+// session, for the timeline in the preview pane.
+type ContextLoader func(Record) (before []Record, after []Record, err error)
 
-	// Style for selected items
-	selectedStyle = lipgloss.NewStyle().
-			Foreground(lipgloss.Color("205")).
-			Bold(true)
+// FingerprintLoader fetches the fingerprint of the environment a session ran
+// in, for the preview pane.
+type FingerprintLoader func(session string) (Fingerprint, error)
 
-	// Style for normal items
-	normalStyle = lipgloss.NewStyle().
-			Foreground(lipgloss.Color("252"))
-)
+// sessionContext holds the commands surrounding a record and the environment
+// they ran in
+type sessionContext struct {
+	before      []Record
+	after       []Record
+	fingerprint Fingerprint
+}
+
+// PageLoader fetches up to limit records following after in the order the
+// picker shows them, so the history is loaded as it is scrolled rather than
+// all at once. after may since have been deleted.
+type PageLoader func(after *Record, limit int) ([]Record, error)
+
+// pageLoadedMsg delivers the next page of records
+type pageLoadedMsg struct {
+	records []Record
+	err     error
+}
+
+// HistorySearcher fetches up to limit of the records matching filter text,
+// in the match mode given, from the whole history, most recent first, so that
+// matches can be found beyond the records loaded.
+type HistorySearcher func(filterText string, mode MatchMode, limit int) ([]Record, error)
+
+// historySearchDueMsg asks for the whole history to be searched for the text
+// typed, if no more has been typed since the one with the same sequence
+// number
+type historySearchDueMsg struct {
+	seq int
+}
+
+// historySearchedMsg delivers the matches for text found in the whole history
+type historySearchedMsg struct {
+	text    string
+	mode    MatchMode
+	records []Record
+	err     error
+}
+
+// filterDueMsg asks for the records to be filtered by the text typed, if no
+// more has been typed since the one with the same sequence number
+type filterDueMsg struct {
+	seq int
+}
+
+// contextLoadedMsg delivers the result of loading a record's context
+type contextLoadedMsg struct {
+	id      int64
+	context sessionContext
+	err     error
+}
+
+// historyChangedMsg delivers an event published about the history while
+// the picker runs
+type historyChangedMsg struct {
+	event Event
+}
+
+// dangerCheckedMsg delivers the warning about the selection, if any
+type dangerCheckedMsg struct {
+	warning string
+	err     error
+}
+
+// SearchStore saves the picker's searches and runs those saved before.
+type SearchStore interface {
+	SaveSearch(name string, search Search) error
+	SavedSearches() ([]SavedSearch, error)
+	Search(search Search) ([]Record, error)
+}
+
+// searchSavedMsg reports the outcome of saving the search
+type searchSavedMsg struct {
+	name string
+	err  error
+}
+
+// savedSearchesMsg delivers the saved searches to choose from
+type savedSearchesMsg struct {
+	searches []SavedSearch
+	err      error
+}
+
+// searchLoadedMsg delivers the records of the saved search chosen
+type searchLoadedMsg struct {
+	saved   SavedSearch
+	records []Record
+	err     error
+}
+
+// searchChangedMsg delivers the records of the search changed to in place
+type searchChangedMsg struct {
+	search  Search
+	records []Record
+	err     error
+}
+
+// copiedMsg reports the outcome of copying a command to the clipboard
+type copiedMsg struct {
+	line string
+	err  error
+}
+
+// Starrer stars or unstars the record with the given ID in the history.
+type Starrer func(id int64, starred bool) error
+
+// starredMsg reports the outcome of starring or unstarring a record
+type starredMsg struct {
+	record  Record
+	starred bool
+	err     error
+}
+
+// Ignorer deletes the commands matching an exclusion pattern from the
+// history and excludes them from then on, returning how many were deleted.
+type Ignorer func(pattern string) (int, error)
+
+// ignoredMsg reports the outcome of ignoring the commands matching a pattern
+type ignoredMsg struct {
+	pattern string
+	deleted int
+	err     error
+}
+
+// Tagger tags the record with the given ID in the history.
+type Tagger func(id int64, tag string) error
+
+// taggedMsg reports the outcome of tagging a record
+type taggedMsg struct {
+	record Record
+	tag    string
+	err    error
+}
 
 // Model represents the UI state and data
 type Model struct {
-	filter     *Filter // Filter for records
-	cursor     int     // Current selection in the list
-	textCursor int     // Current cursor position in filter input
-	selected   bool    // Whether a selection has been made
-	height     int     // Terminal height
+	filter     *Filter  // Filter for records
+	cursor     int      // Current selection in the list
+	textCursor int      // Current cursor position in filter input
+	selected   bool     // Whether a selection has been made
+	marked     []Record // Records marked for multi-select, in marking order
+	preview    bool     // Whether the preview pane is shown
+	height     int      // Terminal height
+	width      int      // Terminal width
+	columns    Columns  // Columns shown for each record, empty for the command line
+	absolute   bool     // Whether timestamps are shown exactly rather than relative
+	scroll     int      // Cells the highlighted record's last column is scrolled left by
+	filterSeq  int      // Counts the changes to the filter text awaiting filtering
+	readOnly   bool     // Whether actions which would change the history are refused
+	keys       Keymap   // Keys bound to the actions
+	styles     styles   // Styles rendered with, in the colours of the theme
+
+	loadContext ContextLoader             // Fetches session context, nil if unavailable
+	contexts    map[int64]*sessionContext // Loaded contexts by record ID, nil while loading
+
+	loadFingerprint FingerprintLoader // Fetches session fingerprints, nil if unavailable
+
+	events <-chan Event // Changes to the history while the picker runs, nil if not followed
+
+	loadPage  PageLoader // Fetches further records, nil once all are loaded
+	pageLimit int        // Records fetched at a time
+	pageAfter *Record    // Last record of the pages loaded
+	loading   bool       // Whether a page is being fetched
+
+	searchHistory HistorySearcher // Searches the history not yet loaded, nil if unavailable
+	searchSeq     int             // Counts the changes to the filter text awaiting a search
+
+	clipboard Clipboard // Copies commands to the clipboard, nil if unavailable
+	star      Starrer   // Stars and unstars commands, nil if unavailable
+
+	tagger  Tagger  // Tags commands, nil if unavailable
+	tagging *Record // Record a tag is being typed for, nil if none
+	tagName []rune  // Tag typed
+
+	ignorer  Ignorer // Ignores commands, nil if unavailable
+	ignoring string  // Pattern awaiting confirmation to be ignored, empty if none
+
+	checkDanger DangerCheck // Warns about dangerous selections, nil if unavailable
+	warning     string      // Warning awaiting confirmation, empty if none
+
+	searches    SearchStore   // Saves and runs searches, nil if unavailable
+	search      Search        // Search the records were loaded with, without filter text
+	saving      bool          // Whether a name to save the search as is being typed
+	saveName    []rune        // Name typed to save the search as
+	saved       []SavedSearch // Saved searches to choose from, nil unless choosing
+	savedCursor int           // Current selection in the saved searches
+	status      string        // Outcome of the last action, cleared by the next key
 }
 
 // Records returns all records (for testing)
@@ -45,81 +222,339 @@ func (m Model) Cursor() int {
 	return m.cursor
 }
 
-// New creates a new UI model with the given filter
+// Preview returns whether the preview pane is shown (for testing)
+func (m Model) Preview() bool {
+	return m.preview
+}
+
+// New creates a new UI model with the given filter. The text cursor starts
+// at the end of any filter text already present.
 func NewUI(filter *Filter) Model {
+	filter.DeferUpdates(filter.Len() > deferFilterAbove)
 	return Model{
 		filter:     filter,
 		cursor:     0,
-		textCursor: 0,
+		textCursor: filter.FilterLength(),
+		keys:       DefaultKeymap(),
+		styles:     newStyles(Theme{}),
 	}
 }
 
+// WithTheme returns a copy of the model which renders in the colours of
+// theme.
+func (m Model) WithTheme(theme Theme) Model {
+	m.styles = newStyles(theme)
+	return m
+}
+
+// WithKeys returns a copy of the model which binds its actions to the keys
+// of keymap rather than the usual ones.
+func (m Model) WithKeys(keymap Keymap) Model {
+	m.keys = keymap
+	return m
+}
+
+// WithContext returns a copy of the model which uses loader to show the
+// surrounding session commands in the preview pane.
+func (m Model) WithContext(loader ContextLoader) Model {
+	m.loadContext = loader
+	m.contexts = map[int64]*sessionContext{}
+	return m
+}
+
+// WithEvents returns a copy of the model which follows the changes made to
+// the history while it runs, loading the session context shown in the
+// preview again once records are inserted or deleted.
+func (m Model) WithEvents(events <-chan Event) Model {
+	m.events = events
+	return m
+}
+
+// WithFingerprints returns a copy of the model which uses loader to show the
+// environment each record's session ran in, along with its context.
+func (m Model) WithFingerprints(loader FingerprintLoader) Model {
+	m.loadFingerprint = loader
+	return m
+}
+
+// WithPaging returns a copy of the model which uses loader to fetch limit
+// more records at a time once the end of those loaded comes into view. Fewer
+// records than limit means there are no more.
+func (m Model) WithPaging(loader PageLoader, limit int) Model {
+	if limit > 0 && m.filter.Len() >= limit {
+		m.loadPage = loader
+		m.pageLimit = limit
+		last := m.filter.records[m.filter.Len()-1]
+		m.pageAfter = &last
+	}
+	return m
+}
+
+// WithHistorySearch returns a copy of the model which, while only some pages
+// of the history are loaded, uses searcher to look for matches for the
+// filter text in the rest of it once typing pauses, adding those found.
+func (m Model) WithHistorySearch(searcher HistorySearcher) Model {
+	m.searchHistory = searcher
+	return m
+}
+
+// WithColumns returns a copy of the model which shows the columns of each
+// record in the list rather than its command line.
+func (m Model) WithColumns(columns Columns) Model {
+	m.columns = columns
+	return m
+}
+
+// WithAbsoluteTime returns a copy of the model which shows exact timestamps
+// rather than how long ago commands ran, until Ctrl-T toggles them.
+func (m Model) WithAbsoluteTime(absolute bool) Model {
+	m.absolute = absolute
+	return m
+}
+
+// WithDangerCheck returns a copy of the model which asks for confirmation
+// before emitting a selection check warns about.
+func (m Model) WithDangerCheck(check DangerCheck) Model {
+	m.checkDanger = check
+	return m
+}
+
+// WithClipboard returns a copy of the model which copies the highlighted
+// command to clipboard on Ctrl-Y, without leaving the picker.
+func (m Model) WithClipboard(clipboard Clipboard) Model {
+	m.clipboard = clipboard
+	return m
+}
+
+// WithStars returns a copy of the model which stars the highlighted command
+// with star on Alt-S, or unstars it if it is starred.
+func (m Model) WithStars(star Starrer) Model {
+	m.star = star
+	return m
+}
+
+// WithTags returns a copy of the model which, on Alt-G, asks for a tag and
+// tags the highlighted command with it using tagger.
+func (m Model) WithTags(tagger Tagger) Model {
+	m.tagger = tagger
+	return m
+}
+
+// WithIgnore returns a copy of the model which, on Alt-I, asks whether to
+// ignore the highlighted command line and, once confirmed, has ignorer
+// delete it from the history and exclude it from then on.
+func (m Model) WithIgnore(ignorer Ignorer) Model {
+	m.ignorer = ignorer
+	return m
+}
+
+// WithReadOnly returns a copy of the model which, when readOnly is set,
+// refuses the actions which would change the history, such as saving the
+// search, saying why instead.
+func (m Model) WithReadOnly(readOnly bool) Model {
+	m.readOnly = readOnly
+	return m
+}
+
+// WithSearch returns a copy of the model which shows, in the bar atop the
+// list, the time range, result filter and scope of the search the records
+// were loaded with.
+func (m Model) WithSearch(search Search) Model {
+	m.search = search
+	m.search.Filter = ""
+	m.search.Match = ""
+	return m
+}
+
+// WithSearches returns a copy of the model which saves the current search,
+// search with the filter text typed, to store on Ctrl-S and offers the
+// searches saved there on Ctrl-O.
+func (m Model) WithSearches(store SearchStore, search Search) Model {
+	m.searches = store
+	m.search = search
+	m.search.Filter = ""
+	m.search.Match = ""
+	return m
+}
+
+// Status returns the outcome of the last action, if any (for testing)
+func (m Model) Status() string {
+	return m.status
+}
+
+// Warning returns the warning awaiting confirmation, if any (for testing)
+func (m Model) Warning() string {
+	return m.warning
+}
+
 // Init initializes the model
 func (m Model) Init() tea.Cmd {
-	return nil
+	return m.waitForEvent()
 }
 
 // Update handles input and updates the model
-// findWordStart finds the start of the word before the given position
+// findWordStart finds the start of the word before the given rune position
 func findWordStart(text string, pos int) int {
+	runes := []rune(text)
 	// Skip spaces immediately before pos
-	for pos > 0 && pos-1 < len(text) && text[pos-1] == ' ' {
+	for pos > 0 && pos-1 < len(runes) && runes[pos-1] == ' ' {
 		pos--
 	}
 	// Find start of word
-	for pos > 0 && pos-1 < len(text) && text[pos-1] != ' ' {
+	for pos > 0 && pos-1 < len(runes) && runes[pos-1] != ' ' {
 		pos--
 	}
 	return pos
 }
 
 func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if key, ok := msg.(tea.KeyMsg); ok {
+		m.status = ""
+		if key.Type != tea.KeyShiftLeft && key.Type != tea.KeyShiftRight {
+			m.scroll = 0
+		}
+		switch {
+		case m.warning != "":
+			return m.confirm(key)
+		case m.ignoring != "":
+			return m.confirmIgnore(key)
+		case m.saving:
+			return m.nameSearch(key)
+		case m.tagging != nil:
+			return m.nameTag(key)
+		case m.saved != nil:
+			return m.chooseSearch(key)
+		}
+	}
+
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
-		switch msg.Type {
-		case tea.KeyCtrlC:
+		typed, mode := m.filter.Filter(), m.filter.MatchMode()
+		switch action := m.keys.action(msg); {
+		case action == QuitAction:
 			return m, tea.Quit
 
-		case tea.KeyUp, tea.KeyCtrlP:
-			if m.cursor > 0 {
-				m.cursor--
-			}
+		case action == UpAction:
+			m.moveCursor(-1)
 
-		case tea.KeyDown, tea.KeyCtrlN:
-			if m.cursor < len(m.filter.FilteredRecords())-1 {
-				m.cursor++
-			}
+		case action == DownAction:
+			m.moveCursor(1)
 
-		case tea.KeyEnter:
+		case action == SelectAction:
+			// Whatever has been typed counts, even if it is yet to be filtered
+			m.filter.Refresh()
+			if m.checkDanger != nil {
+				return m, m.requestDangerCheck()
+			}
 			m.selected = true
 			return m, tea.Quit
 
-		case tea.KeyBackspace:
-			if len(m.filter.Filter()) > 0 && m.textCursor > 0 {
+		case action == PreviewAction:
+			m.preview = !m.preview
+
+		case action == CopyAction:
+			if record, ok := m.current(); ok && m.clipboard != nil {
+				return m, m.requestCopy(record)
+			}
+
+		case action == StarAction:
+			if m.readOnly {
+				m.status = tr("The history is read-only")
+			} else if record, ok := m.current(); ok && m.star != nil {
+				return m, m.requestStar(record)
+			}
+
+		case action == TagAction:
+			if m.readOnly {
+				m.status = tr("The history is read-only")
+			} else if record, ok := m.current(); ok && m.tagger != nil {
+				m.tagging = &record
+				m.tagName = nil
+			}
+
+		case action == IgnoreAction:
+			if m.readOnly {
+				m.status = tr("The history is read-only")
+			} else if record, ok := m.current(); ok && m.ignorer != nil {
+				m.ignoring = IgnorePattern(record.CommandLine())
+			}
+
+		case action == MatchAction:
+			m.filter.SetMatchMode(m.filter.MatchMode().Next())
+			m.moveCursor(0)
+
+		case action == ResultAction, action == TimeRangeAction, action == ScopeAction:
+			if m.searches != nil {
+				cmd := m.changeSearch(action)
+				return m, cmd
+			}
+
+		case action == DeleteAction:
+			if m.filter.FilterLength() > 0 && m.textCursor > 0 {
 				// Remove the character before the cursor
 				m.filter.RemoveCharBeforeCursor(m.textCursor)
 				m.textCursor--
 			}
 
-		case tea.KeyLeft:
+		case msg.Type == tea.KeyPgUp:
+			m.moveCursor(-m.pageSize())
+
+		case msg.Type == tea.KeyPgDown:
+			m.moveCursor(m.pageSize())
+
+		case msg.Type == tea.KeyHome:
+			m.cursor = 0
+
+		case msg.Type == tea.KeyEnd:
+			m.moveCursor(len(m.filter.FilteredRecords()))
+
+		case msg.Type == tea.KeyCtrlT:
+			m.absolute = !m.absolute
+
+		case msg.Type == tea.KeyCtrlS:
+			if m.readOnly {
+				m.status = tr("The history is read-only")
+			} else if m.searches != nil {
+				m.saving = true
+				m.saveName = nil
+			}
+
+		case msg.Type == tea.KeyCtrlO:
+			if m.searches != nil {
+				return m, m.requestSavedSearches()
+			}
+
+		case msg.Type == tea.KeyCtrlAt:
+			// Ctrl-Space toggles the mark on the highlighted record
+			if record, ok := m.current(); ok {
+				m.marked = toggleMark(m.marked, record)
+			}
+
+		case msg.Type == tea.KeyLeft:
 			if m.textCursor > 0 {
 				m.textCursor--
 			}
 
-		case tea.KeyRight:
-			if m.textCursor < len(m.filter.Filter()) {
+		case msg.Type == tea.KeyRight:
+			if m.textCursor < m.filter.FilterLength() {
 				m.textCursor++
 			}
 
-		case tea.KeyCtrlA:
+		case msg.Type == tea.KeyShiftLeft:
+			m.scroll = max(0, min(m.scroll, m.maxScroll())-scrollStep)
+
+		case msg.Type == tea.KeyShiftRight:
+			m.scroll = min(m.scroll+scrollStep, m.maxScroll())
+
+		case msg.Type == tea.KeyCtrlA:
 			// Beginning of line
 			m.textCursor = 0
 
-		case tea.KeyCtrlE:
+		case msg.Type == tea.KeyCtrlE:
 			// End of line
-			m.textCursor = len(m.filter.Filter())
+			m.textCursor = m.filter.FilterLength()
 
-		case tea.KeyCtrlW:
+		case msg.Type == tea.KeyCtrlW:
 			// Kill word backward
 			if m.textCursor > 0 {
 				newPos := findWordStart(m.filter.Filter(), m.textCursor)
@@ -127,97 +562,1077 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.textCursor = newPos
 			}
 
-		case tea.KeyCtrlK:
+		case msg.Type == tea.KeyCtrlK:
 			// Kill to end of line
-			if m.textCursor < len(m.filter.Filter()) {
+			if m.textCursor < m.filter.FilterLength() {
 				m.filter.RemoveTextAfterCursor(m.textCursor)
 			}
 
-		case tea.KeySpace:
+		case msg.Type == tea.KeySpace:
 			// Insert space at cursor position
 			m.filter.InsertCharAtCursor(' ', m.textCursor)
 			m.textCursor++
 
-		case tea.KeyRunes:
+		case msg.Type == tea.KeyRunes:
 			// Insert the characters at the cursor position
 			m.filter.InsertTextAtCursor(string(msg.Runes), m.textCursor)
 			m.textCursor += len(msg.Runes)
 		}
 
+		// Matches among the history not yet loaded are looked for once
+		// typing pauses. Changing the filter changes the filtered
+		// records, and the cursor must stay among those left
+		var search tea.Cmd
+		if m.filter.Filter() != typed || m.filter.MatchMode() != mode {
+			m.moveCursor(0)
+			search = m.searchHistoryLater()
+		}
+
+		// In a huge history, filtering waits for a pause in typing
+		if m.filter.Stale() {
+			m.filterSeq++
+			seq := m.filterSeq
+			return m, tea.Batch(tea.Tick(filterDelay, func(time.Time) tea.Msg { return filterDueMsg{seq: seq} }), search)
+		}
+		if search != nil {
+			page := m.requestPage()
+			return m, tea.Batch(m.requestContext(), page, search)
+		}
+
+	case tea.MouseMsg:
+		if msg.Action != tea.MouseActionPress {
+			break
+		}
+		switch msg.Button {
+		case tea.MouseButtonWheelUp:
+			m.scroll = 0
+			m.moveCursor(-wheelStep)
+		case tea.MouseButtonWheelDown:
+			m.scroll = 0
+			m.moveCursor(wheelStep)
+		case tea.MouseButtonWheelLeft:
+			m.scroll = max(0, min(m.scroll, m.maxScroll())-scrollStep)
+		case tea.MouseButtonWheelRight:
+			m.scroll = min(m.scroll+scrollStep, m.maxScroll())
+		}
+
 	case tea.WindowSizeMsg:
 		m.height = msg.Height
+		m.width = msg.Width
+
+	case dangerCheckedMsg:
+		switch {
+		case msg.err != nil:
+			// Ask anyway, the check failing doesn't make the command safe
+			m.warning = trf("Could not check the selection: %v", msg.err)
+		case msg.warning != "":
+			m.warning = msg.warning
+		default:
+			m.selected = true
+			return m, tea.Quit
+		}
+		return m, nil
+
+	case copiedMsg:
+		if msg.err != nil {
+			m.status = trf("Could not copy to the clipboard: %v", msg.err)
+		} else {
+			m.status = trf("Copied %q", msg.line)
+		}
+		return m, nil
+
+	case starredMsg:
+		switch {
+		case msg.err != nil:
+			m.status = trf("Could not star %q: %v", msg.record.CommandLine(), msg.err)
+		case msg.starred:
+			m.filter.SetStarred(func(r Record) bool { return r.ID == msg.record.ID }, true)
+			m.status = trf("Starred %q", msg.record.CommandLine())
+		default:
+			// Every run of the command line is unstarred
+			line := msg.record.CommandLine()
+			m.filter.SetStarred(func(r Record) bool { return r.CommandLine() == line }, false)
+			m.status = trf("Unstarred %q", line)
+		}
+		return m, nil
+
+	case ignoredMsg:
+		if msg.deleted > 0 {
+			ignored := func(r Record) bool {
+				excluded, _ := Excluded(r.CommandLine(), []string{msg.pattern})
+				return excluded
+			}
+			m.filter.Remove(ignored)
+			m.marked = slices.DeleteFunc(m.marked, ignored)
+			m.moveCursor(0)
+		}
+		if msg.err != nil {
+			m.status = trf("Could not ignore %s: %v", msg.pattern, msg.err)
+		} else {
+			m.status = trf("Ignoring %s from now on, %d records deleted", msg.pattern, msg.deleted)
+		}
+		return m, nil
+
+	case taggedMsg:
+		if msg.err != nil {
+			m.status = trf("Could not tag %q: %v", msg.record.CommandLine(), msg.err)
+		} else {
+			m.status = trf("Tagged %q with %s", msg.record.CommandLine(), msg.tag)
+		}
+		return m, nil
+
+	case searchSavedMsg:
+		if msg.err != nil {
+			m.status = trf("Could not save the search: %v", msg.err)
+		} else {
+			m.status = trf("Saved the search as %q", msg.name)
+		}
+		return m, nil
+
+	case savedSearchesMsg:
+		switch {
+		case msg.err != nil:
+			m.status = trf("Could not load the saved searches: %v", msg.err)
+		case len(msg.searches) == 0:
+			m.status = tr("No searches are saved, Ctrl-S saves this one")
+		default:
+			m.saved = msg.searches
+			m.savedCursor = 0
+		}
+		return m, nil
+
+	case searchLoadedMsg:
+		if msg.err != nil {
+			m.status = trf("Could not run search %q: %v", msg.saved.Name, msg.err)
+			return m, nil
+		}
+		m.search = msg.saved.Search
+		m.search.Filter = ""
+		m.search.Match = ""
+		m.replaceRecords(msg.records, msg.saved.Search.Filter, msg.saved.Search.Match)
+		m.textCursor = m.filter.FilterLength()
+		m.status = trf("Search %q", msg.saved.Name)
+
+	case searchChangedMsg:
+		// The records of a search since changed again are of no use
+		if msg.search != m.search {
+			return m, nil
+		}
+		if msg.err != nil {
+			m.status = trf("Could not change the search: %v", msg.err)
+			return m, nil
+		}
+		m.replaceRecords(msg.records, m.filter.Filter(), m.filter.MatchMode())
+
+	case pageLoadedMsg:
+		m.loading = false
+		if msg.err != nil {
+			m.status = trf("Could not load more history: %v", msg.err)
+			m.loadPage = nil
+			return m, nil
+		}
+		// Matches found by searching the history may be among the records
+		m.filter.Merge(msg.records)
+		if len(msg.records) > 0 {
+			last := msg.records[len(msg.records)-1]
+			m.pageAfter = &last
+		}
+		if len(msg.records) < m.pageLimit {
+			m.loadPage = nil
+		}
+
+	case historySearchDueMsg:
+		if msg.seq != m.searchSeq || m.loadPage == nil {
+			return m, nil
+		}
+		return m, m.requestHistorySearch()
+
+	case historySearchedMsg:
+		if msg.err != nil {
+			m.status = trf("Could not search the rest of the history: %v", msg.err)
+			return m, nil
+		}
+		// Matches for text since changed, or for a search since replaced,
+		// are of no use
+		if msg.text == m.filter.Filter() && msg.mode == m.filter.MatchMode() && m.loadPage != nil {
+			m.filter.Merge(msg.records)
+		}
+
+	case filterDueMsg:
+		if msg.seq != m.filterSeq {
+			return m, nil
+		}
+		m.filter.Refresh()
+		m.moveCursor(0)
+
+	case contextLoadedMsg:
+		if msg.err != nil {
+			// Leave the timeline out rather than interrupting the search
+			delete(m.contexts, msg.id)
+			return m, nil
+		}
+		m.contexts[msg.id] = &msg.context
+
+	case historyChangedMsg:
+		switch msg.event.(type) {
+		case RecordsInserted, RecordsDeleted:
+			// The sessions of the contexts loaded may have changed
+			if m.loadContext != nil {
+				m.contexts = map[int64]*sessionContext{}
+			}
+		}
+		return m, tea.Batch(m.requestContext(), m.waitForEvent())
+	}
+
+	page := m.requestPage()
+	return m, tea.Batch(m.requestContext(), page)
+}
+
+// confirm handles a key pressed while a warning awaits confirmation: y emits
+// the selection, Ctrl-C quits and anything else goes back to the list
+func (m Model) confirm(key tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch {
+	case m.keys.action(key) == QuitAction:
+		return m, tea.Quit
+	case key.Type == tea.KeyRunes && isYes(string(key.Runes)):
+		m.warning = ""
+		m.selected = true
+		return m, tea.Quit
+	default:
+		m.warning = ""
+		return m, nil
 	}
+}
+
+// confirmIgnore handles a key pressed while ignoring a command line awaits
+// confirmation: y ignores it, Ctrl-C quits and anything else goes back to
+// the list
+func (m Model) confirmIgnore(key tea.KeyMsg) (tea.Model, tea.Cmd) {
+	pattern := m.ignoring
+	m.ignoring = ""
+	switch {
+	case m.keys.action(key) == QuitAction:
+		return m, tea.Quit
+	case key.Type == tea.KeyRunes && isYes(string(key.Runes)):
+		ignorer := m.ignorer
+		return m, func() tea.Msg {
+			deleted, err := ignorer(pattern)
+			return ignoredMsg{pattern: pattern, deleted: deleted, err: err}
+		}
+	default:
+		return m, nil
+	}
+}
 
+// nameSearch handles a key pressed while the name to save the search as is
+// typed: Enter saves it, Esc goes back to the list
+func (m Model) nameSearch(key tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch key.Type {
+	case tea.KeyCtrlC:
+		return m, tea.Quit
+	case tea.KeyEsc:
+		m.saving = false
+	case tea.KeyEnter:
+		m.saving = false
+		return m, m.requestSave(strings.TrimSpace(string(m.saveName)))
+	default:
+		m.saveName = typeName(m.saveName, key)
+	}
+	return m, nil
+}
+
+// nameTag handles a key pressed while the tag for the highlighted record is
+// typed: Enter tags the record with it, Esc goes back to the list
+func (m Model) nameTag(key tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch key.Type {
+	case tea.KeyCtrlC:
+		return m, tea.Quit
+	case tea.KeyEsc:
+		m.tagging = nil
+	case tea.KeyEnter:
+		record, tag := *m.tagging, string(m.tagName)
+		m.tagging = nil
+		return m, m.requestTag(record, tag)
+	default:
+		m.tagName = typeName(m.tagName, key)
+	}
 	return m, nil
 }
 
+// typeName returns name edited by a key pressed while it is typed:
+// Backspace deletes the last character and others are typed
+func typeName(name []rune, key tea.KeyMsg) []rune {
+	switch key.Type {
+	case tea.KeyBackspace:
+		if len(name) > 0 {
+			return name[:len(name)-1]
+		}
+	case tea.KeySpace:
+		return append(name, ' ')
+	case tea.KeyRunes:
+		return append(name, key.Runes...)
+	}
+	return name
+}
+
+// chooseSearch handles a key pressed while the saved searches are offered:
+// Enter runs the selected one, Esc goes back to the list
+func (m Model) chooseSearch(key tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch action := m.keys.action(key); {
+	case action == QuitAction:
+		return m, tea.Quit
+	case key.Type == tea.KeyEsc:
+		m.saved = nil
+	case action == UpAction:
+		if m.savedCursor > 0 {
+			m.savedCursor--
+		}
+	case action == DownAction:
+		if m.savedCursor < len(m.saved)-1 {
+			m.savedCursor++
+		}
+	case action == SelectAction:
+		saved := m.saved[m.savedCursor]
+		m.saved = nil
+		return m, m.requestSearch(saved)
+	}
+	return m, nil
+}
+
+// replaceRecords shows records, filtered by text in mode, in place of those
+// of the search replaced
+func (m *Model) replaceRecords(records []Record, text string, mode MatchMode) {
+	m.filter = NewFilter(records)
+	m.filter.SetMatchMode(mode)
+	m.filter.UpdateFilter(text)
+	m.filter.DeferUpdates(m.filter.Len() > deferFilterAbove)
+	// The pages followed the search replaced
+	m.loadPage = nil
+	m.searchSeq++
+	m.cursor = 0
+	m.marked = nil
+}
+
+// changeSearch moves the part of the search action changes on to its next
+// setting and returns a command loading the records the search then finds.
+// Changing the directories searched stops ranking those of here first.
+func (m *Model) changeSearch(action Action) tea.Cmd {
+	switch action {
+	case ResultAction:
+		m.search.Result = nextResult(m.search.Result)
+	case TimeRangeAction:
+		m.search.TimeRange = nextTimeRange(m.search.TimeRange)
+	case ScopeAction:
+		wd, _ := os.Getwd()
+		m.search.Scope = nextScope(m.search.Scope, wd)
+		m.search.Here = false
+	}
+
+	search, store := m.search, m.searches
+	return func() tea.Msg {
+		records, err := store.Search(search)
+		return searchChangedMsg{search: search, records: records, err: err}
+	}
+}
+
+// nextResult returns the result filter following result: all, succeeded
+// then failed commands
+func nextResult(result ResultFilter) ResultFilter {
+	switch result {
+	case SuccessResults:
+		return FailedResults
+	case FailedResults:
+		return AllResults
+	default:
+		return SuccessResults
+	}
+}
+
+// nextTimeRange returns the time range following timeRange: all time,
+// today, yesterday then the last week
+func nextTimeRange(timeRange TimeRange) TimeRange {
+	switch timeRange {
+	case Today:
+		return Yesterday
+	case Yesterday:
+		return LastWeek
+	case LastWeek:
+		return AllTime
+	default:
+		return Today
+	}
+}
+
+// nextScope returns the scope following scope: anywhere, the working
+// directory wd, then the tree below it. The repository and branch are kept.
+func nextScope(scope Scope, wd string) Scope {
+	switch {
+	case scope.Dir == "" && wd != "":
+		scope.Dir, scope.Recursive = wd, false
+	case scope.Dir != "" && !scope.Recursive:
+		scope.Recursive = true
+	default:
+		scope.Dir, scope.Recursive = "", false
+	}
+	return scope
+}
+
+// requestCopy returns a command copying the command line of record to the
+// clipboard
+func (m Model) requestCopy(record Record) tea.Cmd {
+	line, clipboard := record.CommandLine(), m.clipboard
+	return func() tea.Msg {
+		return copiedMsg{line: line, err: clipboard(line)}
+	}
+}
+
+// requestStar returns a command starring record, or unstarring it if it is
+// starred
+func (m Model) requestStar(record Record) tea.Cmd {
+	star, starred := m.star, !record.Starred
+	return func() tea.Msg {
+		return starredMsg{record: record, starred: starred, err: star(record.ID, starred)}
+	}
+}
+
+// requestTag returns a command tagging record with tag
+func (m Model) requestTag(record Record, tag string) tea.Cmd {
+	tagger := m.tagger
+	return func() tea.Msg {
+		return taggedMsg{record: record, tag: strings.TrimSpace(tag), err: tagger(record.ID, tag)}
+	}
+}
+
+// requestSave returns a command saving the current search as name
+func (m Model) requestSave(name string) tea.Cmd {
+	search := m.search
+	search.Filter = m.filter.Filter()
+	search.Match = m.filter.MatchMode()
+	store := m.searches
+	return func() tea.Msg {
+		return searchSavedMsg{name: name, err: store.SaveSearch(name, search)}
+	}
+}
+
+// requestSavedSearches returns a command loading the saved searches
+func (m Model) requestSavedSearches() tea.Cmd {
+	store := m.searches
+	return func() tea.Msg {
+		searches, err := store.SavedSearches()
+		return savedSearchesMsg{searches: searches, err: err}
+	}
+}
+
+// requestSearch returns a command loading the records of a saved search,
+// which are filtered by its text once loaded
+func (m Model) requestSearch(saved SavedSearch) tea.Cmd {
+	search := saved.Search
+	search.Filter = ""
+	store := m.searches
+	return func() tea.Msg {
+		records, err := store.Search(search)
+		return searchLoadedMsg{saved: saved, records: records, err: err}
+	}
+}
+
+// requestDangerCheck returns a command checking whether the records which
+// would be emitted are dangerous
+func (m Model) requestDangerCheck() tea.Cmd {
+	m.selected = true
+	records := m.SelectedAll()
+	if len(records) == 0 {
+		return tea.Quit
+	}
+
+	check := m.checkDanger
+	return func() tea.Msg {
+		warning, err := check(records)
+		return dangerCheckedMsg{warning: warning, err: err}
+	}
+}
+
+// requestContext returns a command loading the session context of the
+// highlighted record if the preview needs it and it isn't already loaded
+func (m Model) requestContext() tea.Cmd {
+	record, ok := m.current()
+	if !ok || !m.preview || m.loadContext == nil || record.ID == 0 {
+		return nil
+	}
+	if _, requested := m.contexts[record.ID]; requested {
+		return nil
+	}
+
+	m.contexts[record.ID] = nil
+	load, loadFingerprint := m.loadContext, m.loadFingerprint
+	return func() tea.Msg {
+		before, after, err := load(record)
+		context := sessionContext{before: before, after: after}
+		if err == nil && loadFingerprint != nil && record.Session != "" {
+			context.fingerprint, err = loadFingerprint(record.Session)
+		}
+		return contextLoadedMsg{id: record.ID, context: context, err: err}
+	}
+}
+
+// waitForEvent returns a command waiting for the next change to the history,
+// nil if they are not followed
+func (m Model) waitForEvent() tea.Cmd {
+	if m.events == nil {
+		return nil
+	}
+	events := m.events
+	return func() tea.Msg {
+		event, ok := <-events
+		if !ok {
+			return nil
+		}
+		return historyChangedMsg{event: event}
+	}
+}
+
+// requestPage returns a command fetching the next page of records once the
+// cursor is within a window's height of the end of the list, unless one is
+// already being fetched
+func (m *Model) requestPage() tea.Cmd {
+	if m.loadPage == nil || m.loading || m.filter.Stale() || m.height == 0 {
+		return nil
+	}
+	if len(m.filter.FilteredRecords())-m.cursor > m.height {
+		return nil
+	}
+
+	m.loading = true
+	load, limit, after := m.loadPage, m.pageLimit, m.pageAfter
+	return func() tea.Msg {
+		records, err := load(after, limit)
+		return pageLoadedMsg{records: records, err: err}
+	}
+}
+
+// searchHistoryLater returns a command asking for the history not yet loaded
+// to be searched for the filter text after historySearchDelay, nil if all of
+// it is loaded
+func (m *Model) searchHistoryLater() tea.Cmd {
+	if m.searchHistory == nil || m.loadPage == nil {
+		return nil
+	}
+	m.searchSeq++
+	seq := m.searchSeq
+	return tea.Tick(historySearchDelay, func(time.Time) tea.Msg { return historySearchDueMsg{seq: seq} })
+}
+
+// requestHistorySearch returns a command searching the whole history for
+// the filter text, nil if there is none
+func (m Model) requestHistorySearch() tea.Cmd {
+	text, mode := m.filter.Filter(), m.filter.MatchMode()
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	search, limit := m.searchHistory, m.pageLimit
+	return func() tea.Msg {
+		records, err := search(text, mode, limit)
+		return historySearchedMsg{text: text, mode: mode, records: records, err: err}
+	}
+}
+
 // View renders the UI
 func (m Model) View() string {
+	defer tracer.First("first render")
 	if m.height == 0 {
-		return "Loading..."
+		return tr("Loading...")
+	}
+	if m.warning != "" {
+		return m.styles.warning.Render(m.warning) + "\n" + m.styles.input.Render(tr("Emit anyway? [y/N]"))
+	}
+	if m.saved != nil {
+		return m.renderSavedSearches()
+	}
+	if m.ignoring != "" {
+		return m.styles.warning.Render(trf("Delete and ignore commands matching %s?", m.ignoring)) +
+			"\n" + m.styles.input.Render(tr("Ignore them? [y/N]"))
 	}
 
-	// Reserve space for input line and padding
-	maxItems := m.height - 2
+	// Render the preview first so the list can fit around it
+	preview := m.renderCurrentPreview()
+	maxItems := m.listHeight(preview)
 	if maxItems <= 0 {
-		return "Window too small"
+		return tr("Window too small")
 	}
 
 	// Build the list view
 	var s strings.Builder
-
-	// Calculate which items to show
-	start := 0
-	if len(m.filter.FilteredRecords()) > maxItems && m.cursor >= maxItems {
-		start = m.cursor - maxItems + 1
-	}
-	end := min(start+maxItems, len(m.filter.FilteredRecords()))
+	s.WriteString(m.renderHeader())
+	s.WriteRune('\n')
 
 	// Render visible items
-	for i, record := range m.filter.FilteredRecords()[start:end] {
-		// Format the record
-		line := formatRecord(record)
+	start, end := m.window(maxItems)
+	visible := m.filter.FilteredRecords()[start:end]
+	lines := m.formatRecords(visible, m.cursor-start)
+	for i, record := range visible {
+		line := lines[i]
+
+		mark := " "
+		switch {
+		case isMarked(m.marked, record):
+			mark = "*"
+		case record.Starred:
+			mark = "★"
+		}
 
 		// Style based on selection
-		if i+start == m.cursor {
-			s.WriteString(selectedStyle.Render("> " + line))
-		} else {
-			s.WriteString(normalStyle.Render("  " + line))
+		switch {
+		case i+start == m.cursor:
+			s.WriteString(m.styles.selected.Render(">" + mark + line))
+		case record.ExitStatus != 0:
+			s.WriteString(m.styles.failed.Render(" " + mark + line))
+		default:
+			s.WriteString(m.styles.normal.Render(" " + mark + line))
 		}
 		s.WriteRune('\n')
 	}
 
+	if preview != "" {
+		s.WriteString(preview)
+		s.WriteRune('\n')
+	}
+	if m.status != "" {
+		s.WriteString(m.styles.context.Render(m.status))
+		s.WriteRune('\n')
+	}
+
+	if m.saving {
+		s.WriteString(m.styles.input.Render(tr("Save search as: ") + string(m.saveName)))
+		s.WriteString(m.styles.input.Reverse(true).Render("█"))
+		return s.String()
+	}
+	if m.tagging != nil {
+		s.WriteString(m.styles.input.Render(trf("Tag %q with: ", m.tagging.CommandLine()) + string(m.tagName)))
+		s.WriteString(m.styles.input.Reverse(true).Render("█"))
+		return s.String()
+	}
+
 	// Add the filter input at the bottom with cursor
-	prefix := "Filter: "
-	beforeCursor := m.filter.Filter()[:m.textCursor]
-	afterCursor := m.filter.Filter()[m.textCursor:]
+	prefix := tr("Filter: ")
+	text := []rune(m.filter.Filter())
+	beforeCursor := string(text[:m.textCursor])
+	afterCursor := text[m.textCursor:]
 	cursorChar := "█"
 	if len(afterCursor) > 0 {
 		cursorChar = string(afterCursor[0])
 		afterCursor = afterCursor[1:]
 	}
-	s.WriteString(inputStyle.Render(prefix + beforeCursor))
-	s.WriteString(inputStyle.Reverse(true).Render(cursorChar))
-	s.WriteString(inputStyle.Render(afterCursor))
+	s.WriteString(m.styles.input.Render(prefix + beforeCursor))
+	s.WriteString(m.styles.input.Reverse(true).Render(cursorChar))
+	s.WriteString(m.styles.input.Render(string(afterCursor)))
+
+	return s.String()
+}
+
+// renderHeader renders the bar atop the list, showing why records may be
+// missing from it: the time range, result filter and scope of the search,
+// and how many of the records loaded match the filter text. A "+" follows
+// the records loaded while there are more to load.
+func (m Model) renderHeader() string {
+	var parts []string
+	switch m.search.TimeRange {
+	case Today:
+		parts = append(parts, tr("Today"))
+	case Yesterday:
+		parts = append(parts, tr("Yesterday"))
+	case LastWeek:
+		parts = append(parts, tr("Last week"))
+	default:
+		parts = append(parts, tr("All time"))
+	}
+	switch m.search.Result {
+	case SuccessResults:
+		parts = append(parts, tr("Succeeded"))
+	case FailedResults:
+		parts = append(parts, tr("Failed"))
+	default:
+		parts = append(parts, tr("All results"))
+	}
+	scope := m.search.Scope
+	switch {
+	case m.search.Here:
+		parts = append(parts, trf("Here in %s", scope.Dir))
+	case scope.Dir != "" && scope.Recursive:
+		parts = append(parts, trf("Under %s", scope.Dir))
+	case scope.Dir != "":
+		parts = append(parts, trf("In %s", scope.Dir))
+	default:
+		parts = append(parts, tr("All directories"))
+	}
+	if scope.Repo != "" {
+		parts = append(parts, trf("Repo %s", scope.Repo))
+	}
+	if scope.Branch != "" {
+		parts = append(parts, trf("Branch %s", scope.Branch))
+	}
+	if scope.Starred {
+		parts = append(parts, tr("Starred"))
+	}
+	if scope.Tag != "" {
+		parts = append(parts, trf("Tag %s", scope.Tag))
+	}
+	switch m.filter.MatchMode() {
+	case FuzzyMatch:
+		parts = append(parts, tr("Fuzzy"))
+	case ExactMatch:
+		parts = append(parts, tr("Exact"))
+	case RegexMatch:
+		parts = append(parts, tr("Regex"))
+	}
+
+	loaded := strconv.Itoa(m.filter.Len())
+	if m.loadPage != nil {
+		loaded += "+"
+	}
+	count := trf("%d/%s shown", len(m.filter.FilteredRecords()), loaded)
+
+	// The count is kept to the right, the search is cut short to fit
+	search := strings.Join(parts, " · ")
+	if m.width > 0 {
+		search = truncate(search, max(1, m.width-lipgloss.Width(count)-1))
+	}
+	gap := max(1, m.width-lipgloss.Width(search)-lipgloss.Width(count))
+	return m.styles.header.Render(search + strings.Repeat(" ", gap) + count)
+}
+
+// renderCurrentPreview renders the preview pane for the highlighted record,
+// empty if it is hidden
+func (m Model) renderCurrentPreview() string {
+	if record, ok := m.current(); ok && m.preview {
+		return m.renderPreview(record)
+	}
+	return ""
+}
+
+// listHeight returns how many records fit in the list beside the preview
+func (m Model) listHeight(preview string) int {
+	// Reserve space for header, input line, status, preview and padding
+	reserved := 3
+	if preview != "" {
+		reserved += lipgloss.Height(preview)
+	}
+	if m.status != "" {
+		reserved++
+	}
+	return m.height - reserved
+}
+
+// moveCursor moves the cursor by delta records, stopping at either end of
+// the list
+func (m *Model) moveCursor(delta int) {
+	m.cursor = max(0, min(m.cursor+delta, len(m.filter.FilteredRecords())-1))
+}
+
+// pageSize returns how many records Page Up and Page Down move by, a list
+// full
+func (m Model) pageSize() int {
+	return max(1, m.listHeight(m.renderCurrentPreview()))
+}
 
+// window returns the range of the filtered records shown in a list of
+// maxItems, keeping the cursor in view
+func (m Model) window(maxItems int) (start, end int) {
+	// The cursor may not have caught up with the records filtered yet
+	records := m.filter.FilteredRecords()
+	cursor := min(m.cursor, len(records)-1)
+	if len(records) > maxItems && cursor >= maxItems {
+		start = cursor - maxItems + 1
+	}
+	return start, min(start+maxItems, len(records))
+}
+
+// renderSavedSearches renders the saved searches to choose from
+func (m Model) renderSavedSearches() string {
+	maxItems := m.height - 2
+	if maxItems <= 0 {
+		return tr("Window too small")
+	}
+	start := 0
+	if len(m.saved) > maxItems && m.savedCursor >= maxItems {
+		start = m.savedCursor - maxItems + 1
+	}
+	end := min(start+maxItems, len(m.saved))
+
+	var s strings.Builder
+	for i, saved := range m.saved[start:end] {
+		if i+start == m.savedCursor {
+			s.WriteString(m.styles.selected.Render("> " + saved.Name))
+		} else {
+			s.WriteString(m.styles.normal.Render("  " + saved.Name))
+		}
+		s.WriteString(m.styles.context.Render("  " + saved.Search.String()))
+		s.WriteRune('\n')
+	}
+	s.WriteString(m.styles.input.Render(tr("Saved searches: Enter runs one, Esc goes back")))
 	return s.String()
 }
 
 // Selected returns the currently selected record, if any
 func (m Model) Selected() (Record, bool) {
-	if !m.selected || len(m.filter.FilteredRecords()) == 0 {
+	if !m.selected {
+		return Record{}, false
+	}
+	return m.current()
+}
+
+// SelectedAll returns the marked records in the order they were marked, or
+// just the selected record if none were marked.
+func (m Model) SelectedAll() []Record {
+	if !m.selected {
+		return nil
+	}
+	if len(m.marked) > 0 {
+		return m.marked
+	}
+	if record, ok := m.current(); ok {
+		return []Record{record}
+	}
+	return nil
+}
+
+// toggleMark adds the record to the marked set, or removes it if already present
+func toggleMark(marked []Record, record Record) []Record {
+	for i, r := range marked {
+		if r == record {
+			return append(marked[:i:i], marked[i+1:]...)
+		}
+	}
+	return append(marked[:len(marked):len(marked)], record)
+}
+
+// isMarked reports whether the record is in the marked set
+func isMarked(marked []Record, record Record) bool {
+	for _, r := range marked {
+		if r == record {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the record under the cursor, if there is one
+func (m Model) current() (Record, bool) {
+	records := m.filter.FilteredRecords()
+	if m.cursor < 0 || m.cursor >= len(records) {
 		return Record{}, false
 	}
-	return m.filter.FilteredRecords()[m.cursor], true
+	return records[m.cursor], true
+}
+
+// renderPreview renders the full details of a record for the preview pane
+func (m Model) renderPreview(r Record) string {
+	duration := tr("unknown")
+	if r.Duration > 0 {
+		duration = r.Duration.String()
+	}
+	when := r.Timestamp.Format("2006-01-02 15:04:05")
+	if now := m.relativeTo(); !now.IsZero() {
+		when = FormatRelative(r.Timestamp, now) + " (" + when + ")"
+	}
+
+	fields := []struct{ label, value string }{
+		{"Command:", r.CommandLine()},
+		{"Directory:", r.WorkingDirectory},
+		{"Time:", when},
+		{"Exit:", fmt.Sprintf("%d (%s)", r.ExitStatus, ClassifyExit(r.ExitStatus))},
+		{"Duration:", duration},
+		{"Session:", r.Session},
+	}
+	if r.Count > 0 {
+		fields = append(fields, struct{ label, value string }{"Runs:", strconv.Itoa(r.Count)})
+	}
+	if r.RerunOf != 0 {
+		fields = append(fields, struct{ label, value string }{"Rerun of:", "#" + strconv.FormatInt(r.RerunOf, 10)})
+	}
+	if r.Repo != "" {
+		fields = append(fields, struct{ label, value string }{"Repo:", r.Repo})
+		fields = append(fields, struct{ label, value string }{"Branch:", r.Branch})
+	}
+
+	// Labels are padded to line the values up whatever the language
+	width := 0
+	for i := range fields {
+		fields[i].label = tr(fields[i].label)
+		width = max(width, lipgloss.Width(fields[i].label))
+	}
+
+	var s strings.Builder
+	for i, field := range fields {
+		if i > 0 {
+			s.WriteRune('\n')
+		}
+		s.WriteString(m.styles.label.Render(field.label + strings.Repeat(" ", width-lipgloss.Width(field.label)+1)))
+		s.WriteString(field.value)
+	}
+
+	// Show the record in the context of its session once that has loaded
+	if context := m.contexts[r.ID]; context != nil && len(context.before)+len(context.after) > 0 {
+		s.WriteRune('\n')
+		s.WriteString(m.styles.label.Render(tr("Timeline:")))
+		for _, before := range context.before {
+			s.WriteString("\n" + m.styles.context.Render("  "+before.CommandLine()))
+		}
+		s.WriteString("\n" + m.styles.label.Render("▸ ") + r.CommandLine())
+		for _, after := range context.after {
+			s.WriteString("\n" + m.styles.context.Render("  "+after.CommandLine()))
+		}
+	}
+	if context := m.contexts[r.ID]; context != nil && !context.fingerprint.IsZero() {
+		s.WriteString(m.renderFingerprint(context.fingerprint))
+	}
+
+	style := m.styles.preview
+	if m.width > 0 {
+		style = style.Width(m.width)
+	}
+	return style.Render(s.String())
+}
+
+// renderFingerprint renders the environment a record's session ran in, each
+// part on its own line below the heading
+func (m Model) renderFingerprint(f Fingerprint) string {
+	var s strings.Builder
+	s.WriteString("\n" + m.styles.label.Render(tr("Environment:")))
+	if f.ShellVersion != "" {
+		s.WriteString("\n  " + trf("shell %s", f.ShellVersion))
+	}
+	if f.PathHash != "" {
+		s.WriteString("\n  " + trf("PATH %s", f.PathHash))
+	}
+	for _, tool := range f.Tools {
+		s.WriteString("\n  " + m.styles.context.Render(tool.Probe+":") + " " + tool.Version)
+	}
+	return s.String()
+}
+
+// relativeTo returns the time timestamps are shown relative to, zero while
+// they are shown exactly
+func (m Model) relativeTo() time.Time {
+	if m.absolute {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+const (
+	// deferFilterAbove is how many records there must be for filtering to
+	// wait until typing pauses for filterDelay
+	deferFilterAbove = 50000
+	filterDelay      = 50 * time.Millisecond
+	// historySearchDelay is how long typing must pause before the history
+	// not yet loaded is searched for the filter text
+	historySearchDelay = 200 * time.Millisecond
+	// scrollStep is how many cells Shift-Left and Shift-Right, or the
+	// sideways wheel, scroll the highlighted record by
+	scrollStep = 8
+	// wheelStep is how many records the mouse wheel moves the cursor by
+	wheelStep = 3
+)
+
+// recordLayout is how the records shown are laid out in columns
+type recordLayout struct {
+	columns Columns
+	rows    [][]string // Value of each column of each record
+	kept    []int      // Columns which fit, by index
+	widths  []int      // Width of each column
+	counted bool       // Whether run counts are shown
+}
+
+// layoutRecords lays the columns of the records shown out to fit the window
+func (m Model) layoutRecords(records []Record) recordLayout {
+	layout := recordLayout{columns: m.columns, rows: make([][]string, len(records))}
+	if len(layout.columns) == 0 {
+		layout.columns = pickerColumns
+	}
+	now := m.relativeTo()
+	home, _ := os.UserHomeDir()
+	for i, r := range records {
+		layout.rows[i] = layout.columns.pickerValues(r, now, home)
+		layout.counted = layout.counted || r.Count > 0
+	}
+
+	// The cursor, mark, status and any count come before the columns
+	width := 0
+	if m.width > 0 {
+		width = m.width - 4
+		if layout.counted {
+			width -= 6
+		}
+	}
+	layout.kept, layout.widths = layoutColumns(layout.columns, layout.rows, width)
+	return layout
+}
+
+// last returns the index of the last column shown
+func (l recordLayout) last() int {
+	return l.kept[len(l.kept)-1]
+}
+
+// maxScroll returns how far the highlighted record's last column can be
+// scrolled before its end is in view
+func (m Model) maxScroll() int {
+	if m.height == 0 {
+		return 0
+	}
+	// The list is as long as View would make it
+	start, end := m.window(max(1, m.listHeight(m.renderCurrentPreview())))
+	if m.cursor < start || m.cursor >= end {
+		return 0
+	}
+
+	layout := m.layoutRecords(m.filter.FilteredRecords()[start:end])
+	value := []rune(layout.rows[m.cursor-start][layout.last()])
+	width := layout.widths[layout.last()]
+	if len(value) <= width {
+		return 0
+	}
+	// Once scrolled, an ellipsis takes the place of what is hidden
+	return len(value) - width + 1
+}
+
+// formatRecords formats the records shown for display, laying their columns
+// out to fit the window. Each starts with whether it succeeded and, for
+// unique command lines, its run count before the last column. The last
+// column of the highlighted record, at that index, is scrolled as far as
+// asked.
+func (m Model) formatRecords(records []Record, highlighted int) []string {
+	layout := m.layoutRecords(records)
+	if highlighted >= 0 && highlighted < len(records) && m.scroll > 0 {
+		value := &layout.rows[highlighted][layout.last()]
+		*value = scrollText(*value, m.scroll, layout.widths[layout.last()])
+	}
+
+	lines := make([]string, len(records))
+	for i, r := range records {
+		status := "✓"
+		if r.ExitStatus != 0 {
+			status = "✗"
+		}
+		cells := make([]string, len(layout.kept))
+		for k, c := range layout.kept {
+			cells[k] = fitColumn(layout.columns[c], layout.rows[i][c], layout.widths[c])
+			if k == len(layout.kept)-1 && layout.counted {
+				cells[k] = fmt.Sprintf("%4d× %s", r.Count, cells[k])
+			}
+		}
+		lines[i] = status + " " + strings.TrimRight(strings.Join(cells, columnGap), " ")
+	}
+	return lines
 }
 
-// formatRecord formats a record for display
-func formatRecord(r Record) string {
-	status := "✓"
-	if r.ExitStatus != 0 {
-		status = "✗"
+// scrollText drops offset characters from the start of text, replacing them
+// with an ellipsis, but no more than needed to bring its end into width cells
+func scrollText(text string, offset, width int) string {
+	runes := []rune(text)
+	if len(runes) <= width || offset <= 0 {
+		return text
 	}
-	return status + " " + r.Command + " " + r.Arguments
+	offset = min(offset, len(runes)-width+1)
+	return "…" + string(runes[offset:])
 }
 
 func min(a, b int) int {
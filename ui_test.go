@@ -1,10 +1,17 @@
 package main_test
 
 import (
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
 	rt "github.com/nuchs/retour"
 )
 
@@ -129,3 +136,955 @@ func TestFilterStub(t *testing.T) {
 		t.Error("Expected no-op filter to return all records")
 	}
 }
+
+func TestInitialFilter(t *testing.T) {
+	records := []rt.Record{
+		{Command: "git", Arguments: "status"},
+		{Command: "ls", Arguments: "-la"},
+	}
+
+	filter := rt.NewFilter(records)
+	filter.UpdateFilter("gi")
+	model := rt.NewUI(filter)
+
+	// Typing continues after the initial filter text
+	newModel, _ := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("t")})
+	m := newModel.(rt.Model)
+
+	if got := filter.Filter(); got != "git" {
+		t.Errorf("Expected filter 'git', got '%s'", got)
+	}
+	if len(m.Records()) != 1 {
+		t.Errorf("Expected 1 record, got %d", len(m.Records()))
+	}
+}
+
+func TestPreview(t *testing.T) {
+	records := []rt.Record{
+		{
+			Command:          "make",
+			Arguments:        "build",
+			WorkingDirectory: "/home/user/project",
+			ExitStatus:       2,
+			Duration:         1500 * time.Millisecond,
+			Session:          "1234-5678",
+			RerunOf:          1234,
+		},
+	}
+
+	model := rt.NewUI(rt.NewFilter(records))
+	newModel, _ := model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	m := newModel.(rt.Model)
+
+	if strings.Contains(m.View(), "1234-5678") {
+		t.Error("Expected preview to be hidden initially")
+	}
+
+	newModel, _ = m.Update(tea.KeyMsg{Type: tea.KeyTab})
+	m = newModel.(rt.Model)
+	if !m.Preview() {
+		t.Fatal("Expected preview after Tab")
+	}
+
+	view := m.View()
+	for _, want := range []string{"make build", "/home/user/project", "1.5s", "1234-5678", "Rerun of:  #1234"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("Expected preview to contain %q", want)
+		}
+	}
+
+	newModel, _ = m.Update(tea.KeyMsg{Type: tea.KeyTab})
+	m = newModel.(rt.Model)
+	if m.Preview() {
+		t.Error("Expected preview to be hidden after second Tab")
+	}
+}
+
+func TestMultiSelect(t *testing.T) {
+	records := []rt.Record{
+		{ID: 1, Command: "first"},
+		{ID: 2, Command: "second"},
+		{ID: 3, Command: "third"},
+	}
+
+	var m tea.Model = rt.NewUI(rt.NewFilter(records))
+	for _, msg := range []tea.KeyMsg{
+		{Type: tea.KeyDown},
+		{Type: tea.KeyDown},
+		{Type: tea.KeyCtrlAt}, // mark third
+		{Type: tea.KeyUp},
+		{Type: tea.KeyUp},
+		{Type: tea.KeyCtrlAt}, // mark first
+		{Type: tea.KeyDown},
+		{Type: tea.KeyCtrlAt}, // mark second
+		{Type: tea.KeyCtrlAt}, // unmark second
+		{Type: tea.KeyEnter},
+	} {
+		m, _ = m.Update(msg)
+	}
+
+	selected := m.(rt.Model).SelectedAll()
+	if len(selected) != 2 {
+		t.Fatalf("Expected 2 selected records, got %d", len(selected))
+	}
+	if selected[0].Command != "third" || selected[1].Command != "first" {
+		t.Errorf("Expected [third first] in marking order, got [%s %s]", selected[0].Command, selected[1].Command)
+	}
+}
+
+func TestSelectedAllWithoutMarks(t *testing.T) {
+	model := rt.NewUI(rt.NewFilter([]rt.Record{{Command: "only"}}))
+	if got := model.SelectedAll(); got != nil {
+		t.Errorf("Expected no selection before Enter, got %v", got)
+	}
+
+	newModel, _ := model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	selected := newModel.(rt.Model).SelectedAll()
+	if len(selected) != 1 || selected[0].Command != "only" {
+		t.Errorf("Expected the highlighted record, got %v", selected)
+	}
+}
+
+func TestPreviewTimeline(t *testing.T) {
+	records := []rt.Record{{ID: 2, Command: "make", Arguments: "build", Session: "s"}}
+
+	loads := 0
+	model := rt.NewUI(rt.NewFilter(records)).WithContext(func(r rt.Record) ([]rt.Record, []rt.Record, error) {
+		loads++
+		return []rt.Record{{Command: "cd", Arguments: "project"}}, []rt.Record{{Command: "make", Arguments: "test"}}, nil
+	})
+
+	newModel, _ := model.Update(tea.WindowSizeMsg{Width: 80, Height: 30})
+	newModel, cmd := newModel.Update(tea.KeyMsg{Type: tea.KeyTab})
+	if cmd == nil {
+		t.Fatal("Expected a command to load the timeline when the preview opens")
+	}
+	if strings.Contains(newModel.View(), "cd project") {
+		t.Error("Expected the timeline to be loaded lazily")
+	}
+
+	newModel, cmd = newModel.Update(cmd())
+	if cmd != nil {
+		t.Error("Expected the loaded timeline to be cached")
+	}
+
+	view := newModel.View()
+	for _, want := range []string{"Timeline:", "cd project", "make test"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("Expected preview to contain %q", want)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("Expected 1 load, got %d", loads)
+	}
+}
+
+func TestPreviewTimelineFollowsHistory(t *testing.T) {
+	records := []rt.Record{{ID: 2, Command: "make", Arguments: "build", Session: "s"}}
+
+	loads := 0
+	events := make(chan rt.Event, 1)
+	model := rt.NewUI(rt.NewFilter(records)).WithContext(func(r rt.Record) ([]rt.Record, []rt.Record, error) {
+		loads++
+		return nil, nil, nil
+	}).WithEvents(events)
+	wait := model.Init()
+	if wait == nil {
+		t.Fatal("Init() returned no command waiting for changes to the history")
+	}
+
+	newModel, _ := model.Update(tea.WindowSizeMsg{Width: 80, Height: 30})
+	newModel, cmd := newModel.Update(tea.KeyMsg{Type: tea.KeyTab})
+	newModel, _ = newModel.Update(cmd())
+
+	// A record run since in the same session changes the timeline
+	events <- rt.RecordsInserted{Records: []rt.Record{{ID: 3, Command: "make", Arguments: "test", Session: "s"}}}
+	newModel, cmd = newModel.Update(wait())
+	// Closed, the next wait ends rather than blocking
+	close(events)
+	runCmds(newModel, cmd)
+	if loads != 2 {
+		t.Errorf("Timeline loaded %d times, want it loaded again once a record was inserted", loads)
+	}
+}
+
+func TestPreviewFingerprint(t *testing.T) {
+	records := []rt.Record{{ID: 2, Command: "go", Arguments: "build", Session: "s"}}
+
+	model := rt.NewUI(rt.NewFilter(records)).WithContext(func(r rt.Record) ([]rt.Record, []rt.Record, error) {
+		return nil, nil, nil
+	}).WithFingerprints(func(session string) (rt.Fingerprint, error) {
+		if session != "s" {
+			t.Errorf("Fingerprint loaded for session %q, want s", session)
+		}
+		return rt.Fingerprint{ShellVersion: "5.9", PathHash: "0123456789ab", Tools: []rt.ToolVersion{{Probe: "go version", Version: "go1.24"}}}, nil
+	})
+
+	newModel, _ := model.Update(tea.WindowSizeMsg{Width: 80, Height: 30})
+	newModel, cmd := newModel.Update(tea.KeyMsg{Type: tea.KeyTab})
+	newModel, _ = newModel.Update(cmd())
+
+	view := newModel.View()
+	for _, want := range []string{"Environment:", "shell 5.9", "PATH 0123456789ab", "go version: go1.24"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("Expected preview to contain %q, got:\n%s", want, view)
+		}
+	}
+}
+
+func TestPageNavigation(t *testing.T) {
+	var records []rt.Record
+	for i := range 50 {
+		records = append(records, rt.Record{ID: int64(i + 1), Command: "cmd" + strconv.Itoa(i)})
+	}
+	var model tea.Model = rt.NewUI(rt.NewFilter(records))
+	// Ten records fit between the header and the filter line and padding
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 13})
+
+	steps := []struct {
+		msg  tea.Msg
+		want int
+	}{
+		{tea.KeyMsg{Type: tea.KeyPgDown}, 10},
+		{tea.KeyMsg{Type: tea.KeyPgDown}, 20},
+		{tea.KeyMsg{Type: tea.KeyEnd}, 49},
+		{tea.KeyMsg{Type: tea.KeyPgDown}, 49},
+		{tea.KeyMsg{Type: tea.KeyPgUp}, 39},
+		{tea.KeyMsg{Type: tea.KeyHome}, 0},
+		{tea.KeyMsg{Type: tea.KeyPgUp}, 0},
+		{tea.MouseMsg{Button: tea.MouseButtonWheelDown, Action: tea.MouseActionPress}, 3},
+		{tea.MouseMsg{Button: tea.MouseButtonWheelDown, Action: tea.MouseActionPress}, 6},
+		{tea.MouseMsg{Button: tea.MouseButtonWheelUp, Action: tea.MouseActionPress}, 3},
+		{tea.MouseMsg{Button: tea.MouseButtonLeft, Action: tea.MouseActionPress}, 3},
+	}
+	for i, step := range steps {
+		model, _ = model.Update(step.msg)
+		if got := model.(rt.Model).Cursor(); got != step.want {
+			t.Fatalf("Step %d: Cursor() = %d, want %d", i, got, step.want)
+		}
+	}
+	if !strings.Contains(model.View(), "cmd3") {
+		t.Errorf("Expected the cursor's record in view:\n%s", model.View())
+	}
+}
+
+func TestDebouncedFiltering(t *testing.T) {
+	// Enough records for filtering to wait for a pause in typing
+	records := make([]rt.Record, 60000)
+	for i := range records {
+		records[i] = rt.Record{ID: int64(i + 1), Command: "ls"}
+	}
+	records[0].Command = "grep"
+
+	var model tea.Model = rt.NewUI(rt.NewFilter(records))
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	model, first := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("g")})
+	model, second := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("r")})
+	if first == nil || second == nil {
+		t.Fatal("Expected typing to schedule filtering")
+	}
+	if got := len(model.(rt.Model).Records()); got != len(records) {
+		t.Fatalf("Expected filtering to wait, got %d records", got)
+	}
+
+	// Only the filtering due after the last key press goes ahead
+	model, _ = model.Update(first())
+	if got := len(model.(rt.Model).Records()); got != len(records) {
+		t.Errorf("Expected filtering to wait for the last key press, got %d records", got)
+	}
+	model, _ = model.Update(second())
+	if got := model.(rt.Model).Records(); len(got) != 1 || got[0].Command != "grep" {
+		t.Errorf("Records() = %d records, want only grep", len(got))
+	}
+}
+
+func TestPaging(t *testing.T) {
+	var history []rt.Record
+	for i := range 25 {
+		history = append(history, rt.Record{ID: int64(100 - i), Command: "cmd" + strconv.Itoa(i)})
+	}
+	loads := 0
+	loader := func(after *rt.Record, limit int) ([]rt.Record, error) {
+		loads++
+		for i, r := range history {
+			if r.ID == after.ID {
+				return history[i+1 : min(i+1+limit, len(history))], nil
+			}
+		}
+		t.Fatalf("Page requested after unknown record %d", after.ID)
+		return nil, nil
+	}
+
+	var model tea.Model = rt.NewUI(rt.NewFilter(history[:10])).WithPaging(loader, 10)
+	// The whole first page fits in the window, so the next is fetched at once
+	model, cmd := model.Update(tea.WindowSizeMsg{Width: 80, Height: 12})
+	if cmd == nil {
+		t.Fatal("Expected the next page to be fetched")
+	}
+	model, _ = model.Update(cmd())
+	if got := len(model.(rt.Model).Records()); got != 20 {
+		t.Fatalf("Expected 20 records after a page loaded, got %d", got)
+	}
+
+	// The rest is fetched once the cursor nears the end
+	model, cmd = model.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if cmd != nil {
+		if msg := cmd(); msg != nil {
+			t.Fatalf("Expected no page to be fetched far from the end, got %T", msg)
+		}
+	}
+	model, cmd = model.Update(tea.KeyMsg{Type: tea.KeyPgDown})
+	model, _ = model.Update(cmd())
+	if got := len(model.(rt.Model).Records()); got != 25 {
+		t.Fatalf("Expected all 25 records, got %d", got)
+	}
+
+	// A short page was the last
+	model.Update(tea.KeyMsg{Type: tea.KeyEnd})
+	if loads != 2 {
+		t.Errorf("Expected 2 pages fetched, got %d", loads)
+	}
+}
+
+func TestHistorySearch(t *testing.T) {
+	at := func(minute int) time.Time { return time.Date(2025, 1, 1, 0, minute, 0, 0, time.UTC) }
+	var loaded []rt.Record
+	for i := range 20 {
+		loaded = append(loaded, rt.Record{ID: int64(100 - i), Command: "ls", Timestamp: at(100 - i)})
+	}
+	pages := func(after *rt.Record, limit int) ([]rt.Record, error) {
+		t.Fatal("Expected no page to be fetched before the window size is known")
+		return nil, nil
+	}
+	var searched []string
+	searcher := func(text string, mode rt.MatchMode, limit int) ([]rt.Record, error) {
+		searched = append(searched, text)
+		return []rt.Record{{ID: 3, Command: "make", Arguments: "release", Timestamp: at(3)}}, nil
+	}
+
+	var model tea.Model = rt.NewUI(rt.NewFilter(loaded)).WithPaging(pages, 20).WithHistorySearch(searcher)
+	var cmds []tea.Cmd
+	for _, r := range "make" {
+		var cmd tea.Cmd
+		model, cmd = model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+		cmds = append(cmds, cmd)
+	}
+	if got := len(model.(rt.Model).Records()); got != 0 {
+		t.Fatalf("Expected no matches among the records loaded, got %d", got)
+	}
+
+	// Only the search asked for once typing paused goes ahead
+	for _, cmd := range cmds {
+		model = runCmds(model, cmd)
+	}
+	if !slices.Equal(searched, []string{"make"}) {
+		t.Errorf("Searched the history for %q, want only the text typed", searched)
+	}
+	if got := model.(rt.Model).Records(); len(got) != 1 || got[0].CommandLine() != "make release" {
+		t.Errorf("Records() after searching = %+v, want the match found", got)
+	}
+}
+
+// runCmds runs cmd and those of any batch it returns, passing their messages
+// to the model
+func runCmds(model tea.Model, cmd tea.Cmd) tea.Model {
+	if cmd == nil {
+		return model
+	}
+	switch msg := cmd().(type) {
+	case nil:
+	case tea.BatchMsg:
+		for _, cmd := range msg {
+			model = runCmds(model, cmd)
+		}
+	default:
+		var next tea.Cmd
+		model, next = model.Update(msg)
+		model = runCmds(model, next)
+	}
+	return model
+}
+
+func TestHorizontalScroll(t *testing.T) {
+	records := []rt.Record{
+		{ID: 1, Command: "echo", Arguments: "0123456789abcdefghijklmnopqrstuvwxyz"},
+		{ID: 2, Command: "ls"},
+	}
+	model := rt.NewUI(rt.NewFilter(records)).WithColumns(rt.Columns{{Name: "line"}})
+	newModel, _ := model.Update(tea.WindowSizeMsg{Width: 30, Height: 10})
+
+	press := func(key tea.KeyType) {
+		t.Helper()
+		newModel, _ = newModel.Update(tea.KeyMsg{Type: key})
+	}
+	expect := func(want string) {
+		t.Helper()
+		if view := newModel.View(); !strings.Contains(view, want) {
+			t.Errorf("View() does not contain %q:\n%s", want, view)
+		}
+	}
+
+	expect("✓ echo 0123456789abcdefghij…")
+	press(tea.KeyShiftRight)
+	expect("✓ …3456789abcdefghijklmnopq…")
+	for range 5 {
+		press(tea.KeyShiftRight)
+	}
+	expect("✓ …bcdefghijklmnopqrstuvwxyz")
+	press(tea.KeyShiftLeft)
+	expect("✓ …3456789abcdefghijklmnopq…")
+
+	// Only the highlighted record scrolls, until the cursor moves
+	press(tea.KeyDown)
+	expect("✓ echo 0123456789abcdefghij…")
+	press(tea.KeyShiftRight)
+	expect("✓ ls")
+}
+
+func TestUniqueCounts(t *testing.T) {
+	records := []rt.Record{{ID: 1, Command: "ls", Count: 12}, {ID: 2, Command: "make", Count: 1}}
+
+	model := rt.NewUI(rt.NewFilter(records))
+	newModel, _ := model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	view := newModel.(rt.Model).View()
+
+	for _, want := range []string{"  12× ls", "   1× make"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("Expected view to contain %q, got:\n%s", want, view)
+		}
+	}
+}
+
+func TestDangerConfirmation(t *testing.T) {
+	records := []rt.Record{
+		{Command: "rm", Arguments: "-rf /", Timestamp: time.Now()},
+		{Command: "ls", Timestamp: time.Now()},
+	}
+	check := func(selected []rt.Record) (string, error) {
+		if selected[0].Command == "rm" {
+			return "rm -rf / is marked dangerous: never run before", nil
+		}
+		return "", nil
+	}
+	sized, _ := rt.NewUI(rt.NewFilter(records)).WithDangerCheck(check).Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	model := sized.(rt.Model)
+
+	// press sends a key, running any command it returns other than quitting
+	press := func(m tea.Model, key tea.KeyMsg) (rt.Model, bool) {
+		m, cmd := m.Update(key)
+		if cmd == nil {
+			return m.(rt.Model), false
+		}
+		msg := cmd()
+		if _, quit := msg.(tea.QuitMsg); quit {
+			return m.(rt.Model), true
+		}
+		m, cmd = m.Update(msg)
+		if cmd == nil {
+			return m.(rt.Model), false
+		}
+		_, quit := cmd().(tea.QuitMsg)
+		return m.(rt.Model), quit
+	}
+	enter := tea.KeyMsg{Type: tea.KeyEnter}
+
+	m, quit := press(model, enter)
+	if quit || m.Warning() == "" || len(m.SelectedAll()) != 0 {
+		t.Fatalf("Enter on a dangerous command quit = %v with warning %q, want a confirmation", quit, m.Warning())
+	}
+	if view := m.View(); !strings.Contains(view, "never run before") || !strings.Contains(view, "Emit anyway?") {
+		t.Errorf("View() = %q, want the warning and question", view)
+	}
+
+	m, quit = press(m, tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("n")})
+	if quit || m.Warning() != "" || len(m.SelectedAll()) != 0 {
+		t.Fatalf("Declining quit = %v with warning %q, want back to the list", quit, m.Warning())
+	}
+
+	m, _ = press(m, enter)
+	m, quit = press(m, tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("y")})
+	if selected := m.SelectedAll(); !quit || len(selected) != 1 || selected[0].Command != "rm" {
+		t.Errorf("Confirming quit = %v with %+v selected, want rm", quit, selected)
+	}
+
+	// Safe commands are emitted straight away
+	m, _ = press(model, tea.KeyMsg{Type: tea.KeyDown})
+	m, quit = press(m, enter)
+	if selected := m.SelectedAll(); !quit || len(selected) != 1 || selected[0].Command != "ls" {
+		t.Errorf("Enter on a safe command quit = %v with %+v selected, want ls", quit, selected)
+	}
+}
+
+func TestSavedSearchPicker(t *testing.T) {
+	database := openTestDB(t)
+	for _, line := range []string{"git pull", "make", "git push"} {
+		record := rt.NewRecord(line, "/src", 0, time.Now())
+		if err := database.Insert(&record); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+	}
+	search := rt.Search{Result: rt.AllResults}
+	records, err := database.Search(search)
+	if err != nil {
+		t.Fatalf("Search() unexpected error = %v", err)
+	}
+
+	// press sends a key, then delivers the message of any command it returns
+	press := func(m rt.Model, key tea.KeyMsg) rt.Model {
+		next, cmd := m.Update(key)
+		if cmd != nil {
+			next, _ = next.Update(cmd())
+		}
+		return next.(rt.Model)
+	}
+	typed := func(m rt.Model, text string) rt.Model {
+		return press(m, tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(text)})
+	}
+	enter := tea.KeyMsg{Type: tea.KeyEnter}
+	sized, _ := rt.NewUI(rt.NewFilter(records)).WithSearches(database, search).Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	model := sized.(rt.Model)
+
+	m := press(model, tea.KeyMsg{Type: tea.KeyCtrlO})
+	if !strings.Contains(m.Status(), "No searches are saved") {
+		t.Errorf("Status() with nothing saved = %q, want a hint", m.Status())
+	}
+
+	m = typed(model, "git")
+	m = press(m, tea.KeyMsg{Type: tea.KeyCtrlS})
+	if view := m.View(); !strings.Contains(view, "Save search as:") {
+		t.Errorf("View() after Ctrl-S = %q, want the name prompt", view)
+	}
+	m = press(typed(m, "gits"), enter)
+	if !strings.Contains(m.Status(), `"gits"`) {
+		t.Errorf("Status() after saving = %q, want the name saved", m.Status())
+	}
+	saved, err := database.SavedSearch("gits")
+	if err != nil || saved.Filter != "git" || saved.Result != rt.AllResults {
+		t.Errorf("SavedSearch() = %+v, %v, want the search filtered by git", saved, err)
+	}
+
+	// Recalling the search restores its filter text over the whole history
+	m = press(model, tea.KeyMsg{Type: tea.KeyCtrlO})
+	if view := m.View(); !strings.Contains(view, "gits") || !strings.Contains(view, `"git"`) {
+		t.Errorf("View() after Ctrl-O = %q, want the saved search", view)
+	}
+	m = press(m, enter)
+	if got := m.Records(); len(got) != 2 || !strings.HasPrefix(got[0].CommandLine(), "git") {
+		t.Errorf("Records() after recalling = %+v, want the git commands", got)
+	}
+	if view := m.View(); !strings.Contains(view, "Filter: git") {
+		t.Errorf("View() after recalling = %q, want the filter text", view)
+	}
+}
+
+func TestReadOnlyPicker(t *testing.T) {
+	database := openTestDB(t)
+	search := rt.Search{Result: rt.AllResults}
+	records := []rt.Record{{ID: 1, Command: "git", Arguments: "pull"}}
+	sized, _ := rt.NewUI(rt.NewFilter(records)).WithSearches(database, search).WithReadOnly(true).
+		Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+
+	next, _ := sized.Update(tea.KeyMsg{Type: tea.KeyCtrlS})
+	m := next.(rt.Model)
+	if !strings.Contains(m.Status(), "read-only") {
+		t.Errorf("Status() after Ctrl-S = %q, want it refused", m.Status())
+	}
+	if view := m.View(); strings.Contains(view, "Save search as:") {
+		t.Errorf("View() after Ctrl-S = %q, want no name prompt", view)
+	}
+}
+
+func TestRemappedKeys(t *testing.T) {
+	records := []rt.Record{
+		{ID: 1, Command: "git", Arguments: "pull"},
+		{ID: 2, Command: "make"},
+		{ID: 3, Command: "ls"},
+	}
+	keys := rt.DefaultKeymap()
+	keys.Up = []string{"ctrl+k"}
+	keys.Down = []string{"ctrl+j"}
+	keys.Quit = []string{"esc"}
+	sized, _ := rt.NewUI(rt.NewFilter(records)).WithKeys(keys).Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+
+	m := sized.(rt.Model)
+	for _, key := range []tea.KeyMsg{{Type: tea.KeyCtrlJ}, {Type: tea.KeyCtrlJ}, {Type: tea.KeyCtrlK}, {Type: tea.KeyDown}} {
+		next, _ := m.Update(key)
+		m = next.(rt.Model)
+	}
+	next, _ := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if got, ok := next.(rt.Model).Selected(); !ok || got.ID != 2 {
+		t.Errorf("Selected() after Ctrl-J, Ctrl-J, Ctrl-K and Down = %+v, want record 2 as Down is no longer bound", got)
+	}
+
+	if _, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEsc}); cmd == nil || cmd() != tea.Quit() {
+		t.Error("Esc did not quit once bound to quit")
+	}
+	if _, cmd := m.Update(tea.KeyMsg{Type: tea.KeyCtrlC}); cmd != nil {
+		t.Error("Ctrl-C still quit once quit was bound to Esc")
+	}
+}
+
+func TestTheme(t *testing.T) {
+	lipgloss.SetColorProfile(termenv.ANSI256)
+	defer lipgloss.SetColorProfile(termenv.Ascii)
+
+	records := []rt.Record{
+		{ID: 1, Command: "ls"},
+		{ID: 2, Command: "make", ExitStatus: 2},
+	}
+	tests := []struct {
+		name  string
+		theme rt.Theme
+		want  []string
+	}{
+		// The highlighted record, then the failed one
+		{name: "Default", want: []string{"38;5;205", "38;5;167"}},
+		{name: "Preset", theme: rt.Theme{Preset: "ocean", Failed: "#ff0000"}, want: []string{"38;5;39", "38;5;196"}},
+		{name: "No colour", theme: rt.Theme{NoColor: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sized, _ := rt.NewUI(rt.NewFilter(records)).WithTheme(tt.theme).Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+			view := sized.View()
+			for _, want := range tt.want {
+				if !strings.Contains(view, want) {
+					t.Errorf("View() = %q, want colour %s", view, want)
+				}
+			}
+			if tt.want == nil && strings.Contains(view, "38;5;") {
+				t.Errorf("View() = %q, want no colours", view)
+			}
+		})
+	}
+}
+
+func TestHeader(t *testing.T) {
+	records := []rt.Record{
+		{ID: 1, Command: "git", Arguments: "pull"},
+		{ID: 2, Command: "make"},
+		{ID: 3, Command: "git", Arguments: "push"},
+	}
+	search := rt.Search{TimeRange: rt.Today, Result: rt.FailedResults, Scope: rt.Scope{Dir: "/src", Recursive: true}}
+	var model tea.Model = rt.NewUI(rt.NewFilter(records)).WithSearch(search)
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+
+	header := strings.SplitN(model.View(), "\n", 2)[0]
+	for _, want := range []string{"Today", "Failed", "Under /src", "3/3 shown"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("header = %q, want %q", header, want)
+		}
+	}
+
+	model, _ = model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("git")})
+	if header := strings.SplitN(model.View(), "\n", 2)[0]; !strings.Contains(header, "2/3 shown") {
+		t.Errorf("header after typing git = %q, want 2/3 shown", header)
+	}
+}
+
+func TestChangeSearch(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd() unexpected error = %v", err)
+	}
+	database := openTestDB(t)
+	// Today's records are run since midnight, however soon after it the test is
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, r := range []rt.Record{
+		rt.NewRecord("git pull", wd, 0, midnight.Add(now.Sub(midnight)/3)),
+		rt.NewRecord("make", wd+"/sub", 2, midnight.Add(now.Sub(midnight)*2/3)),
+		rt.NewRecord("git push", "/elsewhere", 1, now.Add(-72*time.Hour)),
+	} {
+		if err := database.Insert(&r); err != nil {
+			t.Fatalf("Insert() unexpected error = %v", err)
+		}
+	}
+	search := rt.Search{Result: rt.AllResults}
+	records, err := database.Search(search)
+	if err != nil {
+		t.Fatalf("Search() unexpected error = %v", err)
+	}
+	sized, _ := rt.NewUI(rt.NewFilter(records)).WithSearches(database, search).Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+
+	// press sends a key, then delivers the message of any command it returns
+	press := func(m tea.Model, keys ...string) rt.Model {
+		for _, key := range keys {
+			next, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(key[len(key)-1:]), Alt: strings.HasPrefix(key, "alt+")})
+			if cmd != nil {
+				next, _ = next.Update(cmd())
+			}
+			m = next
+		}
+		return m.(rt.Model)
+	}
+	commands := func(m rt.Model) []string {
+		var lines []string
+		for _, r := range m.Records() {
+			lines = append(lines, r.CommandLine())
+		}
+		return lines
+	}
+
+	tests := []struct {
+		name   string
+		keys   []string
+		want   []string
+		header string
+	}{
+		{name: "Succeeded", keys: []string{"alt+r"}, want: []string{"git pull"}, header: "Succeeded"},
+		{name: "Failed", keys: []string{"alt+r", "alt+r"}, want: []string{"make", "git push"}, header: "Failed"},
+		{name: "All results", keys: []string{"alt+r", "alt+r", "alt+r"}, want: []string{"make", "git pull", "git push"}, header: "All results"},
+		{name: "Today", keys: []string{"alt+t"}, want: []string{"make", "git pull"}, header: "Today"},
+		{name: "This directory", keys: []string{"alt+d"}, want: []string{"git pull"}, header: "In " + wd},
+		{name: "Subtree", keys: []string{"alt+d", "alt+d"}, want: []string{"make", "git pull"}, header: "Under " + wd},
+		{name: "Anywhere", keys: []string{"alt+d", "alt+d", "alt+d"}, want: []string{"make", "git pull", "git push"}, header: "All directories"},
+		{name: "Filter text kept", keys: []string{"g", "alt+r", "alt+r"}, want: []string{"git push"}, header: "Failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := press(sized, tt.keys...)
+			if got := commands(m); !slices.Equal(got, tt.want) {
+				t.Errorf("Records() after %v = %q, want %q", tt.keys, got, tt.want)
+			}
+			if header := strings.SplitN(m.View(), "\n", 2)[0]; !strings.Contains(header, tt.header) {
+				t.Errorf("header after %v = %q, want %q", tt.keys, header, tt.header)
+			}
+		})
+	}
+}
+
+func TestCopy(t *testing.T) {
+	records := []rt.Record{
+		{ID: 1, Command: "git", Arguments: "pull"},
+		{ID: 2, Command: "make"},
+	}
+	var copied []string
+	clipboard := func(text string) error {
+		copied = append(copied, text)
+		return nil
+	}
+	var model tea.Model = rt.NewUI(rt.NewFilter(records)).WithClipboard(clipboard)
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	model, _ = model.Update(tea.KeyMsg{Type: tea.KeyDown})
+
+	next, cmd := model.Update(tea.KeyMsg{Type: tea.KeyCtrlY})
+	if cmd == nil {
+		t.Fatal("Ctrl-Y returned no command")
+	}
+	next, _ = next.Update(cmd())
+	m := next.(rt.Model)
+	if !slices.Equal(copied, []string{"make"}) {
+		t.Errorf("Copied %q, want the highlighted command", copied)
+	}
+	if _, ok := m.Selected(); ok || !strings.Contains(m.Status(), `"make"`) {
+		t.Errorf("After Ctrl-Y Selected() = %v and Status() = %q, want the picker still open saying what was copied", ok, m.Status())
+	}
+
+	failing := rt.NewUI(rt.NewFilter(records)).WithClipboard(func(string) error { return errors.New("no clipboard available") })
+	_, cmd = failing.Update(tea.KeyMsg{Type: tea.KeyCtrlY})
+	next, _ = failing.Update(cmd())
+	if status := next.(rt.Model).Status(); !strings.Contains(status, "no clipboard available") {
+		t.Errorf("Status() after failing to copy = %q, want the error", status)
+	}
+}
+
+func TestStar(t *testing.T) {
+	records := []rt.Record{
+		{ID: 1, Command: "git", Arguments: "pull"},
+		{ID: 2, Command: "make"},
+		{ID: 3, Command: "make"},
+	}
+	type call struct {
+		id      int64
+		starred bool
+	}
+	var calls []call
+	star := func(id int64, starred bool) error {
+		calls = append(calls, call{id, starred})
+		return nil
+	}
+	altS := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("s"), Alt: true}
+	var model tea.Model = rt.NewUI(rt.NewFilter(records)).WithStars(star)
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	model, _ = model.Update(tea.KeyMsg{Type: tea.KeyDown})
+
+	next, cmd := model.Update(altS)
+	if cmd == nil {
+		t.Fatal("Alt-S returned no command")
+	}
+	next, _ = next.Update(cmd())
+	m := next.(rt.Model)
+	if !slices.Equal(calls, []call{{2, true}}) || !m.Records()[1].Starred || m.Records()[2].Starred {
+		t.Errorf("After Alt-S calls = %v and records = %+v, want the highlighted record starred", calls, m.Records())
+	}
+	if !strings.Contains(m.View(), ">★") || !strings.Contains(m.Status(), `"make"`) {
+		t.Errorf("View() after Alt-S = %q, want the record shown starred", m.View())
+	}
+
+	// Unstarring unstars every run of the command line
+	next, _ = m.Update(tea.KeyMsg{Type: tea.KeyDown})
+	m = next.(rt.Model)
+	m.Records()[2].Starred = true
+	next, cmd = m.Update(altS)
+	next, _ = next.Update(cmd())
+	m = next.(rt.Model)
+	if !slices.Equal(calls, []call{{2, true}, {3, false}}) || m.Records()[1].Starred || m.Records()[2].Starred {
+		t.Errorf("After unstarring calls = %v and records = %+v, want every make unstarred", calls, m.Records())
+	}
+
+	readOnly := rt.NewUI(rt.NewFilter(records)).WithStars(star).WithReadOnly(true)
+	next, cmd = readOnly.Update(altS)
+	if cmd != nil || !strings.Contains(next.(rt.Model).Status(), "read-only") {
+		t.Errorf("Alt-S in a read-only picker returned %v with status %q, want it refused", cmd, next.(rt.Model).Status())
+	}
+}
+
+func TestTag(t *testing.T) {
+	records := []rt.Record{
+		{ID: 1, Command: "git", Arguments: "pull"},
+		{ID: 2, Command: "make"},
+	}
+	var tagged []string
+	tagger := func(id int64, tag string) error {
+		tagged = append(tagged, strconv.FormatInt(id, 10)+" "+tag)
+		return nil
+	}
+	altG := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("g"), Alt: true}
+	var model tea.Model = rt.NewUI(rt.NewFilter(records)).WithTags(tagger)
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	model, _ = model.Update(tea.KeyMsg{Type: tea.KeyDown})
+	model, _ = model.Update(altG)
+	if view := model.View(); !strings.Contains(view, `Tag "make" with: `) {
+		t.Errorf("View() after Alt-G = %q, want a prompt for the tag", view)
+	}
+
+	// The tag is typed, not the filter text
+	model, _ = model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("deplox")})
+	model, _ = model.Update(tea.KeyMsg{Type: tea.KeyBackspace})
+	model, _ = model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("y")})
+	next, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if cmd == nil {
+		t.Fatal("Enter returned no command")
+	}
+	next, _ = next.Update(cmd())
+	m := next.(rt.Model)
+	if !slices.Equal(tagged, []string{"2 deploy"}) || len(m.Records()) != len(records) {
+		t.Errorf("Tagged %q leaving %d records shown, want the highlighted record tagged deploy and the filter untouched", tagged, len(m.Records()))
+	}
+	if _, ok := m.Selected(); ok || !strings.Contains(m.Status(), "deploy") {
+		t.Errorf("After tagging Selected() = %v and Status() = %q, want the picker still open saying what was tagged", ok, m.Status())
+	}
+
+	// Esc leaves the prompt without tagging
+	next, _ = m.Update(altG)
+	next, cmd = next.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if cmd != nil || len(tagged) != 1 || strings.Contains(next.View(), "Tag \"") {
+		t.Errorf("Esc returned %v having tagged %q, want the prompt left", cmd, tagged)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	records := []rt.Record{
+		{ID: 1, Command: "ls"},
+		{ID: 2, Command: "make"},
+		{ID: 3, Command: "ls"},
+	}
+	var ignored []string
+	ignorer := func(pattern string) (int, error) {
+		ignored = append(ignored, pattern)
+		return 2, nil
+	}
+	altI := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("i"), Alt: true}
+	var model tea.Model = rt.NewUI(rt.NewFilter(records)).WithIgnore(ignorer)
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+
+	// Anything but y leaves the command alone
+	model, _ = model.Update(altI)
+	if view := model.View(); !strings.Contains(view, "[y/N]") {
+		t.Errorf("View() after Alt-I = %q, want a confirmation", view)
+	}
+	model, cmd := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("n")})
+	if cmd != nil || len(ignored) != 0 || strings.Contains(model.View(), "[y/N]") {
+		t.Errorf("n returned %v having ignored %q, want the confirmation left", cmd, ignored)
+	}
+
+	model, _ = model.Update(altI)
+	model, cmd = model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("y")})
+	if cmd == nil {
+		t.Fatal("y returned no command")
+	}
+	model, _ = model.Update(cmd())
+	m := model.(rt.Model)
+	if !slices.Equal(ignored, []string{rt.IgnorePattern("ls")}) {
+		t.Errorf("Ignored %q, want the highlighted command line", ignored)
+	}
+	if got := m.Records(); len(got) != 1 || got[0].Command != "make" {
+		t.Errorf("Records() after ignoring = %+v, want ls gone", got)
+	}
+	if _, ok := m.Selected(); ok || !strings.Contains(m.Status(), "2") {
+		t.Errorf("After ignoring Selected() = %v and Status() = %q, want the picker still open saying how many were deleted", ok, m.Status())
+	}
+
+	// A read-only history cannot be changed
+	var readOnly tea.Model = rt.NewUI(rt.NewFilter(records)).WithIgnore(ignorer).WithReadOnly(true)
+	readOnly, _ = readOnly.Update(altI)
+	if status := readOnly.(rt.Model).Status(); !strings.Contains(status, "read-only") {
+		t.Errorf("Status() after Alt-I on a read-only history = %q, want it refused", status)
+	}
+}
+
+func TestMatchModeToggle(t *testing.T) {
+	records := []rt.Record{
+		{ID: 1, Command: "git", Arguments: "checkout main"},
+		{ID: 2, Command: "go", Arguments: "test"},
+	}
+	var model tea.Model = rt.NewUI(rt.NewFilter(records))
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 20})
+	model, _ = model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("gco")})
+	if got := len(model.(rt.Model).Records()); got != 0 {
+		t.Fatalf("Substrings matched %d records, want none", got)
+	}
+
+	// Alt-M cycles through the modes, shown in the header
+	altM := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("m"), Alt: true}
+	model, _ = model.Update(altM)
+	if got := model.(rt.Model).Records(); len(got) != 1 || got[0].ID != 1 {
+		t.Errorf("Records() in fuzzy mode = %+v, want git checkout", got)
+	}
+	if view := model.View(); !strings.Contains(view, "Fuzzy") {
+		t.Errorf("View() in fuzzy mode = %q, want the mode shown", view)
+	}
+	for range 3 {
+		model, _ = model.Update(altM)
+	}
+	if view := model.View(); strings.Contains(view, "Fuzzy") || len(model.(rt.Model).Records()) != 0 {
+		t.Errorf("View() after cycling back to substrings = %q, want no mode shown nor matches", view)
+	}
+}
+
+func TestFilterAfterCursorMove(t *testing.T) {
+	var records []rt.Record
+	for i := range 30 {
+		command := "ls"
+		if i%6 == 0 {
+			command = "git"
+		}
+		records = append(records, rt.Record{ID: int64(30 - i), Command: command})
+	}
+	var model tea.Model = rt.NewUI(rt.NewFilter(records))
+	model, _ = model.Update(tea.WindowSizeMsg{Width: 80, Height: 12})
+	for range 25 {
+		model, _ = model.Update(tea.KeyMsg{Type: tea.KeyDown})
+	}
+
+	// Fewer records are left than the cursor had moved past
+	for _, r := range "git" {
+		model, _ = model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+	}
+	if view := model.View(); !strings.Contains(view, ">") {
+		t.Errorf("View() after filtering = %q, want a record highlighted", view)
+	}
+	if got, want := model.(rt.Model).Cursor(), len(model.(rt.Model).Records())-1; got != want {
+		t.Errorf("Cursor() after filtering = %d, want the last of the records left, %d", got, want)
+	}
+}
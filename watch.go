@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Watch subscribes to records inserted after the call, from this or any other
+// process, by polling the database every interval. Records are delivered in
+// insertion order on the returned channel.
+//
+// Both channels are closed when ctx is cancelled. If polling fails the error
+// is sent on the error channel before both are closed.
+func (db *DB) Watch(ctx context.Context, interval time.Duration) (<-chan Record, <-chan error) {
+	records := make(chan Record)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(records)
+		defer close(errs)
+
+		var lastID int64
+		if err := db.conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM history").Scan(&lastID); err != nil {
+			errs <- err
+			return
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			batch, err := db.Query(`
+			SELECT `+recordColumns+`
+			FROM history
+			WHERE id > ?
+			ORDER BY id
+			`, lastID)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			for _, r := range batch {
+				select {
+				case records <- r:
+					lastID = r.ID
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return records, errs
+}
@@ -0,0 +1,52 @@
+package main_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestWatch(t *testing.T) {
+	database := openTestDB(t)
+
+	// Records from before the subscription are not delivered
+	if err := database.Insert(&rt.Record{Command: "old", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	records, errs := database.Watch(ctx, 10*time.Millisecond)
+
+	// Give the watcher time to note the current position
+	time.Sleep(50 * time.Millisecond)
+	for _, command := range []string{"first", "second"} {
+		if err := database.Insert(&rt.Record{Command: command, Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Failed to insert record: %v", err)
+		}
+	}
+
+	for _, want := range []string{"first", "second"} {
+		select {
+		case r := <-records:
+			if r.Command != want {
+				t.Errorf("Expected command %q, got %q", want, r.Command)
+			}
+		case err := <-errs:
+			t.Fatalf("Watch failed: %v", err)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %q", want)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-records:
+		if ok {
+			t.Error("Expected records channel to be closed after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for records channel to close")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// WriterOptions controls how a Writer batches and retries.
+type WriterOptions struct {
+	// BatchSize is how many records are stored in each transaction
+	BatchSize int
+
+	// MaxRetries is how many times a batch is retried when the database is
+	// locked by another writer before giving up
+	MaxRetries int
+
+	// RetryDelay is how long to wait before the first retry, doubling for
+	// each retry after it
+	RetryDelay time.Duration
+}
+
+// DefaultWriterOptions returns the options used unless configured otherwise
+func DefaultWriterOptions() WriterOptions {
+	return WriterOptions{
+		BatchSize:  500,
+		MaxRetries: 5,
+		RetryDelay: 50 * time.Millisecond,
+	}
+}
+
+// Writer stores records in batches, one transaction per batch, for programs
+// ingesting many commands at once, e.g. from CI logs, where inserting them
+// one at a time would be slow. A batch which fails because the database is
+// locked is retried. A Writer is safe for concurrent use.
+type Writer struct {
+	db      *DB
+	options WriterOptions
+
+	mu      sync.Mutex
+	pending []Record
+}
+
+// NewWriter creates a writer storing records in db. Zero options are
+// replaced by their defaults.
+func NewWriter(db *DB, options WriterOptions) *Writer {
+	defaults := DefaultWriterOptions()
+	if options.BatchSize <= 0 {
+		options.BatchSize = defaults.BatchSize
+	}
+	if options.MaxRetries < 0 {
+		options.MaxRetries = 0
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = defaults.RetryDelay
+	}
+	return &Writer{db: db, options: options}
+}
+
+// Add queues a record, storing the queued records once there is a full batch.
+// The record is not stored until then, or until Flush is called.
+func (w *Writer) Add(record Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = append(w.pending, record)
+	if len(w.pending) < w.options.BatchSize {
+		return nil
+	}
+	return w.flush()
+}
+
+// Flush stores any queued records. It must be called once the last record
+// has been added. Records which could not be stored remain queued, so Flush
+// may be called again to retry them.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+// flush stores the queued records, the lock must be held
+func (w *Writer) flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	delay := w.options.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := w.store(w.pending)
+		if err == nil {
+			w.pending = w.pending[:0]
+			return nil
+		}
+		if attempt == w.options.MaxRetries || !isLocked(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// store inserts the records in a single transaction
+func (w *Writer) store(records []Record) error {
+	tx, err := w.db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stored := make([]Record, len(records))
+	for i, r := range records {
+		if err := w.db.insert(tx, &r); err != nil {
+			return err
+		}
+		stored[i] = r
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	w.db.publishInserted(stored)
+	return nil
+}
+
+// isLocked reports whether err is SQLite reporting that another connection
+// holds a lock, which is worth retrying
+func isLocked(err error) bool {
+	code := sqliteCode(err)
+	return code == sqliteBusy || code == sqliteLocked
+}
@@ -0,0 +1,82 @@
+package main_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	rt "github.com/nuchs/retour"
+)
+
+func TestWriterBatches(t *testing.T) {
+	database := openTestDB(t)
+	writer := rt.NewWriter(database, rt.WriterOptions{BatchSize: 2})
+
+	for i, line := range []string{"ls", "pwd", "make", "make test", "git status"} {
+		record := rt.NewRecord(line, "/tmp", 0, time.Unix(1700000000+int64(i), 0))
+		record.Session = "ci"
+		if err := writer.Add(record); err != nil {
+			t.Fatalf("Add() unexpected error = %v", err)
+		}
+	}
+	checkStored(t, database, 4)
+
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush() unexpected error = %v", err)
+	}
+	checkStored(t, database, 5)
+
+	sessions, err := database.Sessions(10)
+	if err != nil {
+		t.Fatalf("Sessions() unexpected error = %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Commands != 5 {
+		t.Errorf("Sessions() = %+v, want one session with 5 commands", sessions)
+	}
+}
+
+func TestWriterRetriesWhenLocked(t *testing.T) {
+	path := t.TempDir() + "/history.db"
+	pragmas := rt.DefaultPragmas()
+	pragmas.BusyTimeout = 0
+	database, err := rt.NewDBWithPragmas(path, pragmas)
+	if err != nil {
+		t.Fatalf("NewDBWithPragmas() unexpected error = %v", err)
+	}
+	defer database.Close()
+
+	// Another process holds the write lock for a while
+	other, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer other.Close()
+	other.SetMaxOpenConns(1)
+	if _, err := other.Exec("BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("Failed to lock database: %v", err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		other.Exec("COMMIT")
+	}()
+
+	writer := rt.NewWriter(database, rt.WriterOptions{BatchSize: 10, MaxRetries: 10, RetryDelay: 10 * time.Millisecond})
+	if err := writer.Add(rt.NewRecord("ls", "/tmp", 0, time.Now())); err != nil {
+		t.Fatalf("Add() unexpected error = %v", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Flush() unexpected error = %v", err)
+	}
+	checkStored(t, database, 1)
+}
+
+func checkStored(t *testing.T, database *rt.DB, want int) {
+	t.Helper()
+	records, err := database.Query("SELECT * FROM history")
+	if err != nil {
+		t.Fatalf("Query() unexpected error = %v", err)
+	}
+	if len(records) != want {
+		t.Errorf("Stored %d records, want %d", len(records), want)
+	}
+}